@@ -1,18 +1,77 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/guanw/ct-dns/pkg/auth"
+	"github.com/guanw/ct-dns/pkg/healthcheck"
+	"github.com/guanw/ct-dns/pkg/lifecycle"
 	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/pkg/tlsconfig"
+	"github.com/guanw/ct-dns/plugins/storage/bolt"
+	"github.com/guanw/ct-dns/plugins/storage/dynamodb"
+	"github.com/guanw/ct-dns/plugins/storage/etcd"
+	"github.com/guanw/ct-dns/plugins/storage/raft"
+	"github.com/guanw/ct-dns/plugins/storage/redis"
+	"github.com/guanw/ct-dns/plugins/storage/sql"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+// envPrefix prefixes env vars overriding config keys, CT_DNS_STORAGE_REDIS_ENDPOINT sets storage.redis.endpoint
+const envPrefix = "CT_DNS"
+
 // Config contains config for ct-dns service
 type Config struct {
-	Etcd     []EtcdConfig `yaml:"etcd"`
-	HTTPPort string       `yaml:"httpport"`
-	GRPCPort string       `yaml:"grpcport"`
-	Redis    RedisConfig  `yaml:"redis"`
+	HTTPPort    string              `yaml:"httpport"`
+	GRPCPort    string              `yaml:"grpcport"`
+	Storage     StorageConfig       `yaml:"storage"`
+	Log         LogConfig           `yaml:"log"`
+	DNS         DNSConfig           `yaml:"dns"`
+	HealthCheck HealthCheckConfig   `yaml:"healthcheck"`
+	Cache       store.CacheConfig   `yaml:"cache"`
+	Retry       store.RetryPolicy   `yaml:"retry"`
+	Breaker     store.BreakerConfig `yaml:"breaker"`
+	Auth        auth.Config         `yaml:"auth"`
+	// TLS applies to both http and grpc ports
+	TLS tlsconfig.Config `yaml:"tls"`
+	// RequestTimeout bounds every http request, unary grpc call and dns query, 0 leaves them unbounded
+	RequestTimeout time.Duration `yaml:"requesttimeout"`
+	// Lifecycle defines readiness checks and graceful shutdown on SIGTERM
+	Lifecycle lifecycle.Config `yaml:"lifecycle"`
+	// Reload defines how config is reloaded while serving, see Watcher
+	Reload ReloadConfig `yaml:"reload"`
+	// Etcd is deprecated, it is read into storage.etcd.endpoints
+	Etcd []EtcdConfig `yaml:"etcd"`
+	// Redis is deprecated, it is read into storage.redis.endpoint
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// StorageConfig selects storage plugin by Type and contains config of every plugin
+type StorageConfig struct {
+	Type     string          `yaml:"type"`
+	Redis    redis.Config    `yaml:"redis"`
+	Etcd     etcd.Config     `yaml:"etcd"`
+	DynamoDB dynamodb.Config `yaml:"dynamodb"`
+	Bolt     bolt.Config     `yaml:"bolt"`
+	Raft     raft.Config     `yaml:"raft"`
+	SQL      sql.Config      `yaml:"sql"`
+}
+
+// LogConfig contains config for logging
+type LogConfig struct {
+	// Level is one of panic, fatal, error, warn, info, debug and trace
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
 }
 
 // EtcdConfig contains config for etcd cluster
@@ -27,28 +86,331 @@ type RedisConfig struct {
 	Port string `yaml:"port"`
 }
 
-// ReadConfig reads config file based on env
-func ReadConfig(path string) Config {
-	viper.AddConfigPath(path)
-	logging.GetLogger().WithField("environment", os.Getenv("CT_DNS_ENV")).Info("Initializing config...")
-	env := os.Getenv("CT_DNS_ENV")
+// DNSConfig contains config for dns server
+type DNSConfig struct {
+	Port string `yaml:"port"`
+	Zone string `yaml:"zone"`
+	TTL  uint32 `yaml:"ttl"`
+}
+
+// HealthCheckConfig contains config for active health checking of registered hosts,
+// Services overrides Default per envoy cluster name, namespace/service outside the default namespace
+// (lower case, as config keys are case insensitive)
+type HealthCheckConfig struct {
+	Enabled  bool                          `yaml:"enabled"`
+	Default  healthcheck.Config            `yaml:"default"`
+	Services map[string]healthcheck.Config `yaml:"services"`
+}
+
+// Default returns config used for keys missing from config file, env and flags
+func Default() Config {
+	return Config{
+		HTTPPort: "8080",
+		GRPCPort: "50051",
+		Storage: StorageConfig{
+			Type: "redis",
+			Redis: redis.Config{
+				Mode:         redis.ModeStandalone,
+				Endpoint:     "0.0.0.0:6379",
+				DialTimeout:  5 * time.Second,
+				ReadTimeout:  3 * time.Second,
+				WriteTimeout: 3 * time.Second,
+				MaxIdle:      80,
+				MaxActive:    12000,
+				IdleTimeout:  5 * time.Minute,
+			},
+			Etcd: etcd.Config{
+				Endpoints:   []string{"http://127.0.0.1:2379"},
+				Prefix:      etcd.DefaultPrefix,
+				DialTimeout: 5 * time.Second,
+			},
+			DynamoDB: dynamodb.Config{
+				Region:        "us-east-1",
+				Table:         dynamodb.DefaultTable,
+				WatchInterval: 5 * time.Second,
+			},
+			Bolt: bolt.Config{Path: bolt.DefaultPath, OpenTimeout: time.Second},
+			Raft: raft.Config{
+				BindAddress:       raft.DefaultBindAddress,
+				DataDir:           raft.DefaultDataDir,
+				ReadMode:          raft.ReadLinearizable,
+				ApplyTimeout:      raft.DefaultApplyTimeout,
+				SnapshotInterval:  2 * time.Minute,
+				SnapshotThreshold: 8192,
+				RetainSnapshots:   raft.DefaultRetainSnapshots,
+			},
+			SQL: sql.Config{
+				Driver:        sql.DriverPostgres,
+				WatchInterval: 5 * time.Second,
+				MaxOpenConns:  10,
+				MaxIdleConns:  5,
+			},
+		},
+		Log: LogConfig{Level: "info", Format: "text"},
+		DNS: DNSConfig{Port: "8053", Zone: "ct-dns.local.", TTL: 30},
+		HealthCheck: HealthCheckConfig{
+			Default: healthcheck.DefaultConfig,
+		},
+		Cache:   store.DefaultCacheConfig,
+		Retry:   store.DefaultRetryPolicy,
+		Breaker: store.DefaultBreakerConfig,
+		Auth: auth.Config{
+			JWT: auth.JWTConfig{IdentityClaim: "sub", Leeway: 30 * time.Second},
+		},
+		TLS:            tlsconfig.Config{ReloadInterval: tlsconfig.DefaultReloadInterval},
+		RequestTimeout: 10 * time.Second,
+		Lifecycle: lifecycle.Config{
+			ReadinessInterval: 5 * time.Second,
+			ShutdownTimeout:   lifecycle.DefaultShutdownTimeout,
+		},
+		Reload: ReloadConfig{Interval: 10 * time.Second},
+	}
+}
+
+// configFiles maps CT_DNS_ENV to config file picked when --config is not set
+var configFiles = map[string]string{
+	"":                 "development",
+	"DEVELOPMENT":      "development",
+	"PRODUCTION":       "production",
+	"KUBERNETES-REDIS": "kubernetes-with-redis",
+	// misspelled name kept working for existing deployments
+	"KUBERNETERS-REDIS": "kubernetes-with-redis",
+}
 
-	switch env {
-	case "PRODUCTION":
-		viper.SetConfigName("production")
-	case "KUBERNETERS-REDIS":
-		viper.SetConfigName("kubernetes-with-redis")
-	default:
-		viper.SetConfigName("development")
+// configFile returns --config if set, otherwise the file of dir CT_DNS_ENV picks
+func configFile(dir string, flags *pflag.FlagSet) (string, error) {
+	if f := flags.Lookup(configFlag); f != nil && f.Value.String() != "" {
+		return f.Value.String(), nil
 	}
-	err := viper.ReadInConfig()
+	env := os.Getenv("CT_DNS_ENV")
+	name, found := configFiles[env]
+	if !found {
+		return "", errors.Errorf("Unknown CT_DNS_ENV %q, expected DEVELOPMENT, PRODUCTION or KUBERNETES-REDIS", env)
+	}
+	if env == "KUBERNETERS-REDIS" {
+		logging.GetLogger().Warn("CT_DNS_ENV=KUBERNETERS-REDIS is deprecated, use KUBERNETES-REDIS")
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + name + ".yml", nil
+}
+
+// Load reads config layering Default, the config file, CT_DNS_ prefixed env vars and flags changed on flags,
+// later ones override earlier ones. The config file is --config, or picked from dir by CT_DNS_ENV.
+// Unknown keys and invalid values are rejected.
+func Load(dir string, flags *pflag.FlagSet) (Config, error) {
+	path, err := configFile(dir, flags)
 	if err != nil {
-		logging.GetLogger().Fatalln("Failed to read config", err)
+		return Config{}, err
+	}
+	logging.GetLogger().WithField("config", path).Info("Initializing config...")
+	file := viper.New()
+	file.SetConfigFile(path)
+	if err := file.ReadInConfig(); err != nil {
+		return Config{}, errors.Wrapf(err, "Failed to read config %s", path)
+	}
+
+	v := viper.New()
+	setDefaults(v, reflect.ValueOf(Default()))
+	if err := setLegacyDefaults(v, file); err != nil {
+		return Config{}, errors.Wrapf(err, "Invalid config %s", path)
 	}
+	if err := v.MergeConfigMap(file.AllSettings()); err != nil {
+		return Config{}, errors.Wrapf(err, "Failed to read config %s", path)
+	}
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if err := bindFlags(v, flags); err != nil {
+		return Config{}, err
+	}
+
 	var c Config
-	err = viper.Unmarshal(&c)
-	if err != nil {
-		logging.GetLogger().Fatalln("Failed to unmarshal config", err)
+	if err := v.UnmarshalExact(&c); err != nil {
+		return Config{}, errors.Wrapf(err, "Invalid config %s", path)
+	}
+	if err := c.Validate(); err != nil {
+		return Config{}, errors.Wrapf(err, "Invalid config %s", path)
+	}
+	return c, nil
+}
+
+// setDefaults sets every field of value as default of its key
+func setDefaults(v *viper.Viper, value reflect.Value) {
+	walk("", value, func(key string, field reflect.Value) {
+		if (field.Kind() == reflect.Slice || field.Kind() == reflect.Map) && field.IsNil() {
+			return
+		}
+		v.SetDefault(key, field.Interface())
+	})
+}
+
+// walk calls fn with every field of value that is not a struct, fields are keyed by yaml tag under prefix
+func walk(prefix string, value reflect.Value, fn func(key string, field reflect.Value)) {
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		field := value.Field(i)
+		if field.Kind() == reflect.Struct {
+			walk(prefix+key+".", field, fn)
+			continue
+		}
+		fn(prefix+key, field)
+	}
+}
+
+// setLegacyDefaults reads deprecated etcd hosts and redis host/port of file into their storage keys,
+// at file precedence as file does not set the storage keys itself
+func setLegacyDefaults(v, file *viper.Viper) error {
+	var hosts []EtcdConfig
+	if err := file.UnmarshalKey("etcd", &hosts); err != nil {
+		return errors.Wrap(err, "Failed to read etcd")
+	}
+	if len(hosts) > 0 {
+		if file.IsSet("storage.etcd.endpoints") {
+			return errors.New("etcd and storage.etcd.endpoints are both set, remove deprecated etcd")
+		}
+		endpoints := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			endpoints = append(endpoints, host.Host+":"+host.Port)
+		}
+		v.SetDefault("storage.etcd.endpoints", endpoints)
+		logging.GetLogger().Warn("etcd is deprecated, use storage.etcd.endpoints")
+	}
+	host, port := file.GetString("redis.host"), file.GetString("redis.port")
+	if host != "" && port != "" {
+		if file.IsSet("storage.redis.endpoint") {
+			return errors.New("redis and storage.redis.endpoint are both set, remove deprecated redis")
+		}
+		v.SetDefault("storage.redis.endpoint", host+":"+port)
+		logging.GetLogger().Warn("redis is deprecated, use storage.redis.endpoint")
+	}
+	return nil
+}
+
+// Validate returns an error listing every invalid value of c
+func (c Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, port := range []struct{ key, value string }{{"httpport", c.HTTPPort}, {"grpcport", c.GRPCPort}, {"dns.port", c.DNS.Port}} {
+		if p, err := strconv.Atoi(port.value); err != nil || p <= 0 || p > 65535 {
+			invalid("%s %q is not a port", port.key, port.value)
+		}
+	}
+	if c.HTTPPort == c.GRPCPort {
+		invalid("httpport and grpcport are both %s", c.HTTPPort)
+	}
+	switch c.Storage.Type {
+	case "":
+		invalid("storage.type is empty")
+	case "redis":
+		redisConfig := c.Storage.Redis
+		switch redisConfig.Mode {
+		case "", redis.ModeStandalone:
+			if redisConfig.Endpoint == "" {
+				invalid("storage.redis.endpoint is empty")
+			}
+		case redis.ModeSentinel:
+			if len(redisConfig.SentinelAddresses) == 0 || redisConfig.SentinelMaster == "" {
+				invalid("storage.redis.sentineladdresses and storage.redis.sentinelmaster are required")
+			}
+		case redis.ModeCluster:
+			if len(redisConfig.ClusterAddresses) == 0 {
+				invalid("storage.redis.clusteraddresses is empty")
+			}
+			if redisConfig.DB != 0 {
+				invalid("storage.redis.db has to be 0 in cluster mode")
+			}
+		default:
+			invalid("storage.redis.mode %q is neither standalone, sentinel nor cluster", redisConfig.Mode)
+		}
+		if redisConfig.DB < 0 || redisConfig.MaxIdle < 0 || redisConfig.MaxActive < 0 {
+			invalid("storage.redis.db, storage.redis.maxidle and storage.redis.maxactive cannot be negative")
+		}
+		if redisConfig.DialTimeout < 0 || redisConfig.ReadTimeout < 0 || redisConfig.WriteTimeout < 0 || redisConfig.IdleTimeout < 0 {
+			invalid("storage.redis timeouts cannot be negative")
+		}
+	case "etcd":
+		if len(c.Storage.Etcd.Endpoints) == 0 {
+			invalid("storage.etcd.endpoints is empty")
+		}
+	case "dynamodb":
+		if c.Storage.DynamoDB.Region == "" || c.Storage.DynamoDB.Table == "" {
+			invalid("storage.dynamodb.region and storage.dynamodb.table are required")
+		}
+		if (c.Storage.DynamoDB.AccessKeyID == "") != (c.Storage.DynamoDB.SecretAccessKey == "") {
+			invalid("storage.dynamodb.accesskeyid and storage.dynamodb.secretaccesskey are set together")
+		}
+		if c.Storage.DynamoDB.ReadCapacity < 0 || c.Storage.DynamoDB.WriteCapacity < 0 {
+			invalid("storage.dynamodb.readcapacity and storage.dynamodb.writecapacity cannot be negative")
+		}
+	case "bolt":
+		if c.Storage.Bolt.Path == "" {
+			invalid("storage.bolt.path is empty")
+		}
+	case "raft":
+		if c.Storage.Raft.BindAddress == "" || c.Storage.Raft.DataDir == "" {
+			invalid("storage.raft.bindaddress and storage.raft.datadir are required")
+		}
+		if c.Storage.Raft.ReadMode != raft.ReadLinearizable && c.Storage.Raft.ReadMode != raft.ReadStale {
+			invalid("storage.raft.readmode %q is neither linearizable nor stale", c.Storage.Raft.ReadMode)
+		}
+		if raftConfig := c.Storage.Raft; (raftConfig.TLSCert != "" || raftConfig.TLSKey != "" || raftConfig.TLSCA != "") &&
+			(raftConfig.TLSCert == "" || raftConfig.TLSKey == "" || raftConfig.TLSCA == "") {
+			invalid("storage.raft.tlscert, storage.raft.tlskey and storage.raft.tlsca are set together")
+		}
+	case "sql":
+		if c.Storage.SQL.Driver == "" || c.Storage.SQL.DSN == "" {
+			invalid("storage.sql.driver and storage.sql.dsn are required")
+		}
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		invalid("log.level %q is not a level", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		invalid("log.format %q is neither text nor json", c.Log.Format)
+	}
+	if c.RequestTimeout < 0 {
+		invalid("requesttimeout is negative")
+	}
+	if c.Reload.Interval < 0 {
+		invalid("reload.interval is negative")
+	}
+	if c.Retry.MaxAttempts < 1 {
+		invalid("retry.maxattempts is less than 1")
+	}
+	if c.Retry.BaseBackoff <= 0 || c.Retry.MaxBackoff < c.Retry.BaseBackoff {
+		invalid("retry.basebackoff has to be positive and at most retry.maxbackoff")
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		invalid("retry.jitter is outside [0, 1]")
+	}
+	if c.Retry.Deadline < 0 || c.Retry.AttemptTimeout < 0 {
+		invalid("retry.deadline and retry.attempttimeout cannot be negative")
+	}
+	if c.Cache.Enabled && (c.Cache.TTL <= 0 || c.Cache.MaxEntries <= 0) {
+		invalid("cache.ttl and cache.maxentries have to be positive")
+	}
+	if c.Breaker.Enabled && (c.Breaker.FailureThreshold <= 0 || c.Breaker.OpenTimeout <= 0 || c.Breaker.MaxEntries <= 0) {
+		invalid("breaker.failurethreshold, breaker.opentimeout and breaker.maxentries have to be positive")
+	}
+	if c.HealthCheck.Enabled && (c.HealthCheck.Default.Interval <= 0 || c.HealthCheck.Default.Timeout <= 0) {
+		invalid("healthcheck.default.interval and healthcheck.default.timeout have to be positive")
+	}
+	if c.TLS.Enabled() && c.TLS.KeyFile == "" {
+		invalid("tls.keyfile is required with tls.certfile")
+	}
+	if !c.TLS.Enabled() && (c.TLS.KeyFile != "" || c.TLS.ClientCAFile != "" || c.TLS.RequireClientCert) {
+		invalid("tls.certfile is required with tls.keyfile, tls.clientcafile and tls.requireclientcert")
+	}
+	if c.TLS.RequireClientCert && c.TLS.ClientCAFile == "" {
+		invalid("tls.clientcafile is required with tls.requireclientcert")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
 	}
-	return c
+	return nil
 }
@@ -1,44 +1,309 @@
 package config
 
 import (
+	"flag"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/guanw/ct-dns/pkg/tlsconfig"
+	"github.com/guanw/ct-dns/plugins/storage/bolt"
+	"github.com/guanw/ct-dns/plugins/storage/dynamodb"
+	"github.com/guanw/ct-dns/plugins/storage/etcd"
+	"github.com/guanw/ct-dns/plugins/storage/raft"
+	"github.com/guanw/ct-dns/plugins/storage/redis"
+	"github.com/guanw/ct-dns/plugins/storage/sql"
+	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
 )
 
-func Test_ReadConfig(t *testing.T) {
+// newFlags returns flags of ct-dns parsed from args
+func newFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	goFlags := new(flag.FlagSet)
+	AddFlags(goFlags)
+	bolt.AddFlags(goFlags)
+	raft.AddFlags(goFlags)
+	dynamodb.AddFlags(goFlags)
+	etcd.AddFlags(goFlags)
+	redis.AddFlags(goFlags)
+	sql.AddFlags(goFlags)
+	tlsconfig.AddFlags(goFlags)
+	goFlags.String("storage-type", "redis", "--storage-type <name>")
+	flags := pflag.NewFlagSet("ct-dns", pflag.ContinueOnError)
+	flags.AddGoFlagSet(goFlags)
+	assert.NoError(t, flags.Parse(args))
+	return flags
+}
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "ct-dns-config")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "config.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func Test_Load(t *testing.T) {
 	tests := []struct {
-		env               string
-		expectedHTTPPort  string
-		expectedRedisPort string
-		expectedRedisHost string
+		env                   string
+		expectedHTTPPort      string
+		expectedRedisEndpoint string
+		// only local runs talk to dynamodb local
+		expectedDynamoDBEndpoint string
+		// local runs stop right away
+		expectedShutdownDelay time.Duration
 	}{
 		{
-			env:               "DEVELOPMENT",
-			expectedHTTPPort:  "8080",
-			expectedRedisPort: "",
-			expectedRedisHost: "",
+			env:                      "",
+			expectedHTTPPort:         "8080",
+			expectedRedisEndpoint:    "0.0.0.0:6379",
+			expectedDynamoDBEndpoint: "http://localhost:8000",
 		},
 		{
-			env:               "KUBERNETERS-REDIS",
-			expectedHTTPPort:  "8080",
-			expectedRedisPort: "6379",
-			expectedRedisHost: "redis-master",
+			env:                      "DEVELOPMENT",
+			expectedHTTPPort:         "8080",
+			expectedRedisEndpoint:    "0.0.0.0:6379",
+			expectedDynamoDBEndpoint: "http://localhost:8000",
 		},
 		{
-			env:               "PRODUCTION",
-			expectedHTTPPort:  "5000",
-			expectedRedisPort: "",
-			expectedRedisHost: "",
+			env:                   "KUBERNETES-REDIS",
+			expectedHTTPPort:      "8080",
+			expectedRedisEndpoint: "redis-master:6379",
+			expectedShutdownDelay: 5 * time.Second,
+		},
+		{
+			env:                   "KUBERNETERS-REDIS",
+			expectedHTTPPort:      "8080",
+			expectedRedisEndpoint: "redis-master:6379",
+			expectedShutdownDelay: 5 * time.Second,
+		},
+		{
+			env:                   "PRODUCTION",
+			expectedHTTPPort:      "5000",
+			expectedRedisEndpoint: "0.0.0.0:6379",
+			expectedShutdownDelay: 5 * time.Second,
 		},
 	}
 	for _, test := range tests {
 		os.Setenv("CT_DNS_ENV", test.env)
-		cfg := ReadConfig("../config/")
-		assert.Equal(t, test.expectedHTTPPort, cfg.HTTPPort)
-		assert.Equal(t, test.expectedRedisPort, cfg.Redis.Port)
-		assert.Equal(t, test.expectedRedisHost, cfg.Redis.Host)
+		cfg, err := Load("../config/", newFlags(t))
 		os.Unsetenv("CT_DNS_ENV")
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedHTTPPort, cfg.HTTPPort)
+		assert.Equal(t, "50051", cfg.GRPCPort)
+		assert.Equal(t, "redis", cfg.Storage.Type)
+		assert.Equal(t, test.expectedRedisEndpoint, cfg.Storage.Redis.Endpoint)
+		assert.Equal(t, redis.ModeStandalone, cfg.Storage.Redis.Mode)
+		assert.Equal(t, 80, cfg.Storage.Redis.MaxIdle)
+		assert.Equal(t, 12000, cfg.Storage.Redis.MaxActive)
+		assert.Equal(t, 3*time.Second, cfg.Storage.Redis.ReadTimeout)
+		assert.Equal(t, []string{"http://10.110.251.205:2379"}, cfg.Storage.Etcd.Endpoints)
+		assert.Equal(t, etcd.DefaultPrefix, cfg.Storage.Etcd.Prefix)
+		assert.Equal(t, 5*time.Second, cfg.Storage.Etcd.DialTimeout)
+		assert.Equal(t, "us-east-1", cfg.Storage.DynamoDB.Region)
+		assert.Equal(t, test.expectedDynamoDBEndpoint, cfg.Storage.DynamoDB.Endpoint)
+		assert.Equal(t, dynamodb.DefaultTable, cfg.Storage.DynamoDB.Table)
+		assert.Equal(t, 5*time.Second, cfg.Storage.DynamoDB.WatchInterval)
+		assert.False(t, cfg.Storage.DynamoDB.Bootstrap)
+		assert.Empty(t, cfg.Storage.DynamoDB.Profile)
+		assert.Equal(t, bolt.Config{Path: bolt.DefaultPath, OpenTimeout: time.Second}, cfg.Storage.Bolt)
+		assert.Equal(t, raft.DefaultBindAddress, cfg.Storage.Raft.BindAddress)
+		assert.Equal(t, raft.ReadLinearizable, cfg.Storage.Raft.ReadMode)
+		assert.Equal(t, uint64(8192), cfg.Storage.Raft.SnapshotThreshold)
+		assert.Empty(t, cfg.Storage.Raft.Peers)
+		assert.Equal(t, sql.DriverPostgres, cfg.Storage.SQL.Driver)
+		assert.Empty(t, cfg.Storage.SQL.DSN)
+		assert.Equal(t, 10, cfg.Storage.SQL.MaxOpenConns)
+		assert.Equal(t, LogConfig{Level: "info", Format: "text"}, cfg.Log)
+		assert.Equal(t, "8053", cfg.DNS.Port)
+		assert.Equal(t, "ct-dns.local.", cfg.DNS.Zone)
+		assert.False(t, cfg.HealthCheck.Enabled)
+		assert.Equal(t, "tcp", cfg.HealthCheck.Default.Protocol)
+		assert.Equal(t, 10*time.Second, cfg.HealthCheck.Default.Interval)
+		assert.Equal(t, 3, cfg.HealthCheck.Default.UnhealthyThreshold)
+		assert.False(t, cfg.Cache.Enabled)
+		assert.Equal(t, 5*time.Second, cfg.Cache.TTL)
+		assert.Equal(t, 10000, cfg.Cache.MaxEntries)
+		assert.Equal(t, 5, cfg.Retry.MaxAttempts)
+		assert.Equal(t, 50*time.Millisecond, cfg.Retry.BaseBackoff)
+		assert.Equal(t, 0.2, cfg.Retry.Jitter)
+		assert.Equal(t, 2*time.Second, cfg.Retry.AttemptTimeout)
+		assert.False(t, cfg.Breaker.Enabled)
+		assert.Equal(t, 5, cfg.Breaker.FailureThreshold)
+		assert.Equal(t, 10*time.Second, cfg.Breaker.OpenTimeout)
+		assert.Equal(t, 10000, cfg.Breaker.MaxEntries)
+		assert.Equal(t, 10*time.Second, cfg.RequestTimeout)
+		assert.False(t, cfg.Auth.Enabled)
+		assert.Equal(t, "sub", cfg.Auth.JWT.IdentityClaim)
+		assert.Equal(t, 30*time.Second, cfg.Auth.JWT.Leeway)
+		assert.Empty(t, cfg.Auth.Policy)
+		assert.False(t, cfg.TLS.Enabled())
+		assert.Equal(t, 30*time.Second, cfg.TLS.ReloadInterval)
+		assert.Equal(t, 5*time.Second, cfg.Lifecycle.ReadinessInterval)
+		assert.Equal(t, test.expectedShutdownDelay, cfg.Lifecycle.ShutdownDelay)
+		assert.Equal(t, 20*time.Second, cfg.Lifecycle.ShutdownTimeout)
 	}
 }
+
+func Test_LoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+httpport: 9000
+grpcport: 9001
+storage:
+  type: etcd
+  etcd:
+    endpoints: [http://etcd-0:2379]
+retry:
+  maxattempts: 3
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// defaults < file
+	cfg, err := Load("../config/", newFlags(t, "--config", path))
+	assert.NoError(t, err)
+	assert.Equal(t, "9000", cfg.HTTPPort)
+	assert.Equal(t, "etcd", cfg.Storage.Type)
+	assert.Equal(t, []string{"http://etcd-0:2379"}, cfg.Storage.Etcd.Endpoints)
+	assert.Equal(t, 3, cfg.Retry.MaxAttempts)
+	assert.Equal(t, Default().Retry.MaxBackoff, cfg.Retry.MaxBackoff)
+	assert.Equal(t, Default().DNS, cfg.DNS)
+	// AWS resolves the endpoint of region unless one is set
+	assert.Empty(t, cfg.Storage.DynamoDB.Endpoint)
+
+	// file < env
+	os.Setenv("CT_DNS_HTTPPORT", "9100")
+	os.Setenv("CT_DNS_STORAGE_ETCD_ENDPOINTS", "http://etcd-1:2379,http://etcd-2:2379")
+	os.Setenv("CT_DNS_RETRY_MAXATTEMPTS", "4")
+	defer os.Unsetenv("CT_DNS_HTTPPORT")
+	defer os.Unsetenv("CT_DNS_STORAGE_ETCD_ENDPOINTS")
+	defer os.Unsetenv("CT_DNS_RETRY_MAXATTEMPTS")
+	cfg, err = Load("../config/", newFlags(t, "--config", path))
+	assert.NoError(t, err)
+	assert.Equal(t, "9100", cfg.HTTPPort)
+	assert.Equal(t, []string{"http://etcd-1:2379", "http://etcd-2:2379"}, cfg.Storage.Etcd.Endpoints)
+	assert.Equal(t, 4, cfg.Retry.MaxAttempts)
+
+	// env < flags, flags left unset do not override
+	cfg, err = Load("../config/", newFlags(t, "--config", path, "--http-port", "9200", "--etcd-endpoints", "http://etcd-3:2379"))
+	assert.NoError(t, err)
+	assert.Equal(t, "9200", cfg.HTTPPort)
+	assert.Equal(t, []string{"http://etcd-3:2379"}, cfg.Storage.Etcd.Endpoints)
+	assert.Equal(t, "9001", cfg.GRPCPort)
+	assert.Equal(t, "etcd", cfg.Storage.Type)
+	assert.Equal(t, etcd.DefaultPrefix, cfg.Storage.Etcd.Prefix)
+
+	cfg, err = Load("../config/", newFlags(t, "--config", path, "--redis-mode", "sentinel",
+		"--redis-sentinel-addresses", "sentinel-0:26379,sentinel-1:26379", "--redis-sentinel-master", "ct-dns"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sentinel-0:26379", "sentinel-1:26379"}, cfg.Storage.Redis.SentinelAddresses)
+	assert.Equal(t, "ct-dns", cfg.Storage.Redis.SentinelMaster)
+}
+
+func Test_LoadLegacy(t *testing.T) {
+	path := writeConfig(t, `
+etcd:
+  - host: 10.0.0.1
+    port: 2379
+  - host: 10.0.0.2
+    port: 2379
+redis:
+  host: redis-master
+  port: 6379
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	cfg, err := Load("../config/", newFlags(t, "--config", path))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:2379", "10.0.0.2:2379"}, cfg.Storage.Etcd.Endpoints)
+	assert.Equal(t, "redis-master:6379", cfg.Storage.Redis.Endpoint)
+
+	// flags still override deprecated keys
+	cfg, err = Load("../config/", newFlags(t, "--config", path, "--redis-endpoint", "redis-replica:6379"))
+	assert.NoError(t, err)
+	assert.Equal(t, "redis-replica:6379", cfg.Storage.Redis.Endpoint)
+
+	path = writeConfig(t, `
+etcd:
+  - host: 10.0.0.1
+    port: 2379
+storage:
+  etcd:
+    endpoints: [http://10.0.0.1:2379]
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	_, err = Load("../config/", newFlags(t, "--config", path))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "etcd and storage.etcd.endpoints are both set")
+}
+
+func Test_LoadErrors(t *testing.T) {
+	os.Setenv("CT_DNS_ENV", "STAGING")
+	_, err := Load("../config/", newFlags(t))
+	os.Unsetenv("CT_DNS_ENV")
+	assert.EqualError(t, err, `Unknown CT_DNS_ENV "STAGING", expected DEVELOPMENT, PRODUCTION or KUBERNETES-REDIS`)
+
+	_, err = Load("../config/", newFlags(t, "--config", "/nonexistent/ct-dns.yml"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed to read config /nonexistent/ct-dns.yml")
+
+	path := writeConfig(t, "httpport: 8080\nstorage:\n  redis:\n    endpiont: redis:6379\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	_, err = Load("../config/", newFlags(t, "--config", path))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "endpiont")
+
+	_, err = Load("../config/", newFlags(t, "--grpc-port", "8080", "--log-level", "verbose"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "httpport and grpcport are both 8080")
+	assert.Contains(t, err.Error(), `log.level "verbose" is not a level`)
+}
+
+func Test_Validate(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+
+	cfg := Default()
+	cfg.HTTPPort = "http"
+	cfg.Storage.Type = "etcd"
+	cfg.Storage.Etcd.Endpoints = nil
+	cfg.Log.Format = "xml"
+	cfg.Retry.MaxAttempts = 0
+	cfg.Retry.Jitter = 2
+	cfg.Cache.Enabled = true
+	cfg.Cache.TTL = 0
+	cfg.TLS.RequireClientCert = true
+	assert.EqualError(t, cfg.Validate(), `httpport "http" is not a port, storage.etcd.endpoints is empty, `+
+		`log.format "xml" is neither text nor json, retry.maxattempts is less than 1, retry.jitter is outside [0, 1], `+
+		`cache.ttl and cache.maxentries have to be positive, `+
+		`tls.certfile is required with tls.keyfile, tls.clientcafile and tls.requireclientcert, `+
+		`tls.clientcafile is required with tls.requireclientcert`)
+
+	cfg = Default()
+	cfg.Storage.Redis.Mode = redis.ModeCluster
+	cfg.Storage.Redis.DB = 1
+	cfg.Storage.Redis.ReadTimeout = -time.Second
+	assert.EqualError(t, cfg.Validate(), "storage.redis.clusteraddresses is empty, storage.redis.db has to be 0 in cluster mode, "+
+		"storage.redis timeouts cannot be negative")
+
+	cfg = Default()
+	cfg.Storage.Redis.Mode = "replicated"
+	assert.EqualError(t, cfg.Validate(), `storage.redis.mode "replicated" is neither standalone, sentinel nor cluster`)
+
+	cfg = Default()
+	cfg.Storage.Type = "raft"
+	cfg.Storage.Raft.ReadMode = "eventual"
+	cfg.Storage.Raft.TLSCert = "node.crt"
+	assert.EqualError(t, cfg.Validate(), `storage.raft.readmode "eventual" is neither linearizable nor stale, `+
+		"storage.raft.tlscert, storage.raft.tlskey and storage.raft.tlsca are set together")
+
+	cfg = Default()
+	cfg.Storage.Type = "sql"
+	assert.EqualError(t, cfg.Validate(), "storage.sql.driver and storage.sql.dsn are required")
+
+	cfg = Default()
+	cfg.Storage.Type = "dynamodb"
+	cfg.Storage.DynamoDB.AccessKeyID = "id"
+	cfg.Storage.DynamoDB.ReadCapacity = -1
+	assert.EqualError(t, cfg.Validate(), "storage.dynamodb.accesskeyid and storage.dynamodb.secretaccesskey are set together, "+
+		"storage.dynamodb.readcapacity and storage.dynamodb.writecapacity cannot be negative")
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"flag"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const configFlag = "config"
+
+// flagKeys maps flags to config keys they override, flags of storage plugins and tlsconfig are added by their AddFlags
+var flagKeys = map[string]string{
+	"http-port":  "httpport",
+	"grpc-port":  "grpcport",
+	"log-level":  "log.level",
+	"log-format": "log.format",
+
+	"storage-type": "storage.type",
+
+	"redis-mode":               "storage.redis.mode",
+	"redis-endpoint":           "storage.redis.endpoint",
+	"redis-sentinel-addresses": "storage.redis.sentineladdresses",
+	"redis-sentinel-master":    "storage.redis.sentinelmaster",
+	"redis-sentinel-username":  "storage.redis.sentinelusername",
+	"redis-sentinel-password":  "storage.redis.sentinelpassword",
+	"redis-cluster-addresses":  "storage.redis.clusteraddresses",
+	"redis-username":           "storage.redis.username",
+	"redis-password":           "storage.redis.password",
+	"redis-db":                 "storage.redis.db",
+	"redis-dial-timeout":       "storage.redis.dialtimeout",
+	"redis-read-timeout":       "storage.redis.readtimeout",
+	"redis-write-timeout":      "storage.redis.writetimeout",
+	"redis-max-idle":           "storage.redis.maxidle",
+	"redis-max-active":         "storage.redis.maxactive",
+	"redis-idle-timeout":       "storage.redis.idletimeout",
+	"redis-wait":               "storage.redis.wait",
+	"redis-tls":                "storage.redis.tls",
+	"redis-tls-cert":           "storage.redis.tlscert",
+	"redis-tls-key":            "storage.redis.tlskey",
+	"redis-tls-ca":             "storage.redis.tlsca",
+	"redis-tls-skip-verify":    "storage.redis.tlsskipverify",
+
+	"etcd-endpoints":    "storage.etcd.endpoints",
+	"etcd-prefix":       "storage.etcd.prefix",
+	"etcd-dial-timeout": "storage.etcd.dialtimeout",
+	"etcd-username":     "storage.etcd.username",
+	"etcd-password":     "storage.etcd.password",
+	"etcd-tls-cert":     "storage.etcd.tlscert",
+	"etcd-tls-key":      "storage.etcd.tlskey",
+	"etcd-tls-ca":       "storage.etcd.tlsca",
+
+	"dynamodb-region":            "storage.dynamodb.region",
+	"dynamodb-endpoint":          "storage.dynamodb.endpoint",
+	"dynamodb-table":             "storage.dynamodb.table",
+	"dynamodb-watch-interval":    "storage.dynamodb.watchinterval",
+	"dynamodb-access-key-id":     "storage.dynamodb.accesskeyid",
+	"dynamodb-secret-access-key": "storage.dynamodb.secretaccesskey",
+	"dynamodb-session-token":     "storage.dynamodb.sessiontoken",
+	"dynamodb-profile":           "storage.dynamodb.profile",
+	"dynamodb-role-arn":          "storage.dynamodb.rolearn",
+	"dynamodb-bootstrap":         "storage.dynamodb.bootstrap",
+	"dynamodb-read-capacity":     "storage.dynamodb.readcapacity",
+	"dynamodb-write-capacity":    "storage.dynamodb.writecapacity",
+
+	"bolt-path":         "storage.bolt.path",
+	"bolt-open-timeout": "storage.bolt.opentimeout",
+
+	"raft-node-id":            "storage.raft.nodeid",
+	"raft-bind-address":       "storage.raft.bindaddress",
+	"raft-advertise-address":  "storage.raft.advertiseaddress",
+	"raft-data-dir":           "storage.raft.datadir",
+	"raft-peers":              "storage.raft.peers",
+	"raft-read-mode":          "storage.raft.readmode",
+	"raft-apply-timeout":      "storage.raft.applytimeout",
+	"raft-snapshot-interval":  "storage.raft.snapshotinterval",
+	"raft-snapshot-threshold": "storage.raft.snapshotthreshold",
+	"raft-retain-snapshots":   "storage.raft.retainsnapshots",
+	"raft-tls-cert":           "storage.raft.tlscert",
+	"raft-tls-key":            "storage.raft.tlskey",
+	"raft-tls-ca":             "storage.raft.tlsca",
+
+	"sql-driver":         "storage.sql.driver",
+	"sql-dsn":            "storage.sql.dsn",
+	"sql-watch-interval": "storage.sql.watchinterval",
+	"sql-max-open-conns": "storage.sql.maxopenconns",
+	"sql-max-idle-conns": "storage.sql.maxidleconns",
+
+	"tls-cert-file":           "tls.certfile",
+	"tls-key-file":            "tls.keyfile",
+	"tls-client-ca-file":      "tls.clientcafile",
+	"tls-require-client-cert": "tls.requireclientcert",
+}
+
+// AddFlags binds flags selecting the config file and overriding server settings
+func AddFlags(flagSet *flag.FlagSet) {
+	flagSet.String(configFlag, "", "--config <path> of config file, overrides CT_DNS_ENV")
+	flagSet.String("http-port", "", "--http-port <port>")
+	flagSet.String("grpc-port", "", "--grpc-port <port>")
+	flagSet.String("log-level", "", "--log-level <level>")
+	flagSet.String("log-format", "", "--log-format <text|json>")
+}
+
+// bindFlags lets flags of flagKeys override their config keys once set on the command line
+func bindFlags(v *viper.Viper, flags *pflag.FlagSet) error {
+	for name, key := range flagKeys {
+		f := flags.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if err := v.BindPFlag(key, f); err != nil {
+			return errors.Wrapf(err, "Failed to bind flag %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics defines all metrics for config reloads
+type Metrics struct {
+	ReloadSuccess  prometheus.Counter
+	ReloadFailure  prometheus.Counter
+	ReloadRejected prometheus.Counter
+}
+
+// InitializeMetrics initialize config metrics
+func InitializeMetrics() *Metrics {
+	return &Metrics{
+		ReloadSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "config_reload_success",
+		}),
+		ReloadFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "config_reload_failure",
+		}),
+		ReloadRejected: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "config_reload_rejected_keys",
+		}),
+	}
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// ReloadConfig contains config for reloading config while serving
+type ReloadConfig struct {
+	// Interval is how often the config file is checked for changes, 0 only reloads on SIGHUP
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Watcher reloads config on SIGHUP and once the config file changes. Settings safe to change while serving
+// (log, retry, cache, auth and requesttimeout) are handed to functions registered with OnReload,
+// changes of any other key need a restart and are rejected, the running config keeps their previous value.
+type Watcher struct {
+	dir     string
+	flags   *pflag.FlagSet
+	path    string
+	metrics *Metrics
+
+	// lock serializes reloads
+	lock     sync.Mutex
+	current  atomic.Value
+	modTime  time.Time
+	appliers []applier
+}
+
+type applier struct {
+	name  string
+	apply func(Config) error
+}
+
+// NewWatcher creates Watcher of config loaded by Load(dir, flags), current is the config servers started with
+func NewWatcher(dir string, flags *pflag.FlagSet, current Config, metrics *Metrics) (*Watcher, error) {
+	path, err := configFile(dir, flags)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read config %s", path)
+	}
+	w := &Watcher{
+		dir:     dir,
+		flags:   flags,
+		path:    path,
+		metrics: metrics,
+		modTime: info.ModTime(),
+	}
+	w.current.Store(current)
+	return w, nil
+}
+
+// Current returns the running config
+func (w *Watcher) Current() Config {
+	return w.current.Load().(Config)
+}
+
+// OnReload registers apply, called with the new running config whenever a reload changes it
+func (w *Watcher) OnReload(name string, apply func(Config) error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.appliers = append(w.appliers, applier{name: name, apply: apply})
+}
+
+// Run reloads config on every signal and once the config file changes, checked every interval
+// of the running config, until ctx is done
+func (w *Watcher) Run(ctx context.Context, signals <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval := w.Current().Reload.Interval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			logging.GetLogger().WithField("signal", sig.String()).Info("Received signal, reloading config")
+		case <-tick:
+			if !w.changed() {
+				continue
+			}
+			logging.GetLogger().WithField("config", w.path).Info("Config file changed, reloading config")
+		}
+		// failures are logged and counted by Reload
+		w.Reload()
+	}
+}
+
+// changed tells whether modification time of the config file differs from the one last loaded
+func (w *Watcher) changed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	info, err := os.Stat(w.path)
+	return err == nil && !info.ModTime().Equal(w.modTime)
+}
+
+// Reload loads config and applies settings safe to change while serving, returning keys whose change
+// is rejected since they need a restart. A config failing to load or validate is rejected as a whole,
+// an OnReload function failing keeps its previous settings and fails Reload once all of them ran.
+func (w *Watcher) Reload() ([]string, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if info, err := os.Stat(w.path); err == nil {
+		w.modTime = info.ModTime()
+	}
+	loaded, err := Load(w.dir, w.flags)
+	if err != nil {
+		w.metrics.ReloadFailure.Inc()
+		logging.GetLogger().WithError(err).Error("Failed to reload config, keeping the running one")
+		return nil, err
+	}
+	current := w.Current()
+	next := withLiveSettings(current, loaded)
+	rejected := changedKeys(next, loaded)
+	if len(rejected) > 0 {
+		w.metrics.ReloadRejected.Add(float64(len(rejected)))
+		logging.GetLogger().WithField("keys", rejected).Warn("Config changes need a restart, keeping their running values")
+	}
+	changed := changedKeys(current, next)
+	if len(changed) == 0 {
+		w.metrics.ReloadSuccess.Inc()
+		return rejected, nil
+	}
+	w.current.Store(next)
+	var failed []string
+	for _, a := range w.appliers {
+		if err := a.apply(next); err != nil {
+			logging.GetLogger().WithError(err).WithField("name", a.name).Error("Failed to apply reloaded config")
+			failed = append(failed, a.name+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		w.metrics.ReloadFailure.Inc()
+		return rejected, errors.Errorf("Failed to apply reloaded config to %s", strings.Join(failed, ", "))
+	}
+	w.metrics.ReloadSuccess.Inc()
+	logging.GetLogger().WithFields(logrus.Fields{"config": w.path, "keys": changed}).Info("Reloaded config")
+	return rejected, nil
+}
+
+// withLiveSettings returns current with the settings of loaded safe to change while serving
+func withLiveSettings(current, loaded Config) Config {
+	next := current
+	next.Log = loaded.Log
+	next.Retry = loaded.Retry
+	next.Cache = loaded.Cache
+	next.Cache.Enabled = current.Cache.Enabled
+	next.Auth = loaded.Auth
+	next.Auth.Enabled = current.Auth.Enabled
+	next.RequestTimeout = loaded.RequestTimeout
+	return next
+}
+
+// changedKeys returns sorted keys of values differing between a and b
+func changedKeys(a, b Config) []string {
+	values := make(map[string]interface{})
+	walk("", reflect.ValueOf(a), func(key string, field reflect.Value) {
+		values[key] = field.Interface()
+	})
+	var keys []string
+	walk("", reflect.ValueOf(b), func(key string, field reflect.Value) {
+		if !reflect.DeepEqual(values[key], field.Interface()) {
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	return keys
+}
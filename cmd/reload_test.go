@@ -0,0 +1,149 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var metrics = InitializeMetrics()
+
+func newTestWatcher(t *testing.T, content string) (*Watcher, string) {
+	path := writeConfig(t, content)
+	flags := newFlags(t, "--config", path)
+	cfg, err := Load("../config/", flags)
+	assert.NoError(t, err)
+	w, err := NewWatcher("../config/", flags, cfg, metrics)
+	assert.NoError(t, err)
+	return w, path
+}
+
+func Test_Reload(t *testing.T) {
+	w, path := newTestWatcher(t, "httpport: 8080\nretry:\n  maxattempts: 3\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	var applied []Config
+	w.OnReload("retry", func(c Config) error {
+		applied = append(applied, c)
+		return nil
+	})
+	rejectedKeys := testutil.ToFloat64(metrics.ReloadRejected)
+
+	// nothing changed
+	rejected, err := w.Reload()
+	assert.NoError(t, err)
+	assert.Empty(t, rejected)
+	assert.Empty(t, applied)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+httpport: 9090
+storage:
+  type: memory
+retry:
+  maxattempts: 7
+log:
+  level: debug
+cache:
+  enabled: true
+  ttl: 1m
+requesttimeout: 3s
+`), 0600))
+	rejected, err = w.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cache.enabled", "httpport", "storage.type"}, rejected)
+	assert.Equal(t, rejectedKeys+3, testutil.ToFloat64(metrics.ReloadRejected))
+	assert.Len(t, applied, 1)
+	cfg := w.Current()
+	assert.Equal(t, cfg, applied[0])
+	assert.Equal(t, 7, cfg.Retry.MaxAttempts)
+	assert.Equal(t, "debug", cfg.Log.Level)
+	assert.Equal(t, time.Minute, cfg.Cache.TTL)
+	assert.Equal(t, 3*time.Second, cfg.RequestTimeout)
+	// restart-only keys keep the values servers run with
+	assert.Equal(t, "8080", cfg.HTTPPort)
+	assert.Equal(t, "redis", cfg.Storage.Type)
+	assert.False(t, cfg.Cache.Enabled)
+
+	// reloading the same file again has nothing to apply, rejected keys are still reported
+	rejected, err = w.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cache.enabled", "httpport", "storage.type"}, rejected)
+	assert.Len(t, applied, 1)
+}
+
+func Test_ReloadFailure(t *testing.T) {
+	w, path := newTestWatcher(t, "retry:\n  maxattempts: 3\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	w.OnReload("auth", func(c Config) error { return errors.New("Failed to read JWKS") })
+	retried := 0
+	w.OnReload("retry", func(c Config) error {
+		retried = c.Retry.MaxAttempts
+		return nil
+	})
+	failures := testutil.ToFloat64(metrics.ReloadFailure)
+
+	// invalid config is rejected as a whole
+	assert.NoError(t, ioutil.WriteFile(path, []byte("retry:\n  maxattempts: 0\n"), 0600))
+	_, err := w.Reload()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "retry.maxattempts is less than 1")
+	assert.Equal(t, 3, w.Current().Retry.MaxAttempts)
+	assert.Equal(t, 0, retried)
+	assert.Equal(t, failures+1, testutil.ToFloat64(metrics.ReloadFailure))
+
+	// a failing OnReload function does not keep the others from applying
+	assert.NoError(t, ioutil.WriteFile(path, []byte("retry:\n  maxattempts: 4\n"), 0600))
+	_, err = w.Reload()
+	assert.EqualError(t, err, "Failed to apply reloaded config to auth: Failed to read JWKS")
+	assert.Equal(t, 4, retried)
+	assert.Equal(t, failures+2, testutil.ToFloat64(metrics.ReloadFailure))
+}
+
+func Test_Run(t *testing.T) {
+	w, path := newTestWatcher(t, "reload:\n  interval: 10ms\nretry:\n  maxattempts: 3\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	var lock sync.Mutex
+	attempts := 3
+	w.OnReload("retry", func(c Config) error {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts = c.Retry.MaxAttempts
+		return nil
+	})
+	// waitForAttempts polls as assert.Eventually of testify 1.4 may send on a closed channel once condition is slow
+	waitForAttempts := func(expected int) {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			lock.Lock()
+			current := attempts
+			lock.Unlock()
+			if current == expected {
+				return
+			}
+		}
+		t.Errorf("retry.maxattempts %d was not applied", expected)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	go w.Run(ctx, signals)
+
+	// file changes are picked up
+	assert.NoError(t, ioutil.WriteFile(path, []byte("reload:\n  interval: 10ms\nretry:\n  maxattempts: 4\n"), 0600))
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, future, future))
+	waitForAttempts(4)
+
+	// SIGHUP reloads even if modification time stays the same
+	assert.NoError(t, ioutil.WriteFile(path, []byte("reload:\n  interval: 10ms\nretry:\n  maxattempts: 5\n"), 0600))
+	assert.NoError(t, os.Chtimes(path, future, future))
+	signals <- syscall.SIGHUP
+	waitForAttempts(5)
+}
@@ -1,3 +1,3 @@
 export PUBLIC_IP=$(ipconfig getifaddr en0)
-docker run -d -p 8001:8001 -p 5001:5001 quay.io/coreos/etcd:v0.4.6 -peer-addr ${PUBLIC_IP}:8001 -addr ${PUBLIC_IP}:5001 -name etcd-node1
-curl -L $PUBLIC_IP:5001/v2/stats/leader
\ No newline at end of file
+docker run -d -p 2380:2380 -p 5001:5001 quay.io/coreos/etcd:v3.4.3 etcd -name etcd-node1 -listen-client-urls http://0.0.0.0:5001 -advertise-client-urls http://${PUBLIC_IP}:5001 -listen-peer-urls http://0.0.0.0:2380
+curl -L $PUBLIC_IP:5001/health
\ No newline at end of file
@@ -1,89 +1,225 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"net/http"
 
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
 	"github.com/gorilla/mux"
 	config "github.com/guanw/ct-dns/cmd"
+	"github.com/guanw/ct-dns/pkg/auth"
+	ctDNS "github.com/guanw/ct-dns/pkg/dns"
 	dns "github.com/guanw/ct-dns/pkg/grpc"
 	pb "github.com/guanw/ct-dns/pkg/grpc/proto-gen"
+	"github.com/guanw/ct-dns/pkg/healthcheck"
 	ctHttp "github.com/guanw/ct-dns/pkg/http"
+	"github.com/guanw/ct-dns/pkg/lifecycle"
 	"github.com/guanw/ct-dns/pkg/logging"
 	ctStore "github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/pkg/tlsconfig"
+	"github.com/guanw/ct-dns/pkg/xds"
 	"github.com/guanw/ct-dns/plugins/storage"
+	"github.com/guanw/ct-dns/plugins/storage/bolt"
 	"github.com/guanw/ct-dns/plugins/storage/dynamodb"
 	"github.com/guanw/ct-dns/plugins/storage/etcd"
+	"github.com/guanw/ct-dns/plugins/storage/raft"
 	"github.com/guanw/ct-dns/plugins/storage/redis"
+	"github.com/guanw/ct-dns/plugins/storage/sql"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
-	cfg := config.ReadConfig("./config/")
-	v := viper.New()
 	command := &cobra.Command{
 		Use:   "ct-dns",
 		Short: "ct-dns register and update host information for specific service",
 		Long:  `ct-dns register and update host information for specific service, User can configure different storage types using terminal flag`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			f := storage.NewFactory(v, cfg)
+			cfg, err := config.Load("./config/", cmd.Flags())
+			if err != nil {
+				return err
+			}
+			if err := logging.Configure(cfg.Log.Level, cfg.Log.Format); err != nil {
+				return err
+			}
+			watcher, err := config.NewWatcher("./config/", cmd.Flags(), cfg, config.InitializeMetrics())
+			if err != nil {
+				return err
+			}
+			watcher.OnReload("log", func(c config.Config) error {
+				return logging.Configure(c.Log.Level, c.Log.Format)
+			})
+			f := storage.NewFactory(cfg.Storage)
 			client, err := f.Initialize()
 			if err != nil {
 				return errors.Wrap(err, "Failed to start storage client")
 			}
+			// background work is stopped once servers are drained, before storage is closed
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 			store := ctStore.NewStore(client)
-			// TODO move 5 to config/from flag
-			retryStore := ctStore.NewRetryHandler(5, store, ctStore.InitializeMetrics())
+			retryHandler := ctStore.NewRetryHandler(cfg.Retry, store, ctStore.InitializeMetrics())
+			watcher.OnReload("retry", func(c config.Config) error {
+				retryHandler.SetPolicy(c.Retry)
+				return nil
+			})
+			var retryStore ctStore.Store = retryHandler
+			if cfg.Breaker.Enabled {
+				retryStore = ctStore.NewBreaker(retryStore, cfg.Breaker, ctStore.InitializeBreakerMetrics())
+				logging.GetLogger().Printf("storage circuit breaker opens after %d failures", cfg.Breaker.FailureThreshold)
+			}
+			if cfg.Cache.Enabled {
+				cache := ctStore.NewCache(retryStore, cfg.Cache, ctStore.InitializeCacheMetrics())
+				watcher.OnReload("cache", func(c config.Config) error {
+					cache.SetConfig(c.Cache)
+					return nil
+				})
+				retryStore = cache
+				logging.GetLogger().Printf("caching services for %s", cfg.Cache.TTL)
+			}
+			if cfg.HealthCheck.Enabled {
+				checker, err := healthcheck.NewChecker(retryStore, cfg.HealthCheck.Default, cfg.HealthCheck.Services, healthcheck.InitializeMetrics())
+				if err != nil {
+					return errors.Wrap(err, "Failed to start health checker")
+				}
+				go checker.Run(ctx)
+				retryStore = checker
+				logging.GetLogger().Printf("health checking hosts every %s over %s", cfg.HealthCheck.Default.Interval, cfg.HealthCheck.Default.Protocol)
+			}
+			healthServer := health.NewServer()
+			lc := lifecycle.NewManager(cfg.Lifecycle, healthServer)
+			var grpcOpts []grpc.ServerOption
+			requestTimeout := func() time.Duration { return watcher.Current().RequestTimeout }
+			unaryInterceptors := []grpc.UnaryServerInterceptor{dns.TimeoutInterceptorFunc(requestTimeout)}
+			// streams are ended once shutdown starts, so draining only waits on unary calls
+			streamInterceptors := []grpc.StreamServerInterceptor{lc.StreamInterceptor()}
+			r := mux.NewRouter()
+			if cfg.Auth.Enabled {
+				authMetrics := auth.InitializeMetrics()
+				authenticator, err := auth.NewAuthenticator(cfg.Auth, authMetrics)
+				if err != nil {
+					return errors.Wrap(err, "Failed to start authentication")
+				}
+				reloadable := auth.NewReloadable(authenticator)
+				authorizer := auth.NewAuthorizer(retryStore, cfg.Auth.Policy, authMetrics)
+				watcher.OnReload("auth", func(c config.Config) error {
+					authenticator, err := auth.NewAuthenticator(c.Auth, authMetrics)
+					if err != nil {
+						return err
+					}
+					reloadable.Set(authenticator)
+					authorizer.SetPolicy(c.Auth.Policy)
+					return nil
+				})
+				retryStore = authorizer
+				unaryInterceptors = append(unaryInterceptors, dns.AuthUnaryInterceptor(reloadable))
+				streamInterceptors = append(streamInterceptors, dns.AuthStreamInterceptor(reloadable))
+				r.Use(ctHttp.Authenticate(reloadable))
+				logging.GetLogger().Printf("authenticating writes with %d policy rules", len(cfg.Auth.Policy))
+			}
+			var tlsReloader *tlsconfig.Reloader
+			if cfg.TLS.Enabled() {
+				tlsReloader, err = tlsconfig.NewReloader(cfg.TLS)
+				if err != nil {
+					return errors.Wrap(err, "Failed to load TLS certificate")
+				}
+				go tlsReloader.Run(ctx)
+				grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsReloader.TLSConfig("h2"))))
+				logging.GetLogger().Printf("serving TLS on http and grpc ports, mTLS %t", cfg.TLS.ClientCAFile != "")
+			}
+			grpcOpts = append(grpcOpts, grpc.UnaryInterceptor(dns.ChainUnaryInterceptors(unaryInterceptors...)))
+			grpcOpts = append(grpcOpts, grpc.StreamInterceptor(dns.ChainStreamInterceptors(streamInterceptors...)))
 			dnsServer := dns.NewServer(retryStore, dns.InitializeMetrics())
 			lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.GRPCPort))
 			if err != nil {
 				return errors.Wrap(err, "Failed to listen")
 			}
-			grpcServer := grpc.NewServer()
-			healthServer := health.NewServer()
-			healthServer.SetServingStatus("ct-dns", grpc_health_v1.HealthCheckResponse_SERVING)
+			grpcServer := grpc.NewServer(grpcOpts...)
 			grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
 			pb.RegisterDnsServer(grpcServer, dnsServer)
+			xdsServer := xds.NewServer(retryStore, xds.InitializeMetrics())
+			endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, xdsServer)
+			discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, xdsServer)
 
-			go grpcServer.Serve(lis)
-			defer grpcServer.Stop()
+			lc.Go("grpc", func() error { return grpcServer.Serve(lis) })
+			lc.OnDrain("grpc", lifecycle.GracefulStopGRPC(grpcServer))
 			logging.GetLogger().Printf("grpc server listening at port %s", cfg.GRPCPort)
 
-			r := mux.NewRouter()
+			resolver := ctDNS.NewServer(retryStore, cfg.DNS.Zone, cfg.DNS.TTL, ctDNS.InitializeMetrics())
+			resolver.SetTimeout(cfg.RequestTimeout)
+			watcher.OnReload("dns", func(c config.Config) error {
+				resolver.SetTimeout(c.RequestTimeout)
+				return nil
+			})
+			lc.Go("dns", func() error { return resolver.ListenAndServe(":" + cfg.DNS.Port) })
+			lc.OnDrain("dns", func(context.Context) error { return resolver.Shutdown() })
+			logging.GetLogger().Printf("dns server listening at port %s for zone %s", cfg.DNS.Port, cfg.DNS.Zone)
+
+			r.Use(ctHttp.TimeoutFunc(requestTimeout))
 			httpHandler := ctHttp.NewHandler(retryStore, ctHttp.InitializeMetrics())
+			httpHandler.Readiness = lc.Report
 			httpHandler.RegisterRoutes(r)
 
 			r.Handle("/metrics", promhttp.Handler())
 			logging.GetLogger().Printf("http server listening at port %s", cfg.HTTPPort)
-			return http.ListenAndServe("0.0.0.0:"+cfg.HTTPPort, r)
+			httpServer := &http.Server{Addr: "0.0.0.0:" + cfg.HTTPPort, Handler: r}
+			if tlsReloader != nil {
+				httpServer.TLSConfig = tlsReloader.TLSConfig("h2", "http/1.1")
+				lc.Go("http", func() error { return httpServer.ListenAndServeTLS("", "") })
+			} else {
+				lc.Go("http", httpServer.ListenAndServe)
+			}
+			lc.OnDrain("http", httpServer.Shutdown)
+			lc.OnClose("background tasks", func() error {
+				cancel()
+				return nil
+			})
+			lc.OnClose("storage", client.Close)
+
+			lc.AddCheck("storage", client.Ping)
+			go lc.Run(ctx)
+			reloads := make(chan os.Signal, 1)
+			signal.Notify(reloads, syscall.SIGHUP)
+			go watcher.Run(ctx, reloads)
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+			return lc.Wait(signals)
 		},
 	}
-	AddFlags(v, command)
+	AddFlags(command)
 	if err := command.Execute(); err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 }
 
-// AddFlags applies binding flags to initialize app
-func AddFlags(v *viper.Viper, command *cobra.Command) {
+// AddFlags applies binding flags to initialize app, flags set on the command line override config
+func AddFlags(command *cobra.Command) {
 	flagSet := new(flag.FlagSet)
 
+	config.AddFlags(flagSet)
+	bolt.AddFlags(flagSet)
+	raft.AddFlags(flagSet)
 	dynamodb.AddFlags(flagSet)
 	etcd.AddFlags(flagSet)
 	redis.AddFlags(flagSet)
+	sql.AddFlags(flagSet)
 	storage.AddFlags(flagSet)
+	tlsconfig.AddFlags(flagSet)
 
 	command.Flags().AddGoFlagSet(flagSet)
-	v.BindPFlags(command.Flags())
 }
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Identity is who a caller authenticated as, Method tells which authenticator vouched for it
+type Identity struct {
+	Name   string
+	Method string
+}
+
+// Credentials are presented by a caller, either of them may be empty
+// VerifiedChains only holds client certificates verified against the listener's client CA
+type Credentials struct {
+	Token          string
+	VerifiedChains [][]*x509.Certificate
+}
+
+// Authenticator resolves credentials to an identity, errNotApplicable tells it has nothing to check
+type Authenticator interface {
+	Authenticate(creds Credentials) (Identity, error)
+}
+
+var (
+	// ErrUnauthenticated is returned for invalid credentials and for writes by anonymous callers
+	ErrUnauthenticated = errors.New("Unauthenticated, valid bearer token or client certificate required")
+	errNotApplicable   = errors.New("credentials not applicable")
+)
+
+// IsUnauthenticated tells whether cause of err is ErrUnauthenticated
+func IsUnauthenticated(err error) bool {
+	return errors.Cause(err) == ErrUnauthenticated
+}
+
+type identityKey struct{}
+
+// NewContext returns ctx carrying identity
+func NewContext(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns identity of ctx, false for anonymous callers
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+type chain struct {
+	authenticators []Authenticator
+	metrics        *Metrics
+}
+
+// Chain tries authenticators in order, the first one accepting credentials wins
+// credentials none of them accepts fail with ErrUnauthenticated, callers presenting none stay anonymous
+// as do callers presenting only a certificate no authenticator checks (mTLS authentication off)
+func Chain(metrics *Metrics, authenticators ...Authenticator) Authenticator {
+	return &chain{
+		authenticators: authenticators,
+		metrics:        metrics,
+	}
+}
+
+func (c *chain) Authenticate(creds Credentials) (Identity, error) {
+	applied := false
+	for _, authenticator := range c.authenticators {
+		identity, err := authenticator.Authenticate(creds)
+		if err == nil {
+			c.metrics.AuthenticationSuccess.Inc()
+			return identity, nil
+		}
+		applied = applied || err != errNotApplicable
+	}
+	// a bearer token is never ignored, a wrong one must not fall back to anonymous
+	if !applied && creds.Token == "" {
+		return Identity{}, errNotApplicable
+	}
+	c.metrics.AuthenticationFailure.Inc()
+	return Identity{}, ErrUnauthenticated
+}
+
+// Reloadable is an Authenticator delegating to one that can be replaced while serving
+type Reloadable struct {
+	current atomic.Value
+}
+
+type holder struct {
+	Authenticator
+}
+
+// NewReloadable creates Reloadable delegating to authenticator
+func NewReloadable(authenticator Authenticator) *Reloadable {
+	r := &Reloadable{}
+	r.Set(authenticator)
+	return r
+}
+
+// Set replaces the authenticator credentials are checked by from now on
+func (r *Reloadable) Set(authenticator Authenticator) {
+	r.current.Store(holder{authenticator})
+}
+
+// Authenticate checks creds with the current authenticator
+func (r *Reloadable) Authenticate(creds Credentials) (Identity, error) {
+	return r.current.Load().(holder).Authenticate(creds)
+}
+
+// Authenticate returns ctx carrying identity of creds, ctx is returned as is for anonymous callers
+func Authenticate(ctx context.Context, authenticator Authenticator, creds Credentials) (context.Context, error) {
+	identity, err := authenticator.Authenticate(creds)
+	if err == errNotApplicable {
+		return ctx, nil
+	}
+	if err != nil {
+		return ctx, err
+	}
+	return NewContext(ctx, identity), nil
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var metrics = InitializeMetrics()
+
+func Test_TokenAuthenticator(t *testing.T) {
+	a, err := NewTokenAuthenticator([]TokenConfig{{Identity: "deployer", Token: "s3cret"}, {Identity: "ci", Token: "other"}})
+	assert.NoError(t, err)
+
+	identity, err := a.Authenticate(Credentials{Token: "other"})
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "ci", Method: MethodToken}, identity)
+	_, err = a.Authenticate(Credentials{Token: "s3cre"})
+	assert.Error(t, err)
+	_, err = a.Authenticate(Credentials{})
+	assert.Equal(t, errNotApplicable, err)
+
+	_, err = NewTokenAuthenticator([]TokenConfig{{Identity: "deployer"}})
+	assert.Error(t, err)
+}
+
+func Test_MTLSAuthenticator(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/default/sa/deployer")
+	a := NewMTLSAuthenticator()
+
+	identity, err := a.Authenticate(Credentials{VerifiedChains: [][]*x509.Certificate{{{URIs: []*url.URL{spiffe}, Subject: pkix.Name{CommonName: "deployer"}}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "spiffe://cluster.local/ns/default/sa/deployer", Method: MethodMTLS}, identity)
+	identity, err = a.Authenticate(Credentials{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "deployer"}}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "deployer", identity.Name)
+	_, err = a.Authenticate(Credentials{Token: "s3cret"})
+	assert.Equal(t, errNotApplicable, err)
+}
+
+func Test_Authenticate(t *testing.T) {
+	authenticator, err := NewAuthenticator(Config{
+		Tokens: []TokenConfig{{Identity: "deployer", Token: "s3cret"}},
+		MTLS:   true,
+	}, metrics)
+	assert.NoError(t, err)
+	failures := testutil.ToFloat64(metrics.AuthenticationFailure)
+
+	ctx, err := Authenticate(context.Background(), authenticator, Credentials{Token: "s3cret"})
+	assert.NoError(t, err)
+	identity, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "deployer", identity.Name)
+
+	ctx, err = Authenticate(context.Background(), authenticator, Credentials{})
+	assert.NoError(t, err)
+	_, ok = FromContext(ctx)
+	assert.False(t, ok)
+
+	_, err = Authenticate(context.Background(), authenticator, Credentials{Token: "wrong"})
+	assert.True(t, IsUnauthenticated(err))
+	assert.Equal(t, failures+1, testutil.ToFloat64(metrics.AuthenticationFailure))
+
+	_, err = NewAuthenticator(Config{Enabled: true}, metrics)
+	assert.Error(t, err)
+}
+
+func Test_AuthenticateCertificateWithoutMTLS(t *testing.T) {
+	authenticator, err := NewAuthenticator(Config{
+		Tokens: []TokenConfig{{Identity: "deployer", Token: "s3cret"}},
+	}, metrics)
+	assert.NoError(t, err)
+	failures := testutil.ToFloat64(metrics.AuthenticationFailure)
+	chains := [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "deployer"}}}}
+
+	// a verified certificate nobody checks leaves the caller anonymous
+	ctx, err := Authenticate(context.Background(), authenticator, Credentials{VerifiedChains: chains})
+	assert.NoError(t, err)
+	_, ok := FromContext(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, failures, testutil.ToFloat64(metrics.AuthenticationFailure))
+
+	ctx, err = Authenticate(context.Background(), authenticator, Credentials{Token: "s3cret", VerifiedChains: chains})
+	assert.NoError(t, err)
+	identity, _ := FromContext(ctx)
+	assert.Equal(t, Identity{Name: "deployer", Method: MethodToken}, identity)
+	_, err = Authenticate(context.Background(), authenticator, Credentials{Token: "wrong", VerifiedChains: chains})
+	assert.True(t, IsUnauthenticated(err))
+}
+
+func Test_Reloadable(t *testing.T) {
+	deployer, err := NewTokenAuthenticator([]TokenConfig{{Identity: "deployer", Token: "s3cret"}})
+	assert.NoError(t, err)
+	r := NewReloadable(deployer)
+	identity, err := r.Authenticate(Credentials{Token: "s3cret"})
+	assert.NoError(t, err)
+	assert.Equal(t, "deployer", identity.Name)
+
+	// rotated token replaces the old one
+	rotated, err := NewTokenAuthenticator([]TokenConfig{{Identity: "deployer", Token: "rotated"}})
+	assert.NoError(t, err)
+	r.Set(rotated)
+	_, err = r.Authenticate(Credentials{Token: "s3cret"})
+	assert.Error(t, err)
+	identity, err = r.Authenticate(Credentials{Token: "rotated"})
+	assert.NoError(t, err)
+	assert.Equal(t, "deployer", identity.Name)
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Config defines how callers authenticate and which identities may write which services
+type Config struct {
+	Enabled bool          `yaml:"enabled"`
+	Tokens  []TokenConfig `yaml:"tokens"`
+	JWT     JWTConfig     `yaml:"jwt"`
+	// MTLS takes identity from verified client certificates, listeners need a client CA for it
+	MTLS   bool   `yaml:"mtls"`
+	Policy Policy `yaml:"policy"`
+}
+
+// NewAuthenticator chains authenticators enabled by config, static tokens first, then JWT and mTLS
+func NewAuthenticator(config Config, metrics *Metrics) (Authenticator, error) {
+	var authenticators []Authenticator
+	if len(config.Tokens) > 0 {
+		tokens, err := NewTokenAuthenticator(config.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if config.JWT.JWKSFile != "" {
+		jwt, err := NewJWTAuthenticator(config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	if config.MTLS {
+		authenticators = append(authenticators, NewMTLSAuthenticator())
+	}
+	if len(authenticators) == 0 {
+		return nil, errors.New("Auth is enabled without tokens, jwt or mtls")
+	}
+	return Chain(metrics, authenticators...), nil
+}
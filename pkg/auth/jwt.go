@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// MethodJWT identifies callers authenticated by a JWT bearer token
+const MethodJWT = "jwt"
+
+// JWTConfig defines how JWT bearer tokens are validated, tokens have to be signed (RS*, PS* or ES*)
+// by a key of JWKSFile, carry an exp claim and match Issuer/Audience when set
+type JWTConfig struct {
+	// JWKSFile is a local JSON Web Key Set, jwt authentication is off while empty
+	JWKSFile string `yaml:"jwksfile"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// IdentityClaim names the claim identity is taken from, sub by default
+	IdentityClaim string `yaml:"identityclaim"`
+	// Leeway tolerates clock skew checking exp and nbf
+	Leeway time.Duration `yaml:"leeway"`
+}
+
+const defaultIdentityClaim = "sub"
+
+// minRSABits is the smallest RSA modulus signing keys are accepted with
+const minRSABits = 2048
+
+// curves maps ES algorithms to the only curve they may be used with
+var curves = map[jose.SignatureAlgorithm]elliptic.Curve{
+	jose.ES256: elliptic.P256(),
+	jose.ES384: elliptic.P384(),
+	jose.ES512: elliptic.P521(),
+}
+
+// rsaAlgorithms are the RS and PS algorithms, none and HMAC are never accepted
+var rsaAlgorithms = map[jose.SignatureAlgorithm]bool{
+	jose.RS256: true,
+	jose.RS384: true,
+	jose.RS512: true,
+	jose.PS256: true,
+	jose.PS384: true,
+	jose.PS512: true,
+}
+
+type jwtAuthenticator struct {
+	config JWTConfig
+	keys   []jose.JSONWebKey
+	now    func() time.Time
+}
+
+// NewJWTAuthenticator creates authenticator validating JWT bearer tokens against keys of config.JWKSFile
+func NewJWTAuthenticator(config JWTConfig) (Authenticator, error) {
+	raw, err := ioutil.ReadFile(config.JWKSFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read JWKS file")
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return nil, err
+	}
+	if config.IdentityClaim == "" {
+		config.IdentityClaim = defaultIdentityClaim
+	}
+	return &jwtAuthenticator{
+		config: config,
+		keys:   keys,
+		now:    time.Now,
+	}, nil
+}
+
+// parseJWKS reads RSA and EC signing keys of a key set, other keys are skipped
+func parseJWKS(raw []byte) ([]jose.JSONWebKey, error) {
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode JWKS")
+	}
+	var keys []jose.JSONWebKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch key := k.Key.(type) {
+		case *rsa.PublicKey:
+			if key.N.BitLen() < minRSABits {
+				return nil, errors.Errorf("RSA key %q is shorter than %d bits", k.KeyID, minRSABits)
+			}
+		case *ecdsa.PublicKey:
+		default:
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+// Authenticate validates signature and claims of a JWT, tokens not shaped like one are not applicable
+func (a *jwtAuthenticator) Authenticate(creds Credentials) (Identity, error) {
+	if strings.Count(creds.Token, ".") != 2 {
+		return Identity{}, errNotApplicable
+	}
+	token, err := jwt.ParseSigned(creds.Token)
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "Failed to decode JWT")
+	}
+	if len(token.Headers) != 1 {
+		return Identity{}, errors.New("JWT has to carry a single signature")
+	}
+	header := token.Headers[0]
+	key, err := a.key(header.KeyID)
+	if err != nil {
+		return Identity{}, err
+	}
+	if err := checkAlgorithm(jose.SignatureAlgorithm(header.Algorithm), key.Key); err != nil {
+		return Identity{}, err
+	}
+	var claims jwt.Claims
+	var custom map[string]interface{}
+	if err := token.Claims(key.Key, &claims, &custom); err != nil {
+		return Identity{}, errors.Wrap(err, "Invalid JWT signature")
+	}
+	if claims.Expiry == nil {
+		return Identity{}, errors.New("JWT has no exp claim")
+	}
+	expected := jwt.Expected{
+		Issuer: a.config.Issuer,
+		Time:   a.now(),
+	}
+	if a.config.Audience != "" {
+		expected.Audience = jwt.Audience{a.config.Audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, a.config.Leeway); err != nil {
+		return Identity{}, errors.Wrap(err, "Invalid JWT claims")
+	}
+	name, _ := custom[a.config.IdentityClaim].(string)
+	if name == "" {
+		return Identity{}, errors.Errorf("JWT has no %s claim", a.config.IdentityClaim)
+	}
+	return Identity{Name: name, Method: MethodJWT}, nil
+}
+
+// key returns key of kid, tokens without kid are only accepted by a single key set
+func (a *jwtAuthenticator) key(kid string) (jose.JSONWebKey, error) {
+	if kid == "" && len(a.keys) == 1 {
+		return a.keys[0], nil
+	}
+	for _, k := range a.keys {
+		if kid != "" && k.KeyID == kid {
+			return k, nil
+		}
+	}
+	return jose.JSONWebKey{}, errors.Errorf("Unknown JWT key %q", kid)
+}
+
+// checkAlgorithm tells whether alg may be verified with key, RS*/PS* need an RSA key,
+// ES256/384/512 an EC key on P-256/384/521 respectively
+func checkAlgorithm(alg jose.SignatureAlgorithm, key interface{}) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if rsaAlgorithms[alg] {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if curve, ok := curves[alg]; ok && curve == key.Curve {
+			return nil
+		}
+	}
+	return errors.Errorf("JWT algorithm %q does not match key", alg)
+}
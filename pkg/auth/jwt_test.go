@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Unix(1577836800, 0)
+
+// ec384Key is a P-384 key of the test key set, only ES384 may be verified with it
+var ec384Key, _ = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+func encode(v interface{}) string {
+	raw, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+var hashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// sign builds a JWT of claims signed with key, the signature is sized by the curve of key
+// rather than by alg so mismatching ones can be built
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, h.Sum(nil))
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		assert.NoError(t, err)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		copy(signature[size-len(r.Bytes()):size], r.Bytes())
+		copy(signature[2*size-len(s.Bytes()):], s.Bytes())
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestJWTAuthenticator(t *testing.T, config JWTConfig) (*jwtAuthenticator, *rsa.PrivateKey, *ecdsa.PrivateKey, func()) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": encodeInt(rsaKey.N), "e": encodeInt(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encodeInt(ecKey.X), "y": encodeInt(ecKey.Y)},
+			{"kty": "EC", "kid": "ec-384", "crv": "P-384", "x": encodeInt(ec384Key.X), "y": encodeInt(ec384Key.Y)},
+			{"kty": "oct", "kid": "hmac-1", "k": "c2VjcmV0"},
+		},
+	}
+	f, err := ioutil.TempFile("", "jwks")
+	assert.NoError(t, err)
+	json.NewEncoder(f).Encode(jwks)
+	f.Close()
+	config.JWKSFile = f.Name()
+	a, err := NewJWTAuthenticator(config)
+	assert.NoError(t, err)
+	authenticator := a.(*jwtAuthenticator)
+	authenticator.now = func() time.Time { return now }
+	return authenticator, rsaKey, ecKey, func() { os.Remove(f.Name()) }
+}
+
+func Test_JWTAuthenticator(t *testing.T) {
+	a, rsaKey, ecKey, done := newTestJWTAuthenticator(t, JWTConfig{Issuer: "https://issuer", Audience: "ct-dns", Leeway: time.Minute})
+	defer done()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "deployer", "iss": "https://issuer", "aud": []string{"ct-dns", "other"}, "exp": now.Add(time.Hour).Unix()}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	identity, err := a.Authenticate(Credentials{Token: sign(t, "RS256", "rsa-1", rsaKey, claims(nil))})
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{Name: "deployer", Method: MethodJWT}, identity)
+	identity, err = a.Authenticate(Credentials{Token: sign(t, "ES256", "ec-1", ecKey, claims(map[string]interface{}{"aud": "ct-dns"}))})
+	assert.NoError(t, err)
+	assert.Equal(t, "deployer", identity.Name)
+	// expired within leeway is still accepted
+	_, err = a.Authenticate(Credentials{Token: sign(t, "RS512", "rsa-1", rsaKey, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}))})
+	assert.NoError(t, err)
+
+	tests := map[string]string{
+		"expired":         sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		"no exp":          sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"exp": nil})),
+		"not valid yet":   sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"wrong issuer":    sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"iss": "https://other"})),
+		"wrong audience":  sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+		"no subject":      sign(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"sub": ""})),
+		"unknown key":     sign(t, "RS256", "rsa-2", rsaKey, claims(nil)),
+		"no kid":          sign(t, "RS256", "", rsaKey, claims(nil)),
+		"other signer":    sign(t, "RS256", "rsa-1", otherKey, claims(nil)),
+		"key type":        sign(t, "RS256", "ec-1", rsaKey, claims(nil)),
+		"curve mismatch":  sign(t, "ES384", "ec-1", ecKey, claims(nil)),
+		"p-384 as es256":  sign(t, "ES256", "ec-384", ec384Key, claims(nil)),
+		"none algorithm":  encode(map[string]string{"alg": "none"}) + "." + encode(claims(nil)) + ".",
+		"hmac algorithm":  encode(map[string]string{"alg": "HS256", "kid": "hmac-1"}) + "." + encode(claims(nil)) + ".c2ln",
+		"broken segments": "a.b.c",
+	}
+	for name, token := range tests {
+		_, err := a.Authenticate(Credentials{Token: token})
+		assert.Error(t, err, name)
+		assert.NotEqual(t, errNotApplicable, err, name)
+	}
+	_, err = a.Authenticate(Credentials{Token: "static-token"})
+	assert.Equal(t, errNotApplicable, err)
+}
+
+func Test_NewJWTAuthenticator(t *testing.T) {
+	_, err := NewJWTAuthenticator(JWTConfig{JWKSFile: "/nonexistent/jwks.json"})
+	assert.Error(t, err)
+	_, err = parseJWKS([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`))
+	assert.Error(t, err)
+	_, err = parseJWKS([]byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+	assert.Error(t, err)
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	_, err = parseJWKS([]byte(`{"keys":[{"kty":"RSA","kid":"weak","n":"` + encodeInt(weakKey.N) + `","e":"AQAB"}]}`))
+	assert.EqualError(t, err, `RSA key "weak" is shorter than 2048 bits`)
+}
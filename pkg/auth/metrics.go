@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics defines all metrics for authentication and authorization
+type Metrics struct {
+	AuthenticationSuccess prometheus.Counter
+	AuthenticationFailure prometheus.Counter
+
+	AuthorizationSuccess prometheus.Counter
+	AuthorizationDenied  prometheus.Counter
+}
+
+// InitializeMetrics initialize auth metrics
+func InitializeMetrics() *Metrics {
+	return &Metrics{
+		AuthenticationSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "auth_authentication_success",
+		}),
+		AuthenticationFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "auth_authentication_failure",
+		}),
+		AuthorizationSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "auth_authorization_success",
+		}),
+		AuthorizationDenied: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "auth_authorization_denied",
+		}),
+	}
+}
@@ -0,0 +1,26 @@
+package auth
+
+// MethodMTLS identifies callers authenticated by a verified client certificate
+const MethodMTLS = "mtls"
+
+type mtlsAuthenticator struct{}
+
+// NewMTLSAuthenticator creates authenticator taking identity from the leaf of a verified client
+// certificate chain, its first URI SAN (e.g. a SPIFFE id) or else its common name
+func NewMTLSAuthenticator() Authenticator {
+	return &mtlsAuthenticator{}
+}
+
+func (a *mtlsAuthenticator) Authenticate(creds Credentials) (Identity, error) {
+	if len(creds.VerifiedChains) == 0 || len(creds.VerifiedChains[0]) == 0 {
+		return Identity{}, errNotApplicable
+	}
+	leaf := creds.VerifiedChains[0][0]
+	if len(leaf.URIs) > 0 {
+		return Identity{Name: leaf.URIs[0].String(), Method: MethodMTLS}, nil
+	}
+	if leaf.Subject.CommonName != "" {
+		return Identity{Name: leaf.Subject.CommonName, Method: MethodMTLS}, nil
+	}
+	return Identity{}, errNotApplicable
+}
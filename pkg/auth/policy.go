@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Rule allows Identities to register and deregister Services of Namespaces,
+// patterns may contain * wildcards and empty lists match anything
+type Rule struct {
+	Identities []string `yaml:"identities"`
+	Namespaces []string `yaml:"namespaces"`
+	Services   []string `yaml:"services"`
+}
+
+// Policy allows a write when any of its rules matches, without rules every authenticated identity may write
+type Policy []Rule
+
+// PermissionError is returned for writes the policy does not allow
+type PermissionError struct {
+	Identity    string
+	Namespace   string
+	ServiceName string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Permission denied, %s may not change service %s of namespace %s", e.Identity, e.ServiceName, e.Namespace)
+}
+
+// IsPermissionDenied tells whether cause of err is a PermissionError
+func IsPermissionDenied(err error) bool {
+	_, ok := errors.Cause(err).(*PermissionError)
+	return ok
+}
+
+// Allow tells whether identity may change serviceName of namespace
+func (p Policy) Allow(identity, namespace, serviceName string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, rule := range p {
+		if matchAny(rule.Identities, identity) && matchAny(rule.Namespaces, namespace) && matchAny(rule.Services, serviceName) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// match tells whether value matches pattern, * matches any sequence including / and :
+func match(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
+
+// Authorizer is a Store authorizing writes to the Store it wraps
+type Authorizer interface {
+	store.Store
+	// SetPolicy replaces the policy writes are authorized by
+	SetPolicy(policy Policy)
+}
+
+type authorizer struct {
+	Store   store.Store
+	Metrics *Metrics
+
+	lock   sync.Mutex
+	policy Policy
+}
+
+// NewAuthorizer creates Store requiring an authenticated identity allowed by policy
+// (see NewContext) for Register, Deregister and UpdateService, reads are left open
+func NewAuthorizer(inner store.Store, policy Policy, metrics *Metrics) Authorizer {
+	return &authorizer{
+		Store:   inner,
+		Metrics: metrics,
+		policy:  policy,
+	}
+}
+
+// SetPolicy replaces policy, writes already authorized are not checked again
+func (a *authorizer) SetPolicy(policy Policy) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.policy = policy
+}
+
+func (a *authorizer) currentPolicy() Policy {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.policy
+}
+
+func (a *authorizer) authorize(ctx context.Context, namespace, serviceName string) error {
+	identity, ok := FromContext(ctx)
+	if !ok {
+		a.Metrics.AuthorizationDenied.Inc()
+		return ErrUnauthenticated
+	}
+	if !a.currentPolicy().Allow(identity.Name, namespace, serviceName) {
+		a.Metrics.AuthorizationDenied.Inc()
+		logging.GetLogger().WithFields(logrus.Fields{
+			"identity":  identity.Name,
+			"method":    identity.Method,
+			"namespace": namespace,
+			"service":   serviceName,
+		}).Warn("Denied write to service")
+		return &PermissionError{Identity: identity.Name, Namespace: namespace, ServiceName: serviceName}
+	}
+	a.Metrics.AuthorizationSuccess.Inc()
+	return nil
+}
+
+// GetService is not authorized
+func (a *authorizer) GetService(ctx context.Context, namespace, serviceName string) ([]storage.Instance, error) {
+	return a.Store.GetService(ctx, namespace, serviceName)
+}
+
+// Register registers instance once identity of ctx is allowed to
+func (a *authorizer) Register(ctx context.Context, namespace, serviceName string, instance storage.Instance, ttl time.Duration) error {
+	if err := a.authorize(ctx, namespace, serviceName); err != nil {
+		return err
+	}
+	return a.Store.Register(ctx, namespace, serviceName, instance, ttl)
+}
+
+// Deregister removes host once identity of ctx is allowed to
+func (a *authorizer) Deregister(ctx context.Context, namespace, serviceName, host string) error {
+	if err := a.authorize(ctx, namespace, serviceName); err != nil {
+		return err
+	}
+	return a.Store.Deregister(ctx, namespace, serviceName, host)
+}
+
+// UpdateService applies operation once identity of ctx is allowed to
+func (a *authorizer) UpdateService(ctx context.Context, namespace, serviceName, operation string, instance storage.Instance, ttl time.Duration) error {
+	if err := a.authorize(ctx, namespace, serviceName); err != nil {
+		return err
+	}
+	return a.Store.UpdateService(ctx, namespace, serviceName, operation, instance, ttl)
+}
+
+// WatchService is not authorized
+func (a *authorizer) WatchService(ctx context.Context, namespace, serviceName string) (<-chan storage.Event, error) {
+	return a.Store.WatchService(ctx, namespace, serviceName)
+}
+
+// ListServices is not authorized
+func (a *authorizer) ListServices(ctx context.Context, namespace, prefix, pageToken string, pageSize int) ([]string, string, error) {
+	return a.Store.ListServices(ctx, namespace, prefix, pageToken, pageSize)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_PolicyAllow(t *testing.T) {
+	policy := Policy{
+		{Identities: []string{"deployer"}},
+		{Identities: []string{"spiffe://cluster.local/ns/payments/*"}, Namespaces: []string{"payments"}, Services: []string{"payments-*", "ledger"}},
+	}
+	tests := []struct {
+		identity    string
+		namespace   string
+		serviceName string
+		allowed     bool
+	}{
+		{identity: "deployer", namespace: "team-a", serviceName: "anything", allowed: true},
+		{identity: "spiffe://cluster.local/ns/payments/sa/api", namespace: "payments", serviceName: "payments-api", allowed: true},
+		{identity: "spiffe://cluster.local/ns/payments/sa/api", namespace: "payments", serviceName: "ledger", allowed: true},
+		{identity: "spiffe://cluster.local/ns/payments/sa/api", namespace: "payments", serviceName: "ledger-v2", allowed: false},
+		{identity: "spiffe://cluster.local/ns/payments/sa/api", namespace: "default", serviceName: "payments-api", allowed: false},
+		{identity: "spiffe://cluster.local/ns/search/sa/api", namespace: "payments", serviceName: "payments-api", allowed: false},
+		{identity: "ci", namespace: "default", serviceName: "anything", allowed: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, policy.Allow(test.identity, test.namespace, test.serviceName), test)
+	}
+	assert.True(t, Policy{}.Allow("anyone", "default", "anything"))
+}
+
+func Test_match(t *testing.T) {
+	assert.True(t, match("*", ""))
+	assert.True(t, match("a*c*e", "abcde"))
+	assert.True(t, match("*-api", "payments-api"))
+	assert.False(t, match("a*c*e", "abcd"))
+	assert.False(t, match("ab*ba", "aba"))
+	assert.False(t, match("payments", "payments-api"))
+}
+
+func Test_Authorizer(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("Register", mock.Anything, "payments", "payments-api", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(nil)
+	mockStore.On("GetService", mock.Anything, "payments", "payments-api").Return([]storage.Instance{{Host: "192.0.0.1:8080"}}, nil)
+	a := NewAuthorizer(mockStore, Policy{{Identities: []string{"payments"}, Namespaces: []string{"payments"}}}, metrics)
+	allowed := NewContext(context.Background(), Identity{Name: "payments", Method: MethodToken})
+	denied := NewContext(context.Background(), Identity{Name: "search", Method: MethodToken})
+
+	assert.NoError(t, a.Register(allowed, "payments", "payments-api", storage.Instance{Host: "192.0.0.1:8080"}, 0))
+	err := a.Deregister(denied, "payments", "payments-api", "192.0.0.1:8080")
+	assert.True(t, IsPermissionDenied(err))
+	assert.EqualError(t, err, "Permission denied, search may not change service payments-api of namespace payments")
+	assert.True(t, IsPermissionDenied(a.UpdateService(allowed, "default", "payments-api", "delete", storage.Instance{Host: "192.0.0.1:8080"}, 0)))
+	assert.True(t, IsUnauthenticated(a.Register(context.Background(), "payments", "payments-api", storage.Instance{Host: "192.0.0.1:8080"}, 0)))
+	// reads are not authorized
+	_, err = a.GetService(context.Background(), "payments", "payments-api")
+	assert.NoError(t, err)
+	mockStore.AssertNumberOfCalls(t, "Register", 1)
+	mockStore.AssertNotCalled(t, "Deregister", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockStore.AssertNotCalled(t, "UpdateService", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	a.SetPolicy(Policy{{Identities: []string{"search"}}})
+	assert.True(t, IsPermissionDenied(a.Register(allowed, "payments", "payments-api", storage.Instance{Host: "192.0.0.1:8080"}, 0)))
+	mockStore.On("Deregister", mock.Anything, "payments", "payments-api", "192.0.0.1:8080").Return(nil)
+	assert.NoError(t, a.Deregister(denied, "payments", "payments-api", "192.0.0.1:8080"))
+}
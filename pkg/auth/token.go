@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/subtle"
+
+	"github.com/pkg/errors"
+)
+
+// MethodToken identifies callers authenticated by a static bearer token
+const MethodToken = "token"
+
+// TokenConfig maps a static bearer token to the identity presenting it
+type TokenConfig struct {
+	Identity string `yaml:"identity"`
+	Token    string `yaml:"token"`
+}
+
+type tokenAuthenticator struct {
+	tokens []TokenConfig
+}
+
+// NewTokenAuthenticator creates authenticator accepting static bearer tokens
+func NewTokenAuthenticator(tokens []TokenConfig) (Authenticator, error) {
+	for _, token := range tokens {
+		if token.Identity == "" || token.Token == "" {
+			return nil, errors.New("Static tokens need both identity and token")
+		}
+	}
+	return &tokenAuthenticator{tokens: tokens}, nil
+}
+
+// Authenticate compares token against every configured one in constant time
+func (a *tokenAuthenticator) Authenticate(creds Credentials) (Identity, error) {
+	if creds.Token == "" {
+		return Identity{}, errNotApplicable
+	}
+	var identity Identity
+	found := false
+	for _, token := range a.tokens {
+		match := subtle.ConstantTimeCompare([]byte(creds.Token), []byte(token.Token)) == 1
+		if match && !found {
+			identity = Identity{Name: token.Identity, Method: MethodToken}
+			found = true
+		}
+	}
+	if !found {
+		return Identity{}, errors.New("Unknown bearer token")
+	}
+	return identity, nil
+}
@@ -0,0 +1,318 @@
+package dns
+
+import (
+	"context"
+	"encoding/hex"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/storage"
+	miekg "github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	addrLabel      = "addr"
+	defaultTimeout = 2 * time.Second
+)
+
+var errNameNotFound = errors.New("Name not found in zone")
+
+// Server answers A/AAAA/SRV queries for services registered in the default namespace of store
+type Server struct {
+	Store   store.Store
+	Metrics *Metrics
+	Zone    string
+	TTL     uint32
+	// Timeout bounds the store lookup behind every query, use SetTimeout once serving
+	Timeout time.Duration
+
+	lock    sync.Mutex
+	servers []*miekg.Server
+}
+
+// NewServer creates new dns Server authoritative for zone
+func NewServer(store store.Store, zone string, ttl uint32, metrics *Metrics) *Server {
+	return &Server{
+		Store:   store,
+		Metrics: metrics,
+		Zone:    miekg.Fqdn(strings.ToLower(zone)),
+		TTL:     ttl,
+		Timeout: defaultTimeout,
+	}
+}
+
+// SetTimeout replaces Timeout while serving, 0 restores the default
+func (s *Server) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Timeout = timeout
+}
+
+func (s *Server) timeout() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Timeout
+}
+
+// ListenAndServe serves dns queries on addr over both udp and tcp
+func (s *Server) ListenAndServe(addr string) error {
+	errCh := make(chan error, 2)
+	s.lock.Lock()
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &miekg.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: s,
+		}
+		s.servers = append(s.servers, srv)
+		go func() {
+			errCh <- srv.ListenAndServe()
+		}()
+	}
+	s.lock.Unlock()
+	return <-errCh
+}
+
+// Shutdown stops both udp and tcp listeners
+func (s *Server) Shutdown() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	for _, srv := range s.servers {
+		if shutdownErr := srv.Shutdown(); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	s.servers = nil
+	return err
+}
+
+// ServeDNS implements miekg.Handler
+func (s *Server) ServeDNS(w miekg.ResponseWriter, r *miekg.Msg) {
+	m := new(miekg.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if len(r.Question) != 1 {
+		s.Metrics.QueryFailure.Inc()
+		m.SetRcode(r, miekg.RcodeFormatError)
+		s.write(w, m)
+		return
+	}
+
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if !miekg.IsSubDomain(s.Zone, name) {
+		s.Metrics.QueryRefused.Inc()
+		m.Authoritative = false
+		m.SetRcode(r, miekg.RcodeRefused)
+		s.write(w, m)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+	answer, extra, err := s.resolve(ctx, q.Qtype, name)
+	if err == errNameNotFound {
+		s.Metrics.QueryFailure.Inc()
+		m.SetRcode(r, miekg.RcodeNameError)
+		m.Ns = []miekg.RR{s.soa()}
+		s.write(w, m)
+		return
+	}
+	if err != nil {
+		// resolvers cache NXDOMAIN, so storage failures are answered SERVFAIL to be retried
+		logging.GetLogger().WithError(err).WithField("name", name).Warn("Failed to resolve dns query")
+		s.Metrics.QueryFailure.Inc()
+		m.SetRcode(r, miekg.RcodeServerFailure)
+		s.write(w, m)
+		return
+	}
+	m.Answer = answer
+	m.Extra = extra
+	if len(answer) == 0 {
+		m.Ns = []miekg.RR{s.soa()}
+	}
+	s.Metrics.QuerySuccess.Inc()
+	s.write(w, m)
+}
+
+func (s *Server) write(w miekg.ResponseWriter, m *miekg.Msg) {
+	if err := w.WriteMsg(m); err != nil {
+		logging.GetLogger().WithError(err).Warn("Failed to write dns response")
+	}
+}
+
+func (s *Server) resolve(ctx context.Context, qtype uint16, name string) ([]miekg.RR, []miekg.RR, error) {
+	if name == s.Zone {
+		if qtype == miekg.TypeSOA {
+			return []miekg.RR{s.soa()}, nil, nil
+		}
+		return nil, nil, nil
+	}
+
+	labels := miekg.SplitDomainName(strings.TrimSuffix(name, "."+s.Zone))
+	if len(labels) == 2 && labels[1] == addrLabel {
+		ip, err := decodeAddr(labels[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.addressRecords(qtype, name, []net.IP{ip}), nil, nil
+	}
+
+	serviceName, port, err := parseServiceName(labels)
+	if err != nil {
+		return nil, nil, err
+	}
+	instances, err := s.Store.GetService(ctx, storage.DefaultNamespace, serviceName)
+	if store.IsNotFound(err) {
+		return nil, nil, errNameNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch qtype {
+	case miekg.TypeA, miekg.TypeAAAA:
+		var ips []net.IP
+		for _, instance := range instances {
+			host, _ := splitHostPort(instance.Host)
+			if ip := net.ParseIP(host); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return s.addressRecords(qtype, name, ips), nil, nil
+	case miekg.TypeSRV:
+		answer, extra := s.srvRecords(name, instances, port)
+		return answer, extra, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+func (s *Server) addressRecords(qtype uint16, name string, ips []net.IP) []miekg.RR {
+	var rrs []miekg.RR
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == miekg.TypeA {
+				rrs = append(rrs, &miekg.A{Hdr: s.header(name, miekg.TypeA), A: ip4})
+			}
+		} else if qtype == miekg.TypeAAAA {
+			rrs = append(rrs, &miekg.AAAA{Hdr: s.header(name, miekg.TypeAAAA), AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+// srvRecords answers hosts of instances listening on port, any port when 0
+func (s *Server) srvRecords(name string, instances []storage.Instance, port uint16) ([]miekg.RR, []miekg.RR) {
+	var answer, extra []miekg.RR
+	for _, instance := range instances {
+		host, hostPort := splitHostPort(instance.Host)
+		if hostPort == 0 || (port != 0 && hostPort != port) {
+			continue
+		}
+		target := miekg.Fqdn(host)
+		if ip := net.ParseIP(host); ip != nil {
+			target = s.addrName(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				extra = append(extra, s.addressRecords(miekg.TypeA, target, []net.IP{ip4})...)
+			} else {
+				extra = append(extra, s.addressRecords(miekg.TypeAAAA, target, []net.IP{ip})...)
+			}
+		}
+		weight := instance.LoadBalancingWeight()
+		if weight > math.MaxUint16 {
+			weight = math.MaxUint16
+		}
+		answer = append(answer, &miekg.SRV{
+			Hdr:      s.header(name, miekg.TypeSRV),
+			Priority: 1,
+			Weight:   uint16(weight),
+			Port:     hostPort,
+			Target:   target,
+		})
+	}
+	return answer, extra
+}
+
+func (s *Server) header(name string, rrtype uint16) miekg.RR_Header {
+	return miekg.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  miekg.ClassINET,
+		Ttl:    s.TTL,
+	}
+}
+
+func (s *Server) soa() miekg.RR {
+	return &miekg.SOA{
+		Hdr:     s.header(s.Zone, miekg.TypeSOA),
+		Ns:      "ns." + s.Zone,
+		Mbox:    "hostmaster." + s.Zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.TTL,
+	}
+}
+
+// addrName encodes ip as <hex>.addr.<zone> so SRV targets stay resolvable
+func (s *Server) addrName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return hex.EncodeToString(ip) + "." + addrLabel + "." + s.Zone
+}
+
+func decodeAddr(label string) (net.IP, error) {
+	b, err := hex.DecodeString(label)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, errNameNotFound
+	}
+	return net.IP(b), nil
+}
+
+// parseServiceName accepts <service>, _<service>._tcp and _<port>._tcp.<service>, returning the
+// port hosts are filtered by, 0 when any. Symbolic ports like _http are unknown to storage, so rejected.
+func parseServiceName(labels []string) (string, uint16, error) {
+	if len(labels) == 0 {
+		return "", 0, errNameNotFound
+	}
+	if !strings.HasPrefix(labels[0], "_") {
+		return strings.Join(labels, "."), 0, nil
+	}
+	if len(labels) < 2 || (labels[1] != "_tcp" && labels[1] != "_udp") {
+		return "", 0, errNameNotFound
+	}
+	if len(labels) == 2 {
+		return strings.TrimPrefix(labels[0], "_"), 0, nil
+	}
+	port, err := strconv.ParseUint(strings.TrimPrefix(labels[0], "_"), 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, errNameNotFound
+	}
+	return strings.Join(labels[2:], "."), uint16(port), nil
+}
+
+func splitHostPort(raw string) (string, uint16) {
+	host, rawPort, err := net.SplitHostPort(raw)
+	if err != nil {
+		return raw, 0
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return host, 0
+	}
+	return host, uint16(port)
+}
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	miekg "github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const zone = "ct-dns.local."
+
+var metrics = InitializeMetrics()
+
+func initialize(t *testing.T, store store.Store) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &miekg.Server{
+		PacketConn: pc,
+		Handler:    NewServer(store, zone, 30, metrics),
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *miekg.Msg {
+	m := new(miekg.Msg)
+	m.SetQuestion(name, qtype)
+	resp, err := miekg.Exchange(m, addr)
+	assert.NoError(t, err)
+	return resp
+}
+
+func Test_ServeDNS(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8080", Weight: 3}, {Host: "[2001:db8::1]:8081"}}, nil)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "unknown-service").Return(nil, storage.ErrKeyNotFound)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("storage unavailable"))
+	addr, shutdown := initialize(t, mockStore)
+	defer shutdown()
+
+	t.Run("A query for valid service", func(t *testing.T) {
+		resp := query(t, addr, "valid-service."+zone, miekg.TypeA)
+		assert.Equal(t, miekg.RcodeSuccess, resp.Rcode)
+		assert.True(t, resp.Authoritative)
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, "192.0.0.1", resp.Answer[0].(*miekg.A).A.String())
+		assert.Equal(t, uint32(30), resp.Answer[0].Header().Ttl)
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.QuerySuccess))
+	})
+
+	t.Run("AAAA query for valid service", func(t *testing.T) {
+		resp := query(t, addr, "valid-service."+zone, miekg.TypeAAAA)
+		assert.Equal(t, miekg.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, "2001:db8::1", resp.Answer[0].(*miekg.AAAA).AAAA.String())
+	})
+
+	t.Run("SRV query for valid service", func(t *testing.T) {
+		resp := query(t, addr, "_valid-service._tcp."+zone, miekg.TypeSRV)
+		assert.Equal(t, miekg.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 2)
+		srv := resp.Answer[0].(*miekg.SRV)
+		assert.Equal(t, uint16(8080), srv.Port)
+		assert.Equal(t, uint16(3), srv.Weight)
+		assert.Equal(t, "c0000001.addr."+zone, srv.Target)
+		assert.Len(t, resp.Extra, 2)
+	})
+
+	t.Run("SRV query for a port of valid service", func(t *testing.T) {
+		resp := query(t, addr, "_8081._tcp.valid-service."+zone, miekg.TypeSRV)
+		assert.Equal(t, miekg.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+		srv := resp.Answer[0].(*miekg.SRV)
+		assert.Equal(t, uint16(8081), srv.Port)
+		assert.Equal(t, "20010db8000000000000000000000001.addr."+zone, srv.Target)
+		assert.Len(t, resp.Extra, 1)
+
+		resp = query(t, addr, "_9090._tcp.valid-service."+zone, miekg.TypeSRV)
+		assert.Equal(t, miekg.RcodeSuccess, resp.Rcode)
+		assert.Empty(t, resp.Answer)
+		assert.Len(t, resp.Ns, 1)
+	})
+
+	t.Run("A query for SRV target", func(t *testing.T) {
+		resp := query(t, addr, "c0000001.addr."+zone, miekg.TypeA)
+		assert.Equal(t, miekg.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, "192.0.0.1", resp.Answer[0].(*miekg.A).A.String())
+	})
+
+	t.Run("query for unknown service", func(t *testing.T) {
+		resp := query(t, addr, "unknown-service."+zone, miekg.TypeA)
+		assert.Equal(t, miekg.RcodeNameError, resp.Rcode)
+		assert.Len(t, resp.Ns, 1)
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.QueryFailure))
+	})
+
+	t.Run("query failing in storage", func(t *testing.T) {
+		resp := query(t, addr, "error-service."+zone, miekg.TypeA)
+		assert.Equal(t, miekg.RcodeServerFailure, resp.Rcode)
+		assert.Empty(t, resp.Ns)
+		assert.Equal(t, 2.0, testutil.ToFloat64(metrics.QueryFailure))
+	})
+
+	t.Run("query outside of zone", func(t *testing.T) {
+		resp := query(t, addr, "valid-service.example.com.", miekg.TypeA)
+		assert.Equal(t, miekg.RcodeRefused, resp.Rcode)
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.QueryRefused))
+	})
+}
+
+func Test_parseServiceName(t *testing.T) {
+	tests := []struct {
+		labels       []string
+		expected     string
+		expectedPort uint16
+		expectedErr  bool
+	}{
+		{labels: []string{"dummy-service"}, expected: "dummy-service"},
+		{labels: []string{"_dummy-service", "_tcp"}, expected: "dummy-service"},
+		{labels: []string{"_8080", "_tcp", "dummy-service"}, expected: "dummy-service", expectedPort: 8080},
+		{labels: []string{"_http", "_tcp", "dummy-service"}, expectedErr: true},
+		{labels: []string{"_0", "_tcp", "dummy-service"}, expectedErr: true},
+		{labels: []string{"_http", "dummy-service"}, expectedErr: true},
+		{labels: []string{}, expectedErr: true},
+	}
+	for _, test := range tests {
+		serviceName, port, err := parseServiceName(test.labels)
+		if test.expectedErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, serviceName)
+			assert.Equal(t, test.expectedPort, port)
+		}
+	}
+}
+
+func Test_SetTimeout(t *testing.T) {
+	s := NewServer(nil, "ct-dns.local", 30, nil)
+	assert.Equal(t, defaultTimeout, s.timeout())
+	s.SetTimeout(5 * time.Second)
+	assert.Equal(t, 5*time.Second, s.timeout())
+	s.SetTimeout(0)
+	assert.Equal(t, defaultTimeout, s.timeout())
+}
@@ -0,0 +1,28 @@
+package dns
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics defines all metrics for dns server
+type Metrics struct {
+	QuerySuccess prometheus.Counter
+	QueryFailure prometheus.Counter
+	QueryRefused prometheus.Counter
+}
+
+// InitializeMetrics initialize dns metrics
+func InitializeMetrics() *Metrics {
+	return &Metrics{
+		QuerySuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "dns_handler_query_success",
+		}),
+		QueryFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "dns_handler_query_failure",
+		}),
+		QueryRefused: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "dns_handler_query_refused",
+		}),
+	}
+}
@@ -2,9 +2,21 @@ package grpc
 
 import (
 	"context"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/guanw/ct-dns/pkg/auth"
 	pb "github.com/guanw/ct-dns/pkg/grpc/proto-gen"
 	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 // DNSServer implements pb.DnsServer
@@ -21,31 +33,305 @@ func NewServer(store store.Store, metrics *Metrics) pb.DnsServer {
 	}
 }
 
+// TimeoutInterceptor bounds the context of every unary call by timeout, streams are left unbounded
+func TimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return TimeoutInterceptorFunc(func() time.Duration { return timeout })
+}
+
+// TimeoutInterceptorFunc bounds the context of every unary call by what timeout returns at its start,
+// 0 leaves it unbounded
+func TimeoutInterceptorFunc(timeout func() time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		d := timeout()
+		if d <= 0 {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// ChainUnaryInterceptors runs interceptors in order around every unary call,
+// grpc servers only take a single one
+func ChainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// ChainStreamInterceptors is ChainUnaryInterceptors for streams
+func ChainStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(srv interface{}, stream grpc.ServerStream) error {
+				return interceptor(srv, stream, info, inner)
+			}
+		}
+		return next(srv, stream)
+	}
+}
+
+// AuthUnaryInterceptor attaches identity of the bearer token ("authorization" metadata) or verified
+// client certificate of every unary call to its context, invalid credentials fail with Unauthenticated
+func AuthUnaryInterceptor(authenticator auth.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, authenticator)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// AuthStreamInterceptor is AuthUnaryInterceptor for streams
+func AuthStreamInterceptor(authenticator auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(stream.Context(), authenticator)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func authenticate(ctx context.Context, authenticator auth.Authenticator) (context.Context, error) {
+	var creds auth.Credentials
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		header := md.Get("authorization")[0]
+		const prefix = "bearer "
+		if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+			return ctx, status.Error(codes.Unauthenticated, "Unsupported authorization scheme")
+		}
+		creds.Token = strings.TrimSpace(header[len(prefix):])
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			creds.VerifiedChains = tlsInfo.State.VerifiedChains
+		}
+	}
+	ctx, err := auth.Authenticate(ctx, authenticator, creds)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return ctx, nil
+}
+
 // GetService implements DnsServer.GetService
 func (s *DNSServer) GetService(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
-	serviceName := req.GetServiceName()
-	hosts, err := s.Store.GetService(serviceName)
+	var staleness time.Duration
+	instances, err := s.Store.GetService(store.WithStaleness(ctx, &staleness), namespace(req.GetNamespace()), req.GetServiceName())
 	if err != nil {
 		s.Metrics.GetServiceFailure.Inc()
 	} else {
 		s.Metrics.GetServiceSuccess.Inc()
 	}
-	return &pb.GetResponse{
-		Hosts: hosts,
-	}, err
+	if staleness > 0 {
+		grpc.SetTrailer(ctx, metadata.Pairs(StalenessTrailer, strconv.FormatFloat(staleness.Seconds(), 'f', 3, 64)))
+	}
+	resp := &pb.GetResponse{
+		Hosts: store.Hosts(instances),
+	}
+	for _, instance := range instances {
+		resp.Instances = append(resp.Instances, &pb.Instance{
+			Host:         instance.Host,
+			Zone:         instance.Zone,
+			Weight:       instance.Weight,
+			Canary:       instance.Canary,
+			Tags:         instance.Tags,
+			HealthStatus: healthStatus[instance.HealthStatus],
+		})
+	}
+	return resp, toStatus(err)
+}
+
+// StalenessTrailer carries how old (in seconds) instances are when served
+// from last known good data while storage is unavailable
+const StalenessTrailer = "ct-dns-staleness"
+
+var healthStatus = map[storage.HealthStatus]pb.Instance_HealthStatus{
+	storage.HealthHealthy:   pb.Instance_HEALTHY,
+	storage.HealthUnhealthy: pb.Instance_UNHEALTHY,
 }
 
 // PostService implements DnsServer.PostService
 func (s *DNSServer) PostService(ctx context.Context, req *pb.PostRequest) (*pb.PostResponse, error) {
-	err := s.Store.UpdateService(
-		req.GetServiceName(),
-		req.GetOperation(),
-		req.GetHost(),
-	)
+	ttl := time.Duration(req.GetTtl()) * time.Second
+	err := store.ValidateTTL(ttl)
+	if err == nil {
+		err = s.Store.UpdateService(ctx,
+			namespace(req.GetNamespace()),
+			req.GetServiceName(),
+			req.GetOperation(),
+			storage.Instance{
+				Host:   req.GetHost(),
+				Zone:   req.GetZone(),
+				Weight: req.GetWeight(),
+				Canary: req.GetCanary(),
+				Tags:   req.GetTags(),
+			},
+			ttl,
+		)
+	}
 	if err != nil {
 		s.Metrics.PostServiceFailure.Inc()
 	} else {
 		s.Metrics.PostServiceSuccess.Inc()
 	}
-	return &pb.PostResponse{}, err
+	return &pb.PostResponse{}, toStatus(err)
+}
+
+// Register implements DnsServer.Register
+func (s *DNSServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	ttl := time.Duration(req.GetTtl()) * time.Second
+	err := store.ValidateTTL(ttl)
+	if err == nil {
+		err = s.Store.Register(ctx,
+			namespace(req.GetNamespace()),
+			req.GetServiceName(),
+			storage.Instance{
+				Host:   req.GetHost(),
+				Zone:   req.GetZone(),
+				Weight: req.GetWeight(),
+				Canary: req.GetCanary(),
+				Tags:   req.GetTags(),
+			},
+			ttl,
+		)
+	}
+	if err != nil {
+		s.Metrics.RegisterFailure.Inc()
+		return nil, toStatus(err)
+	}
+	s.Metrics.RegisterSuccess.Inc()
+	return &pb.RegisterResponse{}, nil
+}
+
+// Deregister implements DnsServer.Deregister
+func (s *DNSServer) Deregister(ctx context.Context, req *pb.DeregisterRequest) (*pb.DeregisterResponse, error) {
+	if err := s.Store.Deregister(ctx, namespace(req.GetNamespace()), req.GetServiceName(), req.GetHost()); err != nil {
+		s.Metrics.DeregisterFailure.Inc()
+		return nil, toStatus(err)
+	}
+	s.Metrics.DeregisterSuccess.Inc()
+	return &pb.DeregisterResponse{}, nil
+}
+
+// namespace returns namespace of a request, empty is the default namespace
+func namespace(ns string) string {
+	if ns == "" {
+		return storage.DefaultNamespace
+	}
+	return ns
+}
+
+// toStatus maps store errors to grpc status, invalid requests are reported as InvalidArgument,
+// unauthorized writes as Unauthenticated or PermissionDenied, missing services and hosts as NotFound
+// and requests running out of time as DeadlineExceeded or Canceled. Every other error is a storage
+// failure reported as Unavailable, so clients retry them alike.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case store.IsValidationError(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case auth.IsUnauthenticated(err):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case auth.IsPermissionDenied(err):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case store.IsNotFound(err) || errors.Cause(err) == storage.ErrInstanceNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Cause(err) == context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Cause(err) == context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+// ListServices implements DnsServer.ListServices
+func (s *DNSServer) ListServices(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+	if req.GetPageSize() < 0 {
+		s.Metrics.ListServicesFailure.Inc()
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	}
+	services, next, err := s.Store.ListServices(ctx, namespace(req.GetNamespace()), req.GetPrefix(), req.GetPageToken(), int(req.GetPageSize()))
+	if err != nil {
+		s.Metrics.ListServicesFailure.Inc()
+		return nil, toStatus(err)
+	}
+	s.Metrics.ListServicesSuccess.Inc()
+	return &pb.ListResponse{
+		Services:      services,
+		NextPageToken: next,
+	}, nil
+}
+
+// WatchService implements DnsServer.WatchService
+func (s *DNSServer) WatchService(req *pb.WatchRequest, stream pb.Dns_WatchServiceServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	ns, serviceName := namespace(req.GetNamespace()), req.GetServiceName()
+	// subscribe before reading the snapshot so no change falls in between
+	events, err := s.Store.WatchService(ctx, ns, serviceName)
+	if err != nil {
+		s.Metrics.WatchServiceFailure.Inc()
+		return toStatus(err)
+	}
+	// a service nobody registered yet is watched from an empty snapshot, any other failure
+	// is reported rather than sent as an empty snapshot dropping every host of watchers
+	instances, err := s.Store.GetService(ctx, ns, serviceName)
+	if err != nil && !store.IsNotFound(err) {
+		s.Metrics.WatchServiceFailure.Inc()
+		return toStatus(err)
+	}
+	if err := stream.Send(&pb.WatchResponse{
+		Type:  pb.WatchResponse_SNAPSHOT,
+		Hosts: store.Hosts(instances),
+	}); err != nil {
+		s.Metrics.WatchServiceFailure.Inc()
+		return err
+	}
+	s.Metrics.WatchServiceSuccess.Inc()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.Unavailable, "Watch closed by storage, re-subscribe to resync")
+			}
+			resp := &pb.WatchResponse{
+				Type:  pb.WatchResponse_ADD,
+				Hosts: []string{event.Value},
+			}
+			if event.Type == storage.EventRemove {
+				resp.Type = pb.WatchResponse_REMOVE
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+	}
 }
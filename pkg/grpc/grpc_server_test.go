@@ -5,14 +5,22 @@ import (
 	"errors"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/guanw/ct-dns/pkg/auth"
 	pb "github.com/guanw/ct-dns/pkg/grpc/proto-gen"
 	"github.com/guanw/ct-dns/pkg/logging"
 	"github.com/guanw/ct-dns/pkg/store"
 	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	pkgerrors "github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 )
 
@@ -40,7 +48,7 @@ func bufDialer(context.Context, string) (net.Conn, error) {
 
 func Test_GetServiceSucceed(t *testing.T) {
 	store := &mocks.Store{}
-	store.On("GetService", "valid-service").Return([]string{"192.0.0.1"}, nil)
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1", Zone: "us-east-1a", Weight: 2, Tags: map[string]string{"version": "v2"}, HealthStatus: storage.HealthUnhealthy}}, nil)
 	initialize(store)
 	ctx := context.Background()
 	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
@@ -54,13 +62,19 @@ func Test_GetServiceSucceed(t *testing.T) {
 	})
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"192.0.0.1"}, resp.GetHosts())
+	assert.Len(t, resp.GetInstances(), 1)
+	assert.Equal(t, "us-east-1a", resp.GetInstances()[0].GetZone())
+	assert.Equal(t, uint32(2), resp.GetInstances()[0].GetWeight())
+	assert.Equal(t, map[string]string{"version": "v2"}, resp.GetInstances()[0].GetTags())
+	assert.Equal(t, pb.Instance_UNHEALTHY, resp.GetInstances()[0].GetHealthStatus())
 	//TODO replace with testutil.CollectAndCount with new release
 	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.GetServiceSuccess))
 }
 
 func Test_GetServiceFail(t *testing.T) {
 	store := &mocks.Store{}
-	store.On("GetService", "error-service").Return(nil, errors.New("get service failed"))
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("get service failed"))
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "unknown-service").Return(nil, pkgerrors.Wrap(storage.ErrKeyNotFound, "Failed to get service"))
 	initialize(store)
 	ctx := context.Background()
 	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
@@ -72,13 +86,44 @@ func Test_GetServiceFail(t *testing.T) {
 	_, err = client.GetService(ctx, &pb.GetRequest{
 		ServiceName: "error-service",
 	})
-	assert.Error(t, err)
-	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.GetServiceFailure))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = client.GetService(ctx, &pb.GetRequest{
+		ServiceName: "unknown-service",
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.GetServiceFailure))
+}
+
+func Test_GetServiceStale(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "stale-service").Run(func(args mock.Arguments) {
+		store.RecordStaleness(args.Get(0).(context.Context), 1500*time.Millisecond)
+	}).Return([]storage.Instance{{Host: "192.0.0.1"}}, nil)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "unavailable-service").Return(nil, store.ErrCircuitOpen)
+	initialize(mockStore)
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+
+	var trailer metadata.MD
+	resp, err := client.GetService(ctx, &pb.GetRequest{ServiceName: "stale-service"}, grpc.Trailer(&trailer))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.0.1"}, resp.GetHosts())
+	assert.Equal(t, []string{"1.500"}, trailer.Get(StalenessTrailer))
+
+	trailer = nil
+	_, err = client.GetService(ctx, &pb.GetRequest{ServiceName: "unavailable-service"}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Empty(t, trailer.Get(StalenessTrailer))
 }
 
 func Test_PostServiceSucceed(t *testing.T) {
 	store := &mocks.Store{}
-	store.On("UpdateService", "valid-service", "add", "192.0.0.1").Return(nil)
+	store.On("UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "add", storage.Instance{Host: "192.0.0.1", Zone: "us-east-1a", Canary: true}, 30*time.Second).Return(nil)
 	initialize(store)
 	ctx := context.Background()
 	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
@@ -91,6 +136,9 @@ func Test_PostServiceSucceed(t *testing.T) {
 		ServiceName: "valid-service",
 		Operation:   "add",
 		Host:        "192.0.0.1",
+		Ttl:         30,
+		Zone:        "us-east-1a",
+		Canary:      true,
 	})
 	assert.NoError(t, err)
 	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.PostServiceSuccess))
@@ -98,7 +146,7 @@ func Test_PostServiceSucceed(t *testing.T) {
 
 func Test_PostServiceFail(t *testing.T) {
 	store := &mocks.Store{}
-	store.On("UpdateService", "error-service", "add", "192.0.0.1").Return(errors.New("service update failed"))
+	store.On("UpdateService", mock.Anything, storage.DefaultNamespace, "error-service", "add", storage.Instance{Host: "192.0.0.1"}, time.Duration(0)).Return(errors.New("service update failed"))
 	initialize(store)
 	ctx := context.Background()
 	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
@@ -112,6 +160,338 @@ func Test_PostServiceFail(t *testing.T) {
 		Operation:   "add",
 		Host:        "192.0.0.1",
 	})
-	assert.Error(t, err)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
 	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.PostServiceFailure))
 }
+
+func Test_PostServiceRenewNotFound(t *testing.T) {
+	store := &mocks.Store{}
+	store.On("UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "renew", storage.Instance{Host: "192.0.0.1"}, 30*time.Second).Return(storage.ErrInstanceNotFound)
+	initialize(store)
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+	_, err = client.PostService(ctx, &pb.PostRequest{
+		ServiceName: "valid-service",
+		Operation:   "renew",
+		Host:        "192.0.0.1",
+		Ttl:         30,
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.PostServiceFailure))
+}
+
+func Test_PostServiceInvalidOperation(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "Add", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(&store.ValidationError{Field: "operation"})
+	initialize(mockStore)
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+	_, err = client.PostService(ctx, &pb.PostRequest{
+		ServiceName: "valid-service",
+		Operation:   "Add",
+		Host:        "192.0.0.1:8080",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.PostService(ctx, &pb.PostRequest{
+		ServiceName: "valid-service",
+		Operation:   "add",
+		Host:        "192.0.0.1:8080",
+		Ttl:         -1,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 4.0, testutil.ToFloat64(metrics.PostServiceFailure))
+}
+
+func Test_RegisterDeregister(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "valid-service", storage.Instance{Host: "192.0.0.1:8080", Zone: "us-east-1a", Weight: 3}, 30*time.Second).Return(nil)
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(&store.ValidationError{Field: "service name"})
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "error-service", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(errors.New("storage unavailable"))
+	mockStore.On("Deregister", mock.Anything, storage.DefaultNamespace, "valid-service", "192.0.0.1:8080").Return(nil)
+	mockStore.On("Deregister", mock.Anything, storage.DefaultNamespace, "valid-service", "").Return(&store.ValidationError{Field: "host"})
+	initialize(mockStore)
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+
+	_, err = client.Register(ctx, &pb.RegisterRequest{ServiceName: "valid-service", Host: "192.0.0.1:8080", Ttl: 30, Zone: "us-east-1a", Weight: 3})
+	assert.NoError(t, err)
+	_, err = client.Register(ctx, &pb.RegisterRequest{Host: "192.0.0.1:8080"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Register(ctx, &pb.RegisterRequest{ServiceName: "error-service", Host: "192.0.0.1:8080"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	// negative ttl never reaches the store
+	_, err = client.Register(ctx, &pb.RegisterRequest{ServiceName: "valid-service", Host: "192.0.0.1:8080", Ttl: -30})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Deregister(ctx, &pb.DeregisterRequest{ServiceName: "valid-service", Host: "192.0.0.1:8080"})
+	assert.NoError(t, err)
+	_, err = client.Deregister(ctx, &pb.DeregisterRequest{ServiceName: "valid-service"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RegisterSuccess))
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.RegisterFailure))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.DeregisterSuccess))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.DeregisterFailure))
+}
+
+func Test_ListServices(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("ListServices", mock.Anything, storage.DefaultNamespace, "valid-", "valid-a", 2).Return([]string{"valid-b", "valid-c"}, "valid-c", nil)
+	mockStore.On("ListServices", mock.Anything, storage.DefaultNamespace, "error-", "", 0).Return(nil, "", errors.New("list failed"))
+	mockStore.On("ListServices", mock.Anything, "Team-A", "", "", 0).Return(nil, "", &store.ValidationError{Field: "namespace"})
+	initialize(mockStore)
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+
+	resp, err := client.ListServices(ctx, &pb.ListRequest{Prefix: "valid-", PageToken: "valid-a", PageSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"valid-b", "valid-c"}, resp.GetServices())
+	assert.Equal(t, "valid-c", resp.GetNextPageToken())
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ListServicesSuccess))
+
+	_, err = client.ListServices(ctx, &pb.ListRequest{Prefix: "error-"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = client.ListServices(ctx, &pb.ListRequest{PageSize: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.ListServices(ctx, &pb.ListRequest{Namespace: "Team-A"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.ListServicesFailure))
+}
+
+func Test_WatchService(t *testing.T) {
+	events := make(chan storage.Event, 2)
+	events <- storage.Event{Type: storage.EventAdd, Key: "valid-service", Value: "192.0.0.2"}
+	events <- storage.Event{Type: storage.EventRemove, Key: "valid-service", Value: "192.0.0.1"}
+	close(events)
+	store := &mocks.Store{}
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "valid-service").Return((<-chan storage.Event)(events), nil)
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1"}}, nil)
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("watch failed"))
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "new-service").Return(make(<-chan storage.Event), nil)
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "new-service").Return(nil, pkgerrors.Wrap(storage.ErrKeyNotFound, "Service Name not found"))
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "flaky-service").Return(make(<-chan storage.Event), nil)
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "flaky-service").Return(nil, errors.New("connection refused"))
+	initialize(store)
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+
+	stream, err := client.WatchService(ctx, &pb.WatchRequest{
+		ServiceName: "valid-service",
+	})
+	assert.NoError(t, err)
+	resp, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pb.WatchResponse_SNAPSHOT, resp.GetType())
+	assert.Equal(t, []string{"192.0.0.1"}, resp.GetHosts())
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pb.WatchResponse_ADD, resp.GetType())
+	assert.Equal(t, []string{"192.0.0.2"}, resp.GetHosts())
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pb.WatchResponse_REMOVE, resp.GetType())
+	assert.Equal(t, []string{"192.0.0.1"}, resp.GetHosts())
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.WatchServiceSuccess))
+
+	stream, err = client.WatchService(ctx, &pb.WatchRequest{
+		ServiceName: "error-service",
+	})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.WatchServiceFailure))
+
+	// a service nobody registered yet starts from an empty snapshot
+	watchCtx, cancel := context.WithCancel(ctx)
+	stream, err = client.WatchService(watchCtx, &pb.WatchRequest{
+		ServiceName: "new-service",
+	})
+	assert.NoError(t, err)
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pb.WatchResponse_SNAPSHOT, resp.GetType())
+	assert.Empty(t, resp.GetHosts())
+	cancel()
+
+	// failing to read the snapshot is not sent as an empty one
+	stream, err = client.WatchService(ctx, &pb.WatchRequest{
+		ServiceName: "flaky-service",
+	})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.WatchServiceFailure))
+}
+
+func Test_toStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: nil, code: codes.OK},
+		{err: &store.ValidationError{Field: "host"}, code: codes.InvalidArgument},
+		{err: auth.ErrUnauthenticated, code: codes.Unauthenticated},
+		{err: &auth.PermissionError{Identity: "client", Namespace: "default", ServiceName: "valid-service"}, code: codes.PermissionDenied},
+		{err: pkgerrors.Wrap(storage.ErrKeyNotFound, "Failed to get service"), code: codes.NotFound},
+		{err: storage.ErrInstanceNotFound, code: codes.NotFound},
+		{err: pkgerrors.Wrap(context.DeadlineExceeded, "Failed to get service"), code: codes.DeadlineExceeded},
+		{err: context.Canceled, code: codes.Canceled},
+		{err: store.ErrCircuitOpen, code: codes.Unavailable},
+		{err: storage.Transient(errors.New("connection refused")), code: codes.Unavailable},
+		{err: errors.New("unclassified"), code: codes.Unavailable},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.code, status.Code(toStatus(test.err)), "%v", test.err)
+	}
+}
+
+func Test_TimeoutInterceptor(t *testing.T) {
+	interceptor := TimeoutInterceptor(time.Second)
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 500*time.Millisecond)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	interceptor = TimeoutInterceptorFunc(func() time.Duration { return 0 })
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, ok := ctx.Deadline()
+		assert.False(t, ok)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+}
+
+func Test_Namespace(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, "team-a", "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8080"}}, nil)
+	mockStore.On("GetService", mock.Anything, "Team-A", "valid-service").Return(nil, &store.ValidationError{Field: "namespace"})
+	mockStore.On("Register", mock.Anything, "team-a", "valid-service", storage.Instance{Host: "192.0.0.2:8080"}, time.Duration(0)).Return(nil)
+	mockStore.On("ListServices", mock.Anything, "team-a", "", "", 0).Return([]string{"valid-service"}, "", nil)
+	initialize(mockStore)
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+
+	resp, err := client.GetService(ctx, &pb.GetRequest{Namespace: "team-a", ServiceName: "valid-service"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.0.1:8080"}, resp.GetHosts())
+	_, err = client.GetService(ctx, &pb.GetRequest{Namespace: "Team-A", ServiceName: "valid-service"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Register(ctx, &pb.RegisterRequest{Namespace: "team-a", ServiceName: "valid-service", Host: "192.0.0.2:8080"})
+	assert.NoError(t, err)
+	list, err := client.ListServices(ctx, &pb.ListRequest{Namespace: "team-a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"valid-service"}, list.GetServices())
+}
+
+func Test_AuthInterceptor(t *testing.T) {
+	authMetrics := auth.InitializeMetrics()
+	authenticator, err := auth.NewAuthenticator(auth.Config{Tokens: []auth.TokenConfig{{Identity: "deployer", Token: "s3cret"}}}, authMetrics)
+	assert.NoError(t, err)
+	mockStore := &mocks.Store{}
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "valid-service", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(nil)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8080"}}, nil)
+	authorizer := auth.NewAuthorizer(mockStore, auth.Policy{{Identities: []string{"deployer"}, Services: []string{"valid-*"}}}, authMetrics)
+	lis = bufconn.Listen(bufSize)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(ChainUnaryInterceptors(TimeoutInterceptor(time.Second), AuthUnaryInterceptor(authenticator))),
+		grpc.StreamInterceptor(AuthStreamInterceptor(authenticator)),
+	)
+	pb.RegisterDnsServer(s, NewServer(authorizer, metrics))
+	go s.Serve(lis)
+	defer s.Stop()
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewDnsClient(conn)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	_, err = client.Register(withToken("s3cret"), &pb.RegisterRequest{ServiceName: "valid-service", Host: "192.0.0.1:8080"})
+	assert.NoError(t, err)
+	_, err = client.Register(withToken("s3cret"), &pb.RegisterRequest{ServiceName: "other-service", Host: "192.0.0.1:8080"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Register(ctx, &pb.RegisterRequest{ServiceName: "valid-service", Host: "192.0.0.1:8080"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.GetService(withToken("wrong"), &pb.GetRequest{ServiceName: "valid-service"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.GetService(metadata.AppendToOutgoingContext(ctx, "authorization", "Basic s3cret"), &pb.GetRequest{ServiceName: "valid-service"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	// reads stay open to anonymous callers
+	_, err = client.GetService(ctx, &pb.GetRequest{ServiceName: "valid-service"})
+	assert.NoError(t, err)
+	stream, err := client.WatchService(withToken("wrong"), &pb.WatchRequest{ServiceName: "valid-service"})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	mockStore.AssertNumberOfCalls(t, "Register", 1)
+}
+
+func Test_ChainUnaryInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+	resp, err := ChainUnaryInterceptors(interceptor("first"), interceptor("second"))(context.Background(), "req", &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return req, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "req", resp)
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func Test_ChainStreamInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.StreamServerInterceptor {
+		return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			calls = append(calls, name)
+			return handler(srv, stream)
+		}
+	}
+	err := ChainStreamInterceptors(interceptor("first"), interceptor("second"))("srv", nil, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+		calls = append(calls, "handler")
+		return errors.New("stream closed")
+	})
+	assert.EqualError(t, err, "stream closed")
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
@@ -12,6 +12,17 @@ type Metrics struct {
 
 	PostServiceSuccess prometheus.Counter
 	PostServiceFailure prometheus.Counter
+
+	RegisterSuccess   prometheus.Counter
+	RegisterFailure   prometheus.Counter
+	DeregisterSuccess prometheus.Counter
+	DeregisterFailure prometheus.Counter
+
+	WatchServiceSuccess prometheus.Counter
+	WatchServiceFailure prometheus.Counter
+
+	ListServicesSuccess prometheus.Counter
+	ListServicesFailure prometheus.Counter
 }
 
 // InitializeMetrics initialize grpc metrics
@@ -29,5 +40,29 @@ func InitializeMetrics() *Metrics {
 		PostServiceFailure: promauto.NewCounter(prometheus.CounterOpts{
 			Name: "grpc_handler_post_service_failure",
 		}),
+		RegisterSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_register_success",
+		}),
+		RegisterFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_register_failure",
+		}),
+		DeregisterSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_deregister_success",
+		}),
+		DeregisterFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_deregister_failure",
+		}),
+		WatchServiceSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_watch_service_success",
+		}),
+		WatchServiceFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_watch_service_failure",
+		}),
+		ListServicesSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_list_services_success",
+		}),
+		ListServicesFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "grpc_handler_list_services_failure",
+		}),
 	}
 }
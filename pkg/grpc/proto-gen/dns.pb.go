@@ -24,8 +24,66 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type Instance_HealthStatus int32
+
+const (
+	Instance_UNKNOWN   Instance_HealthStatus = 0
+	Instance_HEALTHY   Instance_HealthStatus = 1
+	Instance_UNHEALTHY Instance_HealthStatus = 2
+)
+
+var Instance_HealthStatus_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "HEALTHY",
+	2: "UNHEALTHY",
+}
+
+var Instance_HealthStatus_value = map[string]int32{
+	"UNKNOWN":   0,
+	"HEALTHY":   1,
+	"UNHEALTHY": 2,
+}
+
+func (x Instance_HealthStatus) String() string {
+	return proto.EnumName(Instance_HealthStatus_name, int32(x))
+}
+
+func (Instance_HealthStatus) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{2, 0}
+}
+
+type WatchResponse_EventType int32
+
+const (
+	WatchResponse_SNAPSHOT WatchResponse_EventType = 0
+	WatchResponse_ADD      WatchResponse_EventType = 1
+	WatchResponse_REMOVE   WatchResponse_EventType = 2
+)
+
+var WatchResponse_EventType_name = map[int32]string{
+	0: "SNAPSHOT",
+	1: "ADD",
+	2: "REMOVE",
+}
+
+var WatchResponse_EventType_value = map[string]int32{
+	"SNAPSHOT": 0,
+	"ADD":      1,
+	"REMOVE":   2,
+}
+
+func (x WatchResponse_EventType) String() string {
+	return proto.EnumName(WatchResponse_EventType_name, int32(x))
+}
+
+func (WatchResponse_EventType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{10, 0}
+}
+
 type GetRequest struct {
-	ServiceName          string   `protobuf:"bytes,1,opt,name=serviceName,proto3" json:"serviceName,omitempty"`
+	ServiceName string `protobuf:"bytes,1,opt,name=serviceName,proto3" json:"serviceName,omitempty"`
+	// empty is the default namespace
+	Namespace            string   `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -63,11 +121,20 @@ func (m *GetRequest) GetServiceName() string {
 	return ""
 }
 
+func (m *GetRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
 type GetResponse struct {
-	Hosts                []string `protobuf:"bytes,1,rep,name=hosts,proto3" json:"hosts,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Hosts []string `protobuf:"bytes,1,rep,name=hosts,proto3" json:"hosts,omitempty"`
+	// hosts along with their metadata
+	Instances            []*Instance `protobuf:"bytes,2,rep,name=instances,proto3" json:"instances,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
 }
 
 func (m *GetResponse) Reset()         { *m = GetResponse{} }
@@ -102,10 +169,108 @@ func (m *GetResponse) GetHosts() []string {
 	return nil
 }
 
+func (m *GetResponse) GetInstances() []*Instance {
+	if m != nil {
+		return m.Instances
+	}
+	return nil
+}
+
+type Instance struct {
+	Host string `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Zone string `protobuf:"bytes,2,opt,name=zone,proto3" json:"zone,omitempty"`
+	// load balancing weight, 0 means 1
+	Weight uint32            `protobuf:"varint,3,opt,name=weight,proto3" json:"weight,omitempty"`
+	Canary bool              `protobuf:"varint,4,opt,name=canary,proto3" json:"canary,omitempty"`
+	Tags   map[string]string `protobuf:"bytes,5,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// observed by active health checking, UNKNOWN when disabled
+	HealthStatus         Instance_HealthStatus `protobuf:"varint,6,opt,name=health_status,json=healthStatus,proto3,enum=Instance_HealthStatus" json:"health_status,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}              `json:"-"`
+	XXX_unrecognized     []byte                `json:"-"`
+	XXX_sizecache        int32                 `json:"-"`
+}
+
+func (m *Instance) Reset()         { *m = Instance{} }
+func (m *Instance) String() string { return proto.CompactTextString(m) }
+func (*Instance) ProtoMessage()    {}
+func (*Instance) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{2}
+}
+
+func (m *Instance) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Instance.Unmarshal(m, b)
+}
+func (m *Instance) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Instance.Marshal(b, m, deterministic)
+}
+func (m *Instance) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Instance.Merge(m, src)
+}
+func (m *Instance) XXX_Size() int {
+	return xxx_messageInfo_Instance.Size(m)
+}
+func (m *Instance) XXX_DiscardUnknown() {
+	xxx_messageInfo_Instance.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Instance proto.InternalMessageInfo
+
+func (m *Instance) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *Instance) GetZone() string {
+	if m != nil {
+		return m.Zone
+	}
+	return ""
+}
+
+func (m *Instance) GetWeight() uint32 {
+	if m != nil {
+		return m.Weight
+	}
+	return 0
+}
+
+func (m *Instance) GetCanary() bool {
+	if m != nil {
+		return m.Canary
+	}
+	return false
+}
+
+func (m *Instance) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *Instance) GetHealthStatus() Instance_HealthStatus {
+	if m != nil {
+		return m.HealthStatus
+	}
+	return Instance_UNKNOWN
+}
+
 type PostRequest struct {
-	ServiceName          string   `protobuf:"bytes,1,opt,name=serviceName,proto3" json:"serviceName,omitempty"`
-	Operation            string   `protobuf:"bytes,2,opt,name=operation,proto3" json:"operation,omitempty"`
-	Host                 string   `protobuf:"bytes,3,opt,name=host,proto3" json:"host,omitempty"`
+	ServiceName string `protobuf:"bytes,1,opt,name=serviceName,proto3" json:"serviceName,omitempty"`
+	// add, delete or renew
+	Operation string `protobuf:"bytes,2,opt,name=operation,proto3" json:"operation,omitempty"`
+	Host      string `protobuf:"bytes,3,opt,name=host,proto3" json:"host,omitempty"`
+	// seconds until host expires unless renewed, 0 never expires
+	Ttl int64 `protobuf:"varint,4,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	// metadata stored with host on add
+	Zone   string            `protobuf:"bytes,5,opt,name=zone,proto3" json:"zone,omitempty"`
+	Weight uint32            `protobuf:"varint,6,opt,name=weight,proto3" json:"weight,omitempty"`
+	Canary bool              `protobuf:"varint,7,opt,name=canary,proto3" json:"canary,omitempty"`
+	Tags   map[string]string `protobuf:"bytes,8,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// empty is the default namespace
+	Namespace            string   `protobuf:"bytes,9,opt,name=namespace,proto3" json:"namespace,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -115,7 +280,7 @@ func (m *PostRequest) Reset()         { *m = PostRequest{} }
 func (m *PostRequest) String() string { return proto.CompactTextString(m) }
 func (*PostRequest) ProtoMessage()    {}
 func (*PostRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_638ff8d8aaf3d8ae, []int{2}
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{3}
 }
 
 func (m *PostRequest) XXX_Unmarshal(b []byte) error {
@@ -157,6 +322,48 @@ func (m *PostRequest) GetHost() string {
 	return ""
 }
 
+func (m *PostRequest) GetTtl() int64 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+func (m *PostRequest) GetZone() string {
+	if m != nil {
+		return m.Zone
+	}
+	return ""
+}
+
+func (m *PostRequest) GetWeight() uint32 {
+	if m != nil {
+		return m.Weight
+	}
+	return 0
+}
+
+func (m *PostRequest) GetCanary() bool {
+	if m != nil {
+		return m.Canary
+	}
+	return false
+}
+
+func (m *PostRequest) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *PostRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
 type PostResponse struct {
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
@@ -167,7 +374,7 @@ func (m *PostResponse) Reset()         { *m = PostResponse{} }
 func (m *PostResponse) String() string { return proto.CompactTextString(m) }
 func (*PostResponse) ProtoMessage()    {}
 func (*PostResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_638ff8d8aaf3d8ae, []int{3}
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{4}
 }
 
 func (m *PostResponse) XXX_Unmarshal(b []byte) error {
@@ -188,30 +395,505 @@ func (m *PostResponse) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_PostResponse proto.InternalMessageInfo
 
+type RegisterRequest struct {
+	ServiceName string `protobuf:"bytes,1,opt,name=serviceName,proto3" json:"serviceName,omitempty"`
+	// host:port
+	Host string `protobuf:"bytes,2,opt,name=host,proto3" json:"host,omitempty"`
+	// seconds until host expires unless registered again, 0 never expires
+	Ttl    int64             `protobuf:"varint,3,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Zone   string            `protobuf:"bytes,4,opt,name=zone,proto3" json:"zone,omitempty"`
+	Weight uint32            `protobuf:"varint,5,opt,name=weight,proto3" json:"weight,omitempty"`
+	Canary bool              `protobuf:"varint,6,opt,name=canary,proto3" json:"canary,omitempty"`
+	Tags   map[string]string `protobuf:"bytes,7,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// empty is the default namespace
+	Namespace            string   `protobuf:"bytes,8,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RegisterRequest) Reset()         { *m = RegisterRequest{} }
+func (m *RegisterRequest) String() string { return proto.CompactTextString(m) }
+func (*RegisterRequest) ProtoMessage()    {}
+func (*RegisterRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{5}
+}
+
+func (m *RegisterRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RegisterRequest.Unmarshal(m, b)
+}
+func (m *RegisterRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RegisterRequest.Marshal(b, m, deterministic)
+}
+func (m *RegisterRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RegisterRequest.Merge(m, src)
+}
+func (m *RegisterRequest) XXX_Size() int {
+	return xxx_messageInfo_RegisterRequest.Size(m)
+}
+func (m *RegisterRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RegisterRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RegisterRequest proto.InternalMessageInfo
+
+func (m *RegisterRequest) GetServiceName() string {
+	if m != nil {
+		return m.ServiceName
+	}
+	return ""
+}
+
+func (m *RegisterRequest) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *RegisterRequest) GetTtl() int64 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+func (m *RegisterRequest) GetZone() string {
+	if m != nil {
+		return m.Zone
+	}
+	return ""
+}
+
+func (m *RegisterRequest) GetWeight() uint32 {
+	if m != nil {
+		return m.Weight
+	}
+	return 0
+}
+
+func (m *RegisterRequest) GetCanary() bool {
+	if m != nil {
+		return m.Canary
+	}
+	return false
+}
+
+func (m *RegisterRequest) GetTags() map[string]string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *RegisterRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+type RegisterResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RegisterResponse) Reset()         { *m = RegisterResponse{} }
+func (m *RegisterResponse) String() string { return proto.CompactTextString(m) }
+func (*RegisterResponse) ProtoMessage()    {}
+func (*RegisterResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{6}
+}
+
+func (m *RegisterResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RegisterResponse.Unmarshal(m, b)
+}
+func (m *RegisterResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RegisterResponse.Marshal(b, m, deterministic)
+}
+func (m *RegisterResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RegisterResponse.Merge(m, src)
+}
+func (m *RegisterResponse) XXX_Size() int {
+	return xxx_messageInfo_RegisterResponse.Size(m)
+}
+func (m *RegisterResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RegisterResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RegisterResponse proto.InternalMessageInfo
+
+type DeregisterRequest struct {
+	ServiceName string `protobuf:"bytes,1,opt,name=serviceName,proto3" json:"serviceName,omitempty"`
+	Host        string `protobuf:"bytes,2,opt,name=host,proto3" json:"host,omitempty"`
+	// empty is the default namespace
+	Namespace            string   `protobuf:"bytes,3,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeregisterRequest) Reset()         { *m = DeregisterRequest{} }
+func (m *DeregisterRequest) String() string { return proto.CompactTextString(m) }
+func (*DeregisterRequest) ProtoMessage()    {}
+func (*DeregisterRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{7}
+}
+
+func (m *DeregisterRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeregisterRequest.Unmarshal(m, b)
+}
+func (m *DeregisterRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeregisterRequest.Marshal(b, m, deterministic)
+}
+func (m *DeregisterRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeregisterRequest.Merge(m, src)
+}
+func (m *DeregisterRequest) XXX_Size() int {
+	return xxx_messageInfo_DeregisterRequest.Size(m)
+}
+func (m *DeregisterRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeregisterRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeregisterRequest proto.InternalMessageInfo
+
+func (m *DeregisterRequest) GetServiceName() string {
+	if m != nil {
+		return m.ServiceName
+	}
+	return ""
+}
+
+func (m *DeregisterRequest) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *DeregisterRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+type DeregisterResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeregisterResponse) Reset()         { *m = DeregisterResponse{} }
+func (m *DeregisterResponse) String() string { return proto.CompactTextString(m) }
+func (*DeregisterResponse) ProtoMessage()    {}
+func (*DeregisterResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{8}
+}
+
+func (m *DeregisterResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeregisterResponse.Unmarshal(m, b)
+}
+func (m *DeregisterResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeregisterResponse.Marshal(b, m, deterministic)
+}
+func (m *DeregisterResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeregisterResponse.Merge(m, src)
+}
+func (m *DeregisterResponse) XXX_Size() int {
+	return xxx_messageInfo_DeregisterResponse.Size(m)
+}
+func (m *DeregisterResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeregisterResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeregisterResponse proto.InternalMessageInfo
+
+type WatchRequest struct {
+	ServiceName string `protobuf:"bytes,1,opt,name=serviceName,proto3" json:"serviceName,omitempty"`
+	// empty is the default namespace
+	Namespace            string   `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchRequest) Reset()         { *m = WatchRequest{} }
+func (m *WatchRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()    {}
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{9}
+}
+
+func (m *WatchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchRequest.Unmarshal(m, b)
+}
+func (m *WatchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchRequest.Merge(m, src)
+}
+func (m *WatchRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchRequest.Size(m)
+}
+func (m *WatchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchRequest proto.InternalMessageInfo
+
+func (m *WatchRequest) GetServiceName() string {
+	if m != nil {
+		return m.ServiceName
+	}
+	return ""
+}
+
+func (m *WatchRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+type WatchResponse struct {
+	Type                 WatchResponse_EventType `protobuf:"varint,1,opt,name=type,proto3,enum=WatchResponse_EventType" json:"type,omitempty"`
+	Hosts                []string                `protobuf:"bytes,2,rep,name=hosts,proto3" json:"hosts,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}                `json:"-"`
+	XXX_unrecognized     []byte                  `json:"-"`
+	XXX_sizecache        int32                   `json:"-"`
+}
+
+func (m *WatchResponse) Reset()         { *m = WatchResponse{} }
+func (m *WatchResponse) String() string { return proto.CompactTextString(m) }
+func (*WatchResponse) ProtoMessage()    {}
+func (*WatchResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{10}
+}
+
+func (m *WatchResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchResponse.Unmarshal(m, b)
+}
+func (m *WatchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchResponse.Marshal(b, m, deterministic)
+}
+func (m *WatchResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchResponse.Merge(m, src)
+}
+func (m *WatchResponse) XXX_Size() int {
+	return xxx_messageInfo_WatchResponse.Size(m)
+}
+func (m *WatchResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchResponse proto.InternalMessageInfo
+
+func (m *WatchResponse) GetType() WatchResponse_EventType {
+	if m != nil {
+		return m.Type
+	}
+	return WatchResponse_SNAPSHOT
+}
+
+func (m *WatchResponse) GetHosts() []string {
+	if m != nil {
+		return m.Hosts
+	}
+	return nil
+}
+
+type ListRequest struct {
+	// only services starting with prefix are listed
+	Prefix string `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	// next_page_token of the previous response, empty for the first page
+	PageToken string `protobuf:"bytes,2,opt,name=page_token,json=pageToken,proto3" json:"page_token,omitempty"`
+	// 0 uses the server default
+	PageSize int32 `protobuf:"varint,3,opt,name=page_size,json=pageSize,proto3" json:"page_size,omitempty"`
+	// empty is the default namespace
+	Namespace            string   `protobuf:"bytes,4,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListRequest) Reset()         { *m = ListRequest{} }
+func (m *ListRequest) String() string { return proto.CompactTextString(m) }
+func (*ListRequest) ProtoMessage()    {}
+func (*ListRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{11}
+}
+
+func (m *ListRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListRequest.Unmarshal(m, b)
+}
+func (m *ListRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListRequest.Marshal(b, m, deterministic)
+}
+func (m *ListRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListRequest.Merge(m, src)
+}
+func (m *ListRequest) XXX_Size() int {
+	return xxx_messageInfo_ListRequest.Size(m)
+}
+func (m *ListRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListRequest proto.InternalMessageInfo
+
+func (m *ListRequest) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+func (m *ListRequest) GetPageToken() string {
+	if m != nil {
+		return m.PageToken
+	}
+	return ""
+}
+
+func (m *ListRequest) GetPageSize() int32 {
+	if m != nil {
+		return m.PageSize
+	}
+	return 0
+}
+
+func (m *ListRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+type ListResponse struct {
+	Services []string `protobuf:"bytes,1,rep,name=services,proto3" json:"services,omitempty"`
+	// empty on the last page
+	NextPageToken        string   `protobuf:"bytes,2,opt,name=next_page_token,json=nextPageToken,proto3" json:"next_page_token,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListResponse) Reset()         { *m = ListResponse{} }
+func (m *ListResponse) String() string { return proto.CompactTextString(m) }
+func (*ListResponse) ProtoMessage()    {}
+func (*ListResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_638ff8d8aaf3d8ae, []int{12}
+}
+
+func (m *ListResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListResponse.Unmarshal(m, b)
+}
+func (m *ListResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListResponse.Marshal(b, m, deterministic)
+}
+func (m *ListResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListResponse.Merge(m, src)
+}
+func (m *ListResponse) XXX_Size() int {
+	return xxx_messageInfo_ListResponse.Size(m)
+}
+func (m *ListResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListResponse proto.InternalMessageInfo
+
+func (m *ListResponse) GetServices() []string {
+	if m != nil {
+		return m.Services
+	}
+	return nil
+}
+
+func (m *ListResponse) GetNextPageToken() string {
+	if m != nil {
+		return m.NextPageToken
+	}
+	return ""
+}
+
 func init() {
+	proto.RegisterEnum("Instance_HealthStatus", Instance_HealthStatus_name, Instance_HealthStatus_value)
+	proto.RegisterEnum("WatchResponse_EventType", WatchResponse_EventType_name, WatchResponse_EventType_value)
 	proto.RegisterType((*GetRequest)(nil), "GetRequest")
 	proto.RegisterType((*GetResponse)(nil), "GetResponse")
+	proto.RegisterType((*Instance)(nil), "Instance")
+	proto.RegisterMapType((map[string]string)(nil), "Instance.TagsEntry")
 	proto.RegisterType((*PostRequest)(nil), "PostRequest")
+	proto.RegisterMapType((map[string]string)(nil), "PostRequest.TagsEntry")
 	proto.RegisterType((*PostResponse)(nil), "PostResponse")
+	proto.RegisterType((*RegisterRequest)(nil), "RegisterRequest")
+	proto.RegisterMapType((map[string]string)(nil), "RegisterRequest.TagsEntry")
+	proto.RegisterType((*RegisterResponse)(nil), "RegisterResponse")
+	proto.RegisterType((*DeregisterRequest)(nil), "DeregisterRequest")
+	proto.RegisterType((*DeregisterResponse)(nil), "DeregisterResponse")
+	proto.RegisterType((*WatchRequest)(nil), "WatchRequest")
+	proto.RegisterType((*WatchResponse)(nil), "WatchResponse")
+	proto.RegisterType((*ListRequest)(nil), "ListRequest")
+	proto.RegisterType((*ListResponse)(nil), "ListResponse")
 }
 
 func init() { proto.RegisterFile("dns.proto", fileDescriptor_638ff8d8aaf3d8ae) }
 
 var fileDescriptor_638ff8d8aaf3d8ae = []byte{
-	// 201 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x90, 0xc1, 0x8a, 0xc2, 0x30,
-	0x10, 0x86, 0xdb, 0xed, 0xee, 0x42, 0x26, 0xdd, 0x3d, 0x0c, 0x7b, 0x08, 0x65, 0x0f, 0x25, 0x7b,
-	0xe9, 0x82, 0xe4, 0xa0, 0xaf, 0x20, 0x78, 0x13, 0xa9, 0x77, 0xa1, 0xea, 0x80, 0x3d, 0x98, 0xd4,
-	0x4e, 0xf4, 0xf9, 0xc5, 0x04, 0x69, 0x8e, 0xde, 0x92, 0x99, 0x9f, 0x2f, 0xdf, 0x1f, 0x10, 0x47,
-	0xcb, 0x66, 0x18, 0x9d, 0x77, 0xda, 0x00, 0xac, 0xc8, 0xb7, 0x74, 0xb9, 0x12, 0x7b, 0xac, 0x41,
-	0x32, 0x8d, 0xb7, 0xfe, 0x40, 0xeb, 0xee, 0x4c, 0x2a, 0xaf, 0xf3, 0x46, 0xb4, 0xe9, 0x48, 0xff,
-	0x81, 0x0c, 0x79, 0x1e, 0x9c, 0x65, 0xc2, 0x1f, 0xf8, 0x38, 0x39, 0xf6, 0xac, 0xf2, 0xba, 0x68,
-	0x44, 0x1b, 0x2f, 0xba, 0x03, 0xb9, 0x71, 0xfc, 0x3a, 0x15, 0x7f, 0x41, 0xb8, 0x81, 0xc6, 0xce,
-	0xf7, 0xce, 0xaa, 0xb7, 0xb0, 0x9f, 0x06, 0x88, 0xf0, 0xfe, 0xe0, 0xaa, 0x22, 0x2c, 0xc2, 0x59,
-	0x7f, 0x43, 0x19, 0x9f, 0x88, 0x22, 0xf3, 0x1d, 0x14, 0x4b, 0xcb, 0xf8, 0x1f, 0xea, 0x6c, 0x23,
-	0x1a, 0xa5, 0x99, 0xba, 0x55, 0xa5, 0x49, 0xc4, 0x75, 0x86, 0xb3, 0x28, 0xf9, 0xcc, 0x96, 0x26,
-	0x51, 0xae, 0xbe, 0x4c, 0x4a, 0xd7, 0xd9, 0xfe, 0x33, 0x7c, 0xd7, 0xe2, 0x1e, 0x00, 0x00, 0xff,
-	0xff, 0x76, 0x05, 0xda, 0x0b, 0x3b, 0x01, 0x00, 0x00,
+	// 763 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x95, 0xcd, 0x6e, 0xdb, 0x46,
+	0x10, 0xc7, 0x45, 0x52, 0x1f, 0xe4, 0x88, 0x94, 0xe9, 0xb5, 0x21, 0x10, 0x6c, 0x0b, 0x08, 0x3c,
+	0xd4, 0x6a, 0xe1, 0x2e, 0x5a, 0xf5, 0xe0, 0xa2, 0x39, 0x19, 0x90, 0x10, 0x05, 0x51, 0x64, 0x83,
+	0x92, 0x63, 0xe4, 0x24, 0x30, 0xca, 0x46, 0x22, 0x6c, 0x93, 0x0c, 0x77, 0xed, 0x58, 0xbe, 0xe4,
+	0x90, 0x57, 0xc9, 0x31, 0x4f, 0x90, 0xa7, 0x0b, 0xb8, 0x5c, 0x7e, 0x48, 0xb2, 0x83, 0x24, 0xf0,
+	0x6d, 0x67, 0xf6, 0x63, 0x66, 0x7f, 0xf3, 0xdf, 0x59, 0xd0, 0xde, 0x04, 0x14, 0x47, 0x71, 0xc8,
+	0x42, 0x67, 0x04, 0xf0, 0x94, 0x30, 0x97, 0xbc, 0xbb, 0x26, 0x94, 0xa1, 0x0e, 0x34, 0x29, 0x89,
+	0x6f, 0xfc, 0x39, 0x19, 0x7b, 0x57, 0xc4, 0x92, 0x3a, 0x52, 0x57, 0x73, 0xcb, 0x2e, 0xf4, 0x2b,
+	0x68, 0x81, 0x77, 0x45, 0x68, 0xe4, 0xcd, 0x89, 0x25, 0xf3, 0xf9, 0xc2, 0xe1, 0x8c, 0xa0, 0xc9,
+	0x4f, 0xa3, 0x51, 0x18, 0x50, 0x82, 0xf6, 0xa1, 0xb6, 0x0c, 0x29, 0xa3, 0x96, 0xd4, 0x51, 0xba,
+	0x9a, 0x9b, 0x1a, 0xe8, 0x00, 0x34, 0x3f, 0xa0, 0xcc, 0x0b, 0xe6, 0x84, 0x5a, 0x72, 0x47, 0xe9,
+	0x36, 0x7b, 0x1a, 0x7e, 0x26, 0x3c, 0x6e, 0x31, 0xe7, 0x7c, 0x91, 0x41, 0xcd, 0xfc, 0x08, 0x41,
+	0x35, 0xd9, 0x2e, 0x72, 0xe2, 0xe3, 0xc4, 0x77, 0x17, 0x06, 0x59, 0x1e, 0x7c, 0x8c, 0xda, 0x50,
+	0x7f, 0x4f, 0xfc, 0xc5, 0x92, 0x59, 0x4a, 0x47, 0xea, 0x1a, 0xae, 0xb0, 0x12, 0xff, 0xdc, 0x0b,
+	0xbc, 0x78, 0x65, 0x55, 0x3b, 0x52, 0x57, 0x75, 0x85, 0x85, 0x0e, 0xa0, 0xca, 0xbc, 0x05, 0xb5,
+	0x6a, 0x3c, 0x91, 0xbd, 0x3c, 0x11, 0x3c, 0xf5, 0x16, 0x74, 0x10, 0xb0, 0x78, 0xe5, 0xf2, 0x05,
+	0xe8, 0x09, 0x18, 0x4b, 0xe2, 0x5d, 0xb2, 0xe5, 0x8c, 0x32, 0x8f, 0x5d, 0x53, 0xab, 0xde, 0x91,
+	0xba, 0xad, 0x5e, 0xbb, 0xd8, 0x31, 0xe4, 0xd3, 0x13, 0x3e, 0xeb, 0xea, 0xcb, 0x92, 0x65, 0x1f,
+	0x81, 0x96, 0x9f, 0x87, 0x4c, 0x50, 0x2e, 0xc8, 0x4a, 0xdc, 0x24, 0x19, 0x26, 0xa0, 0x6e, 0xbc,
+	0xcb, 0xeb, 0xec, 0x26, 0xa9, 0xf1, 0xbf, 0xfc, 0x9f, 0xe4, 0x1c, 0x81, 0x5e, 0x3e, 0x16, 0x35,
+	0xa1, 0x71, 0x36, 0x7e, 0x3e, 0x3e, 0x39, 0x1f, 0x9b, 0x95, 0xc4, 0x18, 0x0e, 0x8e, 0x47, 0xd3,
+	0xe1, 0x2b, 0x53, 0x42, 0x06, 0x68, 0x67, 0xe3, 0xcc, 0x94, 0x13, 0x78, 0xcd, 0xd3, 0x90, 0xfe,
+	0x58, 0x69, 0xc3, 0x88, 0xc4, 0x1e, 0xf3, 0xc3, 0x20, 0x2b, 0x6d, 0xee, 0xc8, 0xf9, 0x2b, 0x25,
+	0xfe, 0x26, 0x28, 0x8c, 0x5d, 0x72, 0xa0, 0x8a, 0x9b, 0x0c, 0xf3, 0x8a, 0xd4, 0xee, 0xad, 0x48,
+	0xfd, 0x81, 0x8a, 0x34, 0xd6, 0x2a, 0xf2, 0xa7, 0xa8, 0x88, 0xca, 0x2b, 0xd2, 0xc6, 0xa5, 0x5b,
+	0x6c, 0x15, 0x65, 0x4d, 0x8e, 0xda, 0x86, 0x1c, 0x7f, 0x9e, 0x7a, 0x0b, 0xf4, 0x34, 0x6a, 0x2a,
+	0x64, 0xe7, 0x93, 0x0c, 0x3b, 0x2e, 0x59, 0xf8, 0x94, 0x91, 0xf8, 0xfb, 0x81, 0x66, 0xc8, 0xe4,
+	0x6d, 0x64, 0xca, 0x36, 0xb2, 0xea, 0xbd, 0xc8, 0x6a, 0x0f, 0x20, 0xab, 0xaf, 0x21, 0xc3, 0x02,
+	0x59, 0x83, 0x23, 0xb3, 0xf1, 0x46, 0xae, 0xdf, 0xc6, 0xa6, 0x3e, 0x1a, 0x36, 0x04, 0x66, 0x11,
+	0x59, 0xa0, 0x5b, 0xc0, 0x6e, 0x9f, 0xc4, 0x8f, 0xc2, 0x6e, 0x2d, 0x6b, 0x65, 0xb3, 0xf7, 0xec,
+	0x03, 0x2a, 0x07, 0x12, 0xe1, 0xc7, 0xa0, 0x9f, 0x7b, 0x6c, 0xbe, 0x7c, 0xac, 0x0e, 0xf7, 0x51,
+	0x02, 0x43, 0x1c, 0x28, 0x9a, 0xdc, 0x21, 0x54, 0xd9, 0x2a, 0x4a, 0x8f, 0x6a, 0xf5, 0x2c, 0xbc,
+	0x36, 0x8b, 0x07, 0x37, 0x24, 0x60, 0xd3, 0x55, 0x44, 0x5c, 0xbe, 0xaa, 0x68, 0x89, 0x72, 0xa9,
+	0x25, 0x3a, 0x18, 0xb4, 0x7c, 0x21, 0xd2, 0x41, 0x9d, 0x8c, 0x8f, 0x4f, 0x27, 0xc3, 0x93, 0xa9,
+	0x59, 0x41, 0x0d, 0x50, 0x8e, 0xfb, 0x7d, 0x53, 0x42, 0x00, 0x75, 0x77, 0xf0, 0xe2, 0xe4, 0xe5,
+	0xc0, 0x94, 0x9d, 0x0f, 0xd0, 0x1c, 0xf9, 0xc5, 0xdb, 0x6e, 0x43, 0x3d, 0x8a, 0xc9, 0x5b, 0xff,
+	0x56, 0xdc, 0x47, 0x58, 0xe8, 0x37, 0x80, 0xc8, 0x5b, 0x90, 0x19, 0x0b, 0x2f, 0x48, 0xfe, 0xa4,
+	0x13, 0xcf, 0x34, 0x71, 0xa0, 0x5f, 0x80, 0x1b, 0x33, 0xea, 0xdf, 0xa5, 0x3c, 0x6b, 0xae, 0x9a,
+	0x38, 0x26, 0xfe, 0xdd, 0x06, 0x86, 0xea, 0x26, 0x06, 0x17, 0xf4, 0x34, 0x01, 0x01, 0xc1, 0x06,
+	0x55, 0x30, 0xcc, 0x9a, 0x7d, 0x6e, 0xa3, 0xdf, 0x61, 0x27, 0x20, 0xb7, 0x6c, 0xb6, 0x95, 0x8a,
+	0x91, 0xb8, 0x4f, 0xb3, 0x74, 0x7a, 0x9f, 0x65, 0x50, 0xfa, 0x01, 0x45, 0x7f, 0xf0, 0x2f, 0x69,
+	0x92, 0x6e, 0x47, 0x4d, 0x5c, 0xfc, 0x4f, 0xb6, 0x8e, 0x4b, 0xdf, 0x8b, 0x53, 0x41, 0x87, 0x69,
+	0x8f, 0xcb, 0xd6, 0xea, 0xe5, 0x5e, 0x61, 0x1b, 0x78, 0xed, 0x0d, 0x57, 0xd0, 0x3f, 0xa0, 0x66,
+	0xf2, 0x44, 0xe6, 0xe6, 0x1b, 0xb1, 0x77, 0xf1, 0x96, 0x76, 0x2b, 0xe8, 0x08, 0xa0, 0x10, 0x15,
+	0x42, 0x78, 0x4b, 0xca, 0xf6, 0x1e, 0xbe, 0x47, 0x75, 0x49, 0xac, 0x54, 0x77, 0x59, 0x6a, 0x06,
+	0x2e, 0xcb, 0xd0, 0x6e, 0xad, 0xcb, 0xc4, 0xa9, 0xfc, 0x2d, 0xa1, 0xbf, 0x52, 0xa6, 0x93, 0x8c,
+	0x9b, 0x8e, 0x4b, 0x35, 0xb6, 0x0d, 0x5c, 0x06, 0xee, 0x54, 0x5e, 0xd7, 0xf9, 0x07, 0xfe, 0xef,
+	0xd7, 0x01, 0x00, 0x62, 0xd3, 0xb6, 0x28, 0xcd, 0x07, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -228,6 +910,13 @@ const _ = grpc.SupportPackageIsVersion4
 type DnsClient interface {
 	GetService(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
 	PostService(ctx context.Context, in *PostRequest, opts ...grpc.CallOption) (*PostResponse, error)
+	// Register adds host to service, or replaces its metadata when already registered
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error)
+	// WatchService sends the full host set first, then every host added/removed
+	WatchService(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Dns_WatchServiceClient, error)
+	// ListServices pages through registered service names in lexical order
+	ListServices(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
 }
 
 type dnsClient struct {
@@ -256,10 +945,76 @@ func (c *dnsClient) PostService(ctx context.Context, in *PostRequest, opts ...gr
 	return out, nil
 }
 
+func (c *dnsClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, "/Dns/Register", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dnsClient) Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error) {
+	out := new(DeregisterResponse)
+	err := c.cc.Invoke(ctx, "/Dns/Deregister", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dnsClient) WatchService(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Dns_WatchServiceClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Dns_serviceDesc.Streams[0], "/Dns/WatchService", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dnsWatchServiceClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Dns_WatchServiceClient interface {
+	Recv() (*WatchResponse, error)
+	grpc.ClientStream
+}
+
+type dnsWatchServiceClient struct {
+	grpc.ClientStream
+}
+
+func (x *dnsWatchServiceClient) Recv() (*WatchResponse, error) {
+	m := new(WatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dnsClient) ListServices(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, "/Dns/ListServices", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DnsServer is the server API for Dns service.
 type DnsServer interface {
 	GetService(context.Context, *GetRequest) (*GetResponse, error)
 	PostService(context.Context, *PostRequest) (*PostResponse, error)
+	// Register adds host to service, or replaces its metadata when already registered
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	Deregister(context.Context, *DeregisterRequest) (*DeregisterResponse, error)
+	// WatchService sends the full host set first, then every host added/removed
+	WatchService(*WatchRequest, Dns_WatchServiceServer) error
+	// ListServices pages through registered service names in lexical order
+	ListServices(context.Context, *ListRequest) (*ListResponse, error)
 }
 
 // UnimplementedDnsServer can be embedded to have forward compatible implementations.
@@ -272,6 +1027,18 @@ func (*UnimplementedDnsServer) GetService(ctx context.Context, req *GetRequest)
 func (*UnimplementedDnsServer) PostService(ctx context.Context, req *PostRequest) (*PostResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PostService not implemented")
 }
+func (*UnimplementedDnsServer) Register(ctx context.Context, req *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (*UnimplementedDnsServer) Deregister(ctx context.Context, req *DeregisterRequest) (*DeregisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Deregister not implemented")
+}
+func (*UnimplementedDnsServer) WatchService(req *WatchRequest, srv Dns_WatchServiceServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchService not implemented")
+}
+func (*UnimplementedDnsServer) ListServices(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListServices not implemented")
+}
 
 func RegisterDnsServer(s *grpc.Server, srv DnsServer) {
 	s.RegisterService(&_Dns_serviceDesc, srv)
@@ -313,6 +1080,81 @@ func _Dns_PostService_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Dns_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DnsServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Dns/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DnsServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dns_Deregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DnsServer).Deregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Dns/Deregister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DnsServer).Deregister(ctx, req.(*DeregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dns_WatchService_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DnsServer).WatchService(m, &dnsWatchServiceServer{stream})
+}
+
+type Dns_WatchServiceServer interface {
+	Send(*WatchResponse) error
+	grpc.ServerStream
+}
+
+type dnsWatchServiceServer struct {
+	grpc.ServerStream
+}
+
+func (x *dnsWatchServiceServer) Send(m *WatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Dns_ListServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DnsServer).ListServices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Dns/ListServices",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DnsServer).ListServices(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Dns_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "Dns",
 	HandlerType: (*DnsServer)(nil),
@@ -325,7 +1167,25 @@ var _Dns_serviceDesc = grpc.ServiceDesc{
 			MethodName: "PostService",
 			Handler:    _Dns_PostService_Handler,
 		},
+		{
+			MethodName: "Register",
+			Handler:    _Dns_Register_Handler,
+		},
+		{
+			MethodName: "Deregister",
+			Handler:    _Dns_Deregister_Handler,
+		},
+		{
+			MethodName: "ListServices",
+			Handler:    _Dns_ListServices_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchService",
+			Handler:       _Dns_WatchService_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "dns.proto",
 }
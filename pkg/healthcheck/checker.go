@@ -0,0 +1,386 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/storage"
+)
+
+// Config defines how hosts of a service are health checked, zero fields fall back to defaults
+type Config struct {
+	Protocol           string        `yaml:"protocol"`
+	Path               string        `yaml:"path"`
+	GRPCService        string        `yaml:"grpcservice"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthythreshold"`
+	UnhealthyThreshold int           `yaml:"unhealthythreshold"`
+}
+
+// DefaultConfig is used for fields left unset in both service and default config
+var DefaultConfig = Config{
+	Protocol:           ProtocolTCP,
+	Path:               "/",
+	Interval:           10 * time.Second,
+	Timeout:            2 * time.Second,
+	HealthyThreshold:   2,
+	UnhealthyThreshold: 3,
+}
+
+func (c Config) merge(defaults Config) Config {
+	if c.Protocol == "" {
+		c.Protocol = defaults.Protocol
+	}
+	if c.Path == "" {
+		c.Path = defaults.Path
+	}
+	if c.GRPCService == "" {
+		c.GRPCService = defaults.GRPCService
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = defaults.HealthyThreshold
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = defaults.UnhealthyThreshold
+	}
+	return c
+}
+
+// Checker is a Store probing hosts of every service looked up or registered through it,
+// instances returned by GetService carry the observed HealthStatus and
+// WatchService additionally streams an EventAdd whenever a host changes health.
+// A service stops being probed once it has no hosts left and nobody watches it.
+type Checker struct {
+	Store   store.Store
+	Metrics *Metrics
+
+	defaults Config
+	services map[string]Config
+	probers  map[string]probeFunc
+
+	lock    sync.Mutex
+	ctx     context.Context
+	targets map[string]*target
+}
+
+type target struct {
+	namespace   string
+	serviceName string
+	config      Config
+	probe       probeFunc
+
+	lock        sync.RWMutex
+	hosts       map[string]*hostState
+	subscribers map[chan storage.Event]struct{}
+}
+
+type hostState struct {
+	status    storage.HealthStatus
+	successes int
+	failures  int
+}
+
+// NewChecker creates health checker on top of store, services overrides defaults per service
+// keyed by cluster name, that is the service name prefixed by its namespace and '/' outside the default namespace
+func NewChecker(store store.Store, defaults Config, services map[string]Config, metrics *Metrics) (*Checker, error) {
+	c := &Checker{
+		Store:    store,
+		Metrics:  metrics,
+		defaults: defaults.merge(DefaultConfig),
+		services: map[string]Config{},
+		probers:  probers,
+		targets:  map[string]*target{},
+	}
+	if err := c.validate(c.defaults); err != nil {
+		return nil, err
+	}
+	for serviceName, config := range services {
+		config = config.merge(c.defaults)
+		if err := c.validate(config); err != nil {
+			return nil, fmt.Errorf("Invalid health check for service %s: %v", serviceName, err)
+		}
+		c.services[serviceName] = config
+	}
+	return c, nil
+}
+
+func (c *Checker) validate(config Config) error {
+	if _, ok := c.probers[config.Protocol]; !ok {
+		return fmt.Errorf("Unsupported health check protocol %q", config.Protocol)
+	}
+	return nil
+}
+
+// Run probes tracked services until ctx is done
+func (c *Checker) Run(ctx context.Context) {
+	c.lock.Lock()
+	c.ctx = ctx
+	for _, t := range c.targets {
+		go c.check(ctx, t)
+	}
+	c.lock.Unlock()
+	<-ctx.Done()
+}
+
+// GetService fires inner Store and annotates instances with their health
+func (c *Checker) GetService(ctx context.Context, namespace, serviceName string) ([]storage.Instance, error) {
+	instances, err := c.Store.GetService(ctx, namespace, serviceName)
+	if err != nil || len(instances) == 0 {
+		return instances, err
+	}
+	t := c.track(namespace, serviceName)
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for i := range instances {
+		if state, ok := t.hosts[instances[i].Host]; ok {
+			instances[i].HealthStatus = state.status
+		}
+	}
+	return instances, nil
+}
+
+// Register fires inner Store and starts checking the service
+func (c *Checker) Register(ctx context.Context, namespace, serviceName string, instance storage.Instance, ttl time.Duration) error {
+	if err := c.Store.Register(ctx, namespace, serviceName, instance, ttl); err != nil {
+		return err
+	}
+	c.track(namespace, serviceName)
+	return nil
+}
+
+// Deregister fires inner Store
+func (c *Checker) Deregister(ctx context.Context, namespace, serviceName, host string) error {
+	return c.Store.Deregister(ctx, namespace, serviceName, host)
+}
+
+// UpdateService fires inner Store and starts checking the service
+func (c *Checker) UpdateService(ctx context.Context, namespace, serviceName, operation string, instance storage.Instance, ttl time.Duration) error {
+	if err := c.Store.UpdateService(ctx, namespace, serviceName, operation, instance, ttl); err != nil {
+		return err
+	}
+	c.track(namespace, serviceName)
+	return nil
+}
+
+// WatchService merges events of inner Store with health transitions of the service
+func (c *Checker) WatchService(ctx context.Context, namespace, serviceName string) (<-chan storage.Event, error) {
+	events, err := c.Store.WatchService(ctx, namespace, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	// subscribing under the checker lock keeps the target from being untracked in between
+	c.lock.Lock()
+	t := c.trackLocked(namespace, serviceName)
+	transitions := t.subscribe()
+	c.lock.Unlock()
+	res := make(chan storage.Event)
+	go func() {
+		defer close(res)
+		defer t.unsubscribe(transitions)
+		for {
+			var event storage.Event
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				event = e
+			case event = <-transitions:
+			}
+			select {
+			case res <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+// ListServices fires inner Store
+func (c *Checker) ListServices(ctx context.Context, namespace, prefix, pageToken string, pageSize int) ([]string, string, error) {
+	return c.Store.ListServices(ctx, namespace, prefix, pageToken, pageSize)
+}
+
+func (c *Checker) track(namespace, serviceName string) *target {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.trackLocked(namespace, serviceName)
+}
+
+// trackLocked returns the target of the service, starting to check it when new, c.lock has to be held
+func (c *Checker) trackLocked(namespace, serviceName string) *target {
+	clusterName := store.ClusterName(namespace, serviceName)
+	if t, ok := c.targets[clusterName]; ok {
+		return t
+	}
+	config, ok := c.services[clusterName]
+	if !ok {
+		config = c.defaults
+	}
+	t := &target{
+		namespace:   namespace,
+		serviceName: serviceName,
+		config:      config,
+		probe:       c.probers[config.Protocol],
+		hosts:       map[string]*hostState{},
+		subscribers: map[chan storage.Event]struct{}{},
+	}
+	c.targets[clusterName] = t
+	if c.ctx != nil {
+		go c.check(c.ctx, t)
+	}
+	return t
+}
+
+func (c *Checker) check(ctx context.Context, t *target) {
+	ticker := time.NewTicker(t.config.Interval)
+	defer ticker.Stop()
+	for {
+		if !c.checkOnce(ctx, t) && c.untrack(t) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// untrack forgets t unless watchers are subscribed to it, telling whether it did
+func (c *Checker) untrack(t *target) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if len(t.subscribers) > 0 {
+		return false
+	}
+	clusterName := store.ClusterName(t.namespace, t.serviceName)
+	if c.targets[clusterName] == t {
+		delete(c.targets, clusterName)
+	}
+	return true
+}
+
+// checkOnce probes hosts of t, returning false once the service has no hosts left
+func (c *Checker) checkOnce(ctx context.Context, t *target) bool {
+	instances, err := c.Store.GetService(ctx, t.namespace, t.serviceName)
+	if err != nil && !store.IsNotFound(err) {
+		logging.GetLogger().WithError(err).WithField("namespace", t.namespace).WithField("service", t.serviceName).Error("Failed to get hosts to health check")
+		return true
+	}
+	if len(instances) == 0 {
+		t.update(nil)
+		return false
+	}
+	results := make(map[string]error, len(instances))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, t.config.Timeout)
+			defer cancel()
+			err := t.probe(probeCtx, host, t.config)
+			lock.Lock()
+			results[host] = err
+			lock.Unlock()
+		}(instance.Host)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return true
+	}
+	for _, host := range t.update(results) {
+		logging.GetLogger().WithField("service", t.serviceName).WithField("host", host).
+			WithError(results[host]).Info("Host changed health status")
+		if results[host] == nil {
+			c.Metrics.MarkedHealthy.Inc()
+		} else {
+			c.Metrics.MarkedUnhealthy.Inc()
+		}
+	}
+	for _, err := range results {
+		if err == nil {
+			c.Metrics.ProbeSuccess.Inc()
+		} else {
+			c.Metrics.ProbeFailure.Inc()
+		}
+	}
+	return true
+}
+
+// update applies probe results, forgets hosts no longer registered and returns hosts which changed status
+func (t *target) update(results map[string]error) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for host := range t.hosts {
+		if _, ok := results[host]; !ok {
+			delete(t.hosts, host)
+		}
+	}
+	var changed []string
+	for host, err := range results {
+		state, ok := t.hosts[host]
+		if !ok {
+			state = &hostState{}
+			t.hosts[host] = state
+		}
+		if err == nil {
+			state.successes++
+			state.failures = 0
+			if state.status != storage.HealthHealthy && state.successes >= t.config.HealthyThreshold {
+				state.status = storage.HealthHealthy
+				changed = append(changed, host)
+			}
+		} else {
+			state.failures++
+			state.successes = 0
+			if state.status != storage.HealthUnhealthy && state.failures >= t.config.UnhealthyThreshold {
+				state.status = storage.HealthUnhealthy
+				changed = append(changed, host)
+			}
+		}
+	}
+	for _, host := range changed {
+		event := storage.Event{Type: storage.EventAdd, Key: t.serviceName, Value: host}
+		for subscriber := range t.subscribers {
+			// subscribers re-read the service on any event, dropping one to a slow subscriber is fine
+			select {
+			case subscriber <- event:
+			default:
+			}
+		}
+	}
+	return changed
+}
+
+func (t *target) subscribe() chan storage.Event {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	subscriber := make(chan storage.Event, 16)
+	t.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (t *target) unsubscribe(subscriber chan storage.Event) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.subscribers, subscriber)
+}
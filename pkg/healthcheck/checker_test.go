@@ -0,0 +1,190 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var metrics = InitializeMetrics()
+
+// fakeProbe reports hosts as failing until set healthy
+type fakeProbe struct {
+	lock    sync.Mutex
+	healthy map[string]bool
+}
+
+func (p *fakeProbe) set(host string, healthy bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.healthy[host] = healthy
+}
+
+func (p *fakeProbe) probe(ctx context.Context, host string, config Config) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.healthy[host] {
+		return nil
+	}
+	return errors.New("probe failed")
+}
+
+func instances(context.Context, string, string) []storage.Instance {
+	return []storage.Instance{{Host: "192.0.0.1:8080"}, {Host: "192.0.0.2:8080"}}
+}
+
+func Test_NewChecker(t *testing.T) {
+	checker, err := NewChecker(&mocks.Store{}, Config{Interval: time.Second}, map[string]Config{
+		"http-service": {Protocol: ProtocolHTTP, Path: "/healthz"},
+	}, metrics)
+	assert.NoError(t, err)
+	assert.Equal(t, Config{
+		Protocol:           ProtocolTCP,
+		Path:               "/",
+		Interval:           time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}, checker.defaults)
+	assert.Equal(t, ProtocolHTTP, checker.services["http-service"].Protocol)
+	assert.Equal(t, "/healthz", checker.services["http-service"].Path)
+	assert.Equal(t, time.Second, checker.services["http-service"].Interval)
+
+	_, err = NewChecker(&mocks.Store{}, Config{Protocol: "udp"}, nil, metrics)
+	assert.Error(t, err)
+	_, err = NewChecker(&mocks.Store{}, Config{}, map[string]Config{"service": {Protocol: "udp"}}, metrics)
+	assert.Error(t, err)
+}
+
+func Test_target_update(t *testing.T) {
+	target := &target{
+		serviceName: "dummy-service",
+		config:      Config{HealthyThreshold: 2, UnhealthyThreshold: 2},
+		hosts:       map[string]*hostState{},
+		subscribers: map[chan storage.Event]struct{}{},
+	}
+	events := target.subscribe()
+	failed := errors.New("probe failed")
+
+	assert.Empty(t, target.update(map[string]error{"192.0.0.1:8080": nil, "192.0.0.2:8080": failed}))
+	assert.Equal(t, storage.HealthUnknown, target.hosts["192.0.0.1:8080"].status)
+	assert.ElementsMatch(t, []string{"192.0.0.1:8080", "192.0.0.2:8080"}, target.update(map[string]error{"192.0.0.1:8080": nil, "192.0.0.2:8080": failed}))
+	assert.Equal(t, storage.HealthHealthy, target.hosts["192.0.0.1:8080"].status)
+	assert.Equal(t, storage.HealthUnhealthy, target.hosts["192.0.0.2:8080"].status)
+	assert.Len(t, events, 2)
+	event := <-events
+	assert.Equal(t, storage.EventAdd, event.Type)
+	assert.Equal(t, "dummy-service", event.Key)
+
+	// a single failure does not flip a healthy host, success in between resets the count
+	assert.Empty(t, target.update(map[string]error{"192.0.0.1:8080": failed}))
+	assert.Empty(t, target.update(map[string]error{"192.0.0.1:8080": nil}))
+	assert.Empty(t, target.update(map[string]error{"192.0.0.1:8080": failed}))
+	assert.Equal(t, []string{"192.0.0.1:8080"}, target.update(map[string]error{"192.0.0.1:8080": failed}))
+	assert.Equal(t, storage.HealthUnhealthy, target.hosts["192.0.0.1:8080"].status)
+	_, ok := target.hosts["192.0.0.2:8080"]
+	assert.False(t, ok)
+
+	target.unsubscribe(events)
+	assert.Empty(t, target.subscribers)
+}
+
+func Test_Checker(t *testing.T) {
+	events := make(chan storage.Event)
+	store := &mocks.Store{}
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return(instances, nil)
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("service not found"))
+	store.On("UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "add", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(nil)
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "valid-service").Return((<-chan storage.Event)(events), nil)
+	probe := &fakeProbe{healthy: map[string]bool{"192.0.0.1:8080": true}}
+	checker, err := NewChecker(store, Config{
+		Interval:           10 * time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}, nil, metrics)
+	assert.NoError(t, err)
+	checker.probers = map[string]probeFunc{ProtocolTCP: probe.probe}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, checker.UpdateService(context.Background(), storage.DefaultNamespace, "valid-service", "add", storage.Instance{Host: "192.0.0.1:8080"}, 0))
+	_, err = checker.GetService(context.Background(), storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	res, err := checker.GetService(context.Background(), storage.DefaultNamespace, "valid-service")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.HealthUnknown, res[0].HealthStatus)
+	watch, err := checker.WatchService(ctx, storage.DefaultNamespace, "valid-service")
+	assert.NoError(t, err)
+
+	go checker.Run(ctx)
+	assert.Eventually(t, func() bool {
+		res, err := checker.GetService(context.Background(), storage.DefaultNamespace, "valid-service")
+		return err == nil && res[0].HealthStatus == storage.HealthHealthy && res[1].HealthStatus == storage.HealthUnhealthy
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.MarkedHealthy))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.MarkedUnhealthy))
+	transitions := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		event := <-watch
+		assert.Equal(t, storage.EventAdd, event.Type)
+		transitions[event.Value] = true
+	}
+	assert.Equal(t, map[string]bool{"192.0.0.1:8080": true, "192.0.0.2:8080": true}, transitions)
+
+	probe.set("192.0.0.2:8080", true)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "valid-service", Value: "192.0.0.2:8080"}, <-watch)
+
+	events <- storage.Event{Type: storage.EventRemove, Key: "valid-service", Value: "192.0.0.3:8080"}
+	assert.Equal(t, storage.EventRemove, (<-watch).Type)
+	close(events)
+	_, ok := <-watch
+	assert.False(t, ok)
+}
+
+func Test_CheckerUntrack(t *testing.T) {
+	store := &mocks.Store{}
+	store.On("Register", mock.Anything, storage.DefaultNamespace, "gone-service", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(nil)
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "gone-service").Return(instances, nil).Once()
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "gone-service").Return(nil, pkgerrors.Wrap(storage.ErrKeyNotFound, "Service Name not found"))
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "empty-service").Return([]storage.Instance{}, nil)
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "empty-service").Return(make(<-chan storage.Event), nil)
+	probe := &fakeProbe{healthy: map[string]bool{}}
+	checker, err := NewChecker(store, Config{Interval: 10 * time.Millisecond}, nil, metrics)
+	assert.NoError(t, err)
+	checker.probers = map[string]probeFunc{ProtocolTCP: probe.probe}
+	tracked := func(clusterName string) bool {
+		checker.lock.Lock()
+		defer checker.lock.Unlock()
+		_, ok := checker.targets[clusterName]
+		return ok
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go checker.Run(ctx)
+
+	// a deregistered service stops being probed
+	assert.NoError(t, checker.Register(context.Background(), storage.DefaultNamespace, "gone-service", storage.Instance{Host: "192.0.0.1:8080"}, 0))
+	assert.Eventually(t, func() bool { return !tracked("gone-service") }, time.Second, 10*time.Millisecond)
+
+	// a service without hosts is not tracked by reads, only while it is watched
+	res, err := checker.GetService(context.Background(), storage.DefaultNamespace, "empty-service")
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+	assert.False(t, tracked("empty-service"))
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	_, err = checker.WatchService(watchCtx, storage.DefaultNamespace, "empty-service")
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, tracked("empty-service"))
+	stopWatching()
+	assert.Eventually(t, func() bool { return !tracked("empty-service") }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,33 @@
+package healthcheck
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics defines all metrics for health checker
+type Metrics struct {
+	ProbeSuccess prometheus.Counter
+	ProbeFailure prometheus.Counter
+
+	MarkedHealthy   prometheus.Counter
+	MarkedUnhealthy prometheus.Counter
+}
+
+// InitializeMetrics initialize health checker metrics
+func InitializeMetrics() *Metrics {
+	return &Metrics{
+		ProbeSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "healthcheck_probe_success",
+		}),
+		ProbeFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "healthcheck_probe_failure",
+		}),
+		MarkedHealthy: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "healthcheck_host_marked_healthy",
+		}),
+		MarkedUnhealthy: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "healthcheck_host_marked_unhealthy",
+		}),
+	}
+}
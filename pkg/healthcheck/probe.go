@@ -0,0 +1,73 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// ProtocolTCP probes succeed when host accepts a tcp connection
+	ProtocolTCP = "tcp"
+	// ProtocolHTTP probes succeed when GET Path on host returns 2xx/3xx
+	ProtocolHTTP = "http"
+	// ProtocolGRPC probes succeed when grpc.health.v1 Check on host returns SERVING
+	ProtocolGRPC = "grpc"
+)
+
+// probeFunc probes host once, ctx carries the probe timeout
+type probeFunc func(ctx context.Context, host string, config Config) error
+
+var probers = map[string]probeFunc{
+	ProtocolTCP:  probeTCP,
+	ProtocolHTTP: probeHTTP,
+	ProtocolGRPC: probeGRPC,
+}
+
+func probeTCP(ctx context.Context, host string, config Config) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeHTTP(ctx context.Context, host string, config Config) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+config.Path, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to build http health check request")
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("Health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probeGRPC(ctx context.Context, host string, config Config) error {
+	conn, err := grpc.DialContext(ctx, host, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: config.GRPCService,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("Health check returned status %s", resp.GetStatus())
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func probeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Second)
+}
+
+func closedAddress(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func Test_probeTCP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	ctx, cancel := probeContext()
+	defer cancel()
+
+	assert.NoError(t, probeTCP(ctx, lis.Addr().String(), DefaultConfig))
+	assert.Error(t, probeTCP(ctx, closedAddress(t), DefaultConfig))
+}
+
+func Test_probeHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ctx, cancel := probeContext()
+	defer cancel()
+
+	assert.NoError(t, probeHTTP(ctx, host, Config{Path: "/healthz"}))
+	assert.Error(t, probeHTTP(ctx, host, Config{Path: "/"}))
+	assert.Error(t, probeHTTP(ctx, closedAddress(t), Config{Path: "/healthz"}))
+}
+
+func Test_probeGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("serving", grpc_health_v1.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("not-serving", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	grpc_health_v1.RegisterHealthServer(s, healthServer)
+	go s.Serve(lis)
+	defer s.Stop()
+	ctx, cancel := probeContext()
+	defer cancel()
+
+	assert.NoError(t, probeGRPC(ctx, lis.Addr().String(), Config{GRPCService: "serving"}))
+	assert.Error(t, probeGRPC(ctx, lis.Addr().String(), Config{GRPCService: "not-serving"}))
+	assert.Error(t, probeGRPC(ctx, lis.Addr().String(), Config{GRPCService: "unknown"}))
+}
@@ -2,14 +2,21 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/guanw/ct-dns/pkg/auth"
+	"github.com/guanw/ct-dns/pkg/lifecycle"
 	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/storage"
 	"github.com/pkg/errors"
 )
 
@@ -17,6 +24,8 @@ import (
 type Handler struct {
 	Store   store.Store
 	Metrics *Metrics
+	// Readiness is served by /api/health/ready, nil means always ready
+	Readiness func() lifecycle.Report
 }
 
 // NewHandler creates a new Handler
@@ -27,13 +36,94 @@ func NewHandler(store store.Store, metrics *Metrics) *Handler {
 	}
 }
 
-// RegisterRoutes registers GetService with router
+// RegisterRoutes registers GetService with router, routes without a namespace serve the default namespace
 func (aH *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/api/service/{serviceName}", aH.GetService).Methods(http.MethodGet)
 	router.HandleFunc("/api/service", aH.PostService).Methods(http.MethodPost)
+	router.HandleFunc("/api/services", aH.ListServices).Methods(http.MethodGet)
+	router.HandleFunc("/api/services/{serviceName}/instances", aH.RegisterInstance).Methods(http.MethodPost)
+	router.HandleFunc("/api/services/{serviceName}/instances", aH.DeregisterInstance).Methods(http.MethodDelete)
+	router.HandleFunc("/api/namespaces/{namespace}/services", aH.ListServices).Methods(http.MethodGet)
+	router.HandleFunc("/api/namespaces/{namespace}/services/{serviceName}", aH.GetService).Methods(http.MethodGet)
+	router.HandleFunc("/api/namespaces/{namespace}/services/{serviceName}/instances", aH.RegisterInstance).Methods(http.MethodPost)
+	router.HandleFunc("/api/namespaces/{namespace}/services/{serviceName}/instances", aH.DeregisterInstance).Methods(http.MethodDelete)
 	router.HandleFunc("/api/health", aH.HealthService).Methods(http.MethodGet)
+	router.HandleFunc("/api/health/live", aH.LivenessService).Methods(http.MethodGet)
+	router.HandleFunc("/api/health/ready", aH.HealthService).Methods(http.MethodGet)
 	router.HandleFunc("/v2/discovery:endpoints", aH.DiscoveryEndpointsV2).Methods(http.MethodPost)
 	router.HandleFunc("/v1/registration/{serviceName}", aH.RegistrationServiceV1).Methods(http.MethodGet)
+	// envoy asks for namespace/service when the cluster name carries a namespace, see store.ClusterName
+	router.HandleFunc("/v1/registration/{namespace}/{serviceName}", aH.RegistrationServiceV1).Methods(http.MethodGet)
+}
+
+// requestNamespace returns namespace of the request route, falling back to the default namespace
+func requestNamespace(r *http.Request) string {
+	if ns := mux.Vars(r)["namespace"]; ns != "" {
+		return ns
+	}
+	return storage.DefaultNamespace
+}
+
+// Timeout bounds the context of every request by timeout, storage calls made for the request give up with it
+func Timeout(timeout time.Duration) mux.MiddlewareFunc {
+	return TimeoutFunc(func() time.Duration { return timeout })
+}
+
+// TimeoutFunc bounds the context of every request by what timeout returns at its start, 0 leaves it unbounded
+func TimeoutFunc(timeout func() time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := timeout()
+			if d <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Authenticate attaches identity of the bearer token or verified client certificate of every request
+// to its context, requests with invalid credentials are rejected with 401, requests without stay anonymous
+func Authenticate(authenticator auth.Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var creds auth.Credentials
+			if header := r.Header.Get("Authorization"); header != "" {
+				token, ok := bearerToken(header)
+				if !ok {
+					unauthorized(w, "Unsupported authorization scheme")
+					return
+				}
+				creds.Token = token
+			}
+			if r.TLS != nil {
+				creds.VerifiedChains = r.TLS.VerifiedChains
+			}
+			ctx, err := auth.Authenticate(r.Context(), authenticator, creds)
+			if err != nil {
+				unauthorized(w, err.Error())
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// bearerToken returns token of a "Bearer <token>" authorization header
+func bearerToken(header string) (string, bool) {
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="ct-dns"`)
+	http.Error(w, message, http.StatusUnauthorized)
 }
 
 // DiscoveryEndpointsV2 process envoy EDS V2 api
@@ -57,24 +147,29 @@ func (aH *Handler) DiscoveryEndpointsV2(w http.ResponseWriter, r *http.Request)
 		VersionInfo: "v1",
 		Resources:   []resourceV2{},
 	}
-	for _, r := range body.ResourceNames {
-		serviceName := r
-		hosts, err := aH.Store.GetService(serviceName)
+	// staleness of every cluster is recorded, the oldest is reported
+	var staleness time.Duration
+	ctx := store.WithStaleness(r.Context(), &staleness)
+	for _, clusterName := range body.ResourceNames {
+		namespace, serviceName := store.ParseClusterName(clusterName)
+		instances, err := aH.Store.GetService(ctx, namespace, serviceName)
 		if err != nil {
 			aH.Metrics.V2DiscoveryFailure.Inc()
-			http.Error(w, err.Error(), http.StatusNotFound)
+			http.Error(w, err.Error(), readErrorStatus(err))
 			return
 		}
-		var eps []lbEndpointV2
-		for _, url := range hosts {
-			host, port, err := parseHostPort(url)
+		// hosts are grouped by zone into localities, in the order zones are first seen
+		var localities []resourceEndpointV2
+		zoneIndex := make(map[string]int)
+		for _, instance := range instances {
+			host, port, err := parseHostPort(instance.Host)
 			if err != nil {
 				aH.Metrics.V2DiscoveryFailure.Inc()
 				http.Error(w, err.Error(), http.StatusBadGateway)
 				return
 			}
 
-			eps = append(eps, lbEndpointV2{
+			ep := lbEndpointV2{
 				Endpoint: endpointV2{
 					Address: addressV2{
 						SocketAddress: socketAddressV2{
@@ -83,19 +178,39 @@ func (aH *Handler) DiscoveryEndpointsV2(w http.ResponseWriter, r *http.Request)
 						},
 					},
 				},
-			})
+				LoadBalancingWeight: instance.LoadBalancingWeight(),
+				HealthStatus:        envoyHealthStatus[instance.HealthStatus],
+			}
+			if lbMetadata := envoyLBMetadata(instance); lbMetadata != nil {
+				ep.Metadata = &metadataV2{
+					FilterMetadata: map[string]map[string]interface{}{
+						"envoy.lb": lbMetadata,
+					},
+				}
+			}
+			index, found := zoneIndex[instance.Zone]
+			if !found {
+				index = len(localities)
+				zoneIndex[instance.Zone] = index
+				locality := resourceEndpointV2{}
+				if instance.Zone != "" {
+					locality.Locality = &localityV2{Zone: instance.Zone}
+				}
+				localities = append(localities, locality)
+			}
+			localities[index].LBEndpoints = append(localities[index].LBEndpoints, ep)
+		}
+		if len(localities) == 0 {
+			localities = []resourceEndpointV2{{}}
 		}
 		resp.Resources = append(resp.Resources, resourceV2{
 			Type:        "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment",
-			ClusterName: serviceName,
-			Endpoints: []resourceEndpointV2{
-				{
-					LBEndpoints: eps,
-				},
-			},
+			ClusterName: clusterName,
+			Endpoints:   localities,
 		})
 	}
 	aH.Metrics.V2DiscoverySuccess.Inc()
+	setStaleness(w, staleness)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
@@ -116,11 +231,29 @@ type resourceV2 struct {
 }
 
 type resourceEndpointV2 struct {
+	Locality    *localityV2    `json:"locality,omitempty"`
 	LBEndpoints []lbEndpointV2 `json:"lb_endpoints"`
 }
 
+type localityV2 struct {
+	Zone string `json:"zone"`
+}
+
 type lbEndpointV2 struct {
-	Endpoint endpointV2 `json:"endpoint"`
+	Endpoint            endpointV2  `json:"endpoint"`
+	LoadBalancingWeight uint32      `json:"load_balancing_weight"`
+	HealthStatus        string      `json:"health_status,omitempty"`
+	Metadata            *metadataV2 `json:"metadata,omitempty"`
+}
+
+// envoyHealthStatus maps health observed by active health checking to envoy HealthStatus names
+var envoyHealthStatus = map[storage.HealthStatus]string{
+	storage.HealthHealthy:   "HEALTHY",
+	storage.HealthUnhealthy: "UNHEALTHY",
+}
+
+type metadataV2 struct {
+	FilterMetadata map[string]map[string]interface{} `json:"filter_metadata"`
 }
 
 type endpointV2 struct {
@@ -136,38 +269,59 @@ type socketAddressV2 struct {
 	PortValue int    `json:"port_value"`
 }
 
+// envoyLBMetadata returns tags and canary flag the way envoy subset load balancer reads them
+func envoyLBMetadata(instance storage.Instance) map[string]interface{} {
+	if len(instance.Tags) == 0 && !instance.Canary {
+		return nil
+	}
+	res := make(map[string]interface{}, len(instance.Tags)+1)
+	for k, v := range instance.Tags {
+		res[k] = v
+	}
+	if instance.Canary {
+		res["canary"] = true
+	}
+	return res
+}
+
 // RegistrationServiceV1 process envoy EDS V1 api
 func (aH *Handler) RegistrationServiceV1(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	serviceName := vars["serviceName"]
-	hosts, err := aH.Store.GetService(serviceName)
+	var staleness time.Duration
+	instances, err := aH.Store.GetService(store.WithStaleness(r.Context(), &staleness), requestNamespace(r), serviceName)
 	if err != nil {
 		aH.Metrics.V1RegistrationFailure.Inc()
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), readErrorStatus(err))
 		return
 	}
 
 	var hostsV1 []hostV1
-	for _, h := range hosts {
-		host, port, err := parseHostPort(h)
+	for _, instance := range instances {
+		host, port, err := parseHostPort(instance.Host)
 		if err != nil {
 			aH.Metrics.V1RegistrationFailure.Inc()
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
+		az := instance.Zone
+		if az == "" {
+			az = "default"
+		}
 		hostsV1 = append(hostsV1, hostV1{
 			IPAddress: host,
 			Port:      port,
 			Tags: tagsV1{
-				AZ:                  "default", //TODO support availability zone
-				Canary:              false,
-				LoadBalancingWeight: 1, // TODO check how this load balancing weight works
+				AZ:                  az,
+				Canary:              instance.Canary,
+				LoadBalancingWeight: int(instance.LoadBalancingWeight()),
 			},
 		})
 	}
 	resp := edsV1Resp{
 		Hosts: hostsV1,
 	}
+	setStaleness(w, staleness)
 	w.WriteHeader(http.StatusOK)
 	aH.Metrics.V1RegistrationSuccess.Inc()
 	json.NewEncoder(w).Encode(resp)
@@ -189,10 +343,29 @@ type tagsV1 struct {
 	LoadBalancingWeight int    `json:"load_balancing_weight"`
 }
 
-// HealthService process healthcheck GET request
+// HealthService process readiness GET request, reporting every check and 503 while not ready or shutting down
 func (aH *Handler) HealthService(w http.ResponseWriter, r *http.Request) {
+	report := lifecycle.Report{Status: lifecycle.StatusReady}
+	if aH.Readiness != nil {
+		report = aH.Readiness()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready() {
+		aH.Metrics.HealthcheckFailure.Inc()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
 	aH.Metrics.HealthcheckSuccess.Inc()
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// LivenessService process liveness GET request, the process is alive as long as it answers
+func (aH *Handler) LivenessService(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
 }
 
 // GetService process GET service request
@@ -201,21 +374,153 @@ func (aH *Handler) GetService(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		vars := mux.Vars(r)
 		serviceName := vars["serviceName"]
-		hosts, err := aH.Store.GetService(serviceName)
+		var staleness time.Duration
+		instances, err := aH.Store.GetService(store.WithStaleness(r.Context(), &staleness), requestNamespace(r), serviceName)
 		w.Header().Set("Content-Type", "application/json")
 		if err != nil {
 			aH.Metrics.GetServiceFailure.Inc()
-			http.Error(w, err.Error(), http.StatusNotFound)
+			http.Error(w, err.Error(), readErrorStatus(err))
 			return
 		}
+		setStaleness(w, staleness)
 		w.WriteHeader(http.StatusOK)
 		aH.Metrics.GetServiceSuccess.Inc()
-		json.NewEncoder(w).Encode(hosts)
+		json.NewEncoder(w).Encode(store.Hosts(instances))
 	default:
 		http.Error(w, "Unsupported Request Operation", http.StatusMethodNotAllowed)
 	}
 }
 
+// ListServices process GET services request, filtered by prefix and paged by page_token/page_size query params
+func (aH *Handler) ListServices(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pageSize := 0
+	if raw := query.Get("page_size"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < 0 {
+			aH.Metrics.ListServicesFailure.Inc()
+			http.Error(w, "Invalid page_size", http.StatusBadRequest)
+			return
+		}
+		pageSize = size
+	}
+	services, next, err := aH.Store.ListServices(r.Context(), requestNamespace(r), query.Get("prefix"), query.Get("page_token"), pageSize)
+	if err != nil {
+		aH.Metrics.ListServicesFailure.Inc()
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	aH.Metrics.ListServicesSuccess.Inc()
+	json.NewEncoder(w).Encode(listServicesResp{
+		Services:      services,
+		NextPageToken: next,
+	})
+}
+
+type listServicesResp struct {
+	Services []string `json:"services"`
+	// NextPageToken is empty on the last page
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// RegisterInstance process POST instance request, registering host of body under serviceName
+func (aH *Handler) RegisterInstance(w http.ResponseWriter, r *http.Request) {
+	var b registerBody
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		aH.Metrics.RegisterFailure.Inc()
+		http.Error(w, errors.Wrap(err, "Failed to decode the register request body").Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(b.TTL) * time.Second
+	err := store.ValidateTTL(ttl)
+	if err == nil {
+		err = aH.Store.Register(r.Context(), requestNamespace(r), mux.Vars(r)["serviceName"], b.instance(), ttl)
+	}
+	if err != nil {
+		aH.Metrics.RegisterFailure.Inc()
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	aH.Metrics.RegisterSuccess.Inc()
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DeregisterInstance process DELETE instance request, removing host query param from serviceName
+func (aH *Handler) DeregisterInstance(w http.ResponseWriter, r *http.Request) {
+	err := aH.Store.Deregister(r.Context(), requestNamespace(r), mux.Vars(r)["serviceName"], r.URL.Query().Get("host"))
+	if err != nil {
+		aH.Metrics.DeregisterFailure.Inc()
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	aH.Metrics.DeregisterSuccess.Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type registerBody struct {
+	Host string `json:"host"`
+	// TTL in seconds, hosts registered with ttl expire unless registered again
+	TTL    int64             `json:"ttl"`
+	Zone   string            `json:"zone"`
+	Weight uint32            `json:"weight"`
+	Canary bool              `json:"canary"`
+	Tags   map[string]string `json:"tags"`
+}
+
+func (b registerBody) instance() storage.Instance {
+	return storage.Instance{
+		Host:   b.Host,
+		Zone:   b.Zone,
+		Weight: b.Weight,
+		Canary: b.Canary,
+		Tags:   b.Tags,
+	}
+}
+
+// errorStatus maps store errors to http status, invalid or unauthorized requests are client errors
+func errorStatus(err error) int {
+	if store.IsValidationError(err) {
+		return http.StatusBadRequest
+	}
+	if auth.IsUnauthenticated(err) {
+		return http.StatusUnauthorized
+	}
+	if auth.IsPermissionDenied(err) {
+		return http.StatusForbidden
+	}
+	if errors.Cause(err) == storage.ErrInstanceNotFound {
+		return http.StatusNotFound
+	}
+	if store.IsCircuitOpen(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// readErrorStatus maps errors looking services up, unknown services are not found
+func readErrorStatus(err error) int {
+	if store.IsValidationError(err) {
+		return http.StatusBadRequest
+	}
+	if store.IsCircuitOpen(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusNotFound
+}
+
+// StalenessHeader carries how old (in seconds, rounded up) data is when served
+// from last known good data while storage is unavailable
+const StalenessHeader = "X-Ct-Dns-Staleness"
+
+func setStaleness(w http.ResponseWriter, staleness time.Duration) {
+	if staleness <= 0 {
+		return
+	}
+	w.Header().Set(StalenessHeader, strconv.FormatInt(int64(math.Ceil(staleness.Seconds())), 10))
+}
+
 // PostService process POST service request
 func (aH *Handler) PostService(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -227,9 +532,13 @@ func (aH *Handler) PostService(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = aH.Store.UpdateService(b.ServiceName, b.Operation, b.Host)
+		ttl := time.Duration(b.TTL) * time.Second
+		err = store.ValidateTTL(ttl)
+		if err == nil {
+			err = aH.Store.UpdateService(r.Context(), b.namespace(), b.ServiceName, b.Operation, b.instance(), ttl)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadGateway)
+			http.Error(w, err.Error(), errorStatus(err))
 			aH.Metrics.PostServiceFailure.Inc()
 			return
 		}
@@ -243,9 +552,35 @@ func (aH *Handler) PostService(w http.ResponseWriter, r *http.Request) {
 }
 
 type postBody struct {
+	// Namespace defaults to the default namespace
+	Namespace   string `json:"namespace"`
 	ServiceName string `json:"serviceName"`
 	Operation   string `json:"operation"`
 	Host        string `json:"host"`
+	// TTL in seconds, hosts added or renewed with ttl expire unless renewed again
+	TTL int64 `json:"ttl"`
+	// metadata stored with host on add
+	Zone   string            `json:"zone"`
+	Weight uint32            `json:"weight"`
+	Canary bool              `json:"canary"`
+	Tags   map[string]string `json:"tags"`
+}
+
+func (b postBody) instance() storage.Instance {
+	return storage.Instance{
+		Host:   b.Host,
+		Zone:   b.Zone,
+		Weight: b.Weight,
+		Canary: b.Canary,
+		Tags:   b.Tags,
+	}
+}
+
+func (b postBody) namespace() string {
+	if b.Namespace == "" {
+		return storage.DefaultNamespace
+	}
+	return b.Namespace
 }
 
 func decodeBody(in io.Reader) (postBody, error) {
@@ -258,14 +593,15 @@ func decodeBody(in io.Reader) (postBody, error) {
 	return b, nil
 }
 
+// parseHostPort splits host:port, ipv6 hosts are bracketed as in [::1]:80
 func parseHostPort(raw string) (string, int, error) {
-	splitStrings := strings.Split(raw, ":")
-	if len(splitStrings) < 2 {
-		return "", 0, errors.New("Host doesn't contain port info")
+	host, rawPort, err := net.SplitHostPort(raw)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "Host doesn't contain port info")
 	}
-	port, err := strconv.Atoi(splitStrings[1])
+	port, err := strconv.ParseUint(rawPort, 10, 16)
 	if err != nil {
 		return "", 0, errors.Wrap(err, "Failed to parse port from host info")
 	}
-	return splitStrings[0], port, nil
+	return host, int(port), nil
 }
@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -13,7 +14,11 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/guanw/ct-dns/pkg/auth"
+	"github.com/guanw/ct-dns/pkg/lifecycle"
+	"github.com/guanw/ct-dns/pkg/store"
 	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -37,15 +42,30 @@ func Test_decodeBody(t *testing.T) {
 			expectedErr: true,
 		},
 		{
-			body: bytes.NewReader([]byte(`{"serviceName":"dummy-service", "host":"192.0.0.1", "operation":"add"}`)),
+			body: bytes.NewReader([]byte(`{"serviceName":"dummy-service", "host":"192.0.0.1", "operation":"add", "ttl":30}`)),
 			expected: postBody{
 				ServiceName: "dummy-service",
 				Host:        "192.0.0.1",
 				Operation:   "add",
+				TTL:         30,
 			},
 			expectedErr: false,
 			description: "body should be parsed correctly",
 		},
+		{
+			body: bytes.NewReader([]byte(`{"serviceName":"dummy-service", "host":"192.0.0.1", "operation":"add", "zone":"us-east-1a", "weight":10, "canary":true, "tags":{"version":"v2"}}`)),
+			expected: postBody{
+				ServiceName: "dummy-service",
+				Host:        "192.0.0.1",
+				Operation:   "add",
+				Zone:        "us-east-1a",
+				Weight:      10,
+				Canary:      true,
+				Tags:        map[string]string{"version": "v2"},
+			},
+			expectedErr: false,
+			description: "body with metadata should be parsed correctly",
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
@@ -84,6 +104,74 @@ func makeGetReq(t *testing.T, server *httptest.Server, path, serviceName string)
 	return res.Body, res.StatusCode
 }
 
+func Test_parseHostPort(t *testing.T) {
+	tests := []struct {
+		raw       string
+		host      string
+		port      int
+		expectErr bool
+	}{
+		{raw: "192.0.0.1:8080", host: "192.0.0.1", port: 8080},
+		{raw: "[::1]:80", host: "::1", port: 80},
+		{raw: "example.com:443", host: "example.com", port: 443},
+		{raw: "192.0.0.1", expectErr: true},
+		{raw: "::1", expectErr: true},
+		{raw: "192.0.0.1:abc", expectErr: true},
+		{raw: "192.0.0.1:99999", expectErr: true},
+	}
+	for _, test := range tests {
+		host, port, err := parseHostPort(test.raw)
+		assert.Equal(t, test.expectErr, err != nil, test.raw)
+		assert.Equal(t, test.host, host, test.raw)
+		assert.Equal(t, test.port, port, test.raw)
+	}
+}
+
+func Test_ListServices(t *testing.T) {
+	mockClient := &mocks.Store{}
+	mockClient.On("ListServices", mock.Anything, storage.DefaultNamespace, "", "", 0).Return([]string{"dummy-service", "valid-service"}, "", nil)
+	mockClient.On("ListServices", mock.Anything, storage.DefaultNamespace, "valid-", "valid-a", 1).Return([]string{"valid-b"}, "valid-b", nil)
+	mockClient.On("ListServices", mock.Anything, storage.DefaultNamespace, "error-", "", 0).Return(nil, "", errors.New("list failed"))
+	server := initializeTestServer(mockClient)
+	defer server.Close()
+	tests := []struct {
+		query              string
+		expectedStatusCode int
+		expected           listServicesResp
+	}{
+		{
+			query:              "",
+			expectedStatusCode: 200,
+			expected:           listServicesResp{Services: []string{"dummy-service", "valid-service"}},
+		},
+		{
+			query:              "?prefix=valid-&page_token=valid-a&page_size=1",
+			expectedStatusCode: 200,
+			expected:           listServicesResp{Services: []string{"valid-b"}, NextPageToken: "valid-b"},
+		},
+		{
+			query:              "?prefix=error-",
+			expectedStatusCode: 502,
+		},
+		{
+			query:              "?page_size=abc",
+			expectedStatusCode: 400,
+		},
+	}
+	for _, test := range tests {
+		body, statusCode := makeGetReq(t, server, "/api/services", test.query)
+		assert.Equal(t, test.expectedStatusCode, statusCode)
+		if statusCode == 200 {
+			var resp listServicesResp
+			assert.NoError(t, json.NewDecoder(body).Decode(&resp))
+			assert.Equal(t, test.expected, resp)
+		}
+		body.Close()
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.ListServicesSuccess))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.ListServicesFailure))
+}
+
 func Test_Healthcheck(t *testing.T) {
 	server := initializeTestServer(&mocks.Store{})
 	defer server.Close()
@@ -99,8 +187,8 @@ func Test_Healthcheck(t *testing.T) {
 
 func Test_GetRequest(t *testing.T) {
 	mockClient := &mocks.Store{}
-	mockClient.On("GetService", "valid-service").Return([]string{"192.0.0.1"}, nil)
-	mockClient.On("GetService", "error-service").Return(nil, errors.New("new error"))
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1"}}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("new error"))
 	server := initializeTestServer(mockClient)
 	defer server.Close()
 
@@ -120,13 +208,15 @@ func Test_GetRequest(t *testing.T) {
 
 func Test_PostRequest(t *testing.T) {
 	mockClient := &mocks.Store{}
-	mockClient.On("UpdateService", "valid-service", "add", "192.0.0.1").Return(nil)
-	mockClient.On("UpdateService", "error-service", mock.Anything, mock.Anything).Return(errors.New("new error"))
+	mockClient.On("UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "add", storage.Instance{Host: "192.0.0.1", Zone: "us-east-1a", Weight: 10}, 30*time.Second).Return(nil)
+	mockClient.On("UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "renew", storage.Instance{Host: "192.0.0.2"}, 30*time.Second).Return(storage.ErrInstanceNotFound)
+	mockClient.On("UpdateService", mock.Anything, storage.DefaultNamespace, "error-service", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("new error"))
+	mockClient.On("UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "Add", mock.Anything, mock.Anything).Return(&store.ValidationError{Field: "operation"})
 	server := initializeTestServer(mockClient)
 	defer server.Close()
 
 	t.Run("POST valid service", func(t *testing.T) {
-		postRes, statusCode := makePostReq(t, server, `{"serviceName":"valid-service","operation":"add","host":"192.0.0.1"}`, "/api/service")
+		postRes, statusCode := makePostReq(t, server, `{"serviceName":"valid-service","operation":"add","host":"192.0.0.1","ttl":30,"zone":"us-east-1a","weight":10}`, "/api/service")
 		defer postRes.Close()
 		assert.Equal(t, 200, statusCode)
 		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.PostServiceSuccess))
@@ -148,14 +238,78 @@ func Test_PostRequest(t *testing.T) {
 		assert.Equal(t, 422, statusCode)
 		assert.Equal(t, 2.0, testutil.ToFloat64(metrics.PostServiceFailure))
 	})
+
+	t.Run("POST renew of expired host", func(t *testing.T) {
+		postRes, statusCode := makePostReq(t, server, `{"serviceName":"valid-service","operation":"renew","host":"192.0.0.2","ttl":30}`, "/api/service")
+		defer postRes.Close()
+		assert.Equal(t, 404, statusCode)
+		assert.Equal(t, 3.0, testutil.ToFloat64(metrics.PostServiceFailure))
+	})
+
+	t.Run("POST unknown operation", func(t *testing.T) {
+		postRes, statusCode := makePostReq(t, server, `{"serviceName":"valid-service","operation":"Add","host":"192.0.0.1:8080"}`, "/api/service")
+		defer postRes.Close()
+		assert.Equal(t, 400, statusCode)
+		assert.Equal(t, 4.0, testutil.ToFloat64(metrics.PostServiceFailure))
+	})
+
+	t.Run("POST negative ttl", func(t *testing.T) {
+		postRes, statusCode := makePostReq(t, server, `{"serviceName":"valid-service","operation":"renew","host":"192.0.0.1:8080","ttl":-1}`, "/api/service")
+		defer postRes.Close()
+		assert.Equal(t, 400, statusCode)
+		assert.Equal(t, 5.0, testutil.ToFloat64(metrics.PostServiceFailure))
+		mockClient.AssertNotCalled(t, "UpdateService", mock.Anything, storage.DefaultNamespace, "valid-service", "renew", storage.Instance{Host: "192.0.0.1:8080"}, -time.Second)
+	})
+}
+
+func makeReq(t *testing.T, server *httptest.Server, method, path, body string) (io.ReadCloser, int) {
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewBuffer([]byte(body)))
+	assert.NoError(t, err)
+	res, err := httpClient.Do(req)
+	assert.NoError(t, err)
+	return res.Body, res.StatusCode
+}
+
+func Test_RegisterDeregisterInstance(t *testing.T) {
+	mockClient := &mocks.Store{}
+	mockClient.On("Register", mock.Anything, storage.DefaultNamespace, "valid-service", storage.Instance{Host: "192.0.0.1:8080", Zone: "us-east-1a", Tags: map[string]string{"version": "v2"}}, 30*time.Second).Return(nil)
+	mockClient.On("Register", mock.Anything, storage.DefaultNamespace, "valid-service", storage.Instance{Host: "192.0.0.1"}, time.Duration(0)).Return(&store.ValidationError{Field: "host"})
+	mockClient.On("Register", mock.Anything, storage.DefaultNamespace, "error-service", mock.Anything, mock.Anything).Return(errors.New("new error"))
+	mockClient.On("Deregister", mock.Anything, storage.DefaultNamespace, "valid-service", "192.0.0.1:8080").Return(nil)
+	mockClient.On("Deregister", mock.Anything, storage.DefaultNamespace, "valid-service", "").Return(&store.ValidationError{Field: "host"})
+	server := initializeTestServer(mockClient)
+	defer server.Close()
+	tests := []struct {
+		method             string
+		path               string
+		body               string
+		expectedStatusCode int
+	}{
+		{http.MethodPost, "/api/services/valid-service/instances", `{"host":"192.0.0.1:8080","ttl":30,"zone":"us-east-1a","tags":{"version":"v2"}}`, 201},
+		{http.MethodPost, "/api/services/valid-service/instances", `{"host":"192.0.0.1"}`, 400},
+		{http.MethodPost, "/api/services/valid-service/instances", `{"host":`, 400},
+		{http.MethodPost, "/api/services/error-service/instances", `{"host":"192.0.0.1:8080"}`, 502},
+		{http.MethodPost, "/api/services/valid-service/instances", `{"host":"192.0.0.1:8080","ttl":-1}`, 400},
+		{http.MethodDelete, "/api/services/valid-service/instances?host=192.0.0.1:8080", ``, 204},
+		{http.MethodDelete, "/api/services/valid-service/instances", ``, 400},
+	}
+	for _, test := range tests {
+		body, statusCode := makeReq(t, server, test.method, test.path, test.body)
+		body.Close()
+		assert.Equal(t, test.expectedStatusCode, statusCode, test.path+" "+test.body)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RegisterSuccess))
+	assert.Equal(t, 4.0, testutil.ToFloat64(metrics.RegisterFailure))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.DeregisterSuccess))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.DeregisterFailure))
 }
 
 func Test_RegistrationServiceV1(t *testing.T) {
 	mockClient := &mocks.Store{}
-	mockClient.On("GetService", "valid-service").Return([]string{"192.0.0.1:8080"}, nil)
-	mockClient.On("GetService", "error-service").Return(nil, errors.New("service not found"))
-	mockClient.On("GetService", "service-without-port").Return([]string{"192.0.0.1"}, nil)
-	mockClient.On("GetService", "service-with-invalid-port").Return([]string{"192.0.0.1:abc"}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8080"}, {Host: "192.0.0.2:8080", Zone: "us-east-1a", Weight: 5, Canary: true}, {Host: "[::1]:8080"}}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("service not found"))
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "service-without-port").Return([]storage.Instance{{Host: "192.0.0.1"}}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "service-with-invalid-port").Return([]storage.Instance{{Host: "192.0.0.1:abc"}}, nil)
 	server := initializeTestServer(mockClient)
 	defer server.Close()
 
@@ -170,6 +324,10 @@ func Test_RegistrationServiceV1(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "192.0.0.1", resp.Hosts[0].IPAddress)
 		assert.Equal(t, 8080, resp.Hosts[0].Port)
+		assert.Equal(t, tagsV1{AZ: "default", LoadBalancingWeight: 1}, resp.Hosts[0].Tags)
+		assert.Equal(t, tagsV1{AZ: "us-east-1a", Canary: true, LoadBalancingWeight: 5}, resp.Hosts[1].Tags)
+		assert.Equal(t, "::1", resp.Hosts[2].IPAddress)
+		assert.Equal(t, 8080, resp.Hosts[2].Port)
 		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.V1RegistrationSuccess))
 	})
 
@@ -197,10 +355,15 @@ func Test_RegistrationServiceV1(t *testing.T) {
 
 func Test_DiscoveryEndpointsV2(t *testing.T) {
 	mockClient := &mocks.Store{}
-	mockClient.On("GetService", "valid-service").Return([]string{"192.0.0.1:8080"}, nil)
-	mockClient.On("GetService", "error-service").Return(nil, errors.New("service not found"))
-	mockClient.On("GetService", "service-without-port").Return([]string{"192.0.0.1"}, nil)
-	mockClient.On("GetService", "service-with-invalid-port").Return([]string{"192.0.0.1:abc"}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{
+		{Host: "192.0.0.1:8080"},
+		{Host: "192.0.0.2:8080", Zone: "us-east-1a", Weight: 5, HealthStatus: storage.HealthUnhealthy},
+		{Host: "192.0.0.3:8080", Zone: "us-east-1a", Canary: true, Tags: map[string]string{"version": "v2"}},
+		{Host: "[2001:db8::1]:8080"},
+	}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("service not found"))
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "service-without-port").Return([]storage.Instance{{Host: "192.0.0.1"}}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "service-with-invalid-port").Return([]storage.Instance{{Host: "192.0.0.1:abc"}}, nil)
 	server := initializeTestServer(mockClient)
 	defer server.Close()
 
@@ -230,6 +393,17 @@ func Test_DiscoveryEndpointsV2(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "192.0.0.1", resp.Resources[0].Endpoints[0].LBEndpoints[0].Endpoint.Address.SocketAddress.Address)
 		assert.Equal(t, 8080, resp.Resources[0].Endpoints[0].LBEndpoints[0].Endpoint.Address.SocketAddress.PortValue)
+		assert.Equal(t, uint32(1), resp.Resources[0].Endpoints[0].LBEndpoints[0].LoadBalancingWeight)
+		assert.Empty(t, resp.Resources[0].Endpoints[0].LBEndpoints[0].HealthStatus)
+		assert.Nil(t, resp.Resources[0].Endpoints[0].Locality)
+		assert.Equal(t, "2001:db8::1", resp.Resources[0].Endpoints[0].LBEndpoints[1].Endpoint.Address.SocketAddress.Address)
+		assert.Equal(t, 8080, resp.Resources[0].Endpoints[0].LBEndpoints[1].Endpoint.Address.SocketAddress.PortValue)
+		assert.Equal(t, &localityV2{Zone: "us-east-1a"}, resp.Resources[0].Endpoints[1].Locality)
+		assert.Len(t, resp.Resources[0].Endpoints[1].LBEndpoints, 2)
+		assert.Equal(t, uint32(5), resp.Resources[0].Endpoints[1].LBEndpoints[0].LoadBalancingWeight)
+		assert.Equal(t, "UNHEALTHY", resp.Resources[0].Endpoints[1].LBEndpoints[0].HealthStatus)
+		assert.Nil(t, resp.Resources[0].Endpoints[1].LBEndpoints[0].Metadata)
+		assert.Equal(t, map[string]interface{}{"version": "v2", "canary": true}, resp.Resources[0].Endpoints[1].LBEndpoints[1].Metadata.FilterMetadata["envoy.lb"])
 	})
 
 	t.Run("get from error service", func(t *testing.T) {
@@ -253,3 +427,170 @@ func Test_DiscoveryEndpointsV2(t *testing.T) {
 		assert.Equal(t, 4.0, testutil.ToFloat64(metrics.V2DiscoveryFailure))
 	})
 }
+
+func Test_GetRequestStale(t *testing.T) {
+	mockClient := &mocks.Store{}
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "stale-service").Run(func(args mock.Arguments) {
+		store.RecordStaleness(args.Get(0).(context.Context), 1500*time.Millisecond)
+	}).Return([]storage.Instance{{Host: "192.0.0.1:80"}}, nil)
+	mockClient.On("GetService", mock.Anything, storage.DefaultNamespace, "unavailable-service").Return(nil, store.ErrCircuitOpen)
+	server := initializeTestServer(mockClient)
+	defer server.Close()
+
+	res, err := httpClient.Get(server.URL + "/api/service/stale-service")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get(StalenessHeader))
+
+	res, err = httpClient.Post(server.URL+"/v2/discovery:endpoints", "application/json", strings.NewReader(`{"resource_names":["stale-service"]}`))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get(StalenessHeader))
+
+	getRes, statusCode := makeGetReq(t, server, "/api/service/", "unavailable-service")
+	defer getRes.Close()
+	assert.Equal(t, 503, statusCode)
+	getRes, statusCode = makeGetReq(t, server, "/v1/registration/", "unavailable-service")
+	defer getRes.Close()
+	assert.Equal(t, 503, statusCode)
+}
+
+func Test_Timeout(t *testing.T) {
+	var deadline time.Time
+	handler := Timeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/services", nil))
+	assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 500*time.Millisecond)
+
+	timeout := time.Duration(0)
+	bounded := true
+	handler = TimeoutFunc(func() time.Duration { return timeout })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, bounded = r.Context().Deadline()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/services", nil))
+	assert.False(t, bounded)
+	timeout = time.Second
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/services", nil))
+	assert.True(t, bounded)
+}
+
+func Test_Namespaces(t *testing.T) {
+	mockClient := &mocks.Store{}
+	mockClient.On("GetService", mock.Anything, "team-a", "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8080"}}, nil)
+	mockClient.On("GetService", mock.Anything, "Team-A", "valid-service").Return(nil, &store.ValidationError{Field: "namespace"})
+	mockClient.On("ListServices", mock.Anything, "team-a", "", "", 0).Return([]string{"valid-service"}, "", nil)
+	mockClient.On("Register", mock.Anything, "team-a", "valid-service", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(nil)
+	mockClient.On("Deregister", mock.Anything, "team-a", "valid-service", "192.0.0.1:8080").Return(nil)
+	mockClient.On("UpdateService", mock.Anything, "team-a", "valid-service", "add", storage.Instance{Host: "192.0.0.1:8080"}, time.Duration(0)).Return(nil)
+	server := initializeTestServer(mockClient)
+	defer server.Close()
+	tests := []struct {
+		method             string
+		path               string
+		body               string
+		expectedStatusCode int
+	}{
+		{http.MethodGet, "/api/namespaces/team-a/services/valid-service", ``, 200},
+		{http.MethodGet, "/api/namespaces/Team-A/services/valid-service", ``, 400},
+		{http.MethodGet, "/api/namespaces/team-a/services", ``, 200},
+		{http.MethodPost, "/api/namespaces/team-a/services/valid-service/instances", `{"host":"192.0.0.1:8080"}`, 201},
+		{http.MethodDelete, "/api/namespaces/team-a/services/valid-service/instances?host=192.0.0.1:8080", ``, 204},
+		{http.MethodPost, "/api/service", `{"namespace":"team-a","serviceName":"valid-service","operation":"add","host":"192.0.0.1:8080"}`, 200},
+		{http.MethodGet, "/v1/registration/team-a/valid-service", ``, 200},
+	}
+	for _, test := range tests {
+		body, statusCode := makeReq(t, server, test.method, test.path, test.body)
+		body.Close()
+		assert.Equal(t, test.expectedStatusCode, statusCode, test.path+" "+test.body)
+	}
+
+	res, err := httpClient.Post(server.URL+"/v2/discovery:endpoints", "application/json", strings.NewReader(`{"resource_names":["team-a/valid-service"]}`))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), `"cluster_name":"team-a/valid-service"`)
+}
+
+func Test_Authenticate(t *testing.T) {
+	authenticator, err := auth.NewAuthenticator(auth.Config{Tokens: []auth.TokenConfig{{Identity: "deployer", Token: "s3cret"}}}, auth.InitializeMetrics())
+	assert.NoError(t, err)
+	var identity auth.Identity
+	var authenticated bool
+	handler := Authenticate(authenticator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, authenticated = auth.FromContext(r.Context())
+	}))
+	tests := []struct {
+		header             string
+		expectedStatusCode int
+		expectedIdentity   string
+	}{
+		{header: "Bearer s3cret", expectedStatusCode: 200, expectedIdentity: "deployer"},
+		{header: "bearer s3cret", expectedStatusCode: 200, expectedIdentity: "deployer"},
+		{header: "", expectedStatusCode: 200},
+		{header: "Bearer wrong", expectedStatusCode: 401},
+		{header: "Basic ZGVwbG95ZXI6czNjcmV0", expectedStatusCode: 401},
+	}
+	for _, test := range tests {
+		identity, authenticated = auth.Identity{}, false
+		req := httptest.NewRequest(http.MethodPost, "/api/service", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, test.expectedStatusCode, rec.Code, test.header)
+		assert.Equal(t, test.expectedIdentity, identity.Name, test.header)
+		assert.Equal(t, test.expectedIdentity != "", authenticated, test.header)
+		if rec.Code == 401 {
+			assert.Equal(t, `Bearer realm="ct-dns"`, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	mockClient := &mocks.Store{}
+	mockClient.On("Register", mock.Anything, storage.DefaultNamespace, "valid-service", mock.Anything, mock.Anything).Return(&auth.PermissionError{Identity: "deployer"})
+	mockClient.On("Deregister", mock.Anything, storage.DefaultNamespace, "valid-service", mock.Anything).Return(auth.ErrUnauthenticated)
+	server := initializeTestServer(mockClient)
+	defer server.Close()
+	body, statusCode := makeReq(t, server, http.MethodPost, "/api/services/valid-service/instances", `{"host":"192.0.0.1:8080"}`)
+	body.Close()
+	assert.Equal(t, 403, statusCode)
+	body, statusCode = makeReq(t, server, http.MethodDelete, "/api/services/valid-service/instances?host=192.0.0.1:8080", ``)
+	body.Close()
+	assert.Equal(t, 401, statusCode)
+}
+
+func Test_HealthcheckNotReady(t *testing.T) {
+	report := lifecycle.Report{
+		Status: lifecycle.StatusNotReady,
+		Checks: map[string]lifecycle.Check{"storage": {Status: lifecycle.CheckFailing, Error: "connection refused"}},
+	}
+	handler := NewHandler(&mocks.Store{}, metrics)
+	handler.Readiness = func() lifecycle.Report { return report }
+	r := mux.NewRouter()
+	handler.RegisterRoutes(r)
+
+	for _, path := range []string{"/api/health", "/api/health/ready"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, 503, rec.Code)
+		var res lifecycle.Report
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		assert.Equal(t, lifecycle.StatusNotReady, res.Status)
+		assert.Equal(t, "connection refused", res.Checks["storage"].Error)
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.HealthcheckFailure))
+	// liveness does not depend on storage
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health/live", nil))
+	assert.Equal(t, 200, rec.Code)
+
+	report = lifecycle.Report{Status: lifecycle.StatusReady, Checks: map[string]lifecycle.Check{"storage": {Status: lifecycle.CheckOK}}}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health/ready", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"ready"`)
+}
@@ -13,7 +13,16 @@ type Metrics struct {
 	PostServiceSuccess prometheus.Counter
 	PostServiceFailure prometheus.Counter
 
+	RegisterSuccess   prometheus.Counter
+	RegisterFailure   prometheus.Counter
+	DeregisterSuccess prometheus.Counter
+	DeregisterFailure prometheus.Counter
+
+	ListServicesSuccess prometheus.Counter
+	ListServicesFailure prometheus.Counter
+
 	HealthcheckSuccess prometheus.Counter
+	HealthcheckFailure prometheus.Counter
 
 	V1RegistrationSuccess prometheus.Counter
 	V1RegistrationFailure prometheus.Counter
@@ -37,9 +46,30 @@ func InitializeMetrics() *Metrics {
 		PostServiceFailure: promauto.NewCounter(prometheus.CounterOpts{
 			Name: "http_handler_post_request_failure",
 		}),
+		RegisterSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "http_handler_register_request_success",
+		}),
+		RegisterFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "http_handler_register_request_failure",
+		}),
+		DeregisterSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "http_handler_deregister_request_success",
+		}),
+		DeregisterFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "http_handler_deregister_request_failure",
+		}),
+		ListServicesSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "http_handler_list_request_success",
+		}),
+		ListServicesFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "http_handler_list_request_failure",
+		}),
 		HealthcheckSuccess: promauto.NewCounter(prometheus.CounterOpts{
 			Name: "http_handler_health_check_success",
 		}),
+		HealthcheckFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "http_handler_health_check_failure",
+		}),
 		V1RegistrationSuccess: promauto.NewCounter(prometheus.CounterOpts{
 			Name: "http_handler_v1_registration_success",
 		}),
@@ -0,0 +1,353 @@
+package lifecycle
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Service is the grpc health service reporting readiness of ct-dns,
+// the server wide "" service reports liveness and stays SERVING until shutdown
+const Service = "ct-dns"
+
+const (
+	// StatusReady is reported once every check passes
+	StatusReady = "ready"
+	// StatusNotReady is reported while any check fails or has not run yet
+	StatusNotReady = "not_ready"
+	// StatusShuttingDown is reported once shutdown starts
+	StatusShuttingDown = "shutting_down"
+	// CheckOK is the status of a passing check
+	CheckOK = "ok"
+	// CheckFailing is the status of a failing check
+	CheckFailing = "failing"
+)
+
+const (
+	// DefaultReadinessInterval is used when ReadinessInterval is not set
+	DefaultReadinessInterval = time.Second
+	// DefaultShutdownTimeout is used when ShutdownTimeout is not set
+	DefaultShutdownTimeout = 20 * time.Second
+	// checkTimeout bounds a single readiness check
+	checkTimeout = 5 * time.Second
+)
+
+// Config contains config for startup and shutdown of the servers
+type Config struct {
+	// ReadinessInterval is how often readiness checks (storage ping) run
+	ReadinessInterval time.Duration `yaml:"readinessinterval"`
+	// ShutdownDelay keeps serving after health turns NOT_SERVING so load balancers stop sending requests first
+	ShutdownDelay time.Duration `yaml:"shutdowndelay"`
+	// ShutdownTimeout bounds draining in-flight requests, the ones still running are cut off
+	ShutdownTimeout time.Duration `yaml:"shutdowntimeout"`
+}
+
+// Check is the latest outcome of a readiness check
+type Check struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Latency   string    `json:"latency"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report describes readiness along with the latest outcome of every check
+type Report struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+}
+
+// Ready tells whether Report allows serving traffic
+func (r Report) Ready() bool {
+	return r.Status == StatusReady
+}
+
+type check struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type stopper struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Manager reports ready while every check passes and shuts servers down gracefully,
+// readiness (http /api/health/ready and grpc Service) turns NOT_SERVING as soon as shutdown starts,
+// grpc streams are ended and servers drained in parallel within ShutdownTimeout, resources are closed afterwards
+type Manager struct {
+	config Config
+	health *health.Server
+	// streams is canceled once servers start draining, ending grpc streams of StreamInterceptor
+	streams    context.Context
+	endStreams context.CancelFunc
+
+	lock     sync.Mutex
+	ready    int32
+	stopping bool
+	checks   []check
+	results  map[string]Check
+	drains   []stopper
+	closers  []stopper
+	errs     chan error
+}
+
+// NewManager creates a Manager reporting Service NOT_SERVING on healthServer until checks pass
+func NewManager(config Config, healthServer *health.Server) *Manager {
+	if config.ReadinessInterval <= 0 {
+		config.ReadinessInterval = DefaultReadinessInterval
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(Service, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	streams, endStreams := context.WithCancel(context.Background())
+	return &Manager{
+		config:     config,
+		health:     healthServer,
+		streams:    streams,
+		endStreams: endStreams,
+		results:    make(map[string]Check),
+		errs:       make(chan error, 1),
+	}
+}
+
+// Ready tells whether every check passed last time and shutdown has not started
+func (m *Manager) Ready() bool {
+	return atomic.LoadInt32(&m.ready) == 1
+}
+
+// AddCheck registers a readiness check, checks registered after Run starts are ignored
+func (m *Manager) AddCheck(name string, c func(ctx context.Context) error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.checks = append(m.checks, check{name: name, check: c})
+}
+
+// Report returns readiness with the latest outcome of every check
+func (m *Manager) Report() Report {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	report := Report{Status: StatusNotReady, Checks: make(map[string]Check, len(m.results))}
+	for name, result := range m.results {
+		report.Checks[name] = result
+	}
+	switch {
+	case m.stopping:
+		report.Status = StatusShuttingDown
+	case m.Ready():
+		report.Status = StatusReady
+	}
+	return report
+}
+
+// Run runs checks right away and every ReadinessInterval after until ctx is done,
+// reporting ready while all of them pass
+func (m *Manager) Run(ctx context.Context) {
+	m.lock.Lock()
+	checks := m.checks
+	m.lock.Unlock()
+	for {
+		m.runChecks(ctx, checks)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.config.ReadinessInterval):
+		}
+	}
+}
+
+func (m *Manager) runChecks(ctx context.Context, checks []check) {
+	results := make(map[string]Check, len(checks))
+	ready := true
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		start := time.Now()
+		err := c.check(checkCtx)
+		cancel()
+		result := Check{Status: CheckOK, Latency: time.Since(start).String(), CheckedAt: start}
+		if err != nil {
+			result.Status, result.Error = CheckFailing, err.Error()
+			ready = false
+		}
+		results[c.name] = result
+	}
+	m.setReady(ready, results)
+}
+
+// setReady records results, logging and reporting changes of readiness, nothing changes once shutdown starts
+func (m *Manager) setReady(ready bool, results map[string]Check) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stopping {
+		return
+	}
+	m.results = results
+	if ready == m.Ready() {
+		return
+	}
+	status := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	if ready {
+		atomic.StoreInt32(&m.ready, 1)
+		status = grpc_health_v1.HealthCheckResponse_SERVING
+		logging.GetLogger().Info("Readiness checks pass, ready to serve")
+	} else {
+		atomic.StoreInt32(&m.ready, 0)
+		for name, result := range results {
+			if result.Status != CheckOK {
+				logging.GetLogger().WithField("check", name).WithField("error", result.Error).Warn("Readiness check failed, not ready")
+			}
+		}
+	}
+	m.health.SetServingStatus(Service, status)
+}
+
+// Go runs serve in the background, shutdown starts once it fails
+// http.ErrServerClosed and nil, returned by servers asked to stop, are not failures
+func (m *Manager) Go(name string, serve func() error) {
+	go func() {
+		err := serve()
+		if err == nil || err == http.ErrServerClosed {
+			return
+		}
+		select {
+		case m.errs <- errors.Wrapf(err, "%s server stopped", name):
+		default:
+		}
+	}()
+}
+
+// OnDrain registers stop of a server, it should return once in-flight requests finish or ctx is done
+func (m *Manager) OnDrain(name string, stop func(ctx context.Context) error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.drains = append(m.drains, stopper{name: name, stop: stop})
+}
+
+// OnClose registers close of a resource used by servers, closes run in order of registration once servers are drained
+func (m *Manager) OnClose(name string, close func() error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closers = append(m.closers, stopper{name: name, stop: func(context.Context) error { return close() }})
+}
+
+// Wait blocks until a signal arrives or a server started by Go fails, then shuts down,
+// the server failure is returned over shutdown errors
+func (m *Manager) Wait(signals <-chan os.Signal) error {
+	var serveErr error
+	select {
+	case sig := <-signals:
+		logging.GetLogger().WithField("signal", sig.String()).Info("Received signal, shutting down")
+	case serveErr = <-m.errs:
+		logging.GetLogger().WithError(serveErr).Error("Server failed, shutting down")
+	}
+	if err := m.Shutdown(); serveErr == nil {
+		return err
+	}
+	return serveErr
+}
+
+// StreamInterceptor ends grpc streams once servers start draining, they fail with Unavailable so clients
+// reconnect to another server. Watch and xDS streams never end on their own, GracefulStop would wait on them.
+func (m *Manager) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := context.WithCancel(stream.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-m.streams.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := handler(srv, &endingStream{ServerStream: stream, ctx: ctx})
+		if m.streams.Err() != nil && stream.Context().Err() == nil {
+			return status.Error(codes.Unavailable, "Server is shutting down")
+		}
+		return err
+	}
+}
+
+type endingStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *endingStream) Context() context.Context {
+	return s.ctx
+}
+
+// Shutdown turns health NOT_SERVING, waits ShutdownDelay, ends grpc streams, drains servers within
+// ShutdownTimeout and closes resources
+func (m *Manager) Shutdown() error {
+	m.lock.Lock()
+	m.stopping = true
+	atomic.StoreInt32(&m.ready, 0)
+	drains, closers := m.drains, m.closers
+	m.lock.Unlock()
+	// health ignores status updates from now on
+	m.health.Shutdown()
+	time.Sleep(m.config.ShutdownDelay)
+
+	m.endStreams()
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.ShutdownTimeout)
+	defer cancel()
+	errs := make(chan error, len(drains))
+	for _, d := range drains {
+		go func(d stopper) {
+			errs <- stop(ctx, d)
+		}(d)
+	}
+	var result error
+	for range drains {
+		if err := <-errs; err != nil {
+			result = err
+		}
+	}
+	for _, c := range closers {
+		if err := stop(ctx, c); err != nil {
+			result = err
+		}
+	}
+	logging.GetLogger().Info("Shutdown complete")
+	return result
+}
+
+func stop(ctx context.Context, s stopper) error {
+	if err := s.stop(ctx); err != nil {
+		logging.GetLogger().WithError(err).WithField("name", s.name).Error("Failed to stop gracefully")
+		return errors.Wrapf(err, "Failed to stop %s", s.name)
+	}
+	return nil
+}
+
+// GracefulStopGRPC returns stop of server waiting for in-flight calls, calls still running once ctx is done
+// are cut off. Streams have to be ended by StreamInterceptor, envoy keeps xDS streams open otherwise.
+func GracefulStopGRPC(server *grpc.Server) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			server.Stop()
+			<-done
+			return nil
+		}
+	}
+}
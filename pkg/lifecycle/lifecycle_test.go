@@ -0,0 +1,194 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func servingStatus(t *testing.T, healthServer *health.Server) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	res, err := healthServer.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: Service})
+	assert.NoError(t, err)
+	return res.Status
+}
+
+func Test_Run(t *testing.T) {
+	healthServer := health.NewServer()
+	m := NewManager(Config{ReadinessInterval: time.Millisecond}, healthServer)
+	assert.False(t, m.Ready())
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus(t, healthServer))
+	assert.Equal(t, Report{Status: StatusNotReady, Checks: map[string]Check{}}, m.Report())
+
+	var lock sync.Mutex
+	var storageErr error = errors.New("connection refused")
+	setStorageErr := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		storageErr = err
+	}
+	m.AddCheck("storage", func(ctx context.Context) error {
+		lock.Lock()
+		defer lock.Unlock()
+		return storageErr
+	})
+	m.AddCheck("disk", func(ctx context.Context) error { return nil })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	assert.Eventually(t, func() bool { return len(m.Report().Checks) == 2 }, time.Second, 10*time.Millisecond)
+	report := m.Report()
+	assert.Equal(t, StatusNotReady, report.Status)
+	assert.Equal(t, CheckFailing, report.Checks["storage"].Status)
+	assert.Equal(t, "connection refused", report.Checks["storage"].Error)
+	assert.Equal(t, CheckOK, report.Checks["disk"].Status)
+	// liveness is served regardless of checks
+	res, err := healthServer.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, res.Status)
+
+	setStorageErr(nil)
+	assert.Eventually(t, m.Ready, time.Second, 10*time.Millisecond)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, servingStatus(t, healthServer))
+	assert.True(t, m.Report().Ready())
+
+	setStorageErr(errors.New("no leader"))
+	assert.Eventually(t, func() bool { return !m.Ready() }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus(t, healthServer))
+}
+
+func Test_Shutdown(t *testing.T) {
+	healthServer := health.NewServer()
+	m := NewManager(Config{ShutdownTimeout: time.Second}, healthServer)
+	m.setReady(true, nil)
+	assert.True(t, m.Ready())
+
+	var lock sync.Mutex
+	var order []string
+	record := func(name string) {
+		lock.Lock()
+		defer lock.Unlock()
+		order = append(order, name)
+	}
+	// drains run in parallel, each waits for the other to start
+	started := make(chan struct{}, 2)
+	for _, name := range []string{"http", "grpc"} {
+		name := name
+		m.OnDrain(name, func(ctx context.Context) error {
+			assert.False(t, m.Ready())
+			assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus(t, healthServer))
+			started <- struct{}{}
+			for len(started) < 2 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Millisecond):
+				}
+			}
+			record(name)
+			return nil
+		})
+	}
+	m.OnClose("background tasks", func() error {
+		record("background tasks")
+		return nil
+	})
+	m.OnClose("storage", func() error {
+		record("storage")
+		return errors.New("already closed")
+	})
+
+	assert.EqualError(t, m.Shutdown(), "Failed to stop storage: already closed")
+	assert.ElementsMatch(t, []string{"http", "grpc"}, order[:2])
+	assert.Equal(t, []string{"background tasks", "storage"}, order[2:])
+	// readiness passing during shutdown does not report ready again
+	m.setReady(true, nil)
+	assert.False(t, m.Ready())
+	assert.Equal(t, StatusShuttingDown, m.Report().Status)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus(t, healthServer))
+}
+
+func Test_Wait(t *testing.T) {
+	m := NewManager(Config{}, health.NewServer())
+	m.Go("http", func() error { return http.ErrServerClosed })
+	m.Go("dns", func() error { return errors.New("address already in use") })
+	closed := false
+	m.OnClose("storage", func() error {
+		closed = true
+		return nil
+	})
+	assert.EqualError(t, m.Wait(make(chan os.Signal)), "dns server stopped: address already in use")
+	assert.True(t, closed)
+
+	m = NewManager(Config{}, health.NewServer())
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	assert.NoError(t, m.Wait(signals))
+}
+
+func Test_GracefulStopGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	// a watch stays open like an xDS stream does
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.NoError(t, GracefulStopGRPC(server)(ctx))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	_, err = stream.Recv()
+	assert.Error(t, err)
+}
+
+func Test_StreamInterceptor(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	healthServer := health.NewServer()
+	m := NewManager(Config{ShutdownTimeout: 10 * time.Second}, healthServer)
+	server := grpc.NewServer(grpc.StreamInterceptor(m.StreamInterceptor()))
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go server.Serve(lis)
+	m.OnDrain("grpc", GracefulStopGRPC(server))
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	// the stream is ended rather than waited on until ShutdownTimeout
+	start := time.Now()
+	assert.NoError(t, m.Shutdown())
+	assert.True(t, time.Since(start) < 5*time.Second)
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
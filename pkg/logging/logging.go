@@ -3,6 +3,7 @@ package logging
 import (
 	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -16,3 +17,21 @@ func GetLogger() *logrus.Logger {
 	})
 	return instance
 }
+
+// Configure sets level and format (text or json) of the logger
+func Configure(level, format string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid log level %q", level)
+	}
+	switch format {
+	case "text":
+		GetLogger().SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		GetLogger().SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("Invalid log format %q, expected text or json", format)
+	}
+	GetLogger().SetLevel(l)
+	return nil
+}
@@ -0,0 +1,332 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+)
+
+// BreakerConfig defines circuit breaker in front of a Store, zero fields fall back to DefaultBreakerConfig
+// FailureThreshold consecutive transient failures open the breaker, once OpenTimeout passed
+// a single call is let through (half-open) which closes the breaker on success or opens it again.
+// Last known good data is kept for the MaxEntries most recently read services.
+type BreakerConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	FailureThreshold int           `yaml:"failurethreshold"`
+	OpenTimeout      time.Duration `yaml:"opentimeout"`
+	MaxEntries       int           `yaml:"maxentries"`
+}
+
+// DefaultBreakerConfig is used for fields left unset
+var DefaultBreakerConfig = BreakerConfig{
+	FailureThreshold: 5,
+	OpenTimeout:      10 * time.Second,
+	MaxEntries:       10000,
+}
+
+func (c BreakerConfig) merge(defaults BreakerConfig) BreakerConfig {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = defaults.FailureThreshold
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = defaults.OpenTimeout
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = defaults.MaxEntries
+	}
+	return c
+}
+
+// ErrCircuitOpen is returned for calls rejected while the breaker is open,
+// reads only get it when there is no last known good data of the service
+var ErrCircuitOpen = errors.New("Storage unavailable, circuit breaker is open")
+
+// IsCircuitOpen tells whether cause of err is ErrCircuitOpen
+func IsCircuitOpen(err error) bool {
+	return errors.Cause(err) == ErrCircuitOpen
+}
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+var breakerStateNames = map[breakerState]string{
+	stateClosed:   "closed",
+	stateOpen:     "open",
+	stateHalfOpen: "half-open",
+}
+
+type breaker struct {
+	Store   Store
+	Metrics *BreakerMetrics
+	config  BreakerConfig
+	now     func() time.Time
+
+	lock     sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the single call let through a half-open breaker is in flight
+	probing bool
+	// lastKnownGood maps service to its element in lru, most recently used first
+	lastKnownGood map[serviceKey]*list.Element
+	lru           *list.List
+}
+
+type lastKnownGood struct {
+	key       serviceKey
+	instances []storage.Instance
+	readAt    time.Time
+}
+
+// NewBreaker initializes circuit breaker in front of store, GetService falls back to
+// the last successful result of the service when rejected or failing with a transient error,
+// recording its staleness on contexts made by WithStaleness
+func NewBreaker(store Store, config BreakerConfig, metrics *BreakerMetrics) Store {
+	metrics.State.Set(float64(stateClosed))
+	return &breaker{
+		Store:         store,
+		Metrics:       metrics,
+		config:        config.merge(DefaultBreakerConfig),
+		now:           time.Now,
+		lastKnownGood: make(map[serviceKey]*list.Element),
+		lru:           list.New(),
+	}
+}
+
+// GetService fires inner Store and falls back to last known good data of the service
+func (b *breaker) GetService(ctx context.Context, namespace, serviceName string) ([]storage.Instance, error) {
+	key := serviceKey{namespace, serviceName}
+	allowed, probe := b.allow()
+	if !allowed {
+		if instances, ok := b.fallback(ctx, key); ok {
+			return instances, nil
+		}
+		return nil, ErrCircuitOpen
+	}
+	instances, err := b.Store.GetService(ctx, namespace, serviceName)
+	b.record(ctx, err, probe)
+	if err != nil {
+		if !storage.IsTransient(err) {
+			b.forget(key)
+			return nil, err
+		}
+		if instances, ok := b.fallback(ctx, key); ok {
+			return instances, nil
+		}
+		return nil, err
+	}
+	b.remember(key, instances)
+	return instances, nil
+}
+
+// Register fires inner Store unless breaker is open
+func (b *breaker) Register(ctx context.Context, namespace, serviceName string, instance storage.Instance, ttl time.Duration) error {
+	return b.do(ctx, func() error {
+		return b.Store.Register(ctx, namespace, serviceName, instance, ttl)
+	})
+}
+
+// Deregister fires inner Store unless breaker is open
+func (b *breaker) Deregister(ctx context.Context, namespace, serviceName, host string) error {
+	err := b.do(ctx, func() error {
+		return b.Store.Deregister(ctx, namespace, serviceName, host)
+	})
+	if err == nil {
+		b.forgetHost(serviceKey{namespace, serviceName}, host)
+	}
+	return err
+}
+
+// UpdateService fires inner Store unless breaker is open
+func (b *breaker) UpdateService(ctx context.Context, namespace, serviceName, operation string, instance storage.Instance, ttl time.Duration) error {
+	err := b.do(ctx, func() error {
+		return b.Store.UpdateService(ctx, namespace, serviceName, operation, instance, ttl)
+	})
+	if err == nil && operation == "delete" {
+		b.forgetHost(serviceKey{namespace, serviceName}, instance.Host)
+	}
+	return err
+}
+
+// WatchService fires inner Store unless breaker is open
+func (b *breaker) WatchService(ctx context.Context, namespace, serviceName string) (<-chan storage.Event, error) {
+	var events <-chan storage.Event
+	err := b.do(ctx, func() error {
+		var err error
+		events, err = b.Store.WatchService(ctx, namespace, serviceName)
+		return err
+	})
+	return events, err
+}
+
+// ListServices fires inner Store unless breaker is open
+func (b *breaker) ListServices(ctx context.Context, namespace, prefix, pageToken string, pageSize int) ([]string, string, error) {
+	var res []string
+	var next string
+	err := b.do(ctx, func() error {
+		var err error
+		res, next, err = b.Store.ListServices(ctx, namespace, prefix, pageToken, pageSize)
+		return err
+	})
+	return res, next, err
+}
+
+func (b *breaker) do(ctx context.Context, call func() error) error {
+	allowed, probe := b.allow()
+	if !allowed {
+		return ErrCircuitOpen
+	}
+	err := call()
+	b.record(ctx, err, probe)
+	return err
+}
+
+// allow tells whether a call may go through to inner Store and whether it is the half-open probe
+func (b *breaker) allow() (bool, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case stateClosed:
+		return true, false
+	case stateOpen:
+		if b.now().Sub(b.openedAt) < b.config.OpenTimeout {
+			b.Metrics.Rejected.Inc()
+			return false, false
+		}
+		b.setState(stateHalfOpen)
+	}
+	if b.probing {
+		b.Metrics.Rejected.Inc()
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// record moves breaker according to outcome of a call let through, only transient errors count as failures,
+// calls abandoned by their caller tell nothing about storage
+func (b *breaker) record(ctx context.Context, err error, probe bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if err != nil && storage.IsTransient(err) {
+		b.failures++
+		if (probe && b.state == stateHalfOpen) || (b.state == stateClosed && b.failures >= b.config.FailureThreshold) {
+			b.openedAt = b.now()
+			b.setState(stateOpen)
+		}
+		return
+	}
+	b.failures = 0
+	b.Metrics.Staleness.Set(0)
+	if b.state != stateClosed {
+		b.setState(stateClosed)
+	}
+}
+
+// setState switches state, caller must hold lock
+func (b *breaker) setState(state breakerState) {
+	logging.GetLogger().WithField("from", breakerStateNames[b.state]).WithField("to", breakerStateNames[state]).Warn("Storage circuit breaker changed state")
+	b.state = state
+	b.Metrics.State.Set(float64(state))
+}
+
+// remember stores instances of service, evicting least recently used services over MaxEntries
+func (b *breaker) remember(key serviceKey, instances []storage.Instance) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	lkg := &lastKnownGood{key: key, instances: copyInstances(instances), readAt: b.now()}
+	if elem, found := b.lastKnownGood[key]; found {
+		elem.Value = lkg
+		b.lru.MoveToFront(elem)
+		return
+	}
+	b.lastKnownGood[key] = b.lru.PushFront(lkg)
+	for b.lru.Len() > b.config.MaxEntries {
+		oldest := b.lru.Back()
+		b.lru.Remove(oldest)
+		delete(b.lastKnownGood, oldest.Value.(*lastKnownGood).key)
+	}
+}
+
+func (b *breaker) forget(key serviceKey) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if elem, found := b.lastKnownGood[key]; found {
+		b.lru.Remove(elem)
+		delete(b.lastKnownGood, key)
+	}
+}
+
+// forgetHost removes deregistered host from last known good data, forgetting the service along with its last host
+func (b *breaker) forgetHost(key serviceKey, host string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	elem, found := b.lastKnownGood[key]
+	if !found {
+		return
+	}
+	lkg := elem.Value.(*lastKnownGood)
+	var instances []storage.Instance
+	for _, instance := range lkg.instances {
+		if instance.Host != host {
+			instances = append(instances, instance)
+		}
+	}
+	if len(instances) == 0 {
+		b.lru.Remove(elem)
+		delete(b.lastKnownGood, key)
+		return
+	}
+	elem.Value = &lastKnownGood{key: key, instances: instances, readAt: lkg.readAt}
+}
+
+// fallback returns last known good instances of service and records their staleness on ctx
+func (b *breaker) fallback(ctx context.Context, key serviceKey) ([]storage.Instance, bool) {
+	b.lock.Lock()
+	elem, ok := b.lastKnownGood[key]
+	if !ok {
+		b.lock.Unlock()
+		return nil, false
+	}
+	b.lru.MoveToFront(elem)
+	lkg := elem.Value.(*lastKnownGood)
+	staleness := b.now().Sub(lkg.readAt)
+	b.lock.Unlock()
+	RecordStaleness(ctx, staleness)
+	b.Metrics.LastKnownGoodServed.Inc()
+	b.Metrics.Staleness.Set(staleness.Seconds())
+	return copyInstances(lkg.instances), true
+}
+
+type stalenessKey struct{}
+
+// WithStaleness returns ctx recording in staleness how long ago the oldest instances GetService returned under it
+// were read from storage, staleness is left zero unless they were served from last known good data.
+// It is not safe for concurrent GetService calls.
+func WithStaleness(ctx context.Context, staleness *time.Duration) context.Context {
+	return context.WithValue(ctx, stalenessKey{}, staleness)
+}
+
+// RecordStaleness records on ctx made by WithStaleness that instances served under it were read from storage
+// staleness ago
+func RecordStaleness(ctx context.Context, staleness time.Duration) {
+	if recorded, ok := ctx.Value(stalenessKey{}).(*time.Duration); ok && staleness > *recorded {
+		*recorded = staleness
+	}
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BreakerMetrics defines all metrics for circuit breaker
+type BreakerMetrics struct {
+	// State is 0 while closed, 1 while open and 2 while half-open
+	State    prometheus.Gauge
+	Rejected prometheus.Counter
+
+	LastKnownGoodServed prometheus.Counter
+	// Staleness is the age of the last known good data served last, reset once storage answers again
+	Staleness prometheus.Gauge
+}
+
+// InitializeBreakerMetrics initialize circuit breaker metrics
+func InitializeBreakerMetrics() *BreakerMetrics {
+	return &BreakerMetrics{
+		State: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "store_circuit_breaker_state",
+		}),
+		Rejected: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "store_circuit_breaker_rejected",
+		}),
+		LastKnownGoodServed: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "get_service_last_known_good_served",
+		}),
+		Staleness: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "get_service_last_known_good_staleness_seconds",
+		}),
+	}
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var breakerMetrics = InitializeBreakerMetrics()
+
+func newTestBreaker(inner Store, config BreakerConfig) (*breaker, *clock) {
+	b := NewBreaker(inner, config, breakerMetrics).(*breaker)
+	clk := &clock{t: time.Unix(1000, 0)}
+	b.now = clk.now
+	return b, clk
+}
+
+func TestBreaker_OpensAndServesLastKnownGood(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil).Once()
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return(nil, transientErr).Times(3)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.2:8081"}}, nil)
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.2:8081"}, time.Duration(0)).Return(nil)
+	b, clk := newTestBreaker(mockStore, BreakerConfig{FailureThreshold: 2, OpenTimeout: 10 * time.Second})
+	served := testutil.ToFloat64(breakerMetrics.LastKnownGoodServed)
+	rejected := testutil.ToFloat64(breakerMetrics.Rejected)
+
+	// getService returns instances along with their staleness
+	getService := func() ([]storage.Instance, time.Duration, error) {
+		var staleness time.Duration
+		res, err := b.GetService(WithStaleness(context.Background(), &staleness), storage.DefaultNamespace, "service")
+		return res, staleness, err
+	}
+	_, staleness, err := getService()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), staleness)
+
+	// failures while closed fall back to last known good data too
+	clk.t = clk.t.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		res, staleness, err := getService()
+		assert.NoError(t, err)
+		assert.Equal(t, []storage.Instance{{Host: "192.0.0.1:8081"}}, res)
+		assert.Equal(t, time.Second, staleness)
+	}
+	assert.Equal(t, float64(stateOpen), testutil.ToFloat64(breakerMetrics.State))
+	assert.Equal(t, 1.0, testutil.ToFloat64(breakerMetrics.Staleness))
+
+	// open breaker does not reach storage at all
+	clk.t = clk.t.Add(5 * time.Second)
+	_, staleness, err = getService()
+	assert.NoError(t, err)
+	assert.Equal(t, 6*time.Second, staleness)
+	assert.Equal(t, ErrCircuitOpen, b.Register(context.Background(), storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.2:8081"}, 0))
+	_, err = b.GetService(context.Background(), storage.DefaultNamespace, "unknown-service")
+	assert.True(t, IsCircuitOpen(err))
+	mockStore.AssertNumberOfCalls(t, "GetService", 3)
+	assert.Equal(t, rejected+3, testutil.ToFloat64(breakerMetrics.Rejected))
+
+	// failing half-open probe opens breaker again
+	clk.t = clk.t.Add(10 * time.Second)
+	_, staleness, err = getService()
+	assert.NoError(t, err)
+	assert.Equal(t, 16*time.Second, staleness)
+	assert.Equal(t, float64(stateOpen), testutil.ToFloat64(breakerMetrics.State))
+	mockStore.AssertNumberOfCalls(t, "GetService", 4)
+
+	// succeeding probe closes it
+	clk.t = clk.t.Add(10 * time.Second)
+	res, staleness, err := getService()
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.2:8081"}}, res)
+	assert.Equal(t, time.Duration(0), staleness)
+	assert.Equal(t, float64(stateClosed), testutil.ToFloat64(breakerMetrics.State))
+	assert.Equal(t, 0.0, testutil.ToFloat64(breakerMetrics.Staleness))
+	assert.NoError(t, b.Register(context.Background(), storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.2:8081"}, 0))
+	assert.Equal(t, served+4, testutil.ToFloat64(breakerMetrics.LastKnownGoodServed))
+}
+
+func TestBreaker_HalfOpenLetsSingleProbeThrough(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("ListServices", mock.Anything, storage.DefaultNamespace, "", "", 0).Return(nil, "", transientErr)
+	b, clk := newTestBreaker(mockStore, BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Second})
+
+	_, _, err := b.ListServices(context.Background(), storage.DefaultNamespace, "", "", 0)
+	assert.True(t, storage.IsTransient(err))
+	clk.t = clk.t.Add(time.Second)
+	allowed, probe := b.allow()
+	assert.True(t, allowed && probe)
+	allowed, _ = b.allow()
+	assert.False(t, allowed)
+	b.record(context.Background(), nil, true)
+	allowed, probe = b.allow()
+	assert.True(t, allowed)
+	assert.False(t, probe)
+}
+
+func TestBreaker_PermanentErrorsDoNotTrip(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil).Once()
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return(nil, errors.New("Service Name not found"))
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "", storage.Instance{}, time.Duration(0)).Return(&ValidationError{Field: "service name"})
+	b, _ := newTestBreaker(mockStore, BreakerConfig{FailureThreshold: 1})
+
+	_, err := b.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.NoError(t, err)
+	// a service known to be gone is not served from last known good data
+	_, err = b.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.EqualError(t, err, "Service Name not found")
+	assert.True(t, IsValidationError(b.Register(context.Background(), storage.DefaultNamespace, "", storage.Instance{}, 0)))
+	assert.Equal(t, stateClosed, b.state)
+	_, err = b.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.EqualError(t, err, "Service Name not found")
+}
+
+func TestBreaker_BoundsLastKnownGood(t *testing.T) {
+	mockStore := &mocks.Store{}
+	for _, service := range []string{"service-a", "service-b", "service-c"} {
+		mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, service).Return([]storage.Instance{{Host: "192.0.0.1:8081"}, {Host: "192.0.0.2:8081"}}, nil)
+	}
+	mockStore.On("Deregister", mock.Anything, storage.DefaultNamespace, "service-c", mock.Anything).Return(nil)
+	mockStore.On("UpdateService", mock.Anything, storage.DefaultNamespace, "service-c", "delete", mock.Anything, time.Duration(0)).Return(nil)
+	b, _ := newTestBreaker(mockStore, BreakerConfig{FailureThreshold: 1, MaxEntries: 2})
+	remembered := func(service string) bool {
+		_, ok := b.lastKnownGood[serviceKey{storage.DefaultNamespace, service}]
+		return ok
+	}
+
+	for _, service := range []string{"service-a", "service-b", "service-a", "service-c"} {
+		_, err := b.GetService(context.Background(), storage.DefaultNamespace, service)
+		assert.NoError(t, err)
+	}
+	// least recently read service is evicted
+	assert.True(t, remembered("service-a"))
+	assert.False(t, remembered("service-b"))
+	assert.True(t, remembered("service-c"))
+	assert.Equal(t, 2, b.lru.Len())
+
+	// deregistered hosts are dropped, along with the service once its last host is gone
+	assert.NoError(t, b.Deregister(context.Background(), storage.DefaultNamespace, "service-c", "192.0.0.1:8081"))
+	lkg := b.lastKnownGood[serviceKey{storage.DefaultNamespace, "service-c"}].Value.(*lastKnownGood)
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.2:8081"}}, lkg.instances)
+	assert.NoError(t, b.UpdateService(context.Background(), storage.DefaultNamespace, "service-c", "delete", storage.Instance{Host: "192.0.0.2:8081"}, 0))
+	assert.False(t, remembered("service-c"))
+	assert.Equal(t, 1, b.lru.Len())
+}
+
+func TestCache_SkipsStaleInstances(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Run(func(args mock.Arguments) {
+		RecordStaleness(args.Get(0).(context.Context), time.Second)
+	}).Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil)
+	c, _ := newTestCache(mockStore, CacheConfig{TTL: time.Minute})
+
+	var staleness time.Duration
+	c.GetService(WithStaleness(context.Background(), &staleness), storage.DefaultNamespace, "service")
+	c.GetService(context.Background(), storage.DefaultNamespace, "service")
+	mockStore.AssertNumberOfCalls(t, "GetService", 2)
+	// staleness is passed on to callers of the cache
+	assert.Equal(t, time.Second, staleness)
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
+)
+
+// CacheConfig defines read-through cache of GetService, zero fields fall back to DefaultCacheConfig
+// ServeStale returns expired entries (up to MaxStale past expiration, zero is unbounded)
+// when the inner Store fails transiently or its breaker is open
+type CacheConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	TTL        time.Duration `yaml:"ttl"`
+	MaxEntries int           `yaml:"maxentries"`
+	ServeStale bool          `yaml:"servestale"`
+	MaxStale   time.Duration `yaml:"maxstale"`
+}
+
+// DefaultCacheConfig is used for fields left unset
+var DefaultCacheConfig = CacheConfig{
+	TTL:        5 * time.Second,
+	MaxEntries: 10000,
+}
+
+func (c CacheConfig) merge(defaults CacheConfig) CacheConfig {
+	if c.TTL <= 0 {
+		c.TTL = defaults.TTL
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = defaults.MaxEntries
+	}
+	return c
+}
+
+// Cache is a Store caching GetService of the Store it wraps
+type Cache interface {
+	Store
+	// SetConfig replaces TTL, MaxEntries and stale serving, Enabled is ignored
+	SetConfig(config CacheConfig)
+}
+
+type cache struct {
+	Store   Store
+	Metrics *CacheMetrics
+	config  CacheConfig
+	now     func() time.Time
+
+	lock sync.Mutex
+	// entries maps service to its element in lru, most recently used first
+	entries map[serviceKey]*list.Element
+	lru     *list.List
+	// generation is bumped on every invalidation so reads racing a write don't cache what they read
+	generation uint64
+}
+
+type cacheEntry struct {
+	key       serviceKey
+	instances []storage.Instance
+	expiresAt time.Time
+}
+
+// NewCache initializes read-through cache of GetService in front of store,
+// entries are invalidated by writes going through it and expire after TTL otherwise
+func NewCache(store Store, config CacheConfig, metrics *CacheMetrics) Cache {
+	return &cache{
+		Store:   store,
+		Metrics: metrics,
+		config:  config.merge(DefaultCacheConfig),
+		now:     time.Now,
+		entries: make(map[serviceKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// GetService returns cached instances of service, fetching them from inner Store once expired
+func (c *cache) GetService(ctx context.Context, namespace, serviceName string) ([]storage.Instance, error) {
+	key := serviceKey{namespace, serviceName}
+	c.lock.Lock()
+	e, found := c.lookup(key)
+	now := c.now()
+	if found && now.Before(e.expiresAt) {
+		res := copyInstances(e.instances)
+		c.lock.Unlock()
+		c.Metrics.Hits.Inc()
+		return res, nil
+	}
+	generation := c.generation
+	c.lock.Unlock()
+	c.Metrics.Misses.Inc()
+
+	var staleness time.Duration
+	instances, err := c.Store.GetService(WithStaleness(ctx, &staleness), namespace, serviceName)
+	RecordStaleness(ctx, staleness)
+	c.lock.Lock()
+	// anything read before a write went through is not worth keeping or serving
+	current := generation == c.generation
+	if err != nil {
+		if IsNotFound(err) && found && current {
+			// the hosts expired or were deregistered through another server
+			c.remove(key)
+		}
+		stale := found && current && c.servesStale(e, now, err)
+		c.lock.Unlock()
+		if stale {
+			c.Metrics.Stale.Inc()
+			return copyInstances(e.instances), nil
+		}
+		return nil, err
+	}
+	// last known good data served while storage is unavailable is not cached, so it keeps aging
+	if current && staleness == 0 {
+		c.put(key, copyInstances(instances), c.now().Add(c.config.TTL))
+	}
+	c.lock.Unlock()
+	return instances, nil
+}
+
+// SetConfig replaces config, entries already cached keep their expiration and ones over MaxEntries are evicted
+func (c *cache) SetConfig(config CacheConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	config.Enabled = c.config.Enabled
+	c.config = config.merge(DefaultCacheConfig)
+	c.evict()
+}
+
+// servesStale tells whether expired e is still served instead of err, only storage being unavailable is
+// worth hiding, errors telling the service is gone or the request is wrong are not. Caller must hold lock.
+func (c *cache) servesStale(e *cacheEntry, now time.Time, err error) bool {
+	if !storage.IsTransient(err) && !IsCircuitOpen(err) {
+		return false
+	}
+	return c.config.ServeStale && (c.config.MaxStale <= 0 || now.Before(e.expiresAt.Add(c.config.MaxStale)))
+}
+
+// Register fires inner Store and invalidates the service
+func (c *cache) Register(ctx context.Context, namespace, serviceName string, instance storage.Instance, ttl time.Duration) error {
+	defer c.invalidate(serviceKey{namespace, serviceName})
+	return c.Store.Register(ctx, namespace, serviceName, instance, ttl)
+}
+
+// Deregister fires inner Store and invalidates the service
+func (c *cache) Deregister(ctx context.Context, namespace, serviceName, host string) error {
+	defer c.invalidate(serviceKey{namespace, serviceName})
+	return c.Store.Deregister(ctx, namespace, serviceName, host)
+}
+
+// UpdateService fires inner Store and invalidates the service
+func (c *cache) UpdateService(ctx context.Context, namespace, serviceName, operation string, instance storage.Instance, ttl time.Duration) error {
+	defer c.invalidate(serviceKey{namespace, serviceName})
+	return c.Store.UpdateService(ctx, namespace, serviceName, operation, instance, ttl)
+}
+
+// WatchService fires inner Store and invalidates the service before passing each event on,
+// so watchers re-reading the service see changes made through other servers
+func (c *cache) WatchService(ctx context.Context, namespace, serviceName string) (<-chan storage.Event, error) {
+	events, err := c.Store.WatchService(ctx, namespace, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	res := make(chan storage.Event)
+	go func() {
+		defer close(res)
+		for event := range events {
+			c.invalidate(serviceKey{namespace, serviceName})
+			select {
+			case res <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+// ListServices fires inner Store
+func (c *cache) ListServices(ctx context.Context, namespace, prefix, pageToken string, pageSize int) ([]string, string, error) {
+	return c.Store.ListServices(ctx, namespace, prefix, pageToken, pageSize)
+}
+
+// lookup returns entry of service and marks it as recently used, caller must hold lock
+func (c *cache) lookup(key serviceKey) (*cacheEntry, bool) {
+	elem, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry), true
+}
+
+// put stores entry of service evicting least recently used ones over MaxEntries, caller must hold lock
+func (c *cache) put(key serviceKey, instances []storage.Instance, expiresAt time.Time) {
+	if elem, found := c.entries[key]; found {
+		elem.Value = &cacheEntry{key: key, instances: instances, expiresAt: expiresAt}
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, instances: instances, expiresAt: expiresAt})
+	c.evict()
+}
+
+// evict removes least recently used entries over MaxEntries, caller must hold lock
+func (c *cache) evict() {
+	for c.lru.Len() > c.config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.Metrics.Evictions.Inc()
+	}
+}
+
+func (c *cache) invalidate(key serviceKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.remove(key)
+}
+
+// remove drops entry of service, caller must hold lock
+func (c *cache) remove(key serviceKey) {
+	if elem, found := c.entries[key]; found {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// copyInstances keeps callers annotating returned instances from touching cached ones
+func copyInstances(instances []storage.Instance) []storage.Instance {
+	if instances == nil {
+		return nil
+	}
+	res := make([]storage.Instance, len(instances))
+	copy(res, instances)
+	return res
+}
@@ -0,0 +1,32 @@
+package store
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CacheMetrics defines all metrics for cache
+type CacheMetrics struct {
+	Hits      prometheus.Counter
+	Misses    prometheus.Counter
+	Stale     prometheus.Counter
+	Evictions prometheus.Counter
+}
+
+// InitializeCacheMetrics initialize cache metrics
+func InitializeCacheMetrics() *CacheMetrics {
+	return &CacheMetrics{
+		Hits: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "get_service_cache_hits",
+		}),
+		Misses: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "get_service_cache_misses",
+		}),
+		Stale: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "get_service_cache_stale",
+		}),
+		Evictions: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "get_service_cache_evictions",
+		}),
+	}
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var cacheMetrics = InitializeCacheMetrics()
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newTestCache(inner Store, config CacheConfig) (*cache, *clock) {
+	c := NewCache(inner, config, cacheMetrics).(*cache)
+	clk := &clock{t: time.Unix(1000, 0)}
+	c.now = clk.now
+	return c, clk
+}
+
+func TestCache_GetService(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("new error"))
+	c, clk := newTestCache(mockStore, CacheConfig{TTL: time.Second})
+	hits := testutil.ToFloat64(cacheMetrics.Hits)
+	misses := testutil.ToFloat64(cacheMetrics.Misses)
+
+	for i := 0; i < 3; i++ {
+		res, err := c.GetService(context.Background(), storage.DefaultNamespace, "valid-service")
+		assert.NoError(t, err)
+		assert.Equal(t, []storage.Instance{{Host: "192.0.0.1:8081"}}, res)
+		if i > 0 {
+			// callers may annotate what they get back from cache
+			res[0].HealthStatus = storage.HealthHealthy
+		}
+	}
+	mockStore.AssertNumberOfCalls(t, "GetService", 1)
+	assert.Equal(t, hits+2, testutil.ToFloat64(cacheMetrics.Hits))
+	assert.Equal(t, misses+1, testutil.ToFloat64(cacheMetrics.Misses))
+
+	clk.t = clk.t.Add(time.Second)
+	res, err := c.GetService(context.Background(), storage.DefaultNamespace, "valid-service")
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.1:8081"}}, res)
+	mockStore.AssertNumberOfCalls(t, "GetService", 2)
+
+	// errors are not cached
+	_, err = c.GetService(context.Background(), storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	_, err = c.GetService(context.Background(), storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	mockStore.AssertNumberOfCalls(t, "GetService", 4)
+}
+
+func TestCache_InvalidatesOnWrite(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil).Once()
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}, {Host: "192.0.0.2:8081"}}, nil).Once()
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.2:8081"}}, nil).Once()
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{}, nil).Once()
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.2:8081"}, time.Duration(0)).Return(nil)
+	mockStore.On("Deregister", mock.Anything, storage.DefaultNamespace, "service", "192.0.0.1:8081").Return(nil)
+	mockStore.On("UpdateService", mock.Anything, storage.DefaultNamespace, "service", "delete", storage.Instance{Host: "192.0.0.2:8081"}, time.Duration(0)).Return(errors.New("new error"))
+	c, _ := newTestCache(mockStore, CacheConfig{TTL: time.Minute})
+
+	res, _ := c.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.Len(t, res, 1)
+	assert.NoError(t, c.Register(context.Background(), storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.2:8081"}, 0))
+	res, _ = c.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.Len(t, res, 2)
+	assert.NoError(t, c.Deregister(context.Background(), storage.DefaultNamespace, "service", "192.0.0.1:8081"))
+	res, _ = c.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.2:8081"}}, res)
+	// a failed write may still have been applied
+	assert.Error(t, c.UpdateService(context.Background(), storage.DefaultNamespace, "service", "delete", storage.Instance{Host: "192.0.0.2:8081"}, 0))
+	res, _ = c.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.Equal(t, []storage.Instance{}, res)
+	mockStore.AssertNumberOfCalls(t, "GetService", 4)
+}
+
+func TestCache_ServeStale(t *testing.T) {
+	tests := []struct {
+		description string
+		config      CacheConfig
+		elapsed     time.Duration
+		err         error
+		expectStale bool
+	}{
+		{
+			description: "stale disabled",
+			config:      CacheConfig{TTL: time.Second},
+			elapsed:     2 * time.Second,
+			err:         storage.Transient(errors.New("backend down")),
+		},
+		{
+			description: "unbounded stale",
+			config:      CacheConfig{TTL: time.Second, ServeStale: true},
+			elapsed:     time.Hour,
+			err:         storage.Transient(errors.New("backend down")),
+			expectStale: true,
+		},
+		{
+			description: "within max stale",
+			config:      CacheConfig{TTL: time.Second, ServeStale: true, MaxStale: time.Minute},
+			elapsed:     30 * time.Second,
+			err:         storage.Transient(errors.New("backend down")),
+			expectStale: true,
+		},
+		{
+			description: "past max stale",
+			config:      CacheConfig{TTL: time.Second, ServeStale: true, MaxStale: time.Minute},
+			elapsed:     2 * time.Minute,
+			err:         storage.Transient(errors.New("backend down")),
+		},
+		{
+			description: "breaker open",
+			config:      CacheConfig{TTL: time.Second, ServeStale: true},
+			elapsed:     2 * time.Second,
+			err:         ErrCircuitOpen,
+			expectStale: true,
+		},
+		{
+			description: "permanent error",
+			config:      CacheConfig{TTL: time.Second, ServeStale: true},
+			elapsed:     2 * time.Second,
+			err:         errors.New("access denied"),
+		},
+		{
+			description: "service gone",
+			config:      CacheConfig{TTL: time.Second, ServeStale: true},
+			elapsed:     2 * time.Second,
+			err:         storage.ErrKeyNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			mockStore := &mocks.Store{}
+			mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil).Once()
+			mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return(nil, test.err)
+			c, clk := newTestCache(mockStore, test.config)
+			stale := testutil.ToFloat64(cacheMetrics.Stale)
+
+			_, err := c.GetService(context.Background(), storage.DefaultNamespace, "service")
+			assert.NoError(t, err)
+			clk.t = clk.t.Add(test.elapsed)
+			res, err := c.GetService(context.Background(), storage.DefaultNamespace, "service")
+			if test.expectStale {
+				assert.NoError(t, err)
+				assert.Equal(t, []storage.Instance{{Host: "192.0.0.1:8081"}}, res)
+				assert.Equal(t, stale+1, testutil.ToFloat64(cacheMetrics.Stale))
+			} else {
+				assert.Equal(t, test.err, err)
+				assert.Equal(t, stale, testutil.ToFloat64(cacheMetrics.Stale))
+			}
+			_, cached := c.entries[serviceKey{storage.DefaultNamespace, "service"}]
+			assert.Equal(t, !IsNotFound(test.err), cached)
+		})
+	}
+}
+
+func TestCache_MaxEntries(t *testing.T) {
+	mockStore := &mocks.Store{}
+	for _, name := range []string{"a", "b", "c"} {
+		mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, name).Return([]storage.Instance{{Host: name + ":80"}}, nil)
+	}
+	c, _ := newTestCache(mockStore, CacheConfig{TTL: time.Minute, MaxEntries: 2})
+	evictions := testutil.ToFloat64(cacheMetrics.Evictions)
+
+	c.GetService(context.Background(), storage.DefaultNamespace, "a")
+	c.GetService(context.Background(), storage.DefaultNamespace, "b")
+	// a is now most recently used, so c evicts b
+	c.GetService(context.Background(), storage.DefaultNamespace, "a")
+	c.GetService(context.Background(), storage.DefaultNamespace, "c")
+	assert.Equal(t, evictions+1, testutil.ToFloat64(cacheMetrics.Evictions))
+	c.GetService(context.Background(), storage.DefaultNamespace, "a")
+	c.GetService(context.Background(), storage.DefaultNamespace, "c")
+	mockStore.AssertNumberOfCalls(t, "GetService", 3)
+	c.GetService(context.Background(), storage.DefaultNamespace, "b")
+	mockStore.AssertNumberOfCalls(t, "GetService", 4)
+}
+
+func TestCache_SetConfig(t *testing.T) {
+	mockStore := &mocks.Store{}
+	for _, name := range []string{"a", "b", "c"} {
+		mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, name).Return([]storage.Instance{{Host: name + ":80"}}, nil)
+	}
+	c, clk := newTestCache(mockStore, CacheConfig{Enabled: true, TTL: time.Minute})
+	for _, name := range []string{"a", "b", "c"} {
+		c.GetService(context.Background(), storage.DefaultNamespace, name)
+	}
+
+	// shrinking evicts least recently used entries right away, a new ttl applies to entries cached from now on
+	c.SetConfig(CacheConfig{TTL: time.Second, MaxEntries: 2})
+	assert.True(t, c.config.Enabled)
+	assert.Equal(t, 2, c.lru.Len())
+	c.GetService(context.Background(), storage.DefaultNamespace, "a")
+	mockStore.AssertNumberOfCalls(t, "GetService", 4)
+	clk.t = clk.t.Add(2 * time.Second)
+	c.GetService(context.Background(), storage.DefaultNamespace, "a")
+	mockStore.AssertNumberOfCalls(t, "GetService", 5)
+	c.GetService(context.Background(), storage.DefaultNamespace, "c")
+	mockStore.AssertNumberOfCalls(t, "GetService", 5)
+}
+
+func TestCache_InvalidatesOnWatchEvent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan storage.Event)
+	mockStore := &mocks.Store{}
+	mockStore.On("WatchService", ctx, storage.DefaultNamespace, "service").Return((<-chan storage.Event)(events), nil)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil).Once()
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "service").Return([]storage.Instance{{Host: "192.0.0.2:8081"}}, nil).Once()
+	c, _ := newTestCache(mockStore, CacheConfig{TTL: time.Minute})
+
+	watch, err := c.WatchService(ctx, storage.DefaultNamespace, "service")
+	assert.NoError(t, err)
+	res, _ := c.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.1:8081"}}, res)
+	event := storage.Event{Type: storage.EventAdd, Key: "service", Value: "192.0.0.2:8081"}
+	events <- event
+	assert.Equal(t, event, <-watch)
+	res, _ = c.GetService(context.Background(), storage.DefaultNamespace, "service")
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.2:8081"}}, res)
+
+	close(events)
+	_, ok := <-watch
+	assert.False(t, ok)
+}
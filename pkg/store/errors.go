@@ -0,0 +1,81 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+)
+
+// ValidationError is returned when a request is rejected before reaching storage,
+// servers report it as a client error (400 / InvalidArgument)
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", e.Field, e.Reason)
+}
+
+// IsValidationError tells whether cause of err is a ValidationError
+func IsValidationError(err error) bool {
+	_, ok := errors.Cause(err).(*ValidationError)
+	return ok
+}
+
+// IsNotFound tells whether cause of err is a service holding no hosts, which readers may treat as empty
+func IsNotFound(err error) bool {
+	return errors.Cause(err) == storage.ErrKeyNotFound
+}
+
+// namespaces end up in storage keys and envoy cluster names, so they are kept to lower case dns labels
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+func validateNamespace(namespace string) error {
+	if !namespacePattern.MatchString(namespace) {
+		return &ValidationError{Field: "namespace", Reason: fmt.Sprintf("%q is not a lower case dns label", namespace)}
+	}
+	return nil
+}
+
+func validateServiceName(serviceName string) error {
+	if serviceName == "" {
+		return &ValidationError{Field: "service name", Reason: "must not be empty"}
+	}
+	return nil
+}
+
+func requireHost(host string) error {
+	if host == "" {
+		return &ValidationError{Field: "host", Reason: "must not be empty"}
+	}
+	return nil
+}
+
+// ValidateTTL rejects negative ttl, 0 is the only ttl meaning never expires
+func ValidateTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return &ValidationError{Field: "ttl", Reason: fmt.Sprintf("%v is negative", ttl)}
+	}
+	return nil
+}
+
+// validateHost requires host:port with a non-empty host and a port in 1-65535
+func validateHost(host string) error {
+	h, rawPort, err := net.SplitHostPort(host)
+	if err != nil {
+		return &ValidationError{Field: "host", Reason: fmt.Sprintf("%q is not host:port", host)}
+	}
+	if h == "" {
+		return &ValidationError{Field: "host", Reason: fmt.Sprintf("%q has no host", host)}
+	}
+	if port, err := strconv.ParseUint(rawPort, 10, 16); err != nil || port == 0 {
+		return &ValidationError{Field: "host", Reason: fmt.Sprintf("%q has invalid port", host)}
+	}
+	return nil
+}
@@ -1,7 +1,35 @@
 package store
 
-// Store defines interface
+import (
+	"context"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
+)
+
+// Store defines interface, every call gives up once ctx is done
+// services live in a namespace, names only have to be unique within it, invalid namespaces
+// are rejected with a *ValidationError (see ValidateNamespace)
+// Register stores instance under service, replacing metadata of an existing host,
+// hosts registered with a non-zero ttl expire unless renewed (or registered) again
+// Deregister removes host from service
+// UpdateService supports "add" (Register), "delete" (Deregister) and "renew" operations
+// invalid service names, hosts or operations are rejected with a *ValidationError
+// WatchService streams hosts added to/removed from service until ctx is done
+// ListServices returns a page of service names starting with prefix in lexical order,
+// pass the returned page token to get the next page, it is empty on the last page
 type Store interface {
-	GetService(serviceName string) ([]string, error)
-	UpdateService(serviceName, operation, Host string) error
+	GetService(ctx context.Context, namespace, serviceName string) ([]storage.Instance, error)
+	Register(ctx context.Context, namespace, serviceName string, instance storage.Instance, ttl time.Duration) error
+	Deregister(ctx context.Context, namespace, serviceName, host string) error
+	UpdateService(ctx context.Context, namespace, serviceName, operation string, instance storage.Instance, ttl time.Duration) error
+	WatchService(ctx context.Context, namespace, serviceName string) (<-chan storage.Event, error)
+	ListServices(ctx context.Context, namespace, prefix, pageToken string, pageSize int) ([]string, string, error)
 }
+
+const (
+	// DefaultPageSize is used by ListServices when page size is not set
+	DefaultPageSize = 100
+	// MaxPageSize caps page size of ListServices
+	MaxPageSize = 1000
+)
@@ -2,29 +2,51 @@
 
 package mocks
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	context "context"
+
+	mock "github.com/stretchr/testify/mock"
+
+	storage "github.com/guanw/ct-dns/storage"
+
+	time "time"
+)
 
 // Store is an autogenerated mock type for the Store type
 type Store struct {
 	mock.Mock
 }
 
-// GetService provides a mock function with given fields: serviceName
-func (_m *Store) GetService(serviceName string) ([]string, error) {
-	ret := _m.Called(serviceName)
+// Deregister provides a mock function with given fields: ctx, namespace, serviceName, host
+func (_m *Store) Deregister(ctx context.Context, namespace string, serviceName string, host string) error {
+	ret := _m.Called(ctx, namespace, serviceName, host)
 
-	var r0 []string
-	if rf, ok := ret.Get(0).(func(string) []string); ok {
-		r0 = rf(serviceName)
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) error); ok {
+		r0 = rf(ctx, namespace, serviceName, host)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetService provides a mock function with given fields: ctx, namespace, serviceName
+func (_m *Store) GetService(ctx context.Context, namespace string, serviceName string) ([]storage.Instance, error) {
+	ret := _m.Called(ctx, namespace, serviceName)
+
+	var r0 []storage.Instance
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) []storage.Instance); ok {
+		r0 = rf(ctx, namespace, serviceName)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]string)
+			r0 = ret.Get(0).([]storage.Instance)
 		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(serviceName)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, namespace, serviceName)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -32,16 +54,83 @@ func (_m *Store) GetService(serviceName string) ([]string, error) {
 	return r0, r1
 }
 
-// UpdateService provides a mock function with given fields: serviceName, operation, Host
-func (_m *Store) UpdateService(serviceName string, operation string, Host string) error {
-	ret := _m.Called(serviceName, operation, Host)
+// ListServices provides a mock function with given fields: ctx, namespace, prefix, pageToken, pageSize
+func (_m *Store) ListServices(ctx context.Context, namespace string, prefix string, pageToken string, pageSize int) ([]string, string, error) {
+	ret := _m.Called(ctx, namespace, prefix, pageToken, pageSize)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, int) []string); ok {
+		r0 = rf(ctx, namespace, prefix, pageToken, pageSize)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, int) string); ok {
+		r1 = rf(ctx, namespace, prefix, pageToken, pageSize)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, string, string, int) error); ok {
+		r2 = rf(ctx, namespace, prefix, pageToken, pageSize)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// Register provides a mock function with given fields: ctx, namespace, serviceName, instance, ttl
+func (_m *Store) Register(ctx context.Context, namespace string, serviceName string, instance storage.Instance, ttl time.Duration) error {
+	ret := _m.Called(ctx, namespace, serviceName, instance, ttl)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, string) error); ok {
-		r0 = rf(serviceName, operation, Host)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, storage.Instance, time.Duration) error); ok {
+		r0 = rf(ctx, namespace, serviceName, instance, ttl)
 	} else {
 		r0 = ret.Error(0)
 	}
 
 	return r0
 }
+
+// UpdateService provides a mock function with given fields: ctx, namespace, serviceName, operation, instance, ttl
+func (_m *Store) UpdateService(ctx context.Context, namespace string, serviceName string, operation string, instance storage.Instance, ttl time.Duration) error {
+	ret := _m.Called(ctx, namespace, serviceName, operation, instance, ttl)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, storage.Instance, time.Duration) error); ok {
+		r0 = rf(ctx, namespace, serviceName, operation, instance, ttl)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// WatchService provides a mock function with given fields: ctx, namespace, serviceName
+func (_m *Store) WatchService(ctx context.Context, namespace string, serviceName string) (<-chan storage.Event, error) {
+	ret := _m.Called(ctx, namespace, serviceName)
+
+	var r0 <-chan storage.Event
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) <-chan storage.Event); ok {
+		r0 = rf(ctx, namespace, serviceName)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(<-chan storage.Event)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, namespace, serviceName)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -0,0 +1,32 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/guanw/ct-dns/storage"
+)
+
+// clusterNameSeparator splits namespace from service in envoy cluster names, namespaces never contain it
+const clusterNameSeparator = "/"
+
+// serviceKey identifies a service across namespaces
+type serviceKey struct {
+	namespace   string
+	serviceName string
+}
+
+// ClusterName returns envoy cluster name of service, services of the default namespace keep their bare name
+func ClusterName(namespace, serviceName string) string {
+	if namespace == storage.DefaultNamespace {
+		return serviceName
+	}
+	return namespace + clusterNameSeparator + serviceName
+}
+
+// ParseClusterName splits envoy cluster name built by ClusterName into namespace and service
+func ParseClusterName(clusterName string) (string, string) {
+	if i := strings.Index(clusterName, clusterNameSeparator); i > 0 && validateNamespace(clusterName[:i]) == nil {
+		return clusterName[:i], clusterName[i+1:]
+	}
+	return storage.DefaultNamespace, clusterName
+}
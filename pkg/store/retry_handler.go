@@ -1,47 +1,232 @@
 package store
 
 import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// RetryPolicy defines how retry handler retries errors marked transient by storage.Transient,
+// the n-th retry waits BaseBackoff*2^(n-1) capped at MaxBackoff, shortened by up to Jitter
+// (a fraction of the backoff) at random, no attempt is started once Deadline has passed
+// and calls are cancelled once it is reached, AttemptTimeout bounds every single attempt
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"maxattempts"`
+	BaseBackoff    time.Duration `yaml:"basebackoff"`
+	MaxBackoff     time.Duration `yaml:"maxbackoff"`
+	Jitter         float64       `yaml:"jitter"`
+	Deadline       time.Duration `yaml:"deadline"`
+	AttemptTimeout time.Duration `yaml:"attempttimeout"`
+}
+
+// DefaultRetryPolicy is used for fields left unset
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	BaseBackoff:    50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Jitter:         0.2,
+	Deadline:       5 * time.Second,
+	AttemptTimeout: 2 * time.Second,
+}
+
+func (p RetryPolicy) merge(defaults RetryPolicy) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = defaults.BaseBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if p.MaxBackoff < p.BaseBackoff {
+		p.MaxBackoff = p.BaseBackoff
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if p.Deadline <= 0 {
+		p.Deadline = defaults.Deadline
+	}
+	if p.AttemptTimeout <= 0 {
+		p.AttemptTimeout = defaults.AttemptTimeout
+	}
+	return p
+}
+
+// backoff returns how long to wait before retry number retry (starting at 1)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff - time.Duration(p.Jitter*rand.Float64()*float64(backoff))
+}
+
+// RetryHandler is a Store retrying transient errors of the Store it wraps
+type RetryHandler interface {
+	Store
+	// SetPolicy replaces RetryPolicy, calls already running keep the one they started with
+	SetPolicy(policy RetryPolicy)
+}
+
 type retryHandler struct {
-	Store             Store
-	MaximumRetryTimes int
-	Metrics           *Metrics
+	Store   Store
+	Metrics *Metrics
+	now     func() time.Time
+	sleep   func(context.Context, time.Duration) error
+
+	lock   sync.Mutex
+	policy RetryPolicy
 }
 
 // NewRetryHandler initializes RetryHandler
-func NewRetryHandler(maximumRetryTimes int, store Store, metrics *Metrics) Store {
+func NewRetryHandler(policy RetryPolicy, store Store, metrics *Metrics) RetryHandler {
 	return &retryHandler{
-		MaximumRetryTimes: maximumRetryTimes,
-		Store:             store,
-		Metrics:           metrics,
+		policy:  policy.merge(DefaultRetryPolicy),
+		Store:   store,
+		Metrics: metrics,
+		now:     time.Now,
+		sleep:   sleep,
 	}
 }
 
-// GetService fires inner Store maximum times until succeeded
-func (r *retryHandler) GetService(serviceName string) ([]string, error) {
-	var err error
-	var res []string
-	for i := 0; i < r.MaximumRetryTimes; i++ {
-		if res, err = r.Store.GetService(serviceName); err == nil {
-			return res, nil
-		}
-		r.Metrics.GetServiceRetryAttempts.Inc()
+// SetPolicy replaces RetryPolicy, unset fields fall back to DefaultRetryPolicy
+func (r *retryHandler) SetPolicy(policy RetryPolicy) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.policy = policy.merge(DefaultRetryPolicy)
+}
+
+func (r *retryHandler) currentPolicy() RetryPolicy {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.policy
+}
+
+// sleep waits for d unless ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	r.Metrics.GetServiceRetryExhausted.Inc()
-	return nil, errors.Wrap(err, "Failed to GetService with RetryHandler")
 }
 
-// UpdateService fires inner Store maximum times until succeeded
-func (r *retryHandler) UpdateService(serviceName, operation, Host string) error {
+// do runs attempt until it succeeds, fails with an error not marked transient, ctx is done
+// or the policy is exhausted, attempts and exhausted may be nil for operations not counted there
+func (r *retryHandler) do(ctx context.Context, operation string, attempts, exhausted prometheus.Counter, attempt func(context.Context) error) error {
+	policy := r.currentPolicy()
+	ctx, cancel := context.WithTimeout(ctx, policy.Deadline)
+	defer cancel()
+	deadline := r.now().Add(policy.Deadline)
 	var err error
-	for i := 0; i < r.MaximumRetryTimes; i++ {
-		if err = r.Store.UpdateService(serviceName, operation, Host); err == nil {
-			return nil
+	for i := 1; ; i++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, policy.AttemptTimeout)
+		attemptStart := r.now()
+		err = attempt(attemptCtx)
+		cancelAttempt()
+		r.Metrics.AttemptDuration.WithLabelValues(operation, outcome(err)).Observe(r.now().Sub(attemptStart).Seconds())
+		if err == nil || !storage.IsTransient(err) {
+			return err
+		}
+		if attempts != nil {
+			attempts.Inc()
+		}
+		if i >= policy.MaxAttempts || ctx.Err() != nil {
+			break
+		}
+		backoff := policy.backoff(i)
+		if !r.now().Add(backoff).Before(deadline) {
+			break
 		}
-		r.Metrics.PostServiceRetryAttempts.Inc()
+		if r.sleep(ctx, backoff) != nil {
+			break
+		}
+	}
+	if exhausted != nil {
+		exhausted.Inc()
+	}
+	return errors.Wrapf(err, "Failed to %s with RetryHandler", operation)
+}
+
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case storage.IsTransient(err):
+		return "transient"
+	default:
+		return "permanent"
 	}
-	r.Metrics.PostServiceRetryExhausted.Inc()
-	return errors.Wrap(err, "Failed to PostService with RetryHandler")
+}
+
+// GetService fires inner Store until succeeded or retry policy is exhausted
+func (r *retryHandler) GetService(ctx context.Context, namespace, serviceName string) ([]storage.Instance, error) {
+	var res []storage.Instance
+	err := r.do(ctx, "GetService", r.Metrics.GetServiceRetryAttempts, r.Metrics.GetServiceRetryExhausted, func(ctx context.Context) error {
+		var err error
+		res, err = r.Store.GetService(ctx, namespace, serviceName)
+		return err
+	})
+	return res, err
+}
+
+// UpdateService fires inner Store until succeeded or retry policy is exhausted
+func (r *retryHandler) UpdateService(ctx context.Context, namespace, serviceName, operation string, instance storage.Instance, ttl time.Duration) error {
+	return r.do(ctx, "PostService", r.Metrics.PostServiceRetryAttempts, r.Metrics.PostServiceRetryExhausted, func(ctx context.Context) error {
+		return r.Store.UpdateService(ctx, namespace, serviceName, operation, instance, ttl)
+	})
+}
+
+// Register fires inner Store until succeeded or retry policy is exhausted
+func (r *retryHandler) Register(ctx context.Context, namespace, serviceName string, instance storage.Instance, ttl time.Duration) error {
+	return r.do(ctx, "Register", r.Metrics.PostServiceRetryAttempts, r.Metrics.PostServiceRetryExhausted, func(ctx context.Context) error {
+		return r.Store.Register(ctx, namespace, serviceName, instance, ttl)
+	})
+}
+
+// Deregister fires inner Store until succeeded or retry policy is exhausted
+func (r *retryHandler) Deregister(ctx context.Context, namespace, serviceName, host string) error {
+	return r.do(ctx, "Deregister", r.Metrics.PostServiceRetryAttempts, r.Metrics.PostServiceRetryExhausted, func(ctx context.Context) error {
+		return r.Store.Deregister(ctx, namespace, serviceName, host)
+	})
+}
+
+// WatchService fires inner Store until watch is established or retry policy is exhausted
+func (r *retryHandler) WatchService(ctx context.Context, namespace, serviceName string) (<-chan storage.Event, error) {
+	var events <-chan storage.Event
+	// the watch lives as long as ctx of the caller, not just the attempt establishing it
+	err := r.do(ctx, "WatchService", nil, nil, func(context.Context) error {
+		var err error
+		events, err = r.Store.WatchService(ctx, namespace, serviceName)
+		return err
+	})
+	return events, err
+}
+
+// ListServices fires inner Store until succeeded or retry policy is exhausted
+func (r *retryHandler) ListServices(ctx context.Context, namespace, prefix, pageToken string, pageSize int) ([]string, string, error) {
+	var res []string
+	var next string
+	err := r.do(ctx, "ListServices", nil, nil, func(ctx context.Context) error {
+		var err error
+		res, next, err = r.Store.ListServices(ctx, namespace, prefix, pageToken, pageSize)
+		return err
+	})
+	return res, next, err
 }
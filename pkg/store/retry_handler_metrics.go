@@ -12,6 +12,9 @@ type Metrics struct {
 
 	PostServiceRetryAttempts  prometheus.Counter
 	PostServiceRetryExhausted prometheus.Counter
+
+	// AttemptDuration is labelled by operation and outcome (success, transient or permanent)
+	AttemptDuration *prometheus.HistogramVec
 }
 
 // InitializeMetrics initialize retry metrics
@@ -29,5 +32,9 @@ func InitializeMetrics() *Metrics {
 		PostServiceRetryExhausted: promauto.NewCounter(prometheus.CounterOpts{
 			Name: "update_service_retry_exhausted",
 		}),
+		AttemptDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "store_attempt_duration_seconds",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation", "outcome"}),
 	}
 }
@@ -1,24 +1,44 @@
 package store
 
 import (
-	"errors"
+	"context"
 	"testing"
+	"time"
 
 	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 var (
 	metrics      = InitializeMetrics()
 	maximumRetry = 10
+	policy       = RetryPolicy{MaxAttempts: maximumRetry, Deadline: time.Minute}
+	transientErr = storage.Transient(errors.New("new error"))
 )
 
+// newTestRetryHandler returns retry handler recording backoffs instead of sleeping, time only passes when sleeping
+func newTestRetryHandler(policy RetryPolicy, store Store) (*retryHandler, *[]time.Duration) {
+	r := NewRetryHandler(policy, store, metrics).(*retryHandler)
+	var sleeps []time.Duration
+	clk := &clock{t: time.Unix(1000, 0)}
+	r.now = clk.now
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		clk.t = clk.t.Add(d)
+		return ctx.Err()
+	}
+	return r, &sleeps
+}
+
 func TestRetryHandler_GetService(t *testing.T) {
 	mockStore := &mocks.Store{}
-	mockStore.On("GetService", "valid-service").Return([]string{"192.0.0.1:8081"}, nil)
-	mockStore.On("GetService", "error-service").Return(nil, errors.New("new error"))
-	retryHandler := NewRetryHandler(maximumRetry, mockStore, metrics)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8081"}}, nil)
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, transientErr)
+	retryHandler, _ := newTestRetryHandler(policy, mockStore)
 	tests := []struct {
 		ExpectError            bool
 		ServiceName            string
@@ -39,7 +59,7 @@ func TestRetryHandler_GetService(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		_, err := retryHandler.GetService(test.ServiceName)
+		_, err := retryHandler.GetService(context.Background(), storage.DefaultNamespace, test.ServiceName)
 		if test.ExpectError {
 			assert.Error(t, err)
 		} else {
@@ -52,9 +72,9 @@ func TestRetryHandler_GetService(t *testing.T) {
 
 func TestRetryHandler_PostService(t *testing.T) {
 	mockStore := &mocks.Store{}
-	mockStore.On("UpdateService", "service", "add", "192.0.0.1:8081").Return(nil)
-	mockStore.On("UpdateService", "service", "invalid-operation", "xxx").Return(errors.New("new error"))
-	retryHandler := NewRetryHandler(maximumRetry, mockStore, metrics)
+	mockStore.On("UpdateService", mock.Anything, storage.DefaultNamespace, "service", "add", storage.Instance{Host: "192.0.0.1:8081"}, time.Duration(0)).Return(nil)
+	mockStore.On("UpdateService", mock.Anything, storage.DefaultNamespace, "service", "invalid-operation", storage.Instance{Host: "xxx"}, time.Duration(0)).Return(transientErr)
+	retryHandler, _ := newTestRetryHandler(policy, mockStore)
 	tests := []struct {
 		ExpectError            bool
 		ServiceName            string
@@ -81,7 +101,7 @@ func TestRetryHandler_PostService(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		err := retryHandler.UpdateService(test.ServiceName, test.Operation, test.Host)
+		err := retryHandler.UpdateService(context.Background(), storage.DefaultNamespace, test.ServiceName, test.Operation, storage.Instance{Host: test.Host}, 0)
 		if test.ExpectError {
 			assert.Error(t, err)
 		} else {
@@ -91,3 +111,161 @@ func TestRetryHandler_PostService(t *testing.T) {
 		assert.Equal(t, test.ExpectedRetryExhausted, testutil.ToFloat64(metrics.PostServiceRetryExhausted))
 	}
 }
+
+func TestRetryHandler_RegisterDeregister(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.1:8081"}, time.Duration(0)).Return(transientErr).Once()
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.1:8081"}, time.Duration(0)).Return(nil)
+	mockStore.On("Register", mock.Anything, storage.DefaultNamespace, "", storage.Instance{Host: "192.0.0.1:8081"}, time.Duration(0)).Return(&ValidationError{Field: "service name"})
+	mockStore.On("Deregister", mock.Anything, storage.DefaultNamespace, "service", "192.0.0.1:8081").Return(nil)
+	mockStore.On("Deregister", mock.Anything, storage.DefaultNamespace, "service", "").Return(errors.Wrap(&ValidationError{Field: "host"}, "wrapped"))
+	retryHandler, _ := newTestRetryHandler(policy, mockStore)
+	attempts := testutil.ToFloat64(metrics.PostServiceRetryAttempts)
+
+	assert.NoError(t, retryHandler.Register(context.Background(), storage.DefaultNamespace, "service", storage.Instance{Host: "192.0.0.1:8081"}, 0))
+	assert.Equal(t, attempts+1, testutil.ToFloat64(metrics.PostServiceRetryAttempts))
+	assert.True(t, IsValidationError(retryHandler.Register(context.Background(), storage.DefaultNamespace, "", storage.Instance{Host: "192.0.0.1:8081"}, 0)))
+	assert.NoError(t, retryHandler.Deregister(context.Background(), storage.DefaultNamespace, "service", "192.0.0.1:8081"))
+	assert.True(t, IsValidationError(retryHandler.Deregister(context.Background(), storage.DefaultNamespace, "service", "")))
+	mockStore.AssertNumberOfCalls(t, "Register", 3)
+	mockStore.AssertNumberOfCalls(t, "Deregister", 2)
+	assert.Equal(t, attempts+1, testutil.ToFloat64(metrics.PostServiceRetryAttempts))
+}
+
+func TestRetryHandler_WatchService(t *testing.T) {
+	ctx := context.Background()
+	events := make(chan storage.Event)
+	mockStore := &mocks.Store{}
+	mockStore.On("WatchService", ctx, storage.DefaultNamespace, "valid-service").Return(nil, transientErr).Once()
+	mockStore.On("WatchService", ctx, storage.DefaultNamespace, "valid-service").Return((<-chan storage.Event)(events), nil)
+	mockStore.On("WatchService", ctx, storage.DefaultNamespace, "error-service").Return(nil, transientErr)
+	retryHandler, _ := newTestRetryHandler(policy, mockStore)
+
+	res, err := retryHandler.WatchService(ctx, storage.DefaultNamespace, "valid-service")
+	assert.NoError(t, err)
+	assert.Equal(t, (<-chan storage.Event)(events), res)
+	_, err = retryHandler.WatchService(ctx, storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	mockStore.AssertNumberOfCalls(t, "WatchService", 2+maximumRetry)
+}
+
+func TestRetryHandler_ListServices(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("ListServices", mock.Anything, storage.DefaultNamespace, "valid-", "", 10).Return(nil, "", transientErr).Once()
+	mockStore.On("ListServices", mock.Anything, storage.DefaultNamespace, "valid-", "", 10).Return([]string{"valid-service"}, "valid-service", nil)
+	mockStore.On("ListServices", mock.Anything, storage.DefaultNamespace, "error-", "", 10).Return(nil, "", transientErr)
+	retryHandler, _ := newTestRetryHandler(policy, mockStore)
+
+	res, next, err := retryHandler.ListServices(context.Background(), storage.DefaultNamespace, "valid-", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"valid-service"}, res)
+	assert.Equal(t, "valid-service", next)
+	_, _, err = retryHandler.ListServices(context.Background(), storage.DefaultNamespace, "error-", "", 10)
+	assert.Error(t, err)
+	mockStore.AssertNumberOfCalls(t, "ListServices", 2+maximumRetry)
+}
+
+func TestRetryHandler_PermanentErrors(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "missing-service").Return(nil, errors.Wrap(errors.New("key not found"), "Service Name not found"))
+	mockStore.On("UpdateService", mock.Anything, storage.DefaultNamespace, "service", "renew", storage.Instance{Host: "192.0.0.1:8081"}, time.Minute).Return(storage.ErrInstanceNotFound)
+	retryHandler, sleeps := newTestRetryHandler(policy, mockStore)
+	attempts := testutil.ToFloat64(metrics.GetServiceRetryAttempts)
+	exhausted := testutil.ToFloat64(metrics.GetServiceRetryExhausted)
+
+	_, err := retryHandler.GetService(context.Background(), storage.DefaultNamespace, "missing-service")
+	assert.EqualError(t, err, "Service Name not found: key not found")
+	err = retryHandler.UpdateService(context.Background(), storage.DefaultNamespace, "service", "renew", storage.Instance{Host: "192.0.0.1:8081"}, time.Minute)
+	assert.Equal(t, storage.ErrInstanceNotFound, err)
+	mockStore.AssertNumberOfCalls(t, "GetService", 1)
+	mockStore.AssertNumberOfCalls(t, "UpdateService", 1)
+	assert.Empty(t, *sleeps)
+	assert.Equal(t, attempts, testutil.ToFloat64(metrics.GetServiceRetryAttempts))
+	assert.Equal(t, exhausted, testutil.ToFloat64(metrics.GetServiceRetryExhausted))
+}
+
+func TestRetryHandler_Backoff(t *testing.T) {
+	tests := []struct {
+		description    string
+		policy         RetryPolicy
+		expectedSleeps []time.Duration
+	}{
+		{
+			description:    "exponential capped at max backoff",
+			policy:         RetryPolicy{MaxAttempts: 6, BaseBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, Deadline: time.Minute},
+			expectedSleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond},
+		},
+		{
+			description:    "no attempt past deadline",
+			policy:         RetryPolicy{MaxAttempts: 6, BaseBackoff: 10 * time.Millisecond, MaxBackoff: time.Second, Deadline: 65 * time.Millisecond},
+			expectedSleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			mockStore := &mocks.Store{}
+			mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, transientErr)
+			retryHandler, sleeps := newTestRetryHandler(test.policy, mockStore)
+
+			_, err := retryHandler.GetService(context.Background(), storage.DefaultNamespace, "error-service")
+			assert.Error(t, err)
+			assert.True(t, storage.IsTransient(err))
+			assert.Equal(t, test.expectedSleeps, *sleeps)
+			mockStore.AssertNumberOfCalls(t, "GetService", len(test.expectedSleeps)+1)
+		})
+	}
+}
+
+func TestRetryHandler_SetPolicy(t *testing.T) {
+	mockStore := &mocks.Store{}
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, transientErr)
+	retryHandler, sleeps := newTestRetryHandler(RetryPolicy{MaxAttempts: 2, BaseBackoff: 10 * time.Millisecond, Deadline: time.Minute}, mockStore)
+	_, err := retryHandler.GetService(context.Background(), storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond}, *sleeps)
+
+	// unset fields fall back to defaults
+	retryHandler.SetPolicy(RetryPolicy{MaxAttempts: 3, BaseBackoff: 20 * time.Millisecond, Deadline: time.Minute})
+	assert.Equal(t, DefaultRetryPolicy.AttemptTimeout, retryHandler.currentPolicy().AttemptTimeout)
+	*sleeps = nil
+	_, err = retryHandler.GetService(context.Background(), storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	assert.Equal(t, []time.Duration{20 * time.Millisecond, 40 * time.Millisecond}, *sleeps)
+	mockStore.AssertNumberOfCalls(t, "GetService", 5)
+}
+
+func TestRetryHandler_Context(t *testing.T) {
+	mockStore := &mocks.Store{}
+	var deadlines []bool
+	mockStore.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, transientErr).Run(func(args mock.Arguments) {
+		_, ok := args.Get(0).(context.Context).Deadline()
+		deadlines = append(deadlines, ok)
+	})
+	retryHandler, sleeps := newTestRetryHandler(policy, mockStore)
+	ctx, cancel := context.WithCancel(context.Background())
+	retryHandler.sleep = func(context.Context, time.Duration) error {
+		*sleeps = append(*sleeps, 0)
+		if len(*sleeps) == 2 {
+			cancel()
+		}
+		return ctx.Err()
+	}
+
+	_, err := retryHandler.GetService(ctx, storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	assert.Len(t, *sleeps, 2)
+	mockStore.AssertNumberOfCalls(t, "GetService", 2)
+	assert.Equal(t, []bool{true, true}, deadlines)
+
+	_, err = retryHandler.GetService(ctx, storage.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+	mockStore.AssertNumberOfCalls(t, "GetService", 3)
+}
+
+func TestRetryPolicy_Jitter(t *testing.T) {
+	p := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}.merge(DefaultRetryPolicy)
+	for i := 0; i < 100; i++ {
+		backoff := p.backoff(2)
+		assert.True(t, backoff > 100*time.Millisecond && backoff <= 200*time.Millisecond, backoff.String())
+	}
+}
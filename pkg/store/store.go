@@ -1,7 +1,11 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/guanw/ct-dns/pkg/logging"
 	storageInterface "github.com/guanw/ct-dns/storage"
@@ -9,43 +13,144 @@ import (
 )
 
 type store struct {
-	Client storageInterface.Client
+	Client     storageInterface.Client
+	classifier storageInterface.ErrorClassifier
 }
 
 // NewStore creates new store instance
 func NewStore(client storageInterface.Client) Store {
 	logging.GetLogger().Info("Creating new store...")
+	classifier, _ := client.(storageInterface.ErrorClassifier)
 	return &store{
-		Client: client,
+		Client:     client,
+		classifier: classifier,
 	}
 }
 
-func (s *store) GetService(serviceName string) ([]string, error) {
-	res, err := s.Client.Get(serviceName)
+// classify marks errors of Client worth retrying, see storage.ErrorClassifier
+func (s *store) classify(err error) error {
+	if err == nil || err == storageInterface.ErrInstanceNotFound || err == storageInterface.ErrKeyNotFound {
+		return err
+	}
+	if s.classifier != nil && !s.classifier.IsTransient(err) {
+		return err
+	}
+	return storageInterface.Transient(err)
+}
+
+func (s *store) GetService(ctx context.Context, namespace, serviceName string) ([]storageInterface.Instance, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	res, err := s.Client.Get(ctx, namespace, serviceName)
 	if err != nil {
-		return nil, errors.Wrap(err, "Service Name not found")
+		return nil, errors.Wrap(s.classify(err), "Service Name not found")
 	}
-	hosts, err := unmarshalStrToHosts(res)
+	instances, err := unmarshalStrToInstances(res)
 	if err != nil {
-		return nil, errors.Wrap(err, "UnmarshalStrToHosts failed")
+		return nil, errors.Wrap(err, "UnmarshalStrToInstances failed")
 	}
-	return hosts, nil
+	return instances, nil
 }
 
-func (s *store) UpdateService(serviceName, operation, host string) error {
-	var err error
-	if operation == "add" {
-		err = s.Client.Create(serviceName, host)
-	} else if operation == "delete" {
-		err = s.Client.Delete(serviceName, host)
+func (s *store) Register(ctx context.Context, namespace, serviceName string, instance storageInterface.Instance, ttl time.Duration) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateServiceName(serviceName); err != nil {
+		return err
 	}
-	return err
+	if err := validateHost(instance.Host); err != nil {
+		return err
+	}
+	return s.classify(s.Client.Create(ctx, namespace, serviceName, instance, ttl))
 }
 
-func unmarshalStrToHosts(input string) ([]string, error) {
-	var hosts []string
-	if err := json.Unmarshal([]byte(input), &hosts); err != nil {
+// Deregister only requires a non-empty host so hosts registered before validation can still be removed
+func (s *store) Deregister(ctx context.Context, namespace, serviceName, host string) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateServiceName(serviceName); err != nil {
+		return err
+	}
+	if err := requireHost(host); err != nil {
+		return err
+	}
+	return s.classify(s.Client.Delete(ctx, namespace, serviceName, host))
+}
+
+func (s *store) UpdateService(ctx context.Context, namespace, serviceName, operation string, instance storageInterface.Instance, ttl time.Duration) error {
+	switch operation {
+	case "add":
+		return s.Register(ctx, namespace, serviceName, instance, ttl)
+	case "delete":
+		return s.Deregister(ctx, namespace, serviceName, instance.Host)
+	case "renew":
+		if err := validateNamespace(namespace); err != nil {
+			return err
+		}
+		if err := validateServiceName(serviceName); err != nil {
+			return err
+		}
+		if err := requireHost(instance.Host); err != nil {
+			return err
+		}
+		return s.classify(s.Client.Renew(ctx, namespace, serviceName, instance.Host, ttl))
+	default:
+		return &ValidationError{Field: "operation", Reason: fmt.Sprintf("%q is not one of add, delete, renew", operation)}
+	}
+}
+
+func (s *store) WatchService(ctx context.Context, namespace, serviceName string) (<-chan storageInterface.Event, error) {
+	if err := validateNamespace(namespace); err != nil {
 		return nil, err
 	}
-	return hosts, nil
+	events, err := s.Client.Watch(ctx, namespace, serviceName)
+	if err != nil {
+		return nil, errors.Wrap(s.classify(err), "Failed to watch service")
+	}
+	return events, nil
+}
+
+// ListServices pages through service names, page token is the last name of the previous page
+func (s *store) ListServices(ctx context.Context, namespace, prefix, pageToken string, pageSize int) ([]string, string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, "", err
+	}
+	services, err := s.Client.List(ctx, namespace, prefix)
+	if err != nil {
+		return nil, "", errors.Wrap(s.classify(err), "Failed to list services")
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	start := sort.Search(len(services), func(i int) bool {
+		return services[i] > pageToken
+	})
+	end := start + pageSize
+	if end >= len(services) {
+		return services[start:], "", nil
+	}
+	return services[start:end], services[end-1], nil
+}
+
+func unmarshalStrToInstances(input string) ([]storageInterface.Instance, error) {
+	var instances []storageInterface.Instance
+	if err := json.Unmarshal([]byte(input), &instances); err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// Hosts extracts host of every instance
+func Hosts(instances []storageInterface.Instance) []string {
+	var hosts []string
+	for _, instance := range instances {
+		hosts = append(hosts, instance.Host)
+	}
+	return hosts
 }
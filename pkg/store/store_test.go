@@ -1,29 +1,34 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
+	storageInterface "github.com/guanw/ct-dns/storage"
 	"github.com/guanw/ct-dns/storage/mocks"
+	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func Test_GetService(t *testing.T) {
 	mockClient := &mocks.Client{}
-	mockClient.On("Get", "dummy-service").Return(`["192.0.0.1"]`, nil)
-	mockClient.On("Get", "non-exist-service").Return("", nil)
-	mockClient.On("Get", "error-service").Return("", errors.New("not found"))
+	mockClient.On("Get", mock.Anything, storageInterface.DefaultNamespace, "dummy-service").Return(`[{"host":"192.0.0.1","zone":"us-east-1a"}]`, nil)
+	mockClient.On("Get", mock.Anything, storageInterface.DefaultNamespace, "non-exist-service").Return("", nil)
+	mockClient.On("Get", mock.Anything, storageInterface.DefaultNamespace, "error-service").Return("", errors.New("not found"))
 	store := NewStore(mockClient)
 
 	tests := []struct {
 		expectedErr      bool
-		expectedResponse []string
+		expectedResponse []storageInterface.Instance
 		serviceName      string
 	}{
 		{
 			serviceName:      "dummy-service",
 			expectedErr:      false,
-			expectedResponse: []string{"192.0.0.1"},
+			expectedResponse: []storageInterface.Instance{{Host: "192.0.0.1", Zone: "us-east-1a"}},
 		},
 		{
 			serviceName: "non-exist-service",
@@ -36,7 +41,7 @@ func Test_GetService(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		hosts, err := store.GetService(test.serviceName)
+		hosts, err := store.GetService(context.Background(), storageInterface.DefaultNamespace, test.serviceName)
 		if test.expectedErr {
 			assert.Error(t, err)
 		} else {
@@ -48,34 +53,156 @@ func Test_GetService(t *testing.T) {
 
 func Test_ServiceAddNewHost(t *testing.T) {
 	mockClient := &mocks.Client{}
-	mockClient.On("Create", "dummy-service", "192.0.0.1").Return(nil)
+	instance := storageInterface.Instance{Host: "192.0.0.1:8080", Weight: 2, Canary: true}
+	mockClient.On("Create", mock.Anything, storageInterface.DefaultNamespace, "dummy-service", instance, 10*time.Second).Return(nil)
 	store := NewStore(mockClient)
 
-	err := store.UpdateService("dummy-service", "add", "192.0.0.1")
+	err := store.UpdateService(context.Background(), storageInterface.DefaultNamespace, "dummy-service", "add", instance, 10*time.Second)
 	assert.NoError(t, err)
 }
 
 func Test_ServiceDeleteHost(t *testing.T) {
 	mockClient := &mocks.Client{}
-	mockClient.On("Delete", "dummy-service", "192.0.0.1").Return(nil)
+	mockClient.On("Delete", mock.Anything, storageInterface.DefaultNamespace, "dummy-service", "192.0.0.1").Return(nil)
 	store := NewStore(mockClient)
 
-	err := store.UpdateService("dummy-service", "delete", "192.0.0.1")
+	err := store.UpdateService(context.Background(), storageInterface.DefaultNamespace, "dummy-service", "delete", storageInterface.Instance{Host: "192.0.0.1"}, 0)
 	assert.NoError(t, err)
 }
 
-func Test_unmarshalStrToHosts(t *testing.T) {
+func Test_ServiceValidation(t *testing.T) {
+	mockClient := &mocks.Client{}
+	store := NewStore(mockClient)
+	tests := []struct {
+		serviceName string
+		operation   string
+		host        string
+		field       string
+	}{
+		{serviceName: "dummy-service", operation: "Add", host: "192.0.0.1:8080", field: "operation"},
+		{serviceName: "dummy-service", operation: "", host: "192.0.0.1:8080", field: "operation"},
+		{serviceName: "", operation: "add", host: "192.0.0.1:8080", field: "service name"},
+		{serviceName: "", operation: "delete", host: "192.0.0.1:8080", field: "service name"},
+		{serviceName: "", operation: "renew", host: "192.0.0.1:8080", field: "service name"},
+		{serviceName: "dummy-service", operation: "add", host: "192.0.0.1", field: "host"},
+		{serviceName: "dummy-service", operation: "add", host: ":8080", field: "host"},
+		{serviceName: "dummy-service", operation: "add", host: "192.0.0.1:0", field: "host"},
+		{serviceName: "dummy-service", operation: "add", host: "192.0.0.1:99999", field: "host"},
+		{serviceName: "dummy-service", operation: "add", host: "192.0.0.1:http", field: "host"},
+		{serviceName: "dummy-service", operation: "delete", host: "", field: "host"},
+		{serviceName: "dummy-service", operation: "renew", host: "", field: "host"},
+	}
+	for _, test := range tests {
+		err := store.UpdateService(context.Background(), storageInterface.DefaultNamespace, test.serviceName, test.operation, storageInterface.Instance{Host: test.host}, 0)
+		assert.True(t, IsValidationError(err), test)
+		assert.Equal(t, test.field, err.(*ValidationError).Field)
+	}
+	mockClient.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "Renew", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_NamespaceValidation(t *testing.T) {
+	mockClient := &mocks.Client{}
+	mockClient.On("Get", mock.Anything, "team-a", "dummy-service").Return(`[{"host":"192.0.0.1"}]`, nil)
+	store := NewStore(mockClient)
+
+	_, err := store.GetService(context.Background(), "team-a", "dummy-service")
+	assert.NoError(t, err)
+	for _, namespace := range []string{"", "Team-A", "team/a", "-team", "team-", "team.a"} {
+		_, err := store.GetService(context.Background(), namespace, "dummy-service")
+		assert.True(t, IsValidationError(err), namespace)
+		assert.Equal(t, "namespace", err.(*ValidationError).Field)
+		_, _, err = store.ListServices(context.Background(), namespace, "", "", 0)
+		assert.True(t, IsValidationError(err), namespace)
+	}
+	mockClient.AssertNumberOfCalls(t, "Get", 1)
+	mockClient.AssertNotCalled(t, "List", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_RegisterDeregister(t *testing.T) {
+	mockClient := &mocks.Client{}
+	instance := storageInterface.Instance{Host: "[2001:db8::1]:8080", Zone: "us-east-1a"}
+	mockClient.On("Create", mock.Anything, storageInterface.DefaultNamespace, "dummy-service", instance, time.Duration(0)).Return(nil)
+	mockClient.On("Delete", mock.Anything, storageInterface.DefaultNamespace, "dummy-service", "192.0.0.1").Return(nil)
+	store := NewStore(mockClient)
+
+	assert.NoError(t, store.Register(context.Background(), storageInterface.DefaultNamespace, "dummy-service", instance, 0))
+	assert.True(t, IsValidationError(store.Register(context.Background(), storageInterface.DefaultNamespace, "dummy-service", storageInterface.Instance{Host: "192.0.0.1"}, 0)))
+	// hosts without port registered before validation can still be removed
+	assert.NoError(t, store.Deregister(context.Background(), storageInterface.DefaultNamespace, "dummy-service", "192.0.0.1"))
+	assert.True(t, IsValidationError(store.Deregister(context.Background(), storageInterface.DefaultNamespace, "", "192.0.0.1")))
+}
+
+func Test_ServiceRenewHost(t *testing.T) {
+	mockClient := &mocks.Client{}
+	mockClient.On("Renew", mock.Anything, storageInterface.DefaultNamespace, "dummy-service", "192.0.0.1", 10*time.Second).Return(nil)
+	mockClient.On("Renew", mock.Anything, storageInterface.DefaultNamespace, "dummy-service", "192.0.0.2", 10*time.Second).Return(storageInterface.ErrInstanceNotFound)
+	store := NewStore(mockClient)
+
+	err := store.UpdateService(context.Background(), storageInterface.DefaultNamespace, "dummy-service", "renew", storageInterface.Instance{Host: "192.0.0.1"}, 10*time.Second)
+	assert.NoError(t, err)
+	err = store.UpdateService(context.Background(), storageInterface.DefaultNamespace, "dummy-service", "renew", storageInterface.Instance{Host: "192.0.0.2"}, 10*time.Second)
+	assert.Equal(t, storageInterface.ErrInstanceNotFound, err)
+}
+
+func Test_WatchService(t *testing.T) {
+	ctx := context.Background()
+	events := make(chan storageInterface.Event)
+	mockClient := &mocks.Client{}
+	mockClient.On("Watch", ctx, storageInterface.DefaultNamespace, "dummy-service").Return((<-chan storageInterface.Event)(events), nil)
+	mockClient.On("Watch", ctx, storageInterface.DefaultNamespace, "error-service").Return(nil, errors.New("watch failed"))
+	store := NewStore(mockClient)
+
+	res, err := store.WatchService(ctx, storageInterface.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, (<-chan storageInterface.Event)(events), res)
+	_, err = store.WatchService(ctx, storageInterface.DefaultNamespace, "error-service")
+	assert.Error(t, err)
+}
+
+func Test_ListServices(t *testing.T) {
+	mockClient := &mocks.Client{}
+	mockClient.On("List", mock.Anything, storageInterface.DefaultNamespace, "dummy-").Return([]string{"dummy-a", "dummy-b", "dummy-c"}, nil)
+	mockClient.On("List", mock.Anything, storageInterface.DefaultNamespace, "error-").Return(nil, errors.New("list failed"))
+	store := NewStore(mockClient)
+	tests := []struct {
+		pageToken    string
+		pageSize     int
+		expected     []string
+		expectedNext string
+	}{
+		{pageToken: "", pageSize: 0, expected: []string{"dummy-a", "dummy-b", "dummy-c"}, expectedNext: ""},
+		{pageToken: "", pageSize: 2, expected: []string{"dummy-a", "dummy-b"}, expectedNext: "dummy-b"},
+		{pageToken: "dummy-b", pageSize: 2, expected: []string{"dummy-c"}, expectedNext: ""},
+		{pageToken: "dummy-a", pageSize: 2, expected: []string{"dummy-b", "dummy-c"}, expectedNext: ""},
+		{pageToken: "dummy-c", pageSize: 2, expected: []string{}, expectedNext: ""},
+	}
+	for _, test := range tests {
+		res, next, err := store.ListServices(context.Background(), storageInterface.DefaultNamespace, "dummy-", test.pageToken, test.pageSize)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, res)
+		assert.Equal(t, test.expectedNext, next)
+	}
+	_, _, err := store.ListServices(context.Background(), storageInterface.DefaultNamespace, "error-", "", 0)
+	assert.Error(t, err)
+}
+
+func Test_unmarshalStrToInstances(t *testing.T) {
 	tests := []struct {
 		input       string
 		expectedErr bool
 		description string
-		expected    []string
+		expected    []storageInterface.Instance
 	}{
 		{
-			input:       `["192.0.0.1","192.0.0.2"]`,
+			input:       `[{"host":"192.0.0.1"},{"host":"192.0.0.2","weight":3,"tags":{"version":"v2"}}]`,
 			expectedErr: false,
-			expected:    []string{"192.0.0.1", "192.0.0.2"},
-			description: `input: "[192.0.0.1, 192.0.0.2]"`,
+			expected: []storageInterface.Instance{
+				{Host: "192.0.0.1"},
+				{Host: "192.0.0.2", Weight: 3, Tags: map[string]string{"version": "v2"}},
+			},
+			description: `input: "[{192.0.0.1}, {192.0.0.2 with metadata}]"`,
 		},
 		{
 			input:       `""`,
@@ -85,7 +212,7 @@ func Test_unmarshalStrToHosts(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
-			out, err := unmarshalStrToHosts(test.input)
+			out, err := unmarshalStrToInstances(test.input)
 			if test.expectedErr {
 				assert.Error(t, err)
 			} else {
@@ -95,3 +222,66 @@ func Test_unmarshalStrToHosts(t *testing.T) {
 		})
 	}
 }
+
+func Test_ClassifyErrors(t *testing.T) {
+	unclassified := &mocks.Client{}
+	unclassified.On("Get", mock.Anything, storageInterface.DefaultNamespace, "error-service").Return("", errors.New("connection refused"))
+	unclassified.On("Renew", mock.Anything, storageInterface.DefaultNamespace, "dummy-service", "192.0.0.1:8080", time.Minute).Return(storageInterface.ErrInstanceNotFound)
+	unclassified.On("Get", mock.Anything, storageInterface.DefaultNamespace, "missing-service").Return("", storageInterface.ErrKeyNotFound)
+	store := NewStore(unclassified)
+
+	_, err := store.GetService(context.Background(), storageInterface.DefaultNamespace, "error-service")
+	assert.True(t, storageInterface.IsTransient(err))
+	assert.False(t, IsNotFound(err))
+	// missing services are never worth retrying, even for clients not classifying errors
+	_, err = store.GetService(context.Background(), storageInterface.DefaultNamespace, "missing-service")
+	assert.True(t, IsNotFound(err))
+	assert.False(t, storageInterface.IsTransient(err))
+	err = store.UpdateService(context.Background(), storageInterface.DefaultNamespace, "dummy-service", "renew", storageInterface.Instance{Host: "192.0.0.1:8080"}, time.Minute)
+	assert.Equal(t, storageInterface.ErrInstanceNotFound, err)
+	err = store.Register(context.Background(), storageInterface.DefaultNamespace, "", storageInterface.Instance{Host: "192.0.0.1:8080"}, 0)
+	assert.False(t, storageInterface.IsTransient(err))
+
+	classified := &classifyingClient{Client: &mocks.Client{}, transient: errors.New("connection refused")}
+	classified.Client.On("Get", mock.Anything, storageInterface.DefaultNamespace, "error-service").Return("", classified.transient)
+	classified.Client.On("Get", mock.Anything, storageInterface.DefaultNamespace, "missing-service").Return("", storageInterface.ErrKeyNotFound)
+	store = NewStore(classified)
+
+	_, err = store.GetService(context.Background(), storageInterface.DefaultNamespace, "error-service")
+	assert.True(t, storageInterface.IsTransient(err))
+	assert.Equal(t, classified.transient, pkgerrors.Cause(err))
+	_, err = store.GetService(context.Background(), storageInterface.DefaultNamespace, "missing-service")
+	assert.Error(t, err)
+	assert.False(t, storageInterface.IsTransient(err))
+}
+
+type classifyingClient struct {
+	*mocks.Client
+	transient error
+}
+
+func (c *classifyingClient) IsTransient(err error) bool {
+	return err == c.transient
+}
+
+func Test_ClusterName(t *testing.T) {
+	tests := []struct {
+		namespace   string
+		serviceName string
+		clusterName string
+	}{
+		{namespace: storageInterface.DefaultNamespace, serviceName: "dummy-service", clusterName: "dummy-service"},
+		{namespace: "team-a", serviceName: "dummy-service", clusterName: "team-a/dummy-service"},
+		{namespace: "team-a", serviceName: "api/v2", clusterName: "team-a/api/v2"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.clusterName, ClusterName(test.namespace, test.serviceName))
+		namespace, serviceName := ParseClusterName(test.clusterName)
+		assert.Equal(t, test.namespace, namespace)
+		assert.Equal(t, test.serviceName, serviceName)
+	}
+	// cluster names whose prefix is no namespace belong to the default namespace
+	namespace, serviceName := ParseClusterName("Team-A/dummy-service")
+	assert.Equal(t, storageInterface.DefaultNamespace, namespace)
+	assert.Equal(t, "Team-A/dummy-service", serviceName)
+}
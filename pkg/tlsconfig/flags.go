@@ -0,0 +1,11 @@
+package tlsconfig
+
+import "flag"
+
+// AddFlags binds flags overriding TLS of the http and grpc listeners
+func AddFlags(flagSet *flag.FlagSet) {
+	flagSet.String("tls-cert-file", "", "--tls-cert-file <path> of server certificate, enables TLS on http and grpc ports")
+	flagSet.String("tls-key-file", "", "--tls-key-file <path> of server key")
+	flagSet.String("tls-client-ca-file", "", "--tls-client-ca-file <path> of ca bundle verifying client certificates (mTLS)")
+	flagSet.Bool("tls-require-client-cert", false, "--tls-require-client-cert rejects clients without a verified certificate")
+}
@@ -0,0 +1,192 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+// Config defines TLS of a listener, TLS is off while CertFile is empty
+// ClientCAFile turns on mTLS, client certificates are then verified against it and
+// required when RequireClientCert is set, otherwise only verified when presented
+type Config struct {
+	CertFile          string `yaml:"certfile"`
+	KeyFile           string `yaml:"keyfile"`
+	ClientCAFile      string `yaml:"clientcafile"`
+	RequireClientCert bool   `yaml:"requireclientcert"`
+	// ReloadInterval is how often files are checked for changes
+	ReloadInterval time.Duration `yaml:"reloadinterval"`
+}
+
+// DefaultReloadInterval is used when ReloadInterval is not set
+const DefaultReloadInterval = 30 * time.Second
+
+// Enabled tells whether listener serves TLS
+func (c Config) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// Reloader serves certificate and client CA of Config, reloading them once their files change
+type Reloader struct {
+	config Config
+
+	lock     sync.RWMutex
+	current  *tls.Config
+	modTimes map[string]time.Time
+}
+
+// NewReloader loads files of config, failing if any of them cannot be used
+func NewReloader(config Config) (*Reloader, error) {
+	if config.KeyFile == "" {
+		return nil, errors.New("TLS needs both certificate and key file")
+	}
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = DefaultReloadInterval
+	}
+	r := &Reloader{config: config}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns config handing out the latest loaded certificate and client CA to every handshake,
+// nextProtos are offered over ALPN (h2 for grpc, h2 and http/1.1 for http)
+func (r *Reloader) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return &r.current.Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			config := r.current.Clone()
+			r.lock.RUnlock()
+			config.NextProtos = nextProtos
+			return config, nil
+		},
+	}
+}
+
+// Run checks files every ReloadInterval until ctx is done, a broken update keeps serving the previous files
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				logging.GetLogger().WithError(err).Error("Failed to reload TLS certificate, serving the previous one")
+				continue
+			}
+			logging.GetLogger().WithField("cert", r.config.CertFile).Info("Reloaded TLS certificate")
+		}
+	}
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+// changed tells whether modification time of any file differs from the one last loaded
+func (r *Reloader) changed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return errors.Wrap(err, "Failed to stat TLS file")
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load TLS certificate")
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.config.ClientCAFile != "" {
+		pool, err := certPool(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.config.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	r.lock.Lock()
+	r.current = config
+	r.modTimes = modTimes
+	r.lock.Unlock()
+	return nil
+}
+
+func certPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read CA file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("No certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// ClientConfig returns TLS config of a storage client, certFile/keyFile present a client certificate
+// and caFile replaces system roots verifying the server
+func ClientConfig(certFile, keyFile, caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load TLS client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := certPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
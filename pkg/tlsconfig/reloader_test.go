@@ -0,0 +1,212 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate signed by parent, self-signed when parent is nil
+func issue(t *testing.T, serial int64, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// serve accepts TLS connections with config, completing handshakes and sending verified client names
+func serve(t *testing.T, config *tls.Config) (string, func()) {
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				name := "anonymous"
+				if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+					name = chains[0][0].Subject.CommonName
+				}
+				tlsConn.Write([]byte(name))
+			}
+			tlsConn.Close()
+		}
+	}()
+	return lis.Addr().String(), func() { lis.Close() }
+}
+
+// dial returns serial of server certificate and name the server verified the client as
+func dial(t *testing.T, addr string, roots *x509.CertPool, client *testCert) (int64, string, error) {
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		// sent even when server would not accept its issuer
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert := client.tlsCertificate()
+			return &cert, nil
+		}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	name, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(name) == 0 {
+		return 0, "", os.ErrClosed
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), string(name), nil
+}
+
+func Test_Reloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	ca := issue(t, 1, "ca", nil)
+	ca.write(t, caFile, "")
+	issue(t, 2, "server", ca).write(t, certFile, keyFile)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ReloadInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	addr, stop := serve(t, r.TLSConfig())
+	defer stop()
+
+	serial, name, err := dial(t, addr, roots, issue(t, 3, "deployer", ca))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), serial)
+	assert.Equal(t, "deployer", name)
+	// client certificates are optional unless required, but have to be signed by the client CA
+	_, name, err = dial(t, addr, roots, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "anonymous", name)
+	_, _, err = dial(t, addr, roots, issue(t, 4, "intruder", nil))
+	assert.Error(t, err)
+
+	issue(t, 5, "server", ca).write(t, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	assert.Eventually(t, func() bool {
+		serial, _, err := dial(t, addr, roots, nil)
+		return err == nil && serial == 5
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// a broken update keeps serving the previous certificate
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	serial, _, err = dial(t, addr, roots, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), serial)
+}
+
+func Test_RequireClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	ca := issue(t, 1, "ca", nil)
+	ca.write(t, caFile, "")
+	issue(t, 2, "server", ca).write(t, certFile, keyFile)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, RequireClientCert: true})
+	assert.NoError(t, err)
+	addr, stop := serve(t, r.TLSConfig())
+	defer stop()
+	_, _, err = dial(t, addr, roots, nil)
+	assert.Error(t, err)
+	_, name, err := dial(t, addr, roots, issue(t, 3, "deployer", ca))
+	assert.NoError(t, err)
+	assert.Equal(t, "deployer", name)
+
+	_, err = NewReloader(Config{CertFile: certFile})
+	assert.Error(t, err)
+	_, err = NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile})
+	assert.Error(t, err)
+}
+
+func Test_ClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	ca := issue(t, 1, "ca", nil)
+	ca.write(t, caFile, "")
+	issue(t, 2, "client", ca).write(t, certFile, keyFile)
+
+	config, err := ClientConfig(certFile, keyFile, caFile, false)
+	assert.NoError(t, err)
+	assert.Len(t, config.Certificates, 1)
+	assert.NotNil(t, config.RootCAs)
+	config, err = ClientConfig("", "", "", true)
+	assert.NoError(t, err)
+	assert.True(t, config.InsecureSkipVerify)
+	assert.Nil(t, config.RootCAs)
+	_, err = ClientConfig(certFile, "", "", false)
+	assert.Error(t, err)
+}
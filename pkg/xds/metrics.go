@@ -0,0 +1,51 @@
+package xds
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics defines all metrics for xds server
+type Metrics struct {
+	StreamOpened prometheus.Counter
+
+	ResponseSuccess prometheus.Counter
+	ResponseFailure prometheus.Counter
+
+	RequestAck         prometheus.Counter
+	RequestNack        prometheus.Counter
+	RequestUnsupported prometheus.Counter
+
+	FetchSuccess prometheus.Counter
+	FetchFailure prometheus.Counter
+}
+
+// InitializeMetrics initialize xds metrics
+func InitializeMetrics() *Metrics {
+	return &Metrics{
+		StreamOpened: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_stream_opened",
+		}),
+		ResponseSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_response_success",
+		}),
+		ResponseFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_response_failure",
+		}),
+		RequestAck: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_request_ack",
+		}),
+		RequestNack: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_request_nack",
+		}),
+		RequestUnsupported: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_request_unsupported",
+		}),
+		FetchSuccess: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_fetch_success",
+		}),
+		FetchFailure: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "xds_handler_fetch_failure",
+		}),
+	}
+}
@@ -0,0 +1,407 @@
+package xds
+
+import (
+	"context"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EndpointType is the type url of v3 cluster load assignments
+const EndpointType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+const defaultRetryInterval = 5 * time.Second
+
+// errNoAssignment is returned while store fails for a service no assignment is known of yet
+var errNoAssignment = errors.New("Store unavailable for cluster load assignment")
+
+// Server implements v3 EDS and ADS, every service in store is served as a cluster
+// load assignment named by store.ClusterName
+type Server struct {
+	Store   store.Store
+	Metrics *Metrics
+	// RetryInterval is how long a closed store watch waits before resubscribing
+	RetryInterval time.Duration
+}
+
+// NewServer creates new xds Server
+func NewServer(store store.Store, metrics *Metrics) *Server {
+	return &Server{
+		Store:         store,
+		Metrics:       metrics,
+		RetryInterval: defaultRetryInterval,
+	}
+}
+
+type stream interface {
+	Context() context.Context
+	Send(*discovery.DiscoveryResponse) error
+	Recv() (*discovery.DiscoveryRequest, error)
+}
+
+// StreamEndpoints implements EndpointDiscoveryServiceServer.StreamEndpoints
+func (s *Server) StreamEndpoints(stream endpointservice.EndpointDiscoveryService_StreamEndpointsServer) error {
+	return s.process(stream, EndpointType)
+}
+
+// DeltaEndpoints implements EndpointDiscoveryServiceServer.DeltaEndpoints
+func (s *Server) DeltaEndpoints(endpointservice.EndpointDiscoveryService_DeltaEndpointsServer) error {
+	return status.Error(codes.Unimplemented, "Incremental xDS is not supported")
+}
+
+// FetchEndpoints implements EndpointDiscoveryServiceServer.FetchEndpoints
+func (s *Server) FetchEndpoints(ctx context.Context, req *discovery.DiscoveryRequest) (*discovery.DiscoveryResponse, error) {
+	if typeURL := req.GetTypeUrl(); typeURL != "" && typeURL != EndpointType {
+		s.Metrics.FetchFailure.Inc()
+		return nil, status.Errorf(codes.InvalidArgument, "Unsupported type url %s", typeURL)
+	}
+	st := newStreamState()
+	resp, err := s.response(ctx, st, req.GetResourceNames())
+	if err == errNoAssignment {
+		s.Metrics.FetchFailure.Inc()
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		s.Metrics.FetchFailure.Inc()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.Metrics.FetchSuccess.Inc()
+	return resp, nil
+}
+
+// StreamAggregatedResources implements AggregatedDiscoveryServiceServer.StreamAggregatedResources,
+// only cluster load assignments are served, requests for other types are ignored
+func (s *Server) StreamAggregatedResources(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	return s.process(stream, "")
+}
+
+// DeltaAggregatedResources implements AggregatedDiscoveryServiceServer.DeltaAggregatedResources
+func (s *Server) DeltaAggregatedResources(discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return status.Error(codes.Unimplemented, "Incremental xDS is not supported")
+}
+
+// streamState is owned by the goroutine serving one stream
+type streamState struct {
+	names   []string
+	watches map[string]context.CancelFunc
+	// last known assignments, kept when store fails so envoy doesn't lose endpoints
+	assignments map[string]*endpoint.ClusterLoadAssignment
+	version     string
+	nonce       string
+	sent        uint64
+}
+
+func newStreamState() *streamState {
+	return &streamState{
+		watches:     make(map[string]context.CancelFunc),
+		assignments: make(map[string]*endpoint.ClusterLoadAssignment),
+	}
+}
+
+func (s *Server) process(stream stream, defaultTypeURL string) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	s.Metrics.StreamOpened.Inc()
+
+	requests := make(chan *discovery.DiscoveryRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// changed coalesces store notifications, every signal recomputes all subscribed assignments
+	changed := make(chan struct{}, 1)
+	st := newStreamState()
+	defer func() {
+		for _, stop := range st.watches {
+			stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case req := <-requests:
+			typeURL := req.GetTypeUrl()
+			if typeURL == "" {
+				typeURL = defaultTypeURL
+			}
+			if typeURL != EndpointType {
+				s.Metrics.RequestUnsupported.Inc()
+				logging.GetLogger().WithField("typeUrl", typeURL).Warn("Ignoring discovery request for unsupported type")
+				continue
+			}
+			// requests answering an older response are stale, a newer one is already on its way
+			if req.GetResponseNonce() != st.nonce {
+				continue
+			}
+			if req.GetErrorDetail() != nil {
+				s.Metrics.RequestNack.Inc()
+				logging.GetLogger().WithField("version", st.version).WithField("error", req.GetErrorDetail().GetMessage()).Warn("Envoy rejected cluster load assignments")
+			} else if st.nonce != "" {
+				s.Metrics.RequestAck.Inc()
+			}
+			if !s.subscribe(ctx, st, req.GetResourceNames(), changed) && st.nonce != "" {
+				continue
+			}
+			if err := s.push(stream, st, changed); err != nil {
+				return err
+			}
+		case <-changed:
+			if err := s.push(stream, st, changed); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// subscribe starts store watches for newly requested services and stops the ones no longer requested,
+// it reports whether the subscription changed
+func (s *Server) subscribe(ctx context.Context, st *streamState, names []string, changed chan<- struct{}) bool {
+	updated := false
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+		if _, ok := st.watches[name]; ok {
+			continue
+		}
+		updated = true
+		watchCtx, stop := context.WithCancel(ctx)
+		st.watches[name] = stop
+		go s.watch(watchCtx, name, changed)
+	}
+	for name, stop := range st.watches {
+		if !requested[name] {
+			stop()
+			delete(st.watches, name)
+			delete(st.assignments, name)
+			updated = true
+		}
+	}
+	st.names = st.names[:0]
+	for name := range requested {
+		st.names = append(st.names, name)
+	}
+	sort.Strings(st.names)
+	return updated
+}
+
+func (s *Server) watch(ctx context.Context, clusterName string, changed chan<- struct{}) {
+	namespace, serviceName := store.ParseClusterName(clusterName)
+	for {
+		events, err := s.Store.WatchService(ctx, namespace, serviceName)
+		if err == nil {
+			// the first push may have raced the subscription
+			notify(changed)
+			for range events {
+				notify(changed)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logging.GetLogger().WithError(err).WithField("cluster", clusterName).Warn("Store watch closed, resyncing")
+		// changes may have been missed while the watch was down
+		notify(changed)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.RetryInterval):
+		}
+	}
+}
+
+func notify(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+// push sends subscribed assignments when they differ from what was last sent on the stream,
+// nothing is sent while store fails for a service without known assignment, it is retried later
+func (s *Server) push(stream stream, st *streamState, changed chan<- struct{}) error {
+	resp, err := s.response(stream.Context(), st, st.names)
+	if err == errNoAssignment {
+		s.Metrics.ResponseFailure.Inc()
+		time.AfterFunc(s.RetryInterval, func() { notify(changed) })
+		return nil
+	}
+	if err != nil {
+		s.Metrics.ResponseFailure.Inc()
+		return status.Error(codes.Internal, err.Error())
+	}
+	if st.nonce != "" && resp.GetVersionInfo() == st.version {
+		return nil
+	}
+	st.sent++
+	resp.Nonce = strconv.FormatUint(st.sent, 10)
+	if err := stream.Send(resp); err != nil {
+		s.Metrics.ResponseFailure.Inc()
+		return err
+	}
+	st.version = resp.GetVersionInfo()
+	st.nonce = resp.GetNonce()
+	s.Metrics.ResponseSuccess.Inc()
+	return nil
+}
+
+// response builds assignments for names, versioned by a hash of their deterministic encoding
+func (s *Server) response(ctx context.Context, st *streamState, names []string) (*discovery.DiscoveryResponse, error) {
+	h := fnv.New64a()
+	resources := make([]*any.Any, 0, len(names))
+	for _, name := range names {
+		namespace, serviceName := store.ParseClusterName(name)
+		instances, err := s.Store.GetService(ctx, namespace, serviceName)
+		// a service nobody registered yet is served without endpoints
+		if err == nil || store.IsNotFound(err) {
+			st.assignments[name] = assignment(name, instances)
+		} else {
+			logging.GetLogger().WithError(err).WithField("cluster", name).Warn("Failed to get service for cluster load assignment")
+		}
+		cla, ok := st.assignments[name]
+		if !ok {
+			// no endpoints would make envoy drop every host it knows of
+			return nil, errNoAssignment
+		}
+		buf := proto.NewBuffer(nil)
+		// map fields (tags) are encoded in random order otherwise
+		buf.SetDeterministic(true)
+		if err := buf.Marshal(cla); err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal cluster load assignment")
+		}
+		h.Write(buf.Bytes())
+		resources = append(resources, &any.Any{TypeUrl: EndpointType, Value: buf.Bytes()})
+	}
+	return &discovery.DiscoveryResponse{
+		VersionInfo: hex.EncodeToString(h.Sum(nil)),
+		Resources:   resources,
+		TypeUrl:     EndpointType,
+	}, nil
+}
+
+// assignment groups instances sorted by host into one locality per zone, in the order zones are
+// first seen, so the same instances always make the same assignment
+func assignment(clusterName string, instances []storage.Instance) *endpoint.ClusterLoadAssignment {
+	cla := &endpoint.ClusterLoadAssignment{
+		ClusterName: clusterName,
+	}
+	instances = append([]storage.Instance(nil), instances...)
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Host < instances[j].Host
+	})
+	zoneIndex := make(map[string]int)
+	for _, instance := range instances {
+		host, port, err := splitHostPort(instance.Host)
+		if err != nil {
+			logging.GetLogger().WithError(err).WithField("host", instance.Host).Warn("Skipping host without valid port")
+			continue
+		}
+		ep := &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Protocol: core.SocketAddress_TCP,
+								Address:  host,
+								PortSpecifier: &core.SocketAddress_PortValue{
+									PortValue: port,
+								},
+							},
+						},
+					},
+				},
+			},
+			LoadBalancingWeight: &wrappers.UInt32Value{
+				Value: instance.LoadBalancingWeight(),
+			},
+			HealthStatus: healthStatus[instance.HealthStatus],
+			Metadata:     lbMetadata(instance),
+		}
+		index, found := zoneIndex[instance.Zone]
+		if !found {
+			index = len(cla.Endpoints)
+			zoneIndex[instance.Zone] = index
+			locality := &endpoint.LocalityLbEndpoints{}
+			if instance.Zone != "" {
+				locality.Locality = &core.Locality{Zone: instance.Zone}
+			}
+			cla.Endpoints = append(cla.Endpoints, locality)
+		}
+		cla.Endpoints[index].LbEndpoints = append(cla.Endpoints[index].LbEndpoints, ep)
+	}
+	return cla
+}
+
+var healthStatus = map[storage.HealthStatus]core.HealthStatus{
+	storage.HealthHealthy:   core.HealthStatus_HEALTHY,
+	storage.HealthUnhealthy: core.HealthStatus_UNHEALTHY,
+}
+
+// lbMetadata exposes tags and canary flag under envoy.lb for the subset load balancer
+func lbMetadata(instance storage.Instance) *core.Metadata {
+	if len(instance.Tags) == 0 && !instance.Canary {
+		return nil
+	}
+	fields := make(map[string]*structpb.Value, len(instance.Tags)+1)
+	for k, v := range instance.Tags {
+		fields[k] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: v}}
+	}
+	if instance.Canary {
+		fields["canary"] = &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: true}}
+	}
+	return &core.Metadata{
+		FilterMetadata: map[string]*structpb.Struct{
+			"envoy.lb": {Fields: fields},
+		},
+	}
+}
+
+func splitHostPort(raw string) (string, uint32, error) {
+	host, rawPort, err := net.SplitHostPort(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "Failed to parse port from host info")
+	}
+	return host, uint32(port), nil
+}
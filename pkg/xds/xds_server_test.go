@@ -0,0 +1,316 @@
+package xds
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/store"
+	"github.com/guanw/ct-dns/pkg/store/mocks"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufSize = 1024 * 1024
+
+var (
+	lis     *bufconn.Listener
+	metrics = InitializeMetrics()
+)
+
+func initialize(store store.Store) {
+	lis = bufconn.Listen(bufSize)
+	s := grpc.NewServer()
+	xdsServer := NewServer(store, metrics)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(s, xdsServer)
+	discovery.RegisterAggregatedDiscoveryServiceServer(s, xdsServer)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			logging.GetLogger().Fatalf("Server exited with error: %v", err)
+		}
+	}()
+}
+
+func bufDialer(context.Context, string) (net.Conn, error) {
+	return lis.Dial()
+}
+
+func dial(t *testing.T) *grpc.ClientConn {
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithContextDialer(bufDialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	return conn
+}
+
+type hostList struct {
+	lock      sync.Mutex
+	instances []storage.Instance
+}
+
+func (l *hostList) set(hosts ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.instances = nil
+	for _, host := range hosts {
+		l.instances = append(l.instances, storage.Instance{Host: host})
+	}
+}
+
+func (l *hostList) get(context.Context, string, string) []storage.Instance {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.instances
+}
+
+func unmarshalAssignments(t *testing.T, resp *discovery.DiscoveryResponse) []*endpoint.ClusterLoadAssignment {
+	var res []*endpoint.ClusterLoadAssignment
+	for _, resource := range resp.GetResources() {
+		cla := &endpoint.ClusterLoadAssignment{}
+		assert.NoError(t, ptypes.UnmarshalAny(resource, cla))
+		res = append(res, cla)
+	}
+	return res
+}
+
+func Test_StreamEndpoints(t *testing.T) {
+	hosts := &hostList{}
+	hosts.set("192.0.0.1:8080")
+	events := make(chan storage.Event, 1)
+	store := &mocks.Store{}
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return(hosts.get, nil)
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "valid-service").Return((<-chan storage.Event)(events), nil)
+	initialize(store)
+	conn := dial(t)
+	defer conn.Close()
+	client := endpointservice.NewEndpointDiscoveryServiceClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamEndpoints(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, stream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		ResourceNames: []string{"valid-service"},
+	}))
+	resp, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, EndpointType, resp.GetTypeUrl())
+	assert.Equal(t, "1", resp.GetNonce())
+	assert.NotEmpty(t, resp.GetVersionInfo())
+	assignments := unmarshalAssignments(t, resp)
+	assert.Len(t, assignments, 1)
+	assert.Equal(t, "valid-service", assignments[0].GetClusterName())
+	lbEndpoints := assignments[0].GetEndpoints()[0].GetLbEndpoints()
+	assert.Len(t, lbEndpoints, 1)
+	socketAddress := lbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress()
+	assert.Equal(t, "192.0.0.1", socketAddress.GetAddress())
+	assert.Equal(t, uint32(8080), socketAddress.GetPortValue())
+	version := resp.GetVersionInfo()
+
+	assert.NoError(t, stream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		VersionInfo:   version,
+		ResponseNonce: "1",
+		ResourceNames: []string{"valid-service"},
+	}))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.RequestAck) == 1.0
+	}, time.Second, 10*time.Millisecond)
+
+	hosts.set("192.0.0.1:8080", "192.0.0.2:8080")
+	events <- storage.Event{Type: storage.EventAdd, Key: "valid-service", Value: "192.0.0.2:8080"}
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", resp.GetNonce())
+	assert.NotEqual(t, version, resp.GetVersionInfo())
+	assignments = unmarshalAssignments(t, resp)
+	assert.Len(t, assignments[0].GetEndpoints()[0].GetLbEndpoints(), 2)
+
+	assert.NoError(t, stream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		VersionInfo:   version,
+		ResponseNonce: "2",
+		ResourceNames: []string{"valid-service"},
+		ErrorDetail:   &rpcstatus.Status{Message: "rejected"},
+	}))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.RequestNack) == 1.0
+	}, time.Second, 10*time.Millisecond)
+
+	// stale nonce is ignored, the next response is for the unsubscribe below
+	assert.NoError(t, stream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		ResponseNonce: "1",
+		ResourceNames: []string{"stale-service"},
+	}))
+	assert.NoError(t, stream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		ResponseNonce: "2",
+	}))
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "3", resp.GetNonce())
+	assert.Empty(t, resp.GetResources())
+	store.AssertNotCalled(t, "GetService", mock.Anything, storage.DefaultNamespace, "stale-service")
+}
+
+func Test_StreamAggregatedResources(t *testing.T) {
+	store := &mocks.Store{}
+	// the first read fails, the retry after the failed watch finds the service unregistered
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("storage down")).Once()
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, storage.ErrKeyNotFound)
+	store.On("WatchService", mock.Anything, storage.DefaultNamespace, "error-service").Return(nil, errors.New("watch failed"))
+	initialize(store)
+	conn := dial(t)
+	defer conn.Close()
+	client := discovery.NewAggregatedDiscoveryServiceClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamAggregatedResources(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, stream.Send(&discovery.DiscoveryRequest{
+		TypeUrl: "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+	}))
+	assert.NoError(t, stream.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		ResourceNames: []string{"error-service"},
+	}))
+	resp, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RequestUnsupported))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ResponseFailure))
+	assert.Equal(t, "1", resp.GetNonce())
+	assignments := unmarshalAssignments(t, resp)
+	assert.Len(t, assignments, 1)
+	assert.Equal(t, "error-service", assignments[0].GetClusterName())
+	assert.Empty(t, assignments[0].GetEndpoints())
+
+	delta, err := client.DeltaAggregatedResources(ctx)
+	assert.NoError(t, err)
+	_, err = delta.Recv()
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func Test_FetchEndpoints(t *testing.T) {
+	store := &mocks.Store{}
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8080"}}, nil)
+	initialize(store)
+	conn := dial(t)
+	defer conn.Close()
+	client := endpointservice.NewEndpointDiscoveryServiceClient(conn)
+
+	resp, err := client.FetchEndpoints(context.Background(), &discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		ResourceNames: []string{"valid-service"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, unmarshalAssignments(t, resp), 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.FetchSuccess))
+
+	_, err = client.FetchEndpoints(context.Background(), &discovery.DiscoveryRequest{
+		TypeUrl: "type.googleapis.com/envoy.config.listener.v3.Listener",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.FetchFailure))
+}
+
+func Test_assignment(t *testing.T) {
+	cla := assignment("dummy-service", []storage.Instance{
+		{Host: "192.0.0.1:8080"},
+		{Host: "[2001:db8::1]:8081"},
+		{Host: "192.0.0.2"},
+		{Host: "192.0.0.3:port"},
+		{Host: "192.0.0.5:8080", HealthStatus: storage.HealthUnhealthy},
+		{Host: "192.0.0.4:8080", Zone: "us-east-1a", Weight: 5, Canary: true, Tags: map[string]string{"version": "v2"}},
+	})
+	assert.Equal(t, "dummy-service", cla.GetClusterName())
+	assert.Len(t, cla.GetEndpoints(), 2)
+	lbEndpoints := cla.GetEndpoints()[0].GetLbEndpoints()
+	assert.Nil(t, cla.GetEndpoints()[0].GetLocality())
+	assert.Len(t, lbEndpoints, 3)
+	// endpoints are sorted by host
+	assert.Equal(t, core.HealthStatus_UNKNOWN, lbEndpoints[0].GetHealthStatus())
+	assert.Equal(t, core.HealthStatus_UNHEALTHY, lbEndpoints[1].GetHealthStatus())
+	assert.Equal(t, "2001:db8::1", lbEndpoints[2].GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+	assert.Equal(t, uint32(8081), lbEndpoints[2].GetEndpoint().GetAddress().GetSocketAddress().GetPortValue())
+	assert.Equal(t, uint32(1), lbEndpoints[2].GetLoadBalancingWeight().GetValue())
+	assert.Nil(t, lbEndpoints[2].GetMetadata())
+
+	assert.Equal(t, "us-east-1a", cla.GetEndpoints()[1].GetLocality().GetZone())
+	zoned := cla.GetEndpoints()[1].GetLbEndpoints()[0]
+	assert.Equal(t, uint32(5), zoned.GetLoadBalancingWeight().GetValue())
+	lb := zoned.GetMetadata().GetFilterMetadata()["envoy.lb"].GetFields()
+	assert.Equal(t, "v2", lb["version"].GetStringValue())
+	assert.True(t, lb["canary"].GetBoolValue())
+
+	assert.Empty(t, assignment("dummy-service", nil).GetEndpoints())
+}
+
+func Test_FetchNamespacedEndpoints(t *testing.T) {
+	store := &mocks.Store{}
+	store.On("GetService", mock.Anything, "team-a", "valid-service").Return([]storage.Instance{{Host: "192.0.0.1:8080"}}, nil)
+	initialize(store)
+	conn := dial(t)
+	defer conn.Close()
+	client := endpointservice.NewEndpointDiscoveryServiceClient(conn)
+
+	resp, err := client.FetchEndpoints(context.Background(), &discovery.DiscoveryRequest{
+		TypeUrl:       EndpointType,
+		ResourceNames: []string{"team-a/valid-service"},
+	})
+	assert.NoError(t, err)
+	assignments := unmarshalAssignments(t, resp)
+	assert.Len(t, assignments, 1)
+	assert.Equal(t, "team-a/valid-service", assignments[0].GetClusterName())
+	assert.Len(t, assignments[0].GetEndpoints()[0].GetLbEndpoints(), 1)
+}
+
+func Test_responseVersion(t *testing.T) {
+	instances := []storage.Instance{
+		{Host: "192.0.0.1:8080", Zone: "us-east-1a", Tags: map[string]string{"version": "v2", "track": "stable", "team": "a"}},
+		{Host: "192.0.0.2:8080", Zone: "us-east-1b"},
+		{Host: "192.0.0.3:8080", Zone: "us-east-1a"},
+	}
+	reversed := []storage.Instance{instances[2], instances[1], instances[0]}
+	store := &mocks.Store{}
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return(instances, nil).Once()
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "valid-service").Return(reversed, nil)
+	store.On("GetService", mock.Anything, storage.DefaultNamespace, "flaky-service").Return(nil, errors.New("storage down"))
+	s := NewServer(store, metrics)
+
+	resp, err := s.response(context.Background(), newStreamState(), []string{"valid-service"})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		again, err := s.response(context.Background(), newStreamState(), []string{"valid-service"})
+		assert.NoError(t, err)
+		assert.Equal(t, resp.GetVersionInfo(), again.GetVersionInfo())
+		assert.Equal(t, resp.GetResources(), again.GetResources())
+	}
+
+	// a failing service is not served without endpoints, unless an assignment is known of it
+	st := newStreamState()
+	_, err = s.response(context.Background(), st, []string{"flaky-service"})
+	assert.Equal(t, errNoAssignment, err)
+	st.assignments["flaky-service"] = assignment("flaky-service", instances)
+	resp, err = s.response(context.Background(), st, []string{"flaky-service"})
+	assert.NoError(t, err)
+	assert.Len(t, unmarshalAssignments(t, resp)[0].GetEndpoints(), 2)
+}
@@ -0,0 +1,426 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+)
+
+const (
+	watchBufferSize = 128
+	evictInterval   = time.Second
+)
+
+// record is the value stored under host in the bucket of its service
+type record struct {
+	Instance storage.Instance `json:"instance"`
+	// ExpiresAt is in unix nanoseconds, 0 never expires
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+type watchKey struct {
+	namespace, key string
+}
+
+// change is an event under key of namespace
+type change struct {
+	namespace string
+	event     storage.Event
+}
+
+// Client defines storage client on a local bbolt file, every namespace is a top level bucket
+// holding one bucket per service, whose keys are hosts and values json encoded records.
+// bbolt locks the file, so a single ct-dns process serves it and watches are fanned out in process.
+type Client struct {
+	DB *bbolt.DB
+
+	// lock keeps notifications in commit order
+	lock     sync.Mutex
+	watchers map[watchKey]map[chan storage.Event]struct{}
+	now      func() time.Time
+	// stop ends eviction, stopped is closed once it ended
+	stop    context.CancelFunc
+	stopped chan struct{}
+	// closed ends watches
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewClient creates new bolt client on db, expired hosts are removed every evictInterval until Close
+func NewClient(db *bbolt.DB) storage.Client {
+	ctx, stop := context.WithCancel(context.Background())
+	c := &Client{
+		DB:       db,
+		watchers: make(map[watchKey]map[chan storage.Event]struct{}),
+		now:      time.Now,
+		stop:     stop,
+		stopped:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go c.run(ctx)
+	return c
+}
+
+func (c *Client) expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return c.now().Add(ttl).UnixNano()
+}
+
+func (c *Client) expired(r record) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= c.now().UnixNano()
+}
+
+// update runs fn in a read-write transaction and notifies watchers of the changes it returns once committed
+func (c *Client) update(ctx context.Context, fn func(tx *bbolt.Tx) ([]change, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var changes []change
+	err := c.DB.Update(func(tx *bbolt.Tx) error {
+		var err error
+		changes, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		c.notify(ch)
+	}
+	return nil
+}
+
+// Create create new key/instance pair expiring after ttl
+func (c *Client) Create(ctx context.Context, namespace, key string, instance storage.Instance, ttl time.Duration) error {
+	return c.update(ctx, func(tx *bbolt.Tx) ([]change, error) {
+		ns, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create namespace bucket")
+		}
+		service, err := ns.CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create service bucket")
+		}
+		var changes []change
+		var previous record
+		raw := service.Get([]byte(instance.Host))
+		if raw == nil || json.Unmarshal(raw, &previous) != nil || c.expired(previous) || !reflect.DeepEqual(previous.Instance, instance) {
+			changes = append(changes, change{namespace, storage.Event{Type: storage.EventAdd, Key: key, Value: instance.Host}})
+		}
+		value, err := json.Marshal(record{Instance: instance, ExpiresAt: c.expiresAt(ttl)})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal instance")
+		}
+		if err := service.Put([]byte(instance.Host), value); err != nil {
+			return nil, errors.Wrap(err, "Failed to put instance")
+		}
+		return changes, nil
+	})
+}
+
+// Get gets unexpired instances under key
+func (c *Client) Get(ctx context.Context, namespace, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var res []storage.Instance
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		service := bucket(tx, namespace, key)
+		if service == nil {
+			return nil
+		}
+		return service.ForEach(func(host, value []byte) error {
+			r, err := decode(host, value)
+			if err == nil && !c.expired(r) {
+				res = append(res, r.Instance)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to get instances")
+	}
+	if len(res) == 0 {
+		return "", storage.ErrKeyNotFound
+	}
+	jsonized, _ := json.Marshal(res)
+	return string(jsonized), nil
+}
+
+// Delete deletes service & host combination
+func (c *Client) Delete(ctx context.Context, namespace, key, value string) error {
+	return c.update(ctx, func(tx *bbolt.Tx) ([]change, error) {
+		service := bucket(tx, namespace, key)
+		if service == nil || service.Get([]byte(value)) == nil {
+			return nil, nil
+		}
+		if err := service.Delete([]byte(value)); err != nil {
+			return nil, errors.Wrap(err, "Failed to delete instance")
+		}
+		if err := prune(tx, namespace, key); err != nil {
+			return nil, err
+		}
+		return []change{{namespace, storage.Event{Type: storage.EventRemove, Key: key, Value: value}}}, nil
+	})
+}
+
+// Renew extends expiration of service & host combination by ttl
+func (c *Client) Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error {
+	return c.update(ctx, func(tx *bbolt.Tx) ([]change, error) {
+		service := bucket(tx, namespace, key)
+		if service == nil {
+			return nil, storage.ErrInstanceNotFound
+		}
+		raw := service.Get([]byte(value))
+		if raw == nil {
+			return nil, storage.ErrInstanceNotFound
+		}
+		r, err := decode([]byte(value), raw)
+		if err != nil {
+			return nil, err
+		}
+		if c.expired(r) {
+			return nil, storage.ErrInstanceNotFound
+		}
+		r.ExpiresAt = c.expiresAt(ttl)
+		renewed, err := json.Marshal(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal instance")
+		}
+		return nil, service.Put([]byte(value), renewed)
+	})
+}
+
+// Watch streams hosts added/removed under key until ctx is done or Close
+func (c *Client) Watch(ctx context.Context, namespace, key string) (<-chan storage.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sub := make(chan storage.Event, watchBufferSize)
+	wk := watchKey{namespace, key}
+	c.lock.Lock()
+	if _, found := c.watchers[wk]; !found {
+		c.watchers[wk] = make(map[chan storage.Event]struct{})
+	}
+	c.watchers[wk][sub] = struct{}{}
+	c.lock.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.closed:
+		}
+		c.lock.Lock()
+		c.unsubscribe(wk, sub)
+		c.lock.Unlock()
+	}()
+	return sub, nil
+}
+
+// IsTransient tells a timeout waiting for the file lock from permanent errors
+func (c *Client) IsTransient(err error) bool {
+	return errors.Cause(err) == bbolt.ErrTimeout
+}
+
+// List lists keys of namespace starting with prefix holding at least one unexpired host
+func (c *Client) List(ctx context.Context, namespace, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := []string{}
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		ns := tx.Bucket([]byte(namespace))
+		if ns == nil {
+			return nil
+		}
+		cursor := ns.Cursor()
+		// keys are sorted, so services matching prefix are next to each other
+		for key, value := cursor.Seek([]byte(prefix)); key != nil && hasPrefix(key, prefix); key, value = cursor.Next() {
+			if value != nil {
+				continue
+			}
+			if c.live(ns.Bucket(key)) {
+				res = append(res, string(key))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list services")
+	}
+	return res, nil
+}
+
+// live tells whether service holds any unexpired host
+func (c *Client) live(service *bbolt.Bucket) bool {
+	cursor := service.Cursor()
+	for host, value := cursor.First(); host != nil; host, value = cursor.Next() {
+		if r, err := decode(host, value); err == nil && !c.expired(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ping checks the file is open and readable
+func (c *Client) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.DB.View(func(tx *bbolt.Tx) error { return nil }); err != nil {
+		return errors.Wrap(err, "Failed to read bolt file")
+	}
+	return nil
+}
+
+// Close stops evicting expired hosts, ends watches and closes the file
+func (c *Client) Close() error {
+	c.stop()
+	<-c.stopped
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.DB.Close()
+}
+
+// run evicts expired hosts every evictInterval until ctx is done
+func (c *Client) run(ctx context.Context) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.evict(ctx); err != nil && ctx.Err() == nil {
+				logging.GetLogger().WithError(err).Warn("Failed to remove expired hosts from bolt")
+			}
+		}
+	}
+}
+
+// expiredHost is a host found expired by evict
+type expiredHost struct {
+	namespace, key, host string
+}
+
+// evict deletes expired hosts of every service, notifying watchers of their removal. Hosts are looked
+// for in a read transaction, the write one, which locks out writers and syncs the file, only runs if any expired.
+func (c *Client) evict(ctx context.Context) error {
+	var hosts []expiredHost
+	err := c.DB.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(namespace []byte, ns *bbolt.Bucket) error {
+			return ns.ForEach(func(key, value []byte) error {
+				if value != nil {
+					return nil
+				}
+				return ns.Bucket(key).ForEach(func(host, value []byte) error {
+					if r, err := decode(host, value); err == nil && c.expired(r) {
+						hosts = append(hosts, expiredHost{string(namespace), string(key), string(host)})
+					}
+					return nil
+				})
+			})
+		})
+	})
+	if err != nil || len(hosts) == 0 {
+		return err
+	}
+	return c.update(ctx, func(tx *bbolt.Tx) ([]change, error) {
+		var changes []change
+		for _, h := range hosts {
+			service := bucket(tx, h.namespace, h.key)
+			if service == nil {
+				continue
+			}
+			// hosts renewed or deleted since they were found expired are left alone
+			value := service.Get([]byte(h.host))
+			if value == nil {
+				continue
+			}
+			if r, err := decode([]byte(h.host), value); err != nil || !c.expired(r) {
+				continue
+			}
+			if err := service.Delete([]byte(h.host)); err != nil {
+				return nil, errors.Wrap(err, "Failed to delete expired instance")
+			}
+			if err := prune(tx, h.namespace, h.key); err != nil {
+				return nil, err
+			}
+			changes = append(changes, change{h.namespace, storage.Event{Type: storage.EventRemove, Key: h.key, Value: h.host}})
+		}
+		return changes, nil
+	})
+}
+
+// notify fans ch out to watchers of its key, caller must hold lock
+func (c *Client) notify(ch change) {
+	wk := watchKey{ch.namespace, ch.event.Key}
+	for sub := range c.watchers[wk] {
+		select {
+		case sub <- ch.event:
+		default:
+			// watcher fell behind, close it so it resyncs instead of missing events
+			c.unsubscribe(wk, sub)
+		}
+	}
+}
+
+// unsubscribe closes watcher of key, caller must hold lock
+func (c *Client) unsubscribe(wk watchKey, sub chan storage.Event) {
+	if _, found := c.watchers[wk][sub]; !found {
+		return
+	}
+	delete(c.watchers[wk], sub)
+	close(sub)
+	if len(c.watchers[wk]) == 0 {
+		delete(c.watchers, wk)
+	}
+}
+
+// bucket returns bucket of service key in namespace, nil if it does not exist
+func bucket(tx *bbolt.Tx, namespace, key string) *bbolt.Bucket {
+	ns := tx.Bucket([]byte(namespace))
+	if ns == nil {
+		return nil
+	}
+	return ns.Bucket([]byte(key))
+}
+
+// prune deletes bucket of service key once it holds no host, and its namespace once it holds no service
+func prune(tx *bbolt.Tx, namespace, key string) error {
+	ns := tx.Bucket([]byte(namespace))
+	if k, _ := ns.Bucket([]byte(key)).Cursor().First(); k != nil {
+		return nil
+	}
+	if err := ns.DeleteBucket([]byte(key)); err != nil {
+		return errors.Wrap(err, "Failed to delete service bucket")
+	}
+	if k, _ := ns.Cursor().First(); k != nil {
+		return nil
+	}
+	return errors.Wrap(tx.DeleteBucket([]byte(namespace)), "Failed to delete namespace bucket")
+}
+
+func decode(host, value []byte) (record, error) {
+	var r record
+	if err := json.Unmarshal(value, &r); err != nil {
+		logging.GetLogger().WithError(err).WithField("host", string(host)).Warn("Failed to decode bolt instance")
+		return r, errors.Wrap(err, "Failed to decode instance")
+	}
+	return r, nil
+}
+
+func hasPrefix(key []byte, prefix string) bool {
+	return len(key) >= len(prefix) && string(key[:len(prefix)]) == prefix
+}
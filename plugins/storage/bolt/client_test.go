@@ -0,0 +1,223 @@
+package bolt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
+	"github.com/stretchr/testify/assert"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// newTestClient creates client on a temporary file reading time from now, close removes the file,
+// expired hosts are only evicted by calling evict
+func newTestClient(t *testing.T, now func() time.Time) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "ct-dns-bolt")
+	assert.NoError(t, err)
+	db, err := bbolt.Open(filepath.Join(dir, "ct-dns.db"), 0600, nil)
+	assert.NoError(t, err)
+	c := NewClient(db).(*Client)
+	c.stop()
+	<-c.stopped
+	c.now = now
+	return c, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_CreateAndGet(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	_, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+
+	instance := storage.Instance{
+		Host:   "192.0.0.2",
+		Zone:   "us-east-1a",
+		Weight: 10,
+		Canary: true,
+		Tags:   map[string]string{"version": "v2"},
+	}
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", instance, 0))
+	res, err = c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2","zone":"us-east-1a","weight":10,"canary":true,"tags":{"version":"v2"}}]`, res)
+}
+
+func Test_Delete(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1"))
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.3"))
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "unknown-service", "192.0.0.1"))
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.2"}]`, res)
+
+	// the last host takes its service bucket along
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2"))
+	_, err = c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Error(t, err)
+	assert.NoError(t, c.DB.View(func(tx *bbolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(storage.DefaultNamespace)))
+		return nil
+	}))
+}
+
+func Test_ExpireAndRenew(t *testing.T) {
+	now := time.Now()
+	c, close := newTestClient(t, func() time.Time { return now })
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 10*time.Second))
+
+	now = now.Add(5 * time.Second)
+	assert.NoError(t, c.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", 10*time.Second))
+	now = now.Add(5 * time.Second)
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+	assert.Equal(t, storage.ErrInstanceNotFound, c.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2", 10*time.Second))
+	assert.Equal(t, storage.ErrInstanceNotFound, c.Renew(context.Background(), storage.DefaultNamespace, "unknown-service", "192.0.0.1", 10*time.Second))
+
+	now = now.Add(5 * time.Second)
+	_, err = c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Error(t, err)
+	assert.NoError(t, c.evict(context.Background()))
+	assert.NoError(t, c.DB.View(func(tx *bbolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(storage.DefaultNamespace)))
+		return nil
+	}))
+}
+
+func Test_EvictWritesOnlyWhenExpired(t *testing.T) {
+	now := time.Now()
+	c, close := newTestClient(t, func() time.Time { return now })
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	txID := func() int {
+		var id int
+		assert.NoError(t, c.DB.View(func(tx *bbolt.Tx) error {
+			id = tx.ID()
+			return nil
+		}))
+		return id
+	}
+
+	committed := txID()
+	assert.NoError(t, c.evict(context.Background()))
+	assert.Equal(t, committed, txID())
+
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, c.evict(context.Background()))
+	assert.Equal(t, committed+1, txID())
+	_, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Error(t, err)
+}
+
+func Test_List(t *testing.T) {
+	now := time.Now()
+	c, close := newTestClient(t, func() time.Time { return now })
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-api", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-expiring", storage.Instance{Host: "192.0.0.3"}, 10*time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "other-service", storage.Instance{Host: "192.0.0.4"}, 0))
+
+	res, err := c.List(context.Background(), storage.DefaultNamespace, "dummy-")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy-api", "dummy-expiring", "dummy-service"}, res)
+
+	now = now.Add(10 * time.Second)
+	res, err = c.List(context.Background(), storage.DefaultNamespace, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy-api", "dummy-service", "other-service"}, res)
+	res, err = c.List(context.Background(), storage.DefaultNamespace, "unknown")
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func Test_Namespaces(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), "team-a", "api", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), "team-b", "api", storage.Instance{Host: "192.0.0.2"}, 0))
+
+	res, err := c.Get(context.Background(), "team-a", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+	_, err = c.Get(context.Background(), storage.DefaultNamespace, "api")
+	assert.Error(t, err)
+	services, err := c.List(context.Background(), "team-b", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api"}, services)
+	assert.NoError(t, c.Delete(context.Background(), "team-b", "api", "192.0.0.1"))
+	res, err = c.Get(context.Background(), "team-a", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+}
+
+func Test_Watch(t *testing.T) {
+	now := time.Now()
+	c, close := newTestClient(t, func() time.Time { return now })
+	defer close()
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := c.Watch(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2", Weight: 5}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "other-service", storage.Instance{Host: "192.0.0.3"}, 0))
+	assert.NoError(t, c.Create(context.Background(), "team-a", "dummy-service", storage.Instance{Host: "192.0.0.4"}, 0))
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2"))
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, c.evict(context.Background()))
+
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+
+	// Close ends watches as well
+	events, err = c.Watch(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	_, open = <-events
+	assert.False(t, open)
+}
+
+func Test_IsTransient(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	_, err := c.Get(context.Background(), storage.DefaultNamespace, "missing-service")
+	assert.False(t, c.IsTransient(err))
+	assert.True(t, c.IsTransient(bbolt.ErrTimeout))
+}
+
+func Test_PingAndClose(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	assert.NoError(t, c.Ping(context.Background()))
+	assert.NoError(t, c.Close())
+	assert.Error(t, c.Ping(context.Background()))
+}
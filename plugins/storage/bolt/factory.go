@@ -0,0 +1,35 @@
+package bolt
+
+import (
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// DefaultPath is the file registrations are kept in unless configured
+const DefaultPath = "ct-dns.db"
+
+// Config contains config for bolt storage
+type Config struct {
+	// Path of the bbolt file, created if missing
+	Path string `yaml:"path"`
+	// OpenTimeout bounds waiting for the file lock held by another process, 0 waits forever
+	OpenTimeout time.Duration `yaml:"opentimeout"`
+}
+
+// NewFactory opens the bbolt file of cfg and creates bolt Client on it
+func NewFactory(cfg Config) (storage.Client, error) {
+	path := cfg.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: cfg.OpenTimeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot open bolt file %s", path)
+	}
+	logging.GetLogger().WithField("Path", path).Info("Opened bolt storage")
+	return NewClient(db), nil
+}
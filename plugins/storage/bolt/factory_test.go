@@ -0,0 +1,36 @@
+package bolt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewFactory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ct-dns.db")
+
+	c, err := NewFactory(Config{Path: path, OpenTimeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	// the file stays locked while open
+	_, err = NewFactory(Config{Path: path, OpenTimeout: 100 * time.Millisecond})
+	assert.Error(t, err)
+	assert.NoError(t, c.Close())
+
+	// registrations survive a restart
+	c, err = NewFactory(Config{Path: path})
+	assert.NoError(t, err)
+	defer c.Close()
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+}
@@ -0,0 +1,12 @@
+package bolt
+
+import (
+	"flag"
+	"time"
+)
+
+// AddFlags binds flags to bolt setup
+func AddFlags(flagSet *flag.FlagSet) {
+	flagSet.String("bolt-path", DefaultPath, "--bolt-path <path> of the file registrations are kept in")
+	flagSet.Duration("bolt-open-timeout", time.Second, "--bolt-open-timeout <duration> to wait for the file lock")
+}
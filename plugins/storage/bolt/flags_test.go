@@ -0,0 +1,18 @@
+package bolt
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AddFlags(t *testing.T) {
+	flagSet := flag.NewFlagSet("bolt", flag.ExitOnError)
+	AddFlags(flagSet)
+	flagSet.Parse([]string{"--bolt-path", "/var/lib/ct-dns/ct-dns.db"})
+	if flagSet.Parsed() {
+		assert.Equal(t, "/var/lib/ct-dns/ct-dns.db", flagSet.Lookup("bolt-path").Value.String())
+		assert.Equal(t, "1s", flagSet.Lookup("bolt-open-timeout").Value.String())
+	}
+}
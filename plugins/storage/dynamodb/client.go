@@ -1,29 +1,55 @@
 package dynamodb
 
 import (
+	"context"
 	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/guanw/ct-dns/pkg/logging"
 	"github.com/guanw/ct-dns/storage"
 	"github.com/pkg/errors"
 )
 
 // DClient defines dynamodb client instance
 type DClient struct {
-	DB   Client
-	lock sync.Mutex
+	DB Client
+	// Table holds instances, keyed by Service and Host
+	Table string
+	// WatchInterval is how often Watch polls for changes
+	WatchInterval time.Duration
+	lock          sync.Mutex
+	now           func() time.Time
 }
 
 // Client defines the interface for dynamodb client
 type Client interface {
-	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
-	PutItem(putItemInput *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
-	DeleteItem(deleteItemInput *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+	QueryWithContext(ctx context.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error)
+	PutItemWithContext(ctx context.Context, putItemInput *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	DeleteItemWithContext(ctx context.Context, deleteItemInput *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	UpdateItemWithContext(ctx context.Context, updateItemInput *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error)
+	ScanWithContext(ctx context.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error)
+	DescribeTableWithContext(ctx context.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error)
+	CreateTableWithContext(ctx context.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error)
+	WaitUntilTableExistsWithContext(ctx context.Context, input *dynamodb.DescribeTableInput, opts ...request.WaiterOption) error
+	DescribeTimeToLiveWithContext(ctx context.Context, input *dynamodb.DescribeTimeToLiveInput, opts ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLiveWithContext(ctx context.Context, input *dynamodb.UpdateTimeToLiveInput, opts ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error)
 }
 
+const defaultWatchInterval = 5 * time.Second
+
+// DefaultTable is the table instances are stored in unless configured
+const DefaultTable = "service-discovery"
+
 // Params defines config to initialize dynamodb client
 type Params struct {
 	Endpoint string
@@ -33,28 +59,91 @@ type Params struct {
 // NewClient creates new api client
 func NewClient(db Client) storage.Client {
 	return &DClient{
-		DB: db,
+		DB:            db,
+		Table:         DefaultTable,
+		WatchInterval: defaultWatchInterval,
+		now:           time.Now,
 	}
 }
 
 type keyValuePair struct {
 	Service string `dynamodbav:"Service"`
 	Host    string `dynamodbav:"Host"`
+	// Namespace is absent for the default namespace so records written before namespaces keep working
+	Namespace string `dynamodbav:"Namespace,omitempty"`
+	// ExpiresAt is expiration in epoch seconds, absent when the host never expires.
+	// It is the TTL attribute of the table, DynamoDB deletes expired hosts within days.
+	ExpiresAt int64             `dynamodbav:"ExpiresAt,omitempty"`
+	Zone      string            `dynamodbav:"Zone,omitempty"`
+	Weight    uint32            `dynamodbav:"Weight,omitempty"`
+	Canary    bool              `dynamodbav:"Canary,omitempty"`
+	Tags      map[string]string `dynamodbav:"Tags,omitempty"`
+}
+
+func (p keyValuePair) instance() storage.Instance {
+	return storage.Instance{
+		Host:   p.Host,
+		Zone:   p.Zone,
+		Weight: p.Weight,
+		Canary: p.Canary,
+		Tags:   p.Tags,
+	}
 }
 
-// Create create new entry with key as primary key and value as secondary partition key
-func (c *DClient) Create(key, value string) error {
+// namespaceSeparator joins namespace and key into the Service partition key outside the default namespace
+const namespaceSeparator = "#"
+
+// partitionKey returns Service partition key of key in namespace
+func partitionKey(namespace, key string) string {
+	if namespace == storage.DefaultNamespace {
+		return key
+	}
+	return namespace + namespaceSeparator + key
+}
+
+// namespaceAttribute returns Namespace attribute stored for namespace
+func namespaceAttribute(namespace string) string {
+	if namespace == storage.DefaultNamespace {
+		return ""
+	}
+	return namespace
+}
+
+// namespaceFilter adds condition matching records of namespace to values and returns it
+func namespaceFilter(namespace string, values map[string]*dynamodb.AttributeValue) string {
+	if namespace == storage.DefaultNamespace {
+		return "attribute_not_exists(Namespace)"
+	}
+	values[":namespace"] = &dynamodb.AttributeValue{S: aws.String(namespace)}
+	return "Namespace = :namespace"
+}
+
+func (c *DClient) expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return c.now().Add(ttl).Unix()
+}
+
+// Create create new entry with key as primary key and instance host as secondary partition key
+func (c *DClient) Create(ctx context.Context, namespace, key string, instance storage.Instance, ttl time.Duration) error {
 	s := keyValuePair{
-		Service: key,
-		Host:    value,
+		Service:   partitionKey(namespace, key),
+		Host:      instance.Host,
+		Namespace: namespaceAttribute(namespace),
+		ExpiresAt: c.expiresAt(ttl),
+		Zone:      instance.Zone,
+		Weight:    instance.Weight,
+		Canary:    instance.Canary,
+		Tags:      instance.Tags,
 	}
 	sMap, err := dynamodbattribute.MarshalMap(s)
 	if err != nil {
 		return errors.Wrap(err, "Failed to marshal serviceToHost map")
 	}
 	c.lock.Lock()
-	_, err = c.DB.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String("service-discovery"),
+	_, err = c.DB.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(c.Table),
 		Item:      sMap,
 	})
 	c.lock.Unlock()
@@ -64,42 +153,59 @@ func (c *DClient) Create(key, value string) error {
 	return nil
 }
 
-// Get gets hosts under primary key
-func (c *DClient) Get(key string) (string, error) {
+// Get gets instances under primary key
+func (c *DClient) Get(ctx context.Context, namespace, key string) (string, error) {
+	res, err := c.instances(ctx, namespace, key)
+	if err != nil {
+		return "", err
+	}
+	json, _ := json.Marshal(res)
+	return string(json), nil
+}
 
+// instances queries unexpired instances under key page by page, a page holds up to 1MB of items
+func (c *DClient) instances(ctx context.Context, namespace, key string) ([]storage.Instance, error) {
 	params := &dynamodb.QueryInput{
 		KeyConditionExpression: aws.String("Service = :service"),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":service": {
-				S: aws.String(key),
+				S: aws.String(partitionKey(namespace, key)),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(c.now().Unix(), 10)),
 			},
 		},
-		TableName: aws.String("service-discovery"),
+		TableName: aws.String(c.Table),
 	}
+	params.FilterExpression = aws.String("(attribute_not_exists(ExpiresAt) OR ExpiresAt > :now) AND " + namespaceFilter(namespace, params.ExpressionAttributeValues))
 
-	c.lock.Lock()
-	resp, err := c.DB.Query(params)
-	c.lock.Unlock()
-	if err != nil {
-		return "", errors.Wrap(err, "Failed to get hosts corresponding to the service")
-	}
-	var pairs []keyValuePair
-	err = dynamodbattribute.UnmarshalListOfMaps(resp.Items, &pairs)
-	if err != nil {
-		return "", errors.Wrap(err, "Failed to unmarshal dynamo attribute")
-	}
-	var res []string
-	for index := range pairs {
-		res = append(res, pairs[index].Host)
+	var res []storage.Instance
+	for {
+		c.lock.Lock()
+		resp, err := c.DB.QueryWithContext(ctx, params)
+		c.lock.Unlock()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get hosts corresponding to the service")
+		}
+		var pairs []keyValuePair
+		err = dynamodbattribute.UnmarshalListOfMaps(resp.Items, &pairs)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to unmarshal dynamo attribute")
+		}
+		for index := range pairs {
+			res = append(res, pairs[index].instance())
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return res, nil
+		}
+		params.ExclusiveStartKey = resp.LastEvaluatedKey
 	}
-	json, _ := json.Marshal(res)
-	return string(json), nil
 }
 
 // Delete deletes records with key as primary key and value as secondary key
-func (c *DClient) Delete(key, value string) error {
+func (c *DClient) Delete(ctx context.Context, namespace, key, value string) error {
 	s := keyValuePair{
-		Service: key,
+		Service: partitionKey(namespace, key),
 		Host:    value,
 	}
 	sMap, err := dynamodbattribute.MarshalMap(s)
@@ -107,8 +213,8 @@ func (c *DClient) Delete(key, value string) error {
 		return errors.Wrap(err, "Failed to marshal serviceToHost map")
 	}
 	c.lock.Lock()
-	_, err = c.DB.DeleteItem(&dynamodb.DeleteItemInput{
-		TableName: aws.String("service-discovery"),
+	_, err = c.DB.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(c.Table),
 		Key:       sMap,
 	})
 	c.lock.Unlock()
@@ -117,3 +223,178 @@ func (c *DClient) Delete(key, value string) error {
 	}
 	return nil
 }
+
+// Renew pushes expiration of existing record with key as primary key and value as secondary key
+func (c *DClient) Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error {
+	keyMap, err := dynamodbattribute.MarshalMap(keyValuePair{
+		Service: partitionKey(namespace, key),
+		Host:    value,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal serviceToHost map")
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(c.Table),
+		Key:                 keyMap,
+		ConditionExpression: aws.String("attribute_exists(Host) AND (attribute_not_exists(ExpiresAt) OR ExpiresAt > :now)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(c.now().Unix(), 10)),
+			},
+		},
+		UpdateExpression: aws.String("REMOVE ExpiresAt"),
+	}
+	if expiresAt := c.expiresAt(ttl); expiresAt != 0 {
+		input.UpdateExpression = aws.String("SET ExpiresAt = :expiresAt")
+		input.ExpressionAttributeValues[":expiresAt"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(expiresAt, 10)),
+		}
+	}
+	c.lock.Lock()
+	_, err = c.DB.UpdateItemWithContext(ctx, input)
+	c.lock.Unlock()
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return storage.ErrInstanceNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to renew service and host")
+	}
+	return nil
+}
+
+// IsTransient tells throttling, timeouts, connection and server side failures from permanent errors
+func (c *DClient) IsTransient(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	if !ok {
+		return false
+	}
+	if failure, ok := aerr.(awserr.RequestFailure); ok && failure.StatusCode() >= 500 {
+		return true
+	}
+	return request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr)
+}
+
+// List scans primary keys of namespace starting with prefix page by page, skipping expired records
+func (c *DClient) List(ctx context.Context, namespace, prefix string) ([]string, error) {
+	params := &dynamodb.ScanInput{
+		TableName:            aws.String(c.Table),
+		ProjectionExpression: aws.String("Service"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(c.now().Unix(), 10)),
+			},
+		},
+	}
+	params.FilterExpression = aws.String("(attribute_not_exists(ExpiresAt) OR ExpiresAt > :now) AND " + namespaceFilter(namespace, params.ExpressionAttributeValues))
+	root := partitionKey(namespace, "")
+	if root+prefix != "" {
+		params.FilterExpression = aws.String(*params.FilterExpression + " AND begins_with(Service, :prefix)")
+		params.ExpressionAttributeValues[":prefix"] = &dynamodb.AttributeValue{
+			S: aws.String(root + prefix),
+		}
+	}
+	seen := make(map[string]bool)
+	res := []string{}
+	for {
+		c.lock.Lock()
+		resp, err := c.DB.ScanWithContext(ctx, params)
+		c.lock.Unlock()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to scan services")
+		}
+		var pairs []keyValuePair
+		if err := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &pairs); err != nil {
+			return nil, errors.Wrap(err, "Failed to unmarshal dynamo attribute")
+		}
+		for _, pair := range pairs {
+			if key := strings.TrimPrefix(pair.Service, root); !seen[key] {
+				seen[key] = true
+				res = append(res, key)
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		params.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Watch polls hosts under primary key every WatchInterval and streams the difference
+// until ctx is done, DynamoDB Streams would need a separate consumer per shard
+func (c *DClient) Watch(ctx context.Context, namespace, key string) (<-chan storage.Event, error) {
+	previous, err := c.instances(ctx, namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan storage.Event)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(c.WatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := c.instances(ctx, namespace, key)
+			if err != nil {
+				logging.GetLogger().WithError(err).WithField("key", key).Warn("Failed to poll dynamodb for changes")
+				continue
+			}
+			for _, event := range diff(key, previous, current) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			previous = current
+		}
+	}()
+	return events, nil
+}
+
+// Ping describes the table, checking it exists and accepts reads and writes
+func (c *DClient) Ping(ctx context.Context) error {
+	resp, err := c.DB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(c.Table),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to describe table")
+	}
+	// tables being updated keep serving requests
+	switch status := aws.StringValue(resp.Table.TableStatus); status {
+	case dynamodb.TableStatusActive, dynamodb.TableStatusUpdating:
+		return nil
+	default:
+		return errors.Errorf("Table is %s", status)
+	}
+}
+
+// Close does nothing, dynamodb calls are plain https requests without a session to release
+func (c *DClient) Close() error {
+	return nil
+}
+
+func diff(key string, previous, current []storage.Instance) []storage.Event {
+	seen := make(map[string]storage.Instance, len(previous))
+	for _, instance := range previous {
+		seen[instance.Host] = instance
+	}
+	var events []storage.Event
+	for _, instance := range current {
+		if before, found := seen[instance.Host]; !found || !reflect.DeepEqual(before, instance) {
+			events = append(events, storage.Event{Type: storage.EventAdd, Key: key, Value: instance.Host})
+		}
+		delete(seen, instance.Host)
+	}
+	for _, instance := range previous {
+		if _, found := seen[instance.Host]; found {
+			events = append(events, storage.Event{Type: storage.EventRemove, Key: key, Value: instance.Host})
+		}
+	}
+	return events
+}
@@ -1,22 +1,38 @@
 package dynamodb
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/guanw/ct-dns/plugins/storage/dynamodb/mocks"
+	"github.com/guanw/ct-dns/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
+var now = time.Unix(1577836800, 0)
+
+func newTestClient(db Client) *DClient {
+	c := NewClient(db).(*DClient)
+	c.now = func() time.Time { return now }
+	return c
+}
+
 func Test_Create(t *testing.T) {
 	tests := []struct {
 		Input       *dynamodb.PutItemInput
 		ReturnErr   error
 		Description string
 		Value       string
+		Zone        string
+		Weight      uint32
 		Key         string
+		TTL         time.Duration
 		ExpectError bool
 	}{
 		{
@@ -55,13 +71,61 @@ func Test_Create(t *testing.T) {
 			Key:         "error-service",
 			ExpectError: true,
 		},
+		{
+			Input: &dynamodb.PutItemInput{
+				Item: map[string]*dynamodb.AttributeValue{
+					"Service": {
+						S: aws.String("valid-service"),
+					},
+					"Host": {
+						S: aws.String("192.0.0.1"),
+					},
+					"ExpiresAt": {
+						N: aws.String("1577836810"),
+					},
+				},
+				TableName: aws.String("service-discovery"),
+			},
+			ReturnErr:   nil,
+			Description: "set serviceName&host with ttl",
+			Value:       "192.0.0.1",
+			Key:         "valid-service",
+			TTL:         10 * time.Second,
+			ExpectError: false,
+		},
+		{
+			Input: &dynamodb.PutItemInput{
+				Item: map[string]*dynamodb.AttributeValue{
+					"Service": {
+						S: aws.String("valid-service"),
+					},
+					"Host": {
+						S: aws.String("192.0.0.1"),
+					},
+					"Zone": {
+						S: aws.String("us-east-1a"),
+					},
+					"Weight": {
+						N: aws.String("10"),
+					},
+				},
+				TableName: aws.String("service-discovery"),
+			},
+			ReturnErr:   nil,
+			Description: "set serviceName&host with metadata",
+			Value:       "192.0.0.1",
+			Zone:        "us-east-1a",
+			Weight:      10,
+			Key:         "valid-service",
+			ExpectError: false,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.Description, func(t *testing.T) {
 			mockClient := &mocks.DynamodbClient{}
-			c := NewClient(mockClient)
-			mockClient.On("PutItem", test.Input).Return(&dynamodb.PutItemOutput{}, test.ReturnErr)
-			err := c.Create(test.Key, test.Value)
+			c := newTestClient(mockClient)
+			mockClient.On("PutItemWithContext", mock.Anything, test.Input).Return(&dynamodb.PutItemOutput{}, test.ReturnErr)
+			err := c.Create(context.Background(), storage.DefaultNamespace, test.Key, storage.Instance{Host: test.Value, Zone: test.Zone, Weight: test.Weight}, test.TTL)
 			if test.ExpectError {
 				assert.Error(t, err)
 			} else {
@@ -85,10 +149,14 @@ func Test_Get(t *testing.T) {
 			Input: &dynamodb.QueryInput{
 				TableName:              aws.String("service-discovery"),
 				KeyConditionExpression: aws.String("Service = :service"),
+				FilterExpression:       aws.String("(attribute_not_exists(ExpiresAt) OR ExpiresAt > :now) AND attribute_not_exists(Namespace)"),
 				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 					":service": {
 						S: aws.String("empty-service"),
 					},
+					":now": {
+						N: aws.String("1577836800"),
+					},
 				},
 			},
 			ReturnVal: &dynamodb.QueryOutput{
@@ -104,10 +172,14 @@ func Test_Get(t *testing.T) {
 			Input: &dynamodb.QueryInput{
 				TableName:              aws.String("service-discovery"),
 				KeyConditionExpression: aws.String("Service = :service"),
+				FilterExpression:       aws.String("(attribute_not_exists(ExpiresAt) OR ExpiresAt > :now) AND attribute_not_exists(Namespace)"),
 				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 					":service": {
 						S: aws.String("valid-service"),
 					},
+					":now": {
+						N: aws.String("1577836800"),
+					},
 				},
 			},
 			ReturnVal: &dynamodb.QueryOutput{
@@ -119,11 +191,21 @@ func Test_Get(t *testing.T) {
 						"Host": &dynamodb.AttributeValue{
 							S: aws.String("192.0.0.1"),
 						},
+						"Canary": &dynamodb.AttributeValue{
+							BOOL: aws.Bool(true),
+						},
+						"Tags": &dynamodb.AttributeValue{
+							M: map[string]*dynamodb.AttributeValue{
+								"version": {
+									S: aws.String("v2"),
+								},
+							},
+						},
 					},
 				},
 			},
 			Key:         "valid-service",
-			Value:       `["192.0.0.1"]`,
+			Value:       `[{"host":"192.0.0.1","canary":true,"tags":{"version":"v2"}}]`,
 			ReturnErr:   nil,
 			Description: "service name with one host registered",
 			ExpectError: false,
@@ -133,9 +215,9 @@ func Test_Get(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.Description, func(t *testing.T) {
 			mockClient := &mocks.DynamodbClient{}
-			c := NewClient(mockClient)
-			mockClient.On("Query", test.Input).Return(test.ReturnVal, test.ReturnErr)
-			val, err := c.Get(test.Key)
+			c := newTestClient(mockClient)
+			mockClient.On("QueryWithContext", mock.Anything, test.Input).Return(test.ReturnVal, test.ReturnErr)
+			val, err := c.Get(context.Background(), storage.DefaultNamespace, test.Key)
 			if test.ExpectError {
 				assert.Error(t, err)
 			} else {
@@ -146,6 +228,44 @@ func Test_Get(t *testing.T) {
 	}
 }
 
+func Test_GetPages(t *testing.T) {
+	mockClient := &mocks.DynamodbClient{}
+	c := newTestClient(mockClient)
+	item := func(host string) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"Service": {S: aws.String("valid-service")},
+			"Host":    {S: aws.String(host)},
+		}
+	}
+	firstPage := mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return input.ExclusiveStartKey == nil
+	})
+	secondPage := mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return input.ExclusiveStartKey != nil && *input.ExclusiveStartKey["Host"].S == "192.0.0.1"
+	})
+	mockClient.On("QueryWithContext", mock.Anything, firstPage).Return(&dynamodb.QueryOutput{
+		Items:            []map[string]*dynamodb.AttributeValue{item("192.0.0.1")},
+		LastEvaluatedKey: item("192.0.0.1"),
+	}, nil).Once()
+	mockClient.On("QueryWithContext", mock.Anything, secondPage).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{item("192.0.0.2")},
+	}, nil).Once()
+
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "valid-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2"}]`, res)
+	mockClient.AssertExpectations(t)
+
+	// a failing page fails the whole query rather than returning part of the hosts
+	mockClient.On("QueryWithContext", mock.Anything, firstPage).Return(&dynamodb.QueryOutput{
+		Items:            []map[string]*dynamodb.AttributeValue{item("192.0.0.1")},
+		LastEvaluatedKey: item("192.0.0.1"),
+	}, nil).Once()
+	mockClient.On("QueryWithContext", mock.Anything, secondPage).Return(nil, errors.New("throttled")).Once()
+	_, err = c.Get(context.Background(), storage.DefaultNamespace, "valid-service")
+	assert.Error(t, err)
+}
+
 func Test_Delete(t *testing.T) {
 	tests := []struct {
 		Input       *dynamodb.DeleteItemInput
@@ -196,8 +316,8 @@ func Test_Delete(t *testing.T) {
 		t.Run(test.Description, func(t *testing.T) {
 			mockClient := &mocks.DynamodbClient{}
 			c := NewClient(mockClient)
-			mockClient.On("DeleteItem", test.Input).Return(&dynamodb.DeleteItemOutput{}, test.ReturnErr)
-			err := c.Delete(test.Key, test.Value)
+			mockClient.On("DeleteItemWithContext", mock.Anything, test.Input).Return(&dynamodb.DeleteItemOutput{}, test.ReturnErr)
+			err := c.Delete(context.Background(), storage.DefaultNamespace, test.Key, test.Value)
 			if test.ExpectError {
 				assert.Error(t, err)
 			} else {
@@ -206,3 +326,218 @@ func Test_Delete(t *testing.T) {
 		})
 	}
 }
+
+func Test_Renew(t *testing.T) {
+	tests := []struct {
+		Input       *dynamodb.UpdateItemInput
+		ReturnErr   error
+		Description string
+		Value       string
+		TTL         time.Duration
+		ExpectedErr error
+	}{
+		{
+			Input: &dynamodb.UpdateItemInput{
+				Key: map[string]*dynamodb.AttributeValue{
+					"Service": {
+						S: aws.String("valid-service"),
+					},
+					"Host": {
+						S: aws.String("192.0.0.1"),
+					},
+				},
+				ConditionExpression: aws.String("attribute_exists(Host) AND (attribute_not_exists(ExpiresAt) OR ExpiresAt > :now)"),
+				UpdateExpression:    aws.String("SET ExpiresAt = :expiresAt"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":now": {
+						N: aws.String("1577836800"),
+					},
+					":expiresAt": {
+						N: aws.String("1577836810"),
+					},
+				},
+				TableName: aws.String("service-discovery"),
+			},
+			Description: "renew registered host",
+			Value:       "192.0.0.1",
+			TTL:         10 * time.Second,
+		},
+		{
+			Input: &dynamodb.UpdateItemInput{
+				Key: map[string]*dynamodb.AttributeValue{
+					"Service": {
+						S: aws.String("valid-service"),
+					},
+					"Host": {
+						S: aws.String("192.0.0.2"),
+					},
+				},
+				ConditionExpression: aws.String("attribute_exists(Host) AND (attribute_not_exists(ExpiresAt) OR ExpiresAt > :now)"),
+				UpdateExpression:    aws.String("REMOVE ExpiresAt"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":now": {
+						N: aws.String("1577836800"),
+					},
+				},
+				TableName: aws.String("service-discovery"),
+			},
+			ReturnErr:   awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil),
+			Description: "renew unknown host",
+			Value:       "192.0.0.2",
+			ExpectedErr: storage.ErrInstanceNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			mockClient := &mocks.DynamodbClient{}
+			c := newTestClient(mockClient)
+			mockClient.On("UpdateItemWithContext", mock.Anything, test.Input).Return(&dynamodb.UpdateItemOutput{}, test.ReturnErr)
+			err := c.Renew(context.Background(), storage.DefaultNamespace, "valid-service", test.Value, test.TTL)
+			assert.Equal(t, test.ExpectedErr, err)
+		})
+	}
+}
+
+func queryOutput(hosts ...string) *dynamodb.QueryOutput {
+	out := &dynamodb.QueryOutput{}
+	for _, host := range hosts {
+		out.Items = append(out.Items, map[string]*dynamodb.AttributeValue{
+			"Service": {
+				S: aws.String("valid-service"),
+			},
+			"Host": {
+				S: aws.String(host),
+			},
+		})
+	}
+	return out
+}
+
+func Test_Watch(t *testing.T) {
+	mockClient := &mocks.DynamodbClient{}
+	c := newTestClient(mockClient)
+	c.WatchInterval = time.Millisecond
+	mockClient.On("QueryWithContext", mock.Anything, mock.Anything).Return(queryOutput("192.0.0.1"), nil).Once()
+	mockClient.On("QueryWithContext", mock.Anything, mock.Anything).Return(queryOutput("192.0.0.1", "192.0.0.2"), nil).Once()
+	mockClient.On("QueryWithContext", mock.Anything, mock.Anything).Return(nil, errors.New("throttled")).Once()
+	mockClient.On("QueryWithContext", mock.Anything, mock.Anything).Return(queryOutput("192.0.0.2"), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	events, err := c.Watch(ctx, storage.DefaultNamespace, "valid-service")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "valid-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "valid-service", Value: "192.0.0.1"}, <-events)
+	cancel()
+	for range events {
+	}
+}
+
+func scanOutput(lastService string, services ...string) *dynamodb.ScanOutput {
+	out := &dynamodb.ScanOutput{}
+	for _, service := range services {
+		out.Items = append(out.Items, map[string]*dynamodb.AttributeValue{
+			"Service": {S: aws.String(service)},
+		})
+	}
+	if lastService != "" {
+		out.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+			"Service": {S: aws.String(lastService)},
+			"Host":    {S: aws.String("192.0.0.1")},
+		}
+	}
+	return out
+}
+
+func Test_List(t *testing.T) {
+	mockClient := &mocks.DynamodbClient{}
+	c := newTestClient(mockClient)
+	firstPage := mock.MatchedBy(func(input *dynamodb.ScanInput) bool {
+		return input.ExclusiveStartKey == nil
+	})
+	secondPage := mock.MatchedBy(func(input *dynamodb.ScanInput) bool {
+		return input.ExclusiveStartKey != nil && *input.ExclusiveStartKey["Service"].S == "valid-service"
+	})
+	mockClient.On("ScanWithContext", mock.Anything, firstPage).Return(scanOutput("valid-service", "valid-service", "valid-api"), nil).Once()
+	mockClient.On("ScanWithContext", mock.Anything, secondPage).Return(scanOutput("", "valid-service", "valid-worker"), nil).Once()
+
+	res, err := c.List(context.Background(), storage.DefaultNamespace, "valid-")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"valid-api", "valid-service", "valid-worker"}, res)
+	input := mockClient.Calls[0].Arguments.Get(1).(*dynamodb.ScanInput)
+	assert.Equal(t, "service-discovery", *input.TableName)
+	assert.Equal(t, "(attribute_not_exists(ExpiresAt) OR ExpiresAt > :now) AND attribute_not_exists(Namespace) AND begins_with(Service, :prefix)", *input.FilterExpression)
+	assert.Equal(t, "valid-", *input.ExpressionAttributeValues[":prefix"].S)
+	assert.Equal(t, "1577836800", *input.ExpressionAttributeValues[":now"].N)
+
+	mockClient.On("ScanWithContext", mock.Anything, firstPage).Return(nil, errors.New("throttled")).Once()
+	_, err = c.List(context.Background(), storage.DefaultNamespace, "")
+	assert.Error(t, err)
+}
+
+func Test_Namespaces(t *testing.T) {
+	mockClient := &mocks.DynamodbClient{}
+	c := newTestClient(mockClient)
+	mockClient.On("PutItemWithContext", mock.Anything, mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
+	mockClient.On("ScanWithContext", mock.Anything, mock.Anything).Return(scanOutput("", "team-a#valid-api", "team-a#valid-service"), nil)
+
+	assert.NoError(t, c.Create(context.Background(), "team-a", "valid-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	item := mockClient.Calls[0].Arguments.Get(1).(*dynamodb.PutItemInput).Item
+	assert.Equal(t, "team-a#valid-service", *item["Service"].S)
+	assert.Equal(t, "team-a", *item["Namespace"].S)
+
+	res, err := c.List(context.Background(), "team-a", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"valid-api", "valid-service"}, res)
+	input := mockClient.Calls[1].Arguments.Get(1).(*dynamodb.ScanInput)
+	assert.Equal(t, "(attribute_not_exists(ExpiresAt) OR ExpiresAt > :now) AND Namespace = :namespace AND begins_with(Service, :prefix)", *input.FilterExpression)
+	assert.Equal(t, "team-a", *input.ExpressionAttributeValues[":namespace"].S)
+	assert.Equal(t, "team-a#", *input.ExpressionAttributeValues[":prefix"].S)
+}
+
+func Test_diff(t *testing.T) {
+	previous := []storage.Instance{{Host: "192.0.0.1"}, {Host: "192.0.0.2"}}
+	current := []storage.Instance{{Host: "192.0.0.1", Weight: 5}, {Host: "192.0.0.3"}}
+	assert.Equal(t, []storage.Event{
+		{Type: storage.EventAdd, Key: "valid-service", Value: "192.0.0.1"},
+		{Type: storage.EventAdd, Key: "valid-service", Value: "192.0.0.3"},
+		{Type: storage.EventRemove, Key: "valid-service", Value: "192.0.0.2"},
+	}, diff("valid-service", previous, current))
+}
+
+func Test_IsTransient(t *testing.T) {
+	c := newTestClient(&mocks.DynamodbClient{})
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{err: awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil), transient: true},
+		{err: awserr.New("RequestError", "send request failed", errors.New("connection reset")), transient: true},
+		{err: awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeInternalServerError, "oops", nil), 500, "id"), transient: true},
+		{err: awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil), 400, "id")},
+		{err: awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "failed", nil)},
+		{err: errors.New("unmarshal failed")},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.transient, c.IsTransient(test.err), test.err.Error())
+	}
+}
+
+func Test_Ping(t *testing.T) {
+	tests := []struct {
+		status    string
+		err       error
+		expectErr bool
+	}{
+		{status: dynamodb.TableStatusActive},
+		{status: dynamodb.TableStatusUpdating},
+		{status: dynamodb.TableStatusCreating, expectErr: true},
+		{err: awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil), expectErr: true},
+	}
+	for _, test := range tests {
+		db := &mocks.DynamodbClient{}
+		db.On("DescribeTableWithContext", mock.Anything, &dynamodb.DescribeTableInput{TableName: aws.String("service-discovery")}).
+			Return(&dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{TableStatus: aws.String(test.status)}}, test.err)
+		err := newTestClient(db).Ping(context.Background())
+		assert.Equal(t, test.expectErr, err != nil, test.status)
+	}
+}
@@ -1,38 +1,100 @@
 package dynamodb
 
 import (
+	"context"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/guanw/ct-dns/pkg/logging"
 	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
-type builder struct {
-	Region   string
-	Endpoint string
+// Config contains config for dynamodb storage
+type Config struct {
+	Region string `yaml:"region"`
+	// Endpoint overrides the AWS endpoint, e.g. for dynamodb local
+	Endpoint string `yaml:"endpoint"`
+	// Table holds instances, keyed by Service and Host
+	Table string `yaml:"table"`
+	// WatchInterval is how often Watch polls for changes
+	WatchInterval time.Duration `yaml:"watchinterval"`
+	// AccessKeyID, SecretAccessKey and SessionToken are static credentials,
+	// unset falls back to the default chain of environment, shared files and instance roles
+	AccessKeyID     string `yaml:"accesskeyid"`
+	SecretAccessKey string `yaml:"secretaccesskey"`
+	SessionToken    string `yaml:"sessiontoken"`
+	// Profile is the shared config and credentials profile to load
+	Profile string `yaml:"profile"`
+	// RoleARN is assumed with the credentials above
+	RoleARN string `yaml:"rolearn"`
+	// Bootstrap creates Table when missing and enables TTL on ExpiresAt at startup
+	Bootstrap bool `yaml:"bootstrap"`
+	// ReadCapacity and WriteCapacity provision a bootstrapped table, 0 bills per request
+	ReadCapacity  int64 `yaml:"readcapacity"`
+	WriteCapacity int64 `yaml:"writecapacity"`
 }
 
-func initFromViper(v *viper.Viper) *builder {
-	return &builder{
-		Region:   v.GetString("dynamodb-region"),
-		Endpoint: v.GetString("dynamodb-endpoint"),
+// newSession creates AWS session of cfg credentials
+func (cfg Config) newSession() (*session.Session, error) {
+	awsConfig := &aws.Config{Region: aws.String(cfg.Region)}
+	// empty Endpoint resolves the AWS endpoint of Region
+	if cfg.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(cfg.Endpoint)
+	}
+	if cfg.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken)
+	}
+	options := session.Options{Config: *awsConfig}
+	if cfg.Profile != "" {
+		options.Profile = cfg.Profile
+		options.SharedConfigState = session.SharedConfigEnable
 	}
+	s, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RoleARN != "" {
+		s = s.Copy(&aws.Config{Credentials: stscreds.NewCredentials(s, cfg.RoleARN)})
+	}
+	return s, nil
 }
 
-// NewFactory creates dynamodb Client
-func NewFactory(v *viper.Viper) (storage.Client, error) {
-	b := initFromViper(v)
-	s := session.Must(session.NewSession(&aws.Config{
-		Region:   aws.String(b.Region),
-		Endpoint: aws.String(b.Endpoint),
-	}))
+// NewFactory creates dynamodb Client, bootstrapping its table when cfg.Bootstrap
+func NewFactory(cfg Config) (storage.Client, error) {
+	s, err := cfg.newSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot create dynamodb session")
+	}
+	db := dynamodb.New(s)
+	c := NewClient(db).(*DClient)
+	if cfg.Table != "" {
+		c.Table = cfg.Table
+	}
+	if cfg.WatchInterval > 0 {
+		c.WatchInterval = cfg.WatchInterval
+	}
+	// credentials are not logged
 	logging.GetLogger().WithFields(logrus.Fields{
-		"Endpoint": b.Endpoint,
-		"Region":   b.Region,
+		"Endpoint":         cfg.Endpoint,
+		"Region":           cfg.Region,
+		"Table":            c.Table,
+		"Profile":          cfg.Profile,
+		"RoleARN":          cfg.RoleARN,
+		"StaticCredential": cfg.AccessKeyID != "",
 	}).Info("Creating dynamodb session")
-	db := dynamodb.New(s)
-	return NewClient(db), nil
+
+	if cfg.Bootstrap {
+		ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+		defer cancel()
+		if err := c.bootstrap(ctx, cfg.ReadCapacity, cfg.WriteCapacity); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
 }
@@ -1,14 +1,55 @@
 package dynamodb
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_NewFactory(t *testing.T) {
-	v := viper.New()
-	_, err := NewFactory(v)
+	c, err := NewFactory(Config{Region: "us-east-1", Endpoint: "http://localhost:8000"})
 	assert.NoError(t, err)
+	assert.Equal(t, DefaultTable, c.(*DClient).Table)
+
+	c, err = NewFactory(Config{Region: "us-east-1", Endpoint: "http://localhost:8000", Table: "discovery"})
+	assert.NoError(t, err)
+	assert.Equal(t, "discovery", c.(*DClient).Table)
+}
+
+func Test_NewSessionCredentials(t *testing.T) {
+	s, err := Config{Region: "us-east-1", AccessKeyID: "static-id", SecretAccessKey: "static-secret", SessionToken: "token"}.newSession()
+	assert.NoError(t, err)
+	value, err := s.Config.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "static-id", value.AccessKeyID)
+	assert.Equal(t, "static-secret", value.SecretAccessKey)
+	assert.Equal(t, "token", value.SessionToken)
+
+	dir, err := ioutil.TempDir("", "ct-dns-dynamodb")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "credentials")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("[ct-dns]\naws_access_key_id = profile-id\naws_secret_access_key = profile-secret\n"), 0600))
+	defer os.Setenv("AWS_SHARED_CREDENTIALS_FILE", os.Getenv("AWS_SHARED_CREDENTIALS_FILE"))
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", file)
+
+	s, err = Config{Region: "us-east-1", Profile: "ct-dns"}.newSession()
+	assert.NoError(t, err)
+	value, err = s.Config.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "profile-id", value.AccessKeyID)
+
+	// the assumed role is requested with the profile credentials when first used
+	s, err = Config{Region: "us-east-1", Profile: "ct-dns", RoleARN: "arn:aws:iam::123456789012:role/ct-dns"}.newSession()
+	assert.NoError(t, err)
+	assert.NotNil(t, s.Config.Credentials)
+
+	// a missing profile fails once credentials are resolved
+	s, err = Config{Region: "us-east-1", Profile: "missing"}.newSession()
+	assert.NoError(t, err)
+	_, err = s.Config.Credentials.Get()
+	assert.Error(t, err)
 }
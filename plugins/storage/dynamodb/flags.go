@@ -2,10 +2,21 @@ package dynamodb
 
 import (
 	"flag"
+	"time"
 )
 
 // AddFlags binds flags to dynamodb setup
 func AddFlags(flagSet *flag.FlagSet) {
 	flagSet.String("dynamodb-region", "us-east-1", "--dynamodb-region <name>")
-	flagSet.String("dynamodb-endpoint", "http://localhost:8000", "--dynamodb-endpoint <endpoint>")
+	flagSet.String("dynamodb-endpoint", "", "--dynamodb-endpoint <endpoint> overriding the AWS one, e.g. of dynamodb local")
+	flagSet.String("dynamodb-table", DefaultTable, "--dynamodb-table <name> of table holding instances")
+	flagSet.Duration("dynamodb-watch-interval", 5*time.Second, "--dynamodb-watch-interval <duration>")
+	flagSet.String("dynamodb-access-key-id", "", "--dynamodb-access-key-id <id> of static credentials, unset uses the default credential chain")
+	flagSet.String("dynamodb-secret-access-key", "", "--dynamodb-secret-access-key <key> of static credentials")
+	flagSet.String("dynamodb-session-token", "", "--dynamodb-session-token <token> of temporary static credentials")
+	flagSet.String("dynamodb-profile", "", "--dynamodb-profile <name> of shared AWS config and credentials")
+	flagSet.String("dynamodb-role-arn", "", "--dynamodb-role-arn <arn> of role to assume")
+	flagSet.Bool("dynamodb-bootstrap", false, "--dynamodb-bootstrap creates the table when missing and enables its TTL at startup")
+	flagSet.Int64("dynamodb-read-capacity", 0, "--dynamodb-read-capacity <units> of a bootstrapped table, 0 bills per request")
+	flagSet.Int64("dynamodb-write-capacity", 0, "--dynamodb-write-capacity <units> of a bootstrapped table, 0 bills per request")
 }
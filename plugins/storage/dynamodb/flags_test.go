@@ -10,9 +10,17 @@ import (
 func Test_AddFlags(t *testing.T) {
 	flagSet := flag.NewFlagSet("dynamodb", flag.ExitOnError)
 	AddFlags(flagSet)
-	flagSet.Parse([]string{"--dynamodb-region", "us-east-2"})
+	flagSet.Parse([]string{"--dynamodb-region", "us-east-2", "--dynamodb-profile", "ct-dns", "--dynamodb-bootstrap", "--dynamodb-read-capacity", "5"})
 	if flagSet.Parsed() {
 		assert.Equal(t, flagSet.Lookup("dynamodb-region").Value.String(), "us-east-2")
-		assert.Equal(t, flagSet.Lookup("dynamodb-endpoint").Value.String(), "http://localhost:8000")
+		assert.Equal(t, flagSet.Lookup("dynamodb-endpoint").Value.String(), "")
+		assert.Equal(t, flagSet.Lookup("dynamodb-table").Value.String(), DefaultTable)
+		assert.Equal(t, flagSet.Lookup("dynamodb-watch-interval").Value.String(), "5s")
+		assert.Equal(t, flagSet.Lookup("dynamodb-access-key-id").Value.String(), "")
+		assert.Equal(t, flagSet.Lookup("dynamodb-profile").Value.String(), "ct-dns")
+		assert.Equal(t, flagSet.Lookup("dynamodb-role-arn").Value.String(), "")
+		assert.Equal(t, flagSet.Lookup("dynamodb-bootstrap").Value.String(), "true")
+		assert.Equal(t, flagSet.Lookup("dynamodb-read-capacity").Value.String(), "5")
+		assert.Equal(t, flagSet.Lookup("dynamodb-write-capacity").Value.String(), "0")
 	}
 }
@@ -3,8 +3,13 @@
 package mocks
 
 import (
+	context "context"
+
 	dynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
+
 	mock "github.com/stretchr/testify/mock"
+
+	request "github.com/aws/aws-sdk-go/aws/request"
 )
 
 // DynamodbClient is an autogenerated mock type for the DynamodbClient type
@@ -12,13 +17,50 @@ type DynamodbClient struct {
 	mock.Mock
 }
 
-// DeleteItem provides a mock function with given fields: deleteItemInput
-func (_m *DynamodbClient) DeleteItem(deleteItemInput *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
-	ret := _m.Called(deleteItemInput)
+// CreateTableWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) CreateTableWithContext(ctx context.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 *dynamodb.CreateTableOutput
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.CreateTableInput, ...request.Option) *dynamodb.CreateTableOutput); ok {
+		r0 = rf(ctx, input, opts...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dynamodb.CreateTableOutput)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.CreateTableInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteItemWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) DeleteItemWithContext(ctx context.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
 
 	var r0 *dynamodb.DeleteItemOutput
-	if rf, ok := ret.Get(0).(func(*dynamodb.DeleteItemInput) *dynamodb.DeleteItemOutput); ok {
-		r0 = rf(deleteItemInput)
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.DeleteItemInput, ...request.Option) *dynamodb.DeleteItemOutput); ok {
+		r0 = rf(ctx, input, opts...)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*dynamodb.DeleteItemOutput)
@@ -26,8 +68,68 @@ func (_m *DynamodbClient) DeleteItem(deleteItemInput *dynamodb.DeleteItemInput)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(*dynamodb.DeleteItemInput) error); ok {
-		r1 = rf(deleteItemInput)
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.DeleteItemInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DescribeTableWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) DescribeTableWithContext(ctx context.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 *dynamodb.DescribeTableOutput
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.DescribeTableInput, ...request.Option) *dynamodb.DescribeTableOutput); ok {
+		r0 = rf(ctx, input, opts...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dynamodb.DescribeTableOutput)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.DescribeTableInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DescribeTimeToLiveWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) DescribeTimeToLiveWithContext(ctx context.Context, input *dynamodb.DescribeTimeToLiveInput, opts ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 *dynamodb.DescribeTimeToLiveOutput
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.DescribeTimeToLiveInput, ...request.Option) *dynamodb.DescribeTimeToLiveOutput); ok {
+		r0 = rf(ctx, input, opts...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dynamodb.DescribeTimeToLiveOutput)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.DescribeTimeToLiveInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -35,13 +137,20 @@ func (_m *DynamodbClient) DeleteItem(deleteItemInput *dynamodb.DeleteItemInput)
 	return r0, r1
 }
 
-// PutItem provides a mock function with given fields: putItemInput
-func (_m *DynamodbClient) PutItem(putItemInput *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
-	ret := _m.Called(putItemInput)
+// PutItemWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) PutItemWithContext(ctx context.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
 
 	var r0 *dynamodb.PutItemOutput
-	if rf, ok := ret.Get(0).(func(*dynamodb.PutItemInput) *dynamodb.PutItemOutput); ok {
-		r0 = rf(putItemInput)
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.PutItemInput, ...request.Option) *dynamodb.PutItemOutput); ok {
+		r0 = rf(ctx, input, opts...)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*dynamodb.PutItemOutput)
@@ -49,8 +158,8 @@ func (_m *DynamodbClient) PutItem(putItemInput *dynamodb.PutItemInput) (*dynamod
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(*dynamodb.PutItemInput) error); ok {
-		r1 = rf(putItemInput)
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.PutItemInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -58,13 +167,20 @@ func (_m *DynamodbClient) PutItem(putItemInput *dynamodb.PutItemInput) (*dynamod
 	return r0, r1
 }
 
-// Query provides a mock function with given fields: input
-func (_m *DynamodbClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
-	ret := _m.Called(input)
+// QueryWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) QueryWithContext(ctx context.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
 
 	var r0 *dynamodb.QueryOutput
-	if rf, ok := ret.Get(0).(func(*dynamodb.QueryInput) *dynamodb.QueryOutput); ok {
-		r0 = rf(input)
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.QueryInput, ...request.Option) *dynamodb.QueryOutput); ok {
+		r0 = rf(ctx, input, opts...)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*dynamodb.QueryOutput)
@@ -72,11 +188,122 @@ func (_m *DynamodbClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutp
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(*dynamodb.QueryInput) error); ok {
-		r1 = rf(input)
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.QueryInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
 	} else {
 		r1 = ret.Error(1)
 	}
 
 	return r0, r1
 }
+
+// ScanWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) ScanWithContext(ctx context.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 *dynamodb.ScanOutput
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.ScanInput, ...request.Option) *dynamodb.ScanOutput); ok {
+		r0 = rf(ctx, input, opts...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dynamodb.ScanOutput)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.ScanInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateItemWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) UpdateItemWithContext(ctx context.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 *dynamodb.UpdateItemOutput
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.UpdateItemInput, ...request.Option) *dynamodb.UpdateItemOutput); ok {
+		r0 = rf(ctx, input, opts...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dynamodb.UpdateItemOutput)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.UpdateItemInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateTimeToLiveWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) UpdateTimeToLiveWithContext(ctx context.Context, input *dynamodb.UpdateTimeToLiveInput, opts ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 *dynamodb.UpdateTimeToLiveOutput
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.UpdateTimeToLiveInput, ...request.Option) *dynamodb.UpdateTimeToLiveOutput); ok {
+		r0 = rf(ctx, input, opts...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*dynamodb.UpdateTimeToLiveOutput)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *dynamodb.UpdateTimeToLiveInput, ...request.Option) error); ok {
+		r1 = rf(ctx, input, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// WaitUntilTableExistsWithContext provides a mock function with given fields: ctx, input, opts
+func (_m *DynamodbClient) WaitUntilTableExistsWithContext(ctx context.Context, input *dynamodb.DescribeTableInput, opts ...request.WaiterOption) error {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, input)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *dynamodb.DescribeTableInput, ...request.WaiterOption) error); ok {
+		r0 = rf(ctx, input, opts...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
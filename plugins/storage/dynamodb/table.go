@@ -0,0 +1,105 @@
+package dynamodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// bootstrapTimeout bounds creating the table and waiting for it to become active
+const bootstrapTimeout = 5 * time.Minute
+
+// ttlAttribute is the attribute DynamoDB expires instances by
+const ttlAttribute = "ExpiresAt"
+
+// bootstrap creates the table when missing and enables TTL on ExpiresAt.
+// Capacities above 0 provision the table, otherwise it is billed per request.
+func (c *DClient) bootstrap(ctx context.Context, readCapacity, writeCapacity int64) error {
+	_, err := c.DB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(c.Table),
+	})
+	if isErrorCode(err, dynamodb.ErrCodeResourceNotFoundException) {
+		err = c.createTable(ctx, readCapacity, writeCapacity)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to bootstrap table %s", c.Table)
+	}
+	return c.enableTTL(ctx)
+}
+
+// createTable creates the table keyed by Service and Host, waiting until it exists
+func (c *DClient) createTable(ctx context.Context, readCapacity, writeCapacity int64) error {
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(c.Table),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("Service"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("Host"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("Service"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("Host"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	}
+	if readCapacity > 0 || writeCapacity > 0 {
+		input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(readCapacity),
+			WriteCapacityUnits: aws.Int64(writeCapacity),
+		}
+	}
+	logging.GetLogger().WithFields(logrus.Fields{
+		"Table":       c.Table,
+		"BillingMode": aws.StringValue(input.BillingMode),
+	}).Info("Creating dynamodb table")
+	// another ct-dns starting alongside may be creating the table already
+	if _, err := c.DB.CreateTableWithContext(ctx, input); err != nil && !isErrorCode(err, dynamodb.ErrCodeResourceInUseException) {
+		return errors.Wrap(err, "Failed to create table")
+	}
+	err := c.DB.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(c.Table),
+	})
+	return errors.Wrap(err, "Failed to wait for table")
+}
+
+// enableTTL makes DynamoDB delete expired instances, leaving TTL on another attribute as is
+func (c *DClient) enableTTL(ctx context.Context) error {
+	resp, err := c.DB.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(c.Table),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to describe table TTL")
+	}
+	if desc := resp.TimeToLiveDescription; desc != nil {
+		switch aws.StringValue(desc.TimeToLiveStatus) {
+		case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+			if attribute := aws.StringValue(desc.AttributeName); attribute != ttlAttribute {
+				logging.GetLogger().WithFields(logrus.Fields{
+					"Table":     c.Table,
+					"Attribute": attribute,
+				}).Warn("Table TTL is not on ExpiresAt, expired instances are not deleted")
+			}
+			return nil
+		}
+	}
+	_, err = c.DB.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(c.Table),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(ttlAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return errors.Wrap(err, "Failed to enable table TTL")
+}
+
+// isErrorCode tells whether err is an AWS error with code
+func isErrorCode(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
@@ -0,0 +1,97 @@
+package dynamodb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guanw/ct-dns/plugins/storage/dynamodb/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func ttlOutput(status, attribute string) *dynamodb.DescribeTimeToLiveOutput {
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &dynamodb.TimeToLiveDescription{
+		TimeToLiveStatus: aws.String(status),
+		AttributeName:    aws.String(attribute),
+	}}
+}
+
+func Test_BootstrapExistingTable(t *testing.T) {
+	db := &mocks.DynamodbClient{}
+	c := newTestClient(db)
+	c.Table = "discovery"
+	describe := &dynamodb.DescribeTableInput{TableName: aws.String("discovery")}
+	db.On("DescribeTableWithContext", mock.Anything, describe).Return(&dynamodb.DescribeTableOutput{}, nil)
+	db.On("DescribeTimeToLiveWithContext", mock.Anything, mock.Anything).Return(ttlOutput(dynamodb.TimeToLiveStatusEnabled, "ExpiresAt"), nil).Once()
+	assert.NoError(t, c.bootstrap(context.Background(), 0, 0))
+	db.AssertNotCalled(t, "CreateTableWithContext", mock.Anything, mock.Anything)
+	db.AssertNotCalled(t, "UpdateTimeToLiveWithContext", mock.Anything, mock.Anything)
+
+	// TTL on another attribute is left alone
+	db.On("DescribeTimeToLiveWithContext", mock.Anything, mock.Anything).Return(ttlOutput(dynamodb.TimeToLiveStatusEnabling, "Expiry"), nil).Once()
+	assert.NoError(t, c.bootstrap(context.Background(), 0, 0))
+	db.AssertNotCalled(t, "UpdateTimeToLiveWithContext", mock.Anything, mock.Anything)
+
+	db.On("DescribeTimeToLiveWithContext", mock.Anything, mock.Anything).Return(ttlOutput(dynamodb.TimeToLiveStatusDisabled, ""), nil).Once()
+	db.On("UpdateTimeToLiveWithContext", mock.Anything, mock.Anything).Return(&dynamodb.UpdateTimeToLiveOutput{}, nil).Once()
+	assert.NoError(t, c.bootstrap(context.Background(), 0, 0))
+	update := db.Calls[len(db.Calls)-1].Arguments.Get(1).(*dynamodb.UpdateTimeToLiveInput)
+	assert.Equal(t, "discovery", *update.TableName)
+	assert.Equal(t, "ExpiresAt", *update.TimeToLiveSpecification.AttributeName)
+	assert.True(t, *update.TimeToLiveSpecification.Enabled)
+}
+
+func Test_BootstrapMissingTable(t *testing.T) {
+	tests := []struct {
+		readCapacity  int64
+		writeCapacity int64
+		createErr     error
+		billingMode   string
+	}{
+		{billingMode: dynamodb.BillingModePayPerRequest},
+		{readCapacity: 5, writeCapacity: 2, billingMode: dynamodb.BillingModeProvisioned},
+		// another ct-dns is creating the table
+		{createErr: awserr.New(dynamodb.ErrCodeResourceInUseException, "creating", nil), billingMode: dynamodb.BillingModePayPerRequest},
+	}
+	for _, test := range tests {
+		db := &mocks.DynamodbClient{}
+		c := newTestClient(db)
+		db.On("DescribeTableWithContext", mock.Anything, mock.Anything).Return(nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil))
+		db.On("CreateTableWithContext", mock.Anything, mock.Anything).Return(&dynamodb.CreateTableOutput{}, test.createErr)
+		db.On("WaitUntilTableExistsWithContext", mock.Anything, &dynamodb.DescribeTableInput{TableName: aws.String("service-discovery")}).Return(nil)
+		db.On("DescribeTimeToLiveWithContext", mock.Anything, mock.Anything).Return(&dynamodb.DescribeTimeToLiveOutput{}, nil)
+		db.On("UpdateTimeToLiveWithContext", mock.Anything, mock.Anything).Return(&dynamodb.UpdateTimeToLiveOutput{}, nil)
+
+		assert.NoError(t, c.bootstrap(context.Background(), test.readCapacity, test.writeCapacity))
+		input := db.Calls[1].Arguments.Get(1).(*dynamodb.CreateTableInput)
+		assert.Equal(t, "service-discovery", *input.TableName)
+		assert.Equal(t, "Service", *input.KeySchema[0].AttributeName)
+		assert.Equal(t, dynamodb.KeyTypeHash, *input.KeySchema[0].KeyType)
+		assert.Equal(t, "Host", *input.KeySchema[1].AttributeName)
+		assert.Equal(t, dynamodb.KeyTypeRange, *input.KeySchema[1].KeyType)
+		assert.Equal(t, test.billingMode, *input.BillingMode)
+		if test.readCapacity > 0 {
+			assert.Equal(t, test.readCapacity, *input.ProvisionedThroughput.ReadCapacityUnits)
+			assert.Equal(t, test.writeCapacity, *input.ProvisionedThroughput.WriteCapacityUnits)
+		} else {
+			assert.Nil(t, input.ProvisionedThroughput)
+		}
+		db.AssertExpectations(t)
+	}
+}
+
+func Test_BootstrapFailure(t *testing.T) {
+	db := &mocks.DynamodbClient{}
+	db.On("DescribeTableWithContext", mock.Anything, mock.Anything).Return(nil, awserr.New("AccessDeniedException", "denied", nil))
+	assert.Error(t, newTestClient(db).bootstrap(context.Background(), 0, 0))
+	db.AssertNotCalled(t, "CreateTableWithContext", mock.Anything, mock.Anything)
+
+	db = &mocks.DynamodbClient{}
+	db.On("DescribeTableWithContext", mock.Anything, mock.Anything).Return(nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil))
+	db.On("CreateTableWithContext", mock.Anything, mock.Anything).Return(nil, awserr.New(dynamodb.ErrCodeLimitExceededException, "limit", nil))
+	assert.Error(t, newTestClient(db).bootstrap(context.Background(), 0, 0))
+	db.AssertNotCalled(t, "WaitUntilTableExistsWithContext", mock.Anything, mock.Anything)
+}
@@ -3,60 +3,306 @@ package etcd
 import (
 	"context"
 	"encoding/json"
+	"math"
+	"sort"
 	"strings"
-	"sync"
+	"time"
 
+	"github.com/guanw/ct-dns/pkg/logging"
 	"github.com/guanw/ct-dns/storage"
-	"go.etcd.io/etcd/client"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// Client defines api client for Create/Get/Delete operations
+const (
+	// DefaultPrefix is the key prefix instances are stored under unless configured
+	DefaultPrefix         = "/ct-dns"
+	defaultRequestTimeout = 5 * time.Second
+)
+
+// Client defines etcd v3 client for Create/Get/Delete operations
+// every instance is stored as json under Prefix/key/host, instances registered
+// with a ttl are attached to a lease of their own so they expire independently,
+// namespaces other than the default one live under Prefix@namespace/key/host
 type Client struct {
-	API  client.KeysAPI
-	lock sync.Mutex
+	Client *clientv3.Client
+	Prefix string
+	// RequestTimeout bounds every call to etcd on top of the caller's context
+	RequestTimeout time.Duration
 }
 
-// NewClient creates new api client
-func NewClient(api client.KeysAPI) storage.Client {
+// NewClient creates new etcd v3 client storing instances under prefix
+func NewClient(client *clientv3.Client, prefix string) storage.Client {
 	return &Client{
-		API: api,
+		Client:         client,
+		Prefix:         strings.TrimSuffix(prefix, "/"),
+		RequestTimeout: defaultRequestTimeout,
 	}
 }
 
-// Create sets new /key/value directory
-func (c *Client) Create(key, value string) error {
-	c.lock.Lock()
-	_, err := c.API.Set(context.Background(), "/"+key+"/"+value, "", &client.SetOptions{
-		PrevExist: client.PrevIgnore,
-	})
-	c.lock.Unlock()
-	return err
+// root returns the directory keys of namespace live under
+func (c *Client) root(namespace string) string {
+	if namespace == storage.DefaultNamespace {
+		return c.Prefix + "/"
+	}
+	return c.Prefix + "@" + namespace + "/"
+}
+
+func (c *Client) dir(namespace, key string) string {
+	return c.root(namespace) + key + "/"
+}
+
+// context bounds ctx by RequestTimeout
+func (c *Client) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.RequestTimeout)
+}
+
+// grant creates a lease expiring after ttl, rounded up to whole seconds, no lease is needed without ttl
+func (c *Client) grant(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, error) {
+	if ttl <= 0 {
+		return clientv3.NoLease, nil
+	}
+	resp, err := c.Client.Grant(ctx, int64(math.Ceil(ttl.Seconds())))
+	if err != nil {
+		return clientv3.NoLease, errors.Wrap(err, "Failed to grant lease")
+	}
+	return resp.ID, nil
+}
+
+// revoke drops lease previously attached to a key, failures only delay its expiration
+func (c *Client) revoke(ctx context.Context, lease clientv3.LeaseID) {
+	if lease == clientv3.NoLease {
+		return
+	}
+	if _, err := c.Client.Revoke(ctx, lease); err != nil {
+		logging.GetLogger().WithError(err).WithField("lease", lease).Warn("Failed to revoke etcd lease")
+	}
+}
+
+// previousLease returns lease of the key read by the first operation of txn
+func previousLease(resp *clientv3.TxnResponse) clientv3.LeaseID {
+	if len(resp.Responses) == 0 {
+		return clientv3.NoLease
+	}
+	kvs := resp.Responses[0].GetResponseRange().GetKvs()
+	if len(kvs) == 0 {
+		return clientv3.NoLease
+	}
+	return clientv3.LeaseID(kvs[0].Lease)
+}
+
+// Create puts instance under Prefix/key/host on a new lease expiring after ttl,
+// lease of a previously registered instance is revoked once replaced
+func (c *Client) Create(ctx context.Context, namespace, key string, instance storage.Instance, ttl time.Duration) error {
+	meta, err := json.Marshal(instance)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal instance")
+	}
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	lease, err := c.grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	k := c.dir(namespace, key) + instance.Host
+	resp, err := c.Client.Txn(ctx).Then(
+		clientv3.OpGet(k),
+		clientv3.OpPut(k, string(meta), clientv3.WithLease(lease)),
+	).Commit()
+	if err != nil {
+		c.revoke(ctx, lease)
+		return errors.Wrap(err, "Failed to put instance")
+	}
+	if previous := previousLease(resp); previous != lease {
+		c.revoke(ctx, previous)
+	}
+	return nil
 }
 
-// Get gets values under /key directory
-func (c *Client) Get(key string) (string, error) {
-	c.lock.Lock()
-	resp, err := c.API.Get(context.Background(), "/"+key, &client.GetOptions{
-		Recursive: true,
-	})
-	c.lock.Unlock()
+// Get gets instances under Prefix/key, hosts are taken from keys
+func (c *Client) Get(ctx context.Context, namespace, key string) (string, error) {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	dir := c.dir(namespace, key)
+	resp, err := c.Client.Get(ctx, dir, clientv3.WithPrefix())
 	if err != nil {
-		return "", err
+		return "", errors.Wrap(err, "Failed to get instances")
 	}
-	var res []string
-	for index := range resp.Node.Nodes {
-		res = append(res, strings.Split(resp.Node.Nodes[index].Key, "/")[2])
+	if len(resp.Kvs) == 0 {
+		return "", storage.ErrKeyNotFound
+	}
+	res := make([]storage.Instance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var instance storage.Instance
+		if err := json.Unmarshal(kv.Value, &instance); err != nil {
+			logging.GetLogger().WithError(err).WithField("key", string(kv.Key)).Warn("Failed to decode instance metadata")
+		}
+		instance.Host = strings.TrimPrefix(string(kv.Key), dir)
+		res = append(res, instance)
 	}
 	json, _ := json.Marshal(res)
 	return string(json), nil
 }
 
-// Delete delete key recursively
-func (c *Client) Delete(key, value string) error {
-	c.lock.Lock()
-	_, err := c.API.Delete(context.Background(), "/"+key+"/"+value, &client.DeleteOptions{
-		Recursive: true,
-	})
-	c.lock.Unlock()
+// Delete deletes Prefix/key/value and revokes its lease
+func (c *Client) Delete(ctx context.Context, namespace, key, value string) error {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	resp, err := c.Client.Delete(ctx, c.dir(namespace, key)+value, clientv3.WithPrevKV())
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete instance")
+	}
+	for _, kv := range resp.PrevKvs {
+		c.revoke(ctx, clientv3.LeaseID(kv.Lease))
+	}
+	return nil
+}
+
+// Renew moves existing Prefix/key/value onto a new lease expiring after ttl, its value is untouched
+// so watchers are not notified, the compare in txn keeps an expired or deleted value from coming back
+func (c *Client) Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	lease, err := c.grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	k := c.dir(namespace, key) + value
+	resp, err := c.Client.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(k), ">", 0),
+	).Then(
+		clientv3.OpGet(k),
+		clientv3.OpPut(k, "", clientv3.WithIgnoreValue(), clientv3.WithLease(lease)),
+	).Commit()
+	if err != nil {
+		c.revoke(ctx, lease)
+		return errors.Wrap(err, "Failed to renew instance")
+	}
+	if !resp.Succeeded {
+		c.revoke(ctx, lease)
+		return storage.ErrInstanceNotFound
+	}
+	if previous := previousLease(resp); previous != lease {
+		c.revoke(ctx, previous)
+	}
+	return nil
+}
+
+// List lists keys of namespace starting with prefix
+func (c *Client) List(ctx context.Context, namespace, prefix string) ([]string, error) {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	root := c.root(namespace)
+	resp, err := c.Client.Get(ctx, root+prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list keys")
+	}
+	seen := make(map[string]bool)
+	res := []string{}
+	for _, kv := range resp.Kvs {
+		rest := strings.TrimPrefix(string(kv.Key), root)
+		i := strings.LastIndex(rest, "/")
+		if i <= 0 {
+			continue
+		}
+		if key := rest[:i]; !seen[key] {
+			seen[key] = true
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Watch streams hosts added/removed under Prefix/key until ctx is done
+func (c *Client) Watch(ctx context.Context, namespace, key string) (<-chan storage.Event, error) {
+	dir := c.dir(namespace, key)
+	watchCh := c.Client.Watch(clientv3.WithRequireLeader(ctx), dir, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	events := make(chan storage.Event)
+	go func() {
+		defer close(events)
+		for resp := range watchCh {
+			if err := resp.Err(); err != nil {
+				logging.GetLogger().WithError(err).WithField("key", key).Warn("etcd watch broke")
+				return
+			}
+			for _, ev := range resp.Events {
+				event, ok := toEvent(key, dir, ev)
+				if !ok {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// IsTransient tells unavailable or overloaded cluster, lost leader and timeouts from permanent errors
+func (c *Client) IsTransient(err error) bool {
+	err = errors.Cause(err)
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	code := status.Code(err)
+	if etcdErr, ok := err.(rpctypes.EtcdError); ok {
+		code = etcdErr.Code()
+	}
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// Ping asks endpoints for their member status until one reports a leader
+func (c *Client) Ping(ctx context.Context) error {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	err := errors.New("No etcd endpoints")
+	for _, endpoint := range c.Client.Endpoints() {
+		resp, statusErr := c.Client.Status(ctx, endpoint)
+		if statusErr != nil {
+			err = errors.Wrapf(statusErr, "Failed to get status of etcd member %s", endpoint)
+			continue
+		}
+		if resp.Leader == 0 {
+			err = errors.Errorf("etcd member %s has no leader", endpoint)
+			continue
+		}
+		return nil
+	}
 	return err
 }
+
+// Close closes connections to etcd, cancelling watches
+func (c *Client) Close() error {
+	return c.Client.Close()
+}
+
+func toEvent(key, dir string, ev *clientv3.Event) (storage.Event, bool) {
+	event := storage.Event{
+		Key:   key,
+		Value: strings.TrimPrefix(string(ev.Kv.Key), dir),
+	}
+	switch ev.Type {
+	case clientv3.EventTypePut:
+		// renewing or re-adding a host with the same metadata only moves its lease
+		if ev.PrevKv != nil && string(ev.PrevKv.Value) == string(ev.Kv.Value) {
+			return storage.Event{}, false
+		}
+		event.Type = storage.EventAdd
+	case clientv3.EventTypeDelete:
+		event.Type = storage.EventRemove
+	default:
+		return storage.Event{}, false
+	}
+	return event, true
+}
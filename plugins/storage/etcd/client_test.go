@@ -2,65 +2,200 @@ package etcd
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"testing"
+	"time"
 
-	"github.com/guanw/ct-dns/plugins/storage/etcd/mocks"
+	"github.com/guanw/ct-dns/storage"
 	"github.com/stretchr/testify/assert"
-	client "go.etcd.io/etcd/client"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/embed"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func Test_SetKeyValueNonError(t *testing.T) {
-	assert.True(t, true)
-	api := &mocks.KeysAPI{}
-	api.On("Set", context.Background(), "/dummy-service/[192.0.0.1, 192.0.0.2]", "", &client.SetOptions{
-		PrevExist: client.PrevIgnore,
-	}).Return(&client.Response{
-		Node: &client.Node{
-			Key:   "dummy-service",
-			Value: "[192.0.0.1, 192.0.0.2]",
-		},
-	}, nil)
-	client := NewClient(api)
-	err := client.Create("dummy-service", "[192.0.0.1, 192.0.0.2]")
-	assert.NoError(t, err)
+var endpoint string
+
+// TestMain runs tests against a single node etcd embedded in the test binary
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "ct-dns-etcd")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	local, _ := url.Parse("http://127.0.0.1:0")
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.Logger = "zap"
+	cfg.LogLevel = "error"
+	cfg.LCUrls = []url.URL{*local}
+	cfg.LPUrls = []url.URL{*local}
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	<-e.Server.ReadyNotify()
+	endpoint = e.Clients[0].Addr().String()
+	code := m.Run()
+	e.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestClient returns client storing under a prefix unique to the test
+func newTestClient(t *testing.T) (*Client, func()) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{endpoint},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(c, "/"+t.Name()).(*Client), func() { c.Close() }
 }
 
-func Test_Get(t *testing.T) {
-	api := &mocks.KeysAPI{}
-	api.On("Get", context.Background(), "/dummy-service", &client.GetOptions{
-		Recursive: true,
-	}).Return(&client.Response{
-		Node: &client.Node{
-			Nodes: client.Nodes{
-				{
-					Key: "/dummy-service/192.0.0.1",
-				},
-				{
-					Key: "/dummy-service/192.0.0.2",
-				},
-			},
-		},
-	}, nil)
-	cli := NewClient(api)
-	res, err := cli.Get("dummy-service")
+func Test_CreateAndGet(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+	_, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+
+	instance := storage.Instance{Host: "192.0.0.1", Zone: "us-east-1a", Weight: 3, Tags: map[string]string{"version": "v2"}}
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", instance, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1","zone":"us-east-1a","weight":3,"tags":{"version":"v2"}},{"host":"192.0.0.2"}]`, res)
+
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	res, err = c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.NoError(t, err)
-	assert.Equal(t, "[\"192.0.0.1\",\"192.0.0.2\"]", res)
-
-	api.On("Get", context.Background(), "/unseen-service", &client.GetOptions{
-		Recursive: true,
-	}).Return(nil, errors.New("not seen"))
-	res, err = cli.Get("unseen-service")
-	assert.Error(t, err)
-	assert.Equal(t, "", res)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2"}]`, res)
 }
 
 func Test_Delete(t *testing.T) {
-	api := &mocks.KeysAPI{}
-	api.On("Delete", context.Background(), "/dummy-service/192.0.0.1", &client.DeleteOptions{
-		Recursive: true,
-	}).Return(&client.Response{}, nil)
-	cli := NewClient(api)
-	err := cli.Delete("dummy-service", "192.0.0.1")
+	c, done := newTestClient(t)
+	defer done()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, time.Minute))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1"))
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.2"}]`, res)
+
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2"))
+	_, err = c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+	// deleting a missing host is not an error
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.3"))
+}
+
+func Test_TTLExpiresAndRenews(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.3"}, 0))
+	assert.NoError(t, c.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", time.Minute))
+
+	assert.Eventually(t, func() bool {
+		res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+		return err == nil && res == `[{"host":"192.0.0.1"},{"host":"192.0.0.3"}]`
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Equal(t, storage.ErrInstanceNotFound, c.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2", time.Minute))
+	assert.Equal(t, storage.ErrInstanceNotFound, c.Renew(context.Background(), storage.DefaultNamespace, "missing-service", "192.0.0.1", time.Minute))
+}
+
+func Test_List(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "web-frontend", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "web-frontend", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "web-backend", storage.Instance{Host: "192.0.0.3"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "db", storage.Instance{Host: "192.0.0.4"}, 0))
+
+	res, err := c.List(context.Background(), storage.DefaultNamespace, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db", "web-backend", "web-frontend"}, res)
+	res, err = c.List(context.Background(), storage.DefaultNamespace, "web-")
 	assert.NoError(t, err)
+	assert.Equal(t, []string{"web-backend", "web-frontend"}, res)
+	res, err = c.List(context.Background(), storage.DefaultNamespace, "cache")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, res)
+}
+
+func Test_Namespaces(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "api", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), "team-a", "api", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Create(context.Background(), "team-a", "web", storage.Instance{Host: "192.0.0.3"}, 0))
+
+	res, err := c.Get(context.Background(), "team-a", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.2"}]`, res)
+	keys, err := c.List(context.Background(), storage.DefaultNamespace, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api"}, keys)
+	keys, err = c.List(context.Background(), "team-a", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api", "web"}, keys)
+	_, err = c.Get(context.Background(), "team-b", "api")
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+}
+
+func Test_Watch(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := c.Watch(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, time.Minute))
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	// renewing and re-registering unchanged metadata are not reported
+	assert.NoError(t, c.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", time.Minute))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, time.Minute))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1", Zone: "us-east-1a"}, time.Minute))
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1"))
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+
+	cancel()
+	for range events {
+	}
+}
+
+func Test_IsTransient(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{err: rpctypes.ErrNoLeader, transient: true},
+		{err: rpctypes.ErrGRPCTimeout, transient: true},
+		{err: status.Error(codes.Unavailable, "connection refused"), transient: true},
+		{err: context.DeadlineExceeded, transient: true},
+		{err: rpctypes.ErrAuthFailed},
+		{err: storage.ErrKeyNotFound},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.transient, c.IsTransient(test.err), test.err.Error())
+	}
+}
+
+func Test_PingAndClose(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+	assert.NoError(t, c.Ping(context.Background()))
+	assert.NoError(t, c.Close())
+	assert.Error(t, c.Ping(context.Background()))
 }
@@ -1,38 +1,61 @@
 package etcd
 
 import (
-	"strings"
+	"crypto/tls"
+	"time"
 
 	"github.com/guanw/ct-dns/pkg/logging"
 	"github.com/guanw/ct-dns/storage"
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
-	"go.etcd.io/etcd/client"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/pkg/transport"
 )
 
-type builder struct {
-	Endpoints []string
+// Config contains config for etcd storage
+type Config struct {
+	Endpoints   []string      `yaml:"endpoints"`
+	Prefix      string        `yaml:"prefix"`
+	DialTimeout time.Duration `yaml:"dialtimeout"`
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password"`
+	TLSCert     string        `yaml:"tlscert"`
+	TLSKey      string        `yaml:"tlskey"`
+	TLSCA       string        `yaml:"tlsca"`
 }
 
-func initFromViper(v *viper.Viper) *builder {
-	endpoints := strings.Split(v.GetString("etcd-endpoints"), ",")
-	return &builder{
-		Endpoints: endpoints,
+// tlsConfig returns nil unless any of cert, key or ca is set
+func (cfg Config) tlsConfig() (*tls.Config, error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" && cfg.TLSCA == "" {
+		return nil, nil
 	}
+	info := transport.TLSInfo{
+		CertFile:      cfg.TLSCert,
+		KeyFile:       cfg.TLSKey,
+		TrustedCAFile: cfg.TLSCA,
+	}
+	return info.ClientConfig()
 }
 
 // NewFactory creates new etcd factory
-func NewFactory(v *viper.Viper) (storage.Client, error) {
-	b := initFromViper(v)
-	etcdCfg := client.Config{
-		Endpoints: b.Endpoints,
+func NewFactory(cfg Config) (storage.Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot load etcd tls config")
 	}
-
-	c, err := client.New(etcdCfg)
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfg.DialTimeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		TLS:         tlsConfig,
+	})
 	if err != nil {
-		// handle error
 		return nil, errors.Wrap(err, "Cannot initialize the etcd client")
 	}
-	logging.GetLogger().WithField("Endpoints", b.Endpoints).Info("Creating etcd session")
-	return NewClient(client.NewKeysAPI(c)), nil
+	logging.GetLogger().WithField("Endpoints", cfg.Endpoints).WithField("Prefix", prefix).Info("Creating etcd session")
+	return NewClient(c, prefix), nil
 }
@@ -3,12 +3,13 @@ package etcd
 import (
 	"testing"
 
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_NewFactory(t *testing.T) {
-	v := viper.New()
-	_, err := NewFactory(v)
+	_, err := NewFactory(Config{Endpoints: []string{"http://127.0.0.1:2379"}})
 	assert.NoError(t, err)
+
+	_, err = NewFactory(Config{})
+	assert.Error(t, err)
 }
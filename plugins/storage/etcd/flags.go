@@ -2,9 +2,17 @@ package etcd
 
 import (
 	"flag"
+	"time"
 )
 
 // AddFlags binds flags to etcd setup
 func AddFlags(flagSet *flag.FlagSet) {
-	flagSet.String("etcd-endpoints", `http://10.110.251.205:2379`, "--etcd-endpoints <name>")
+	flagSet.String("etcd-endpoints", "http://127.0.0.1:2379", "--etcd-endpoints <comma separated endpoints>")
+	flagSet.String("etcd-prefix", DefaultPrefix, "--etcd-prefix <key prefix instances are stored under>")
+	flagSet.Duration("etcd-dial-timeout", 5*time.Second, "--etcd-dial-timeout <duration>")
+	flagSet.String("etcd-username", "", "--etcd-username <user> to authenticate with")
+	flagSet.String("etcd-password", "", "--etcd-password <password> to authenticate with")
+	flagSet.String("etcd-tls-cert", "", "--etcd-tls-cert <path> of client certificate")
+	flagSet.String("etcd-tls-key", "", "--etcd-tls-key <path> of client key")
+	flagSet.String("etcd-tls-ca", "", "--etcd-tls-ca <path> of ca bundle to verify etcd with")
 }
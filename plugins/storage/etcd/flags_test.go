@@ -10,8 +10,17 @@ import (
 func Test_AddFlags(t *testing.T) {
 	flagSet := flag.NewFlagSet("etcd", flag.ExitOnError)
 	AddFlags(flagSet)
-	flagSet.Parse([]string{"--etcd-endpoints", "http://192.0.0.1:5000,http://192.0.0.1:5001"})
+	flagSet.Parse([]string{
+		"--etcd-endpoints", "http://192.0.0.1:5000,http://192.0.0.1:5001",
+		"--etcd-prefix", "/discovery",
+		"--etcd-username", "ct-dns",
+		"--etcd-tls-ca", "/etc/etcd/ca.pem",
+	})
 	if flagSet.Parsed() {
 		assert.Equal(t, flagSet.Lookup("etcd-endpoints").Value.String(), "http://192.0.0.1:5000,http://192.0.0.1:5001")
+		assert.Equal(t, "/discovery", flagSet.Lookup("etcd-prefix").Value.String())
+		assert.Equal(t, "ct-dns", flagSet.Lookup("etcd-username").Value.String())
+		assert.Equal(t, "/etc/etcd/ca.pem", flagSet.Lookup("etcd-tls-ca").Value.String())
+		assert.Equal(t, "5s", flagSet.Lookup("etcd-dial-timeout").Value.String())
 	}
 }
@@ -1,16 +1,16 @@
 package storage
 
 import (
-	"errors"
-
 	config "github.com/guanw/ct-dns/cmd"
-
+	"github.com/guanw/ct-dns/plugins/storage/bolt"
 	"github.com/guanw/ct-dns/plugins/storage/dynamodb"
 	"github.com/guanw/ct-dns/plugins/storage/etcd"
 	"github.com/guanw/ct-dns/plugins/storage/memory"
+	"github.com/guanw/ct-dns/plugins/storage/raft"
 	"github.com/guanw/ct-dns/plugins/storage/redis"
+	"github.com/guanw/ct-dns/plugins/storage/sql"
 	"github.com/guanw/ct-dns/storage"
-	"github.com/spf13/viper"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -18,6 +18,9 @@ const (
 	dynamodbStorageType = "dynamodb"
 	etcdStorageType     = "etcd"
 	redisStorageType    = "redis"
+	boltStorageType     = "bolt"
+	raftStorageType     = "raft"
+	sqlStorageType      = "sql"
 )
 
 // Factory defines interface for factory
@@ -26,31 +29,31 @@ type Factory interface {
 }
 
 type factory struct {
-	StorageType string
-	V           *viper.Viper
-	Cfg         config.Config
+	Cfg config.StorageConfig
 }
 
 func (f *factory) Initialize() (storage.Client, error) {
-	switch f.StorageType {
+	switch f.Cfg.Type {
 	case memoryStorageType:
 		return memory.NewFactory()
 	case etcdStorageType:
-		return etcd.NewFactory(f.V)
+		return etcd.NewFactory(f.Cfg.Etcd)
 	case dynamodbStorageType:
-		return dynamodb.NewFactory(f.V)
+		return dynamodb.NewFactory(f.Cfg.DynamoDB)
 	case redisStorageType:
-		return redis.NewFactory(f.V, f.Cfg)
+		return redis.NewFactory(f.Cfg.Redis)
+	case boltStorageType:
+		return bolt.NewFactory(f.Cfg.Bolt)
+	case raftStorageType:
+		return raft.NewFactory(f.Cfg.Raft)
+	case sqlStorageType:
+		return sql.NewFactory(f.Cfg.SQL)
 	default:
-		return nil, errors.New("Failed to initialize storage factory")
+		return nil, errors.Errorf("Unknown storage type %q, expected one of memory, etcd, dynamodb, redis, bolt, raft and sql", f.Cfg.Type)
 	}
 }
 
-// NewFactory creates storage factory instance
-func NewFactory(v *viper.Viper, cfg config.Config) Factory {
-	return &factory{
-		V:           v,
-		Cfg:         cfg,
-		StorageType: v.GetString("storage-type"),
-	}
+// NewFactory creates storage factory instance for storage type of cfg
+func NewFactory(cfg config.StorageConfig) Factory {
+	return &factory{Cfg: cfg}
 }
@@ -1,11 +1,14 @@
 package storage
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	config "github.com/guanw/ct-dns/cmd"
-	"github.com/spf13/pflag"
-	"github.com/spf13/viper"
+	"github.com/guanw/ct-dns/plugins/storage/sql"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,23 +33,42 @@ func Test_NewFactory(t *testing.T) {
 			expectedErr: false,
 			factoryType: "redis",
 		},
+		{
+			expectedErr: false,
+			factoryType: "bolt",
+		},
+		{
+			expectedErr: false,
+			factoryType: "raft",
+		},
+		{
+			expectedErr: false,
+			factoryType: "sql",
+		},
 		{
 			expectedErr: true,
 			factoryType: "unknown",
 		},
 	}
 
+	dir, err := ioutil.TempDir("", "ct-dns-storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
 	for _, test := range tests {
-		v := viper.New()
-		flagSet := new(pflag.FlagSet)
-		flagSet.String("storage-type", test.factoryType, "--storage-type <name>")
-		v.BindPFlags(flagSet)
-		f := NewFactory(v, config.Config{})
-		_, err := f.Initialize()
+		cfg := config.Default().Storage
+		cfg.Type = test.factoryType
+		cfg.Bolt.Path = filepath.Join(dir, "ct-dns.db")
+		cfg.Raft.BindAddress = "127.0.0.1:0"
+		cfg.Raft.DataDir = filepath.Join(dir, "raft")
+		cfg.SQL.Driver = sql.DriverSQLite
+		cfg.SQL.DSN = filepath.Join(dir, "ct-dns-sql.db")
+		f := NewFactory(cfg)
+		client, err := f.Initialize()
 		if test.expectedErr {
 			assert.Error(t, err)
 		} else {
 			assert.NoError(t, err)
+			client.Close()
 		}
 	}
 }
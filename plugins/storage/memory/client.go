@@ -1,50 +1,92 @@
 package memory
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/guanw/ct-dns/storage"
 )
 
 type memory interface {
-	put(key, value string)
-	get(key string) ([]string, error)
+	put(key string, instance storage.Instance, ttl time.Duration)
+	get(key string) ([]storage.Instance, error)
 	delete(key, value string)
+	renew(key, value string, ttl time.Duration) error
+	watch(ctx context.Context, key string) <-chan storage.Event
+	list(prefix string) []string
+}
+
+const (
+	watchBufferSize = 128
+	evictInterval   = time.Second
+)
+
+type entry struct {
+	instance storage.Instance
+	// expiresAt is zero when entry never expires
+	expiresAt time.Time
 }
 
 type memoryInstance struct {
-	data map[string]map[string]interface{}
-	lock sync.Mutex
+	// data maps key to host to entry
+	data     map[string]map[string]entry
+	watchers map[string]map[chan storage.Event]struct{}
+	lock     sync.Mutex
+	now      func() time.Time
 }
 
-func newMemory() memory {
+func newMemory() *memoryInstance {
 	return &memoryInstance{
-		data: make(map[string]map[string]interface{}),
+		data:     make(map[string]map[string]entry),
+		watchers: make(map[string]map[chan storage.Event]struct{}),
+		now:      time.Now,
 	}
 }
 
-func (m *memoryInstance) put(key, value string) {
+func (m *memoryInstance) expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(ttl)
+}
+
+func (m *memoryInstance) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !m.now().Before(expiresAt)
+}
+
+func (m *memoryInstance) put(key string, instance storage.Instance, ttl time.Duration) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	m.evict(key)
 	_, found := m.data[key]
 	if !found {
-		m.data[key] = make(map[string]interface{})
+		m.data[key] = make(map[string]entry)
+	}
+	if previous, found := m.data[key][instance.Host]; !found || !reflect.DeepEqual(previous.instance, instance) {
+		m.notify(storage.Event{Type: storage.EventAdd, Key: key, Value: instance.Host})
+	}
+	m.data[key][instance.Host] = entry{
+		instance:  instance,
+		expiresAt: m.expiresAt(ttl),
 	}
-	m.data[key][value] = true
 }
 
-func (m *memoryInstance) get(key string) ([]string, error) {
+func (m *memoryInstance) get(key string) ([]storage.Instance, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	m.evict(key)
 	_, found := m.data[key]
 	if !found {
-		return nil, errors.New("key not found")
+		return nil, storage.ErrKeyNotFound
 	}
-	var res []string
-	for nestedK := range m.data[key] {
-		res = append(res, nestedK)
+	var res []storage.Instance
+	for _, e := range m.data[key] {
+		res = append(res, e.instance)
 	}
 	return res, nil
 }
@@ -59,33 +101,156 @@ func (m *memoryInstance) delete(key, value string) {
 	_, found = nestedMap[value]
 	if found {
 		delete(nestedMap, value)
+		m.notify(storage.Event{Type: storage.EventRemove, Key: key, Value: value})
 		if len(nestedMap) == 0 {
 			delete(m.data, key)
 		}
 	}
 }
 
-// Client defines storage client using memory
+func (m *memoryInstance) renew(key, value string, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.evict(key)
+	e, found := m.data[key][value]
+	if !found {
+		return storage.ErrInstanceNotFound
+	}
+	e.expiresAt = m.expiresAt(ttl)
+	m.data[key][value] = e
+	return nil
+}
+
+func (m *memoryInstance) list(prefix string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := []string{}
+	for key := range m.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		m.evict(key)
+		if _, found := m.data[key]; found {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// evict drops expired values under key, caller must hold lock
+func (m *memoryInstance) evict(key string) {
+	nestedMap, found := m.data[key]
+	if !found {
+		return
+	}
+	for value, e := range nestedMap {
+		if m.expired(e.expiresAt) {
+			delete(nestedMap, value)
+			m.notify(storage.Event{Type: storage.EventRemove, Key: key, Value: value})
+		}
+	}
+	if len(nestedMap) == 0 {
+		delete(m.data, key)
+	}
+}
+
+func (m *memoryInstance) watch(ctx context.Context, key string) <-chan storage.Event {
+	sub := make(chan storage.Event, watchBufferSize)
+	m.lock.Lock()
+	if _, found := m.watchers[key]; !found {
+		m.watchers[key] = make(map[chan storage.Event]struct{})
+	}
+	m.watchers[key][sub] = struct{}{}
+	m.lock.Unlock()
+
+	go func() {
+		// expired values are evicted lazily, tick so watchers learn about them
+		ticker := time.NewTicker(evictInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				m.lock.Lock()
+				m.unsubscribe(key, sub)
+				m.lock.Unlock()
+				return
+			case <-ticker.C:
+				m.lock.Lock()
+				m.evict(key)
+				_, subscribed := m.watchers[key][sub]
+				m.lock.Unlock()
+				if !subscribed {
+					return
+				}
+			}
+		}
+	}()
+	return sub
+}
+
+// notify fans event out to watchers of its key, caller must hold lock
+func (m *memoryInstance) notify(event storage.Event) {
+	for sub := range m.watchers[event.Key] {
+		select {
+		case sub <- event:
+		default:
+			// watcher fell behind, close it so it resyncs instead of missing events
+			m.unsubscribe(event.Key, sub)
+		}
+	}
+}
+
+// unsubscribe closes watcher of key, caller must hold lock
+func (m *memoryInstance) unsubscribe(key string, sub chan storage.Event) {
+	if _, found := m.watchers[key][sub]; !found {
+		return
+	}
+	delete(m.watchers[key], sub)
+	close(sub)
+	if len(m.watchers[key]) == 0 {
+		delete(m.watchers, key)
+	}
+}
+
+// Client defines storage client using memory, every namespace is kept apart in a memory of its own
 type Client struct {
-	m memory
+	lock       sync.Mutex
+	namespaces map[string]memory
+	newMemory  func() memory
 }
 
 // NewClient creates new memory client
 func NewClient() storage.Client {
 	return &Client{
-		m: newMemory(),
+		namespaces: make(map[string]memory),
+		newMemory: func() memory {
+			return newMemory()
+		},
 	}
 }
 
-// Create create new key/value pair
-func (c *Client) Create(key, value string) error {
-	c.m.put(key, value)
+// namespace returns memory of namespace, creating it on first use
+func (c *Client) namespace(namespace string) memory {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m, found := c.namespaces[namespace]
+	if !found {
+		m = c.newMemory()
+		c.namespaces[namespace] = m
+	}
+	return m
+}
+
+// Create create new key/instance pair expiring after ttl
+func (c *Client) Create(ctx context.Context, namespace, key string, instance storage.Instance, ttl time.Duration) error {
+	c.namespace(namespace).put(key, instance, ttl)
 	return nil
 }
 
-// Get gets hosts under key
-func (c *Client) Get(key string) (string, error) {
-	res, err := c.m.get(key)
+// Get gets instances under key
+func (c *Client) Get(ctx context.Context, namespace, key string) (string, error) {
+	res, err := c.namespace(namespace).get(key)
 	if err != nil {
 		return "", err
 	}
@@ -94,7 +259,37 @@ func (c *Client) Get(key string) (string, error) {
 }
 
 // Delete deletes service & host combination
-func (c *Client) Delete(key, value string) error {
-	c.m.delete(key, value)
+func (c *Client) Delete(ctx context.Context, namespace, key, value string) error {
+	c.namespace(namespace).delete(key, value)
+	return nil
+}
+
+// Renew extends expiration of service & host combination by ttl
+func (c *Client) Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error {
+	return c.namespace(namespace).renew(key, value, ttl)
+}
+
+// Watch streams hosts added/removed under key until ctx is done
+func (c *Client) Watch(ctx context.Context, namespace, key string) (<-chan storage.Event, error) {
+	return c.namespace(namespace).watch(ctx, key), nil
+}
+
+// IsTransient tells no memory error is worth retrying
+func (c *Client) IsTransient(err error) bool {
+	return false
+}
+
+// List lists keys starting with prefix
+func (c *Client) List(ctx context.Context, namespace, prefix string) ([]string, error) {
+	return c.namespace(namespace).list(prefix), nil
+}
+
+// Ping always succeeds, memory is always reachable
+func (c *Client) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, memory holds no connections
+func (c *Client) Close() error {
 	return nil
 }
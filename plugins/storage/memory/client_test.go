@@ -1,68 +1,223 @@
 package memory
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/guanw/ct-dns/storage"
 	"github.com/stretchr/testify/assert"
 )
 
+// newTestClient creates client whose namespaces read time from now
+func newTestClient(now func() time.Time) *Client {
+	c := NewClient().(*Client)
+	c.newMemory = func() memory {
+		m := newMemory()
+		m.now = now
+		return m
+	}
+	return c
+}
+
 func Test_InsertNewKey(t *testing.T) {
 	m := NewClient()
-	err := m.Create("dummy-service", "192.0.0.1")
+	err := m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0)
 	assert.NoError(t, err)
-	res, err := m.Get("dummy-service")
+	res, err := m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.NoError(t, err)
-	assert.Equal(t, `["192.0.0.1"]`, res)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
 
-	err = m.Create("dummy-service", "192.0.0.2")
+	err = m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0)
 	assert.NoError(t, err)
-	res, err = m.Get("dummy-service")
+	res, err = m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.NoError(t, err)
-	assert.True(t, `["192.0.0.1","192.0.0.2"]` == res || `["192.0.0.2","192.0.0.1"]` == res)
+	assert.True(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2"}]` == res || `[{"host":"192.0.0.2"},{"host":"192.0.0.1"}]` == res)
 }
 func Test_InsertExistingKeys(t *testing.T) {
 	m := NewClient()
-	err := m.Create("dummy-service", "192.0.0.1")
+	err := m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0)
+	assert.NoError(t, err)
+	res, err := m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+
+	err = m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0)
+	assert.NoError(t, err)
+	res, err = m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+}
+
+func Test_InsertWithMetadata(t *testing.T) {
+	m := NewClient()
+	instance := storage.Instance{
+		Host:   "192.0.0.1",
+		Zone:   "us-east-1a",
+		Weight: 10,
+		Canary: true,
+		Tags:   map[string]string{"version": "v2"},
+	}
+	err := m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", instance, 0)
 	assert.NoError(t, err)
-	res, err := m.Get("dummy-service")
+	res, err := m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.NoError(t, err)
-	assert.Equal(t, `["192.0.0.1"]`, res)
+	assert.Equal(t, `[{"host":"192.0.0.1","zone":"us-east-1a","weight":10,"canary":true,"tags":{"version":"v2"}}]`, res)
 
-	err = m.Create("dummy-service", "192.0.0.1")
+	err = m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0)
 	assert.NoError(t, err)
-	res, err = m.Get("dummy-service")
+	res, err = m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.NoError(t, err)
-	assert.Equal(t, `["192.0.0.1"]`, res)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
 }
 
 func Test_DeleteOnlyExistingKey(t *testing.T) {
 	m := NewClient()
-	err := m.Create("dummy-service", "192.0.0.1")
+	err := m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0)
 	assert.NoError(t, err)
-	err = m.Delete("dummy-service", "192.0.0.1")
+	err = m.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1")
 	assert.NoError(t, err)
-	_, err = m.Get("dummy-service")
+	_, err = m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.Error(t, err)
 }
 
 func Test_DeleteExistingKey(t *testing.T) {
 	m := NewClient()
-	err := m.Create("dummy-service", "192.0.0.1")
+	err := m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0)
 	assert.NoError(t, err)
-	err = m.Create("dummy-service", "192.0.0.2")
+	err = m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0)
 	assert.NoError(t, err)
-	err = m.Delete("dummy-service", "192.0.0.1")
+	err = m.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1")
 	assert.NoError(t, err)
-	res, err := m.Get("dummy-service")
+	res, err := m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.NoError(t, err)
-	assert.Equal(t, `["192.0.0.2"]`, res)
+	assert.Equal(t, `[{"host":"192.0.0.2"}]`, res)
 }
 
 func Test_DeleteNonExistingFirstKey(t *testing.T) {
 	m := NewClient()
-	err := m.Delete("dummy-service", "192.0.0.1")
+	err := m.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1")
 	assert.NoError(t, err)
-	res, err := m.Get("dummy-service")
+	res, err := m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.Error(t, err)
 	assert.Equal(t, ``, res)
 }
+
+func Test_ExpireAfterTTL(t *testing.T) {
+	now := time.Now()
+	m := newTestClient(func() time.Time { return now })
+	err := m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second)
+	assert.NoError(t, err)
+	err = m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0)
+	assert.NoError(t, err)
+
+	now = now.Add(10 * time.Second)
+	res, err := m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.2"}]`, res)
+
+	err = m.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2")
+	assert.NoError(t, err)
+	_, err = m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Error(t, err)
+}
+
+func Test_Renew(t *testing.T) {
+	now := time.Now()
+	m := newTestClient(func() time.Time { return now })
+	err := m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second)
+	assert.NoError(t, err)
+
+	now = now.Add(5 * time.Second)
+	err = m.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", 10*time.Second)
+	assert.NoError(t, err)
+
+	now = now.Add(9 * time.Second)
+	res, err := m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+
+	now = now.Add(time.Second)
+	err = m.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", 10*time.Second)
+	assert.Equal(t, storage.ErrInstanceNotFound, err)
+	err = m.Renew(context.Background(), storage.DefaultNamespace, "unknown-service", "192.0.0.1", 10*time.Second)
+	assert.Equal(t, storage.ErrInstanceNotFound, err)
+}
+
+func Test_List(t *testing.T) {
+	now := time.Now()
+	m := newTestClient(func() time.Time { return now })
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "dummy-api", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "dummy-expiring", storage.Instance{Host: "192.0.0.3"}, 10*time.Second))
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "other-service", storage.Instance{Host: "192.0.0.4"}, 0))
+
+	res, err := m.List(context.Background(), storage.DefaultNamespace, "dummy-")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy-api", "dummy-expiring", "dummy-service"}, res)
+
+	now = now.Add(10 * time.Second)
+	res, err = m.List(context.Background(), storage.DefaultNamespace, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy-api", "dummy-service", "other-service"}, res)
+	res, err = m.List(context.Background(), storage.DefaultNamespace, "unknown")
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func Test_Watch(t *testing.T) {
+	now := time.Now()
+	m := newTestClient(func() time.Time { return now })
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := m.Watch(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2", Weight: 5}, 0))
+	assert.NoError(t, m.Create(context.Background(), storage.DefaultNamespace, "other-service", storage.Instance{Host: "192.0.0.3"}, 0))
+	assert.NoError(t, m.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2"))
+	now = now.Add(10 * time.Second)
+	_, err = m.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Error(t, err)
+
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func Test_IsTransient(t *testing.T) {
+	m := NewClient()
+	_, err := m.Get(context.Background(), storage.DefaultNamespace, "missing-service")
+	assert.False(t, m.(storage.ErrorClassifier).IsTransient(err))
+}
+
+func Test_Namespaces(t *testing.T) {
+	m := NewClient()
+	assert.NoError(t, m.Create(context.Background(), "team-a", "api", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, m.Create(context.Background(), "team-b", "api", storage.Instance{Host: "192.0.0.2"}, 0))
+
+	res, err := m.Get(context.Background(), "team-a", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+	_, err = m.Get(context.Background(), storage.DefaultNamespace, "api")
+	assert.Error(t, err)
+	services, err := m.List(context.Background(), "team-b", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api"}, services)
+	assert.NoError(t, m.Delete(context.Background(), "team-b", "api", "192.0.0.1"))
+	res, err = m.Get(context.Background(), "team-a", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+}
+
+func Test_Ping(t *testing.T) {
+	assert.NoError(t, NewClient().Ping(context.Background()))
+}
@@ -0,0 +1,363 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/storage"
+	hraft "github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ReadLinearizable reads on the leader once it confirmed leadership, followers forward reads to it
+	ReadLinearizable = "linearizable"
+	// ReadStale reads the local state of any node, which may lag behind the leader
+	ReadStale = "stale"
+)
+
+const (
+	watchBufferSize = 128
+	evictInterval   = time.Second
+	readGet         = "get"
+	readList        = "list"
+)
+
+var (
+	errNoLeader       = errors.New("no raft leader")
+	errLeaderNotReady = errors.New("raft leader has not applied previous terms yet")
+)
+
+// Client defines storage client replicating the service -> hosts state machine among ct-dns nodes with raft,
+// writes are applied by the leader, followers forward them to it on the raft port.
+// Every node applies committed changes to its own state, so watches are served by any node.
+type Client struct {
+	Raft *hraft.Raft
+	// ReadMode is ReadLinearizable or ReadStale
+	ReadMode string
+	// ApplyTimeout bounds calls whose ctx has no deadline
+	ApplyTimeout time.Duration
+
+	fsm       *fsm
+	forwarder *forwarder
+	now       func() time.Time
+	// closers release the log store and log writer once raft is shut down
+	closers []io.Closer
+
+	// lock guards leadership, barrier of the current term is done once leader is true
+	lock       sync.Mutex
+	leader     bool
+	generation uint64
+
+	// stop ends the leadership and eviction loop, stopped is closed once it ended
+	stop    context.CancelFunc
+	stopped chan struct{}
+	// closed ends watches
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(fsm *fsm, readMode string, applyTimeout time.Duration) *Client {
+	return &Client{
+		ReadMode:     readMode,
+		ApplyTimeout: applyTimeout,
+		fsm:          fsm,
+		forwarder:    &forwarder{},
+		now:          time.Now,
+		stopped:      make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+}
+
+// start runs the leadership and eviction loop on notifications of leadership changes
+func (c *Client) start(notify <-chan bool) {
+	ctx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+	go c.run(ctx, notify)
+}
+
+func (c *Client) deadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(c.ApplyTimeout)
+}
+
+// apply applies cmd on the leader, forwarding it when this node follows
+func (c *Client) apply(ctx context.Context, cmd command) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline := c.deadline(ctx)
+	if c.Raft.State() == hraft.Leader {
+		return c.applyLocal(cmd, time.Until(deadline))
+	}
+	res, err := c.forward(forwardRequest{Command: &cmd}, deadline)
+	if err != nil {
+		return err
+	}
+	return res.toError()
+}
+
+// applyLocal stamps cmd with the time of the leader and applies it, returning the error of the command
+func (c *Client) applyLocal(cmd command, timeout time.Duration) error {
+	now := c.now()
+	cmd.Now = now.UnixNano()
+	if cmd.TTL > 0 {
+		cmd.ExpiresAt = now.Add(time.Duration(cmd.TTL)).UnixNano()
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal command")
+	}
+	future := c.Raft.Apply(data, timeout)
+	if err := future.Error(); err != nil {
+		return errors.Wrap(err, "Failed to apply command")
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) forward(req forwardRequest, deadline time.Time) (forwardResponse, error) {
+	leader := c.Raft.Leader()
+	if leader == "" {
+		return forwardResponse{}, errNoLeader
+	}
+	return c.forwarder.call(string(leader), req, deadline)
+}
+
+// handleForward serves calls forwarded by followers, they fail if leadership moved meanwhile
+func (c *Client) handleForward(req forwardRequest) forwardResponse {
+	if c.Raft.State() != hraft.Leader {
+		return c.newForwardResponse("", nil, hraft.ErrNotLeader)
+	}
+	if req.Command != nil {
+		return c.newForwardResponse("", nil, c.applyLocal(*req.Command, c.ApplyTimeout))
+	}
+	if err := c.verifyLeader(); err != nil {
+		return c.newForwardResponse("", nil, err)
+	}
+	res, err := c.handleRead(req)
+	return c.newForwardResponse(res.Value, res.Keys, err)
+}
+
+func (c *Client) newForwardResponse(value string, keys []string, err error) forwardResponse {
+	res := newForwardResponse(value, keys, err)
+	if err != nil && res.Code == "" && c.IsTransient(err) {
+		res.Code = codeTransient
+	}
+	return res
+}
+
+// verifyLeader confirms this node still leads a quorum and has applied every entry of previous terms,
+// so its state reflects every write acknowledged before
+func (c *Client) verifyLeader() error {
+	c.lock.Lock()
+	leader := c.leader
+	c.lock.Unlock()
+	if !leader {
+		return errLeaderNotReady
+	}
+	return errors.Wrap(c.Raft.VerifyLeader().Error(), "Failed to verify leadership")
+}
+
+// read serves req from local state in ReadStale mode or once leadership is verified,
+// followers forward linearizable reads to the leader
+func (c *Client) read(ctx context.Context, req forwardRequest) (forwardResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return forwardResponse{}, err
+	}
+	if c.ReadMode == ReadStale {
+		return c.handleRead(req)
+	}
+	if c.Raft.State() == hraft.Leader {
+		if err := c.verifyLeader(); err != nil {
+			return forwardResponse{}, err
+		}
+		return c.handleRead(req)
+	}
+	return c.forward(req, c.deadline(ctx))
+}
+
+func (c *Client) handleRead(req forwardRequest) (forwardResponse, error) {
+	now := c.now().UnixNano()
+	if req.Read == readList {
+		return forwardResponse{Keys: c.fsm.list(req.Namespace, req.Key, now)}, nil
+	}
+	value, err := encode(c.fsm.get(req.Namespace, req.Key, now))
+	return forwardResponse{Value: value}, err
+}
+
+// Create create new key/instance pair expiring after ttl
+func (c *Client) Create(ctx context.Context, namespace, key string, instance storage.Instance, ttl time.Duration) error {
+	return c.apply(ctx, command{Op: opCreate, Namespace: namespace, Key: key, Instance: instance, TTL: int64(ttl)})
+}
+
+// Get gets unexpired instances under key
+func (c *Client) Get(ctx context.Context, namespace, key string) (string, error) {
+	res, err := c.read(ctx, forwardRequest{Read: readGet, Namespace: namespace, Key: key})
+	if err != nil {
+		return "", err
+	}
+	return res.Value, res.toError()
+}
+
+// Delete deletes service & host combination
+func (c *Client) Delete(ctx context.Context, namespace, key, value string) error {
+	return c.apply(ctx, command{Op: opDelete, Namespace: namespace, Key: key, Host: value})
+}
+
+// Renew extends expiration of service & host combination by ttl
+func (c *Client) Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error {
+	return c.apply(ctx, command{Op: opRenew, Namespace: namespace, Key: key, Host: value, TTL: int64(ttl)})
+}
+
+// Watch streams hosts added/removed under key as this node applies them until ctx is done or Close,
+// the channel is closed when a snapshot replaces the state
+func (c *Client) Watch(ctx context.Context, namespace, key string) (<-chan storage.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sub := c.fsm.watch(namespace, key, watchBufferSize)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.closed:
+		}
+		c.fsm.unsubscribe(namespace, key, sub)
+	}()
+	return sub, nil
+}
+
+// List lists keys of namespace starting with prefix holding at least one unexpired host
+func (c *Client) List(ctx context.Context, namespace, prefix string) ([]string, error) {
+	res, err := c.read(ctx, forwardRequest{Read: readList, Namespace: namespace, Key: prefix})
+	if err != nil {
+		return nil, err
+	}
+	if err := res.toError(); err != nil {
+		return nil, err
+	}
+	if res.Keys == nil {
+		return []string{}, nil
+	}
+	return res.Keys, nil
+}
+
+// IsTransient tells leader elections and unreachable nodes from permanent errors
+func (c *Client) IsTransient(err error) bool {
+	if storage.IsTransient(err) {
+		return true
+	}
+	switch cause := errors.Cause(err); cause {
+	case hraft.ErrNotLeader, hraft.ErrLeadershipLost, hraft.ErrEnqueueTimeout, hraft.ErrAbortedByRestore,
+		hraft.ErrLeadershipTransferInProgress, errNoLeader, errLeaderNotReady:
+		return true
+	default:
+		_, ok := cause.(net.Error)
+		return ok
+	}
+}
+
+// Ping checks the cluster has a leader
+func (c *Client) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.Raft.State() == hraft.Shutdown {
+		return hraft.ErrRaftShutdown
+	}
+	if c.Raft.Leader() == "" {
+		return errNoLeader
+	}
+	return nil
+}
+
+// Close leaves the cluster without removing this node from it, ends watches and closes the log store
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.stop()
+		<-c.stopped
+		err = c.Raft.Shutdown().Error()
+		c.forwarder.close()
+		for _, closer := range c.closers {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		close(c.closed)
+	})
+	return err
+}
+
+// run tracks leadership and has the leader evict expired hosts every evictInterval until ctx is done
+func (c *Client) run(ctx context.Context, notify <-chan bool) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case leader := <-notify:
+			c.setLeader(leader)
+		case <-ticker.C:
+			if err := c.evict(); err != nil && ctx.Err() == nil {
+				logging.GetLogger().WithError(err).Warn("Failed to remove expired hosts from raft")
+			}
+		}
+	}
+}
+
+// setLeader records leadership, a new leader only serves linearizable reads once a barrier
+// makes sure entries of previous terms are applied
+func (c *Client) setLeader(leader bool) {
+	c.lock.Lock()
+	c.leader = false
+	c.generation++
+	generation := c.generation
+	c.lock.Unlock()
+	if !leader {
+		return
+	}
+	logging.GetLogger().WithField("node", string(c.Raft.Leader())).Info("Elected raft leader")
+	go func() {
+		for {
+			err := c.Raft.Barrier(c.ApplyTimeout).Error()
+			c.lock.Lock()
+			current := c.generation == generation
+			if err == nil && current {
+				c.leader = true
+			}
+			c.lock.Unlock()
+			if err == nil || !current || c.Raft.State() != hraft.Leader {
+				return
+			}
+			logging.GetLogger().WithError(err).Warn("Failed to apply raft barrier, retrying")
+		}
+	}()
+}
+
+// evict removes expired hosts when this node leads and any expired
+func (c *Client) evict() error {
+	if c.Raft.State() != hraft.Leader || !c.fsm.hasExpired(c.now().UnixNano()) {
+		return nil
+	}
+	return c.applyLocal(command{Op: opEvict}, c.ApplyTimeout)
+}
+
+func encode(instances []storage.Instance) (string, error) {
+	if len(instances) == 0 {
+		return "", storage.ErrKeyNotFound
+	}
+	jsonized, _ := json.Marshal(instances)
+	return string(jsonized), nil
+}
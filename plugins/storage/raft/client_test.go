@@ -0,0 +1,359 @@
+package raft
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/tlsconfig"
+
+	"github.com/guanw/ct-dns/storage"
+	hraft "github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRaftConfig elects a leader within tens of milliseconds over loopback
+func testRaftConfig() *hraft.Config {
+	conf := hraft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	return conf
+}
+
+// freeAddresses reserves n loopback addresses, so peers are known before nodes start
+func freeAddresses(t *testing.T, n int) []string {
+	addresses := make([]string, n)
+	for i := range addresses {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		addresses[i] = listener.Addr().String()
+		listener.Close()
+	}
+	return addresses
+}
+
+type testCluster struct {
+	t     *testing.T
+	dir   string
+	cfgs  []Config
+	nodes []*Client
+}
+
+// newTestCluster starts n nodes in process over loopback, close shuts them down and removes their data
+func newTestCluster(t *testing.T, n int, readMode string, configure ...func(*Config)) (*testCluster, func()) {
+	dir, err := ioutil.TempDir("", "ct-dns-raft")
+	assert.NoError(t, err)
+	addresses := freeAddresses(t, n)
+	peers := make([]string, n)
+	for i, address := range addresses {
+		peers[i] = fmt.Sprintf("node-%d=%s", i, address)
+	}
+	c := &testCluster{t: t, dir: dir}
+	for i, address := range addresses {
+		c.cfgs = append(c.cfgs, Config{
+			NodeID:       fmt.Sprintf("node-%d", i),
+			BindAddress:  address,
+			DataDir:      filepath.Join(dir, fmt.Sprintf("node-%d", i)),
+			Peers:        peers,
+			ReadMode:     readMode,
+			ApplyTimeout: time.Second,
+		})
+		for _, f := range configure {
+			f(&c.cfgs[i])
+		}
+		c.nodes = append(c.nodes, nil)
+		c.start(i)
+	}
+	return c, func() {
+		for _, node := range c.nodes {
+			if node != nil {
+				node.Close()
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func (c *testCluster) start(i int) {
+	node, err := newNode(c.cfgs[i], testRaftConfig())
+	assert.NoError(c.t, err)
+	c.nodes[i] = node
+}
+
+func (c *testCluster) stop(i int) {
+	assert.NoError(c.t, c.nodes[i].Close())
+	c.nodes[i] = nil
+}
+
+// leader waits for a leader ready to serve linearizable reads, returning it along with its followers
+func (c *testCluster) leader() (*Client, []*Client) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader *Client
+		var followers []*Client
+		for _, node := range c.nodes {
+			if node == nil {
+				continue
+			}
+			if node.verifyLeader() == nil {
+				leader = node
+			} else {
+				followers = append(followers, node)
+			}
+		}
+		if leader != nil {
+			return leader, followers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("No raft leader elected")
+	return nil, nil
+}
+
+// eventually polls condition, testify Eventually of this version panics under -race when condition is slow
+func eventually(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ClusterForwardsToLeader(t *testing.T) {
+	c, close := newTestCluster(t, 3, ReadLinearizable)
+	defer close()
+	leader, followers := c.leader()
+	assert.Len(t, followers, 2)
+	ctx := context.Background()
+
+	// writes on followers are forwarded to the leader
+	assert.NoError(t, followers[0].Create(ctx, storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, leader.Create(ctx, storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2", Zone: "us-east-1a"}, time.Minute))
+	assert.NoError(t, followers[1].Create(ctx, "team-a", "dummy-api", storage.Instance{Host: "192.0.0.3"}, 0))
+
+	// linearizable reads of followers see every acknowledged write
+	for _, node := range c.nodes {
+		res, err := node.Get(ctx, storage.DefaultNamespace, "dummy-service")
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2","zone":"us-east-1a"}]`, res)
+		services, err := node.List(ctx, "team-a", "dummy-")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"dummy-api"}, services)
+	}
+
+	assert.NoError(t, followers[0].Renew(ctx, storage.DefaultNamespace, "dummy-service", "192.0.0.2", time.Minute))
+	assert.Equal(t, storage.ErrInstanceNotFound, followers[0].Renew(ctx, storage.DefaultNamespace, "dummy-service", "192.0.0.9", time.Minute))
+	assert.NoError(t, followers[1].Delete(ctx, storage.DefaultNamespace, "dummy-service", "192.0.0.1"))
+	_, err := followers[0].Get(ctx, "team-b", "dummy-service")
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+	assert.False(t, followers[0].IsTransient(err))
+	res, err := followers[0].Get(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.2","zone":"us-east-1a"}]`, res)
+	services, err := followers[0].List(ctx, storage.DefaultNamespace, "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, services)
+}
+
+func Test_StaleReads(t *testing.T) {
+	c, close := newTestCluster(t, 3, ReadStale)
+	defer close()
+	leader, followers := c.leader()
+	assert.NoError(t, leader.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	// followers serve their own state, which catches up with the leader
+	for _, follower := range followers {
+		follower := follower
+		eventually(t, func() bool {
+			res, err := follower.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+			return err == nil && res == `[{"host":"192.0.0.1"}]`
+		})
+	}
+}
+
+func Test_WatchFollower(t *testing.T) {
+	c, close := newTestCluster(t, 3, ReadLinearizable)
+	defer close()
+	leader, followers := c.leader()
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := followers[0].Watch(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+
+	assert.NoError(t, followers[1].Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, leader.Create(context.Background(), storage.DefaultNamespace, "other-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, leader.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1"))
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func Test_Failover(t *testing.T) {
+	c, close := newTestCluster(t, 3, ReadLinearizable)
+	defer close()
+	leader, _ := c.leader()
+	assert.NoError(t, leader.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	for i, node := range c.nodes {
+		if node == leader {
+			c.stop(i)
+		}
+	}
+
+	// the remaining quorum elects a new leader holding every acknowledged write
+	leader, followers := c.leader()
+	assert.Len(t, followers, 1)
+	assert.NoError(t, followers[0].Ping(context.Background()))
+	assert.NoError(t, followers[0].Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	res, err := leader.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2"}]`, res)
+}
+
+func Test_SnapshotAndRestart(t *testing.T) {
+	c, close := newTestCluster(t, 1, ReadLinearizable)
+	defer close()
+	leader, _ := c.leader()
+	assert.NoError(t, leader.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, leader.Raft.Snapshot().Error())
+	assert.NoError(t, leader.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+
+	// the snapshot and the log after it are replayed on restart, the cluster is not bootstrapped again
+	c.stop(0)
+	c.start(0)
+	leader, _ = c.leader()
+	res, err := leader.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2"}]`, res)
+}
+
+func Test_ExpireAndEvict(t *testing.T) {
+	c, close := newTestCluster(t, 1, ReadLinearizable)
+	defer close()
+	leader, _ := c.leader()
+	now := time.Now()
+	leader.now = func() time.Time { return now }
+	events, err := leader.Watch(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.NoError(t, leader.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	assert.NoError(t, leader.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 10*time.Second))
+
+	now = now.Add(5 * time.Second)
+	assert.NoError(t, leader.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", 10*time.Second))
+	now = now.Add(5 * time.Second)
+	res, err := leader.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+	assert.Equal(t, storage.ErrInstanceNotFound, leader.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2", 10*time.Second))
+	assert.NoError(t, leader.evict())
+
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+}
+
+func Test_IsTransient(t *testing.T) {
+	c := newClient(newFSM(), ReadLinearizable, time.Second)
+	assert.True(t, c.IsTransient(hraft.ErrNotLeader))
+	assert.True(t, c.IsTransient(errors.Wrap(hraft.ErrLeadershipLost, "Failed to apply command")))
+	assert.True(t, c.IsTransient(errNoLeader))
+	assert.True(t, c.IsTransient(forwardResponse{Code: codeTransient, Error: "timed out enqueuing operation"}.toError()))
+	assert.True(t, c.IsTransient(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.False(t, c.IsTransient(storage.ErrInstanceNotFound))
+	assert.False(t, c.IsTransient(storage.ErrKeyNotFound))
+	assert.False(t, c.IsTransient(hraft.ErrRaftShutdown))
+}
+
+func Test_PingAndClose(t *testing.T) {
+	c, close := newTestCluster(t, 1, ReadLinearizable)
+	defer close()
+	leader, _ := c.leader()
+	assert.NoError(t, leader.Ping(context.Background()))
+	events, err := leader.Watch(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	c.stop(0)
+	assert.Error(t, leader.Ping(context.Background()))
+	_, open := <-events
+	assert.False(t, open)
+	assert.NoError(t, leader.Close())
+}
+
+// writeCert writes a certificate for 127.0.0.1 and its key to dir/name.crt and dir/name.key,
+// signed by parent or self-signed as a CA when parent is nil
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, key
+}
+
+func Test_ClusterOverMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-raft-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "node", ca, caKey)
+	rogueCA, rogueKey := writeCert(t, dir, "rogue-ca", nil, nil)
+	writeCert(t, dir, "rogue", rogueCA, rogueKey)
+
+	c, close := newTestCluster(t, 3, ReadLinearizable, func(cfg *Config) {
+		cfg.TLSCert = filepath.Join(dir, "node.crt")
+		cfg.TLSKey = filepath.Join(dir, "node.key")
+		cfg.TLSCA = filepath.Join(dir, "ca.crt")
+	})
+	defer close()
+	leader, followers := c.leader()
+	ctx := context.Background()
+	assert.NoError(t, followers[0].Create(ctx, storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	res, err := followers[1].Get(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+
+	// plain TCP and certificates of another CA are turned away
+	address := leader.Raft.Leader()
+	read := forwardRequest{Read: readGet, Namespace: storage.DefaultNamespace, Key: "dummy-service"}
+	_, err = (&forwarder{}).call(string(address), read, time.Now().Add(time.Second))
+	assert.Error(t, err)
+	rogue, err := tlsconfig.ClientConfig(filepath.Join(dir, "rogue.crt"), filepath.Join(dir, "rogue.key"), filepath.Join(dir, "ca.crt"), false)
+	assert.NoError(t, err)
+	_, err = (&forwarder{tls: rogue}).call(string(address), read, time.Now().Add(time.Second))
+	assert.Error(t, err)
+}
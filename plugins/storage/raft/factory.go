@@ -0,0 +1,211 @@
+package raft
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/tlsconfig"
+	"github.com/guanw/ct-dns/storage"
+	hclog "github.com/hashicorp/go-hclog"
+	hraft "github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBindAddress is the address raft and forwarded calls are served on unless configured
+	DefaultBindAddress = "127.0.0.1:50052"
+	// DefaultDataDir is the directory the raft log and snapshots are kept in unless configured
+	DefaultDataDir = "raft"
+	// DefaultApplyTimeout bounds writes and forwarded calls whose ctx has no deadline
+	DefaultApplyTimeout = 5 * time.Second
+	// DefaultRetainSnapshots is the number of snapshots kept on disk
+	DefaultRetainSnapshots = 2
+)
+
+// Config contains config for raft storage
+type Config struct {
+	// NodeID identifies this node in the cluster, it defaults to the advertise address
+	NodeID string `yaml:"nodeid"`
+	// BindAddress is listened on for raft and calls forwarded by followers
+	BindAddress string `yaml:"bindaddress"`
+	// AdvertiseAddress is the address other nodes reach this one on, it defaults to BindAddress
+	AdvertiseAddress string `yaml:"advertiseaddress"`
+	// DataDir holds the raft log and snapshots
+	DataDir string `yaml:"datadir"`
+	// Peers are the id=address of every node of the cluster, this one included, a bare address is its own id.
+	// They bootstrap a new cluster, a single node cluster when empty, and are ignored once the log holds state.
+	Peers []string `yaml:"peers"`
+	// ReadMode is linearizable or stale
+	ReadMode     string        `yaml:"readmode"`
+	ApplyTimeout time.Duration `yaml:"applytimeout"`
+	// SnapshotInterval is how often the log is checked for SnapshotThreshold entries to be compacted into a snapshot
+	SnapshotInterval  time.Duration `yaml:"snapshotinterval"`
+	SnapshotThreshold uint64        `yaml:"snapshotthreshold"`
+	RetainSnapshots   int           `yaml:"retainsnapshots"`
+	// TLSCert and TLSKey are presented to other nodes, TLSCA verifies theirs. Setting them secures the raft
+	// port with mutual TLS, certificates have to name the host of the advertise address. Without them the raft
+	// port has to stay on a private network.
+	TLSCert string `yaml:"tlscert"`
+	TLSKey  string `yaml:"tlskey"`
+	TLSCA   string `yaml:"tlsca"`
+}
+
+// tlsConfigs returns the configs connections from and to other nodes are secured with, both nil while TLS is off
+func (cfg Config) tlsConfigs() (server, client *tls.Config, err error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" && cfg.TLSCA == "" {
+		return nil, nil, nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" || cfg.TLSCA == "" {
+		return nil, nil, errors.New("Raft TLS needs certificate, key and CA")
+	}
+	client, err = tlsconfig.ClientConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA, false)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Cannot load raft tls config")
+	}
+	// nodes are clients of each other, the same CA verifies both ends
+	server = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: client.Certificates,
+		ClientCAs:    client.RootCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	return server, client, nil
+}
+
+// NewFactory starts a raft node of cfg, bootstrapping the cluster of Peers on first start
+func NewFactory(cfg Config) (storage.Client, error) {
+	conf := hraft.DefaultConfig()
+	if cfg.SnapshotInterval > 0 {
+		conf.SnapshotInterval = cfg.SnapshotInterval
+	}
+	if cfg.SnapshotThreshold > 0 {
+		conf.SnapshotThreshold = cfg.SnapshotThreshold
+	}
+	return newNode(cfg, conf)
+}
+
+// newNode starts a raft node of cfg with raft settings of conf
+func newNode(cfg Config, conf *hraft.Config) (*Client, error) {
+	if cfg.BindAddress == "" {
+		cfg.BindAddress = DefaultBindAddress
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = DefaultDataDir
+	}
+	if cfg.ReadMode == "" {
+		cfg.ReadMode = ReadLinearizable
+	}
+	if cfg.ReadMode != ReadLinearizable && cfg.ReadMode != ReadStale {
+		return nil, errors.Errorf("Unknown raft read mode %q, expected linearizable or stale", cfg.ReadMode)
+	}
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = DefaultApplyTimeout
+	}
+	if cfg.RetainSnapshots <= 0 {
+		cfg.RetainSnapshots = DefaultRetainSnapshots
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "Cannot create raft data dir %s", cfg.DataDir)
+	}
+
+	serverTLS, clientTLS, err := cfg.tlsConfigs()
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMux(cfg.BindAddress, cfg.AdvertiseAddress, serverTLS, clientTLS)
+	if err != nil {
+		return nil, err
+	}
+	address := m.Addr().String()
+	nodeID := cfg.NodeID
+	if nodeID == "" {
+		nodeID = address
+	}
+	servers, err := parsePeers(cfg.Peers, nodeID, address)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	logOutput := logging.GetLogger().Writer()
+	conf.LocalID = hraft.ServerID(nodeID)
+	conf.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Info, Output: logOutput})
+	notify := make(chan bool, 1)
+	conf.NotifyCh = notify
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.DataDir, "raft.db"))
+	if err != nil {
+		m.Close()
+		logOutput.Close()
+		return nil, errors.Wrap(err, "Cannot open raft log")
+	}
+	fail := func(err error) (*Client, error) {
+		m.Close()
+		store.Close()
+		logOutput.Close()
+		return nil, err
+	}
+	snapshots, err := hraft.NewFileSnapshotStore(cfg.DataDir, cfg.RetainSnapshots, logOutput)
+	if err != nil {
+		return fail(errors.Wrap(err, "Cannot open raft snapshots"))
+	}
+	existing, err := hraft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		return fail(errors.Wrap(err, "Cannot read raft state"))
+	}
+
+	c := newClient(newFSM(), cfg.ReadMode, cfg.ApplyTimeout)
+	c.forwarder.tls = clientTLS
+	transport := hraft.NewNetworkTransport(m, transportPool, transportTimeout, logOutput)
+	r, err := hraft.NewRaft(conf, c.fsm, store, store, snapshots, transport)
+	if err != nil {
+		return fail(errors.Wrap(err, "Cannot start raft"))
+	}
+	c.Raft = r
+	c.closers = append(c.closers, store, logOutput)
+	c.start(notify)
+	m.serve(c.handleForward)
+
+	if !existing {
+		if err := r.BootstrapCluster(hraft.Configuration{Servers: servers}).Error(); err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, "Cannot bootstrap raft cluster")
+		}
+	}
+	logging.GetLogger().WithField("NodeID", nodeID).WithField("Address", address).WithField("Bootstrapped", !existing).WithField("TLS", serverTLS != nil).Info("Started raft node")
+	return c, nil
+}
+
+// parsePeers returns the voters of peers, which have to include node id at address
+func parsePeers(peers []string, id, address string) ([]hraft.Server, error) {
+	if len(peers) == 0 {
+		return []hraft.Server{{ID: hraft.ServerID(id), Address: hraft.ServerAddress(address)}}, nil
+	}
+	servers := make([]hraft.Server, 0, len(peers))
+	found := false
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		server := hraft.Server{ID: hraft.ServerID(peer), Address: hraft.ServerAddress(peer)}
+		if i := strings.Index(peer, "="); i >= 0 {
+			server.ID, server.Address = hraft.ServerID(peer[:i]), hraft.ServerAddress(peer[i+1:])
+		}
+		if server.ID == "" || server.Address == "" {
+			return nil, errors.Errorf("Invalid raft peer %q, expected id=address", peer)
+		}
+		if string(server.ID) == id {
+			found = true
+		}
+		servers = append(servers, server)
+	}
+	if !found {
+		return nil, errors.Errorf("Raft peers do not include node %s", id)
+	}
+	return servers, nil
+}
@@ -0,0 +1,45 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewFactory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-raft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewFactory(Config{BindAddress: "127.0.0.1:0", DataDir: dir, ReadMode: "eventual"})
+	assert.EqualError(t, err, `Unknown raft read mode "eventual", expected linearizable or stale`)
+	_, err = NewFactory(Config{BindAddress: "127.0.0.1:0", DataDir: dir, NodeID: "node-0", Peers: []string{"node-1=127.0.0.1:1"}})
+	assert.EqualError(t, err, "Raft peers do not include node node-0")
+	_, err = NewFactory(Config{BindAddress: "127.0.0.1:0", DataDir: dir, TLSCert: "node.crt", TLSKey: "node.key"})
+	assert.EqualError(t, err, "Raft TLS needs certificate, key and CA")
+
+	c, err := NewFactory(Config{BindAddress: "127.0.0.1:0", DataDir: filepath.Join(dir, "node-0")})
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.FileExists(t, filepath.Join(dir, "node-0", "raft.db"))
+}
+
+func Test_ParsePeers(t *testing.T) {
+	servers, err := parsePeers(nil, "node-0", "10.0.0.1:50052")
+	assert.NoError(t, err)
+	assert.Equal(t, []hraft.Server{{ID: "node-0", Address: "10.0.0.1:50052"}}, servers)
+
+	servers, err = parsePeers([]string{"node-0=10.0.0.1:50052", " 10.0.0.2:50052", ""}, "node-0", "10.0.0.1:50052")
+	assert.NoError(t, err)
+	assert.Equal(t, []hraft.Server{
+		{ID: "node-0", Address: "10.0.0.1:50052"},
+		{ID: "10.0.0.2:50052", Address: "10.0.0.2:50052"},
+	}, servers)
+
+	_, err = parsePeers([]string{"node-0="}, "node-0", "10.0.0.1:50052")
+	assert.EqualError(t, err, `Invalid raft peer "node-0=", expected id=address`)
+}
@@ -0,0 +1,23 @@
+package raft
+
+import (
+	"flag"
+	"time"
+)
+
+// AddFlags binds flags to raft setup
+func AddFlags(flagSet *flag.FlagSet) {
+	flagSet.String("raft-node-id", "", "--raft-node-id <id> of this node, defaults to the advertise address")
+	flagSet.String("raft-bind-address", DefaultBindAddress, "--raft-bind-address <host:port> to serve raft and forwarded calls on")
+	flagSet.String("raft-advertise-address", "", "--raft-advertise-address <host:port> other nodes reach this one on")
+	flagSet.String("raft-data-dir", DefaultDataDir, "--raft-data-dir <path> of the raft log and snapshots")
+	flagSet.String("raft-peers", "", "--raft-peers <comma separated id=host:port> of every node bootstrapping the cluster")
+	flagSet.String("raft-read-mode", ReadLinearizable, "--raft-read-mode <linearizable|stale>")
+	flagSet.Duration("raft-apply-timeout", DefaultApplyTimeout, "--raft-apply-timeout <duration>")
+	flagSet.Duration("raft-snapshot-interval", 2*time.Minute, "--raft-snapshot-interval <duration>")
+	flagSet.Uint64("raft-snapshot-threshold", 8192, "--raft-snapshot-threshold <log entries> to snapshot after")
+	flagSet.Int("raft-retain-snapshots", DefaultRetainSnapshots, "--raft-retain-snapshots <count>")
+	flagSet.String("raft-tls-cert", "", "--raft-tls-cert <path> of certificate presented to other nodes, enables mutual TLS")
+	flagSet.String("raft-tls-key", "", "--raft-tls-key <path> of key of --raft-tls-cert")
+	flagSet.String("raft-tls-ca", "", "--raft-tls-ca <path> of ca bundle verifying other nodes")
+}
@@ -0,0 +1,23 @@
+package raft
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AddFlags(t *testing.T) {
+	flagSet := flag.NewFlagSet("raft", flag.ExitOnError)
+	AddFlags(flagSet)
+	flagSet.Parse([]string{"--raft-node-id", "ct-dns-0", "--raft-peers", "ct-dns-0=10.0.0.1:50052,ct-dns-1=10.0.0.2:50052", "--raft-tls-ca", "ca.crt"})
+	if flagSet.Parsed() {
+		assert.Equal(t, "ct-dns-0", flagSet.Lookup("raft-node-id").Value.String())
+		assert.Equal(t, "ct-dns-0=10.0.0.1:50052,ct-dns-1=10.0.0.2:50052", flagSet.Lookup("raft-peers").Value.String())
+		assert.Equal(t, DefaultBindAddress, flagSet.Lookup("raft-bind-address").Value.String())
+		assert.Equal(t, ReadLinearizable, flagSet.Lookup("raft-read-mode").Value.String())
+		assert.Equal(t, "5s", flagSet.Lookup("raft-apply-timeout").Value.String())
+		assert.Equal(t, "", flagSet.Lookup("raft-tls-cert").Value.String())
+		assert.Equal(t, "ca.crt", flagSet.Lookup("raft-tls-ca").Value.String())
+	}
+}
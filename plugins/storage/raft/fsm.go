@@ -0,0 +1,297 @@
+package raft
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/storage"
+	hraft "github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+const (
+	opCreate = "create"
+	opDelete = "delete"
+	opRenew  = "renew"
+	opEvict  = "evict"
+)
+
+// command is a change of the state machine replicated through the raft log,
+// Now and ExpiresAt are stamped by the leader so every node applies it the same way
+type command struct {
+	Op        string           `json:"op"`
+	Namespace string           `json:"namespace,omitempty"`
+	Key       string           `json:"key,omitempty"`
+	Instance  storage.Instance `json:"instance,omitempty"`
+	Host      string           `json:"host,omitempty"`
+	// TTL is set by the node receiving the call, the leader turns it into ExpiresAt
+	TTL int64 `json:"ttl,omitempty"`
+	// Now and ExpiresAt are in unix nanoseconds, ExpiresAt 0 never expires
+	Now       int64 `json:"now"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// record is a host registered under a service
+type record struct {
+	Instance storage.Instance `json:"instance"`
+	// ExpiresAt is in unix nanoseconds, 0 never expires
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+func (r record) expired(now int64) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= now
+}
+
+// state maps namespace to service to host to record
+type state map[string]map[string]map[string]record
+
+type watchKey struct {
+	namespace, key string
+}
+
+// fsm is the service -> hosts state machine every node applies committed commands to,
+// watches are served by each node from the commands it applies
+type fsm struct {
+	lock     sync.Mutex
+	data     state
+	watchers map[watchKey]map[chan storage.Event]struct{}
+}
+
+func newFSM() *fsm {
+	return &fsm{
+		data:     make(state),
+		watchers: make(map[watchKey]map[chan storage.Event]struct{}),
+	}
+}
+
+// Apply applies a committed command, returning nil or the error of the command
+func (f *fsm) Apply(log *hraft.Log) interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var cmd command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		logging.GetLogger().WithError(err).WithField("index", log.Index).Error("Failed to decode raft command")
+		return errors.Wrap(err, "Failed to decode command")
+	}
+	switch cmd.Op {
+	case opCreate:
+		f.create(cmd)
+	case opDelete:
+		f.delete(cmd.Namespace, cmd.Key, cmd.Host)
+	case opRenew:
+		return f.renew(cmd)
+	case opEvict:
+		f.evict(cmd.Now)
+	default:
+		return errors.Errorf("Unknown command %q", cmd.Op)
+	}
+	return nil
+}
+
+func (f *fsm) create(cmd command) {
+	services, found := f.data[cmd.Namespace]
+	if !found {
+		services = make(map[string]map[string]record)
+		f.data[cmd.Namespace] = services
+	}
+	hosts, found := services[cmd.Key]
+	if !found {
+		hosts = make(map[string]record)
+		services[cmd.Key] = hosts
+	}
+	previous, found := hosts[cmd.Instance.Host]
+	if !found || previous.expired(cmd.Now) || !reflect.DeepEqual(previous.Instance, cmd.Instance) {
+		f.notify(cmd.Namespace, storage.Event{Type: storage.EventAdd, Key: cmd.Key, Value: cmd.Instance.Host})
+	}
+	hosts[cmd.Instance.Host] = record{Instance: cmd.Instance, ExpiresAt: cmd.ExpiresAt}
+}
+
+func (f *fsm) delete(namespace, key, host string) {
+	if _, found := f.data[namespace][key][host]; !found {
+		return
+	}
+	delete(f.data[namespace][key], host)
+	if len(f.data[namespace][key]) == 0 {
+		delete(f.data[namespace], key)
+	}
+	if len(f.data[namespace]) == 0 {
+		delete(f.data, namespace)
+	}
+	f.notify(namespace, storage.Event{Type: storage.EventRemove, Key: key, Value: host})
+}
+
+func (f *fsm) renew(cmd command) error {
+	r, found := f.data[cmd.Namespace][cmd.Key][cmd.Host]
+	if !found || r.expired(cmd.Now) {
+		return storage.ErrInstanceNotFound
+	}
+	r.ExpiresAt = cmd.ExpiresAt
+	f.data[cmd.Namespace][cmd.Key][cmd.Host] = r
+	return nil
+}
+
+func (f *fsm) evict(now int64) {
+	for namespace, services := range f.data {
+		for key, hosts := range services {
+			for host, r := range hosts {
+				if r.expired(now) {
+					f.delete(namespace, key, host)
+				}
+			}
+		}
+	}
+}
+
+// hasExpired tells whether any host expired by now, so the leader only evicts when there is something to evict
+func (f *fsm) hasExpired(now int64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, services := range f.data {
+		for _, hosts := range services {
+			for _, r := range hosts {
+				if r.expired(now) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// get returns unexpired instances of key sorted by host
+func (f *fsm) get(namespace, key string, now int64) []storage.Instance {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var res []storage.Instance
+	for _, r := range f.data[namespace][key] {
+		if !r.expired(now) {
+			res = append(res, r.Instance)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Host < res[j].Host })
+	return res
+}
+
+// list returns sorted keys of namespace starting with prefix holding an unexpired host
+func (f *fsm) list(namespace, prefix string, now int64) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	res := []string{}
+	for key, hosts := range f.data[namespace] {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, r := range hosts {
+			if !r.expired(now) {
+				res = append(res, key)
+				break
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (f *fsm) watch(namespace, key string, bufferSize int) chan storage.Event {
+	sub := make(chan storage.Event, bufferSize)
+	wk := watchKey{namespace, key}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, found := f.watchers[wk]; !found {
+		f.watchers[wk] = make(map[chan storage.Event]struct{})
+	}
+	f.watchers[wk][sub] = struct{}{}
+	return sub
+}
+
+// notify fans event out to watchers of its key, caller must hold lock
+func (f *fsm) notify(namespace string, event storage.Event) {
+	wk := watchKey{namespace, event.Key}
+	for sub := range f.watchers[wk] {
+		select {
+		case sub <- event:
+		default:
+			// watcher fell behind, close it so it resyncs instead of missing events
+			f.unsubscribeLocked(wk, sub)
+		}
+	}
+}
+
+func (f *fsm) unsubscribe(namespace, key string, sub chan storage.Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.unsubscribeLocked(watchKey{namespace, key}, sub)
+}
+
+// unsubscribeLocked closes watcher of key, caller must hold lock
+func (f *fsm) unsubscribeLocked(wk watchKey, sub chan storage.Event) {
+	if _, found := f.watchers[wk][sub]; !found {
+		return
+	}
+	delete(f.watchers[wk], sub)
+	close(sub)
+	if len(f.watchers[wk]) == 0 {
+		delete(f.watchers, wk)
+	}
+}
+
+// closeWatchers ends every watch, caller must hold lock
+func (f *fsm) closeWatchers() {
+	for wk, subs := range f.watchers {
+		for sub := range subs {
+			f.unsubscribeLocked(wk, sub)
+		}
+	}
+}
+
+// Snapshot captures a copy of the state, it is written out by Persist while commands keep being applied
+func (f *fsm) Snapshot() (hraft.FSMSnapshot, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data := make(state, len(f.data))
+	for namespace, services := range f.data {
+		data[namespace] = make(map[string]map[string]record, len(services))
+		for key, hosts := range services {
+			data[namespace][key] = make(map[string]record, len(hosts))
+			for host, r := range hosts {
+				data[namespace][key][host] = r
+			}
+		}
+	}
+	return &snapshot{data: data}, nil
+}
+
+// Restore replaces the state with a snapshot, watches are ended as they cannot tell what changed
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	data := make(state)
+	if err := json.NewDecoder(rc).Decode(&data); err != nil {
+		return errors.Wrap(err, "Failed to decode snapshot")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.data = data
+	f.closeWatchers()
+	return nil
+}
+
+type snapshot struct {
+	data state
+}
+
+// Persist writes the state json encoded to sink
+func (s *snapshot) Persist(sink hraft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.data); err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "Failed to write snapshot")
+	}
+	return sink.Close()
+}
+
+// Release is a no-op as the snapshot holds a copy of the state
+func (s *snapshot) Release() {}
@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
+	hraft "github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSink collects a persisted snapshot
+type testSink struct {
+	bytes.Buffer
+	cancelled bool
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { s.cancelled = true; return nil }
+func (s *testSink) Close() error  { return nil }
+
+func apply(t *testing.T, f *fsm, index uint64, cmd command) interface{} {
+	data, err := json.Marshal(cmd)
+	assert.NoError(t, err)
+	return f.Apply(&hraft.Log{Index: index, Data: data})
+}
+
+func Test_FSMApply(t *testing.T) {
+	f := newFSM()
+	now := time.Now().UnixNano()
+	events := f.watch(storage.DefaultNamespace, "dummy-service", watchBufferSize)
+
+	assert.Nil(t, apply(t, f, 1, command{Op: opCreate, Namespace: storage.DefaultNamespace, Key: "dummy-service", Instance: storage.Instance{Host: "192.0.0.1"}, Now: now}))
+	assert.Nil(t, apply(t, f, 2, command{Op: opCreate, Namespace: storage.DefaultNamespace, Key: "dummy-service", Instance: storage.Instance{Host: "192.0.0.1"}, Now: now}))
+	assert.Nil(t, apply(t, f, 3, command{Op: opCreate, Namespace: storage.DefaultNamespace, Key: "dummy-service", Instance: storage.Instance{Host: "192.0.0.2"}, Now: now, ExpiresAt: now + int64(10*time.Second)}))
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.1"}, {Host: "192.0.0.2"}}, f.get(storage.DefaultNamespace, "dummy-service", now))
+	assert.Equal(t, []string{"dummy-service"}, f.list(storage.DefaultNamespace, "dummy-", now))
+
+	assert.Equal(t, storage.ErrInstanceNotFound, apply(t, f, 4, command{Op: opRenew, Namespace: storage.DefaultNamespace, Key: "dummy-service", Host: "192.0.0.3", Now: now}))
+	later := now + int64(10*time.Second)
+	assert.Nil(t, apply(t, f, 5, command{Op: opRenew, Namespace: storage.DefaultNamespace, Key: "dummy-service", Host: "192.0.0.2", Now: now, ExpiresAt: later + int64(time.Second)}))
+	assert.False(t, f.hasExpired(later))
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.1"}}, f.get(storage.DefaultNamespace, "dummy-service", later+int64(time.Second)))
+	assert.True(t, f.hasExpired(later+int64(time.Second)))
+	assert.Nil(t, apply(t, f, 6, command{Op: opEvict, Now: later + int64(time.Second)}))
+	assert.Nil(t, apply(t, f, 7, command{Op: opDelete, Namespace: storage.DefaultNamespace, Key: "dummy-service", Host: "192.0.0.1"}))
+	assert.Empty(t, f.data)
+	assert.Error(t, apply(t, f, 8, command{Op: "unknown"}).(error))
+
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+}
+
+func Test_FSMSnapshotAndRestore(t *testing.T) {
+	f := newFSM()
+	now := time.Now().UnixNano()
+	assert.Nil(t, apply(t, f, 1, command{Op: opCreate, Namespace: "team-a", Key: "api", Instance: storage.Instance{Host: "192.0.0.1", Weight: 5}, Now: now}))
+	snapshot, err := f.Snapshot()
+	assert.NoError(t, err)
+	// the snapshot is a copy unaffected by later commands
+	assert.Nil(t, apply(t, f, 2, command{Op: opDelete, Namespace: "team-a", Key: "api", Host: "192.0.0.1"}))
+	sink := &testSink{}
+	assert.NoError(t, snapshot.Persist(sink))
+	snapshot.Release()
+	assert.False(t, sink.cancelled)
+
+	restored := newFSM()
+	events := restored.watch("team-a", "api", watchBufferSize)
+	assert.NoError(t, restored.Restore(ioutil.NopCloser(&sink.Buffer)))
+	assert.Equal(t, []storage.Instance{{Host: "192.0.0.1", Weight: 5}}, restored.get("team-a", "api", now))
+	// watches cannot tell what a snapshot changed, so they end
+	_, open := <-events
+	assert.False(t, open)
+
+	assert.Error(t, restored.Restore(ioutil.NopCloser(bytes.NewBufferString("not json"))))
+}
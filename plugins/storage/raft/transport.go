@@ -0,0 +1,347 @@
+package raft
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/storage"
+	hraft "github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+// the first byte of a connection tells raft traffic from calls forwarded to the leader,
+// so both are served on the single raft port
+const (
+	connRaft    byte = 0
+	connForward byte = 1
+)
+
+const (
+	// connTypeTimeout bounds waiting for the first byte of an accepted connection
+	connTypeTimeout = 5 * time.Second
+	// transportPool and transportTimeout configure connections between raft nodes
+	transportPool    = 3
+	transportTimeout = 10 * time.Second
+	// forwardPool is the number of idle connections kept to the leader
+	forwardPool = 8
+)
+
+const (
+	codeNotFound    = "not_found"
+	codeKeyNotFound = "key_not_found"
+	// codeTransient marks errors worth retrying, like the leader stepping down meanwhile
+	codeTransient = "transient"
+)
+
+var errTransportClosed = errors.New("raft transport closed")
+
+// forwardRequest is a call a follower forwards to the leader, a write Command or a Get/List read
+type forwardRequest struct {
+	Command   *command `json:"command,omitempty"`
+	Read      string   `json:"read,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Key       string   `json:"key,omitempty"`
+}
+
+type forwardResponse struct {
+	Value string   `json:"value,omitempty"`
+	Keys  []string `json:"keys,omitempty"`
+	Error string   `json:"error,omitempty"`
+	// Code identifies errors callers tell apart, like a missing instance
+	Code string `json:"code,omitempty"`
+}
+
+// toError turns the error of res back into the error returned on the leader
+func (res forwardResponse) toError() error {
+	switch res.Code {
+	case "":
+	case codeNotFound:
+		return storage.ErrInstanceNotFound
+	case codeKeyNotFound:
+		return storage.ErrKeyNotFound
+	case codeTransient:
+		return storage.Transient(errors.New(res.Error))
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+func newForwardResponse(value string, keys []string, err error) forwardResponse {
+	res := forwardResponse{Value: value, Keys: keys}
+	if err == nil {
+		return res
+	}
+	res.Error = err.Error()
+	switch errors.Cause(err) {
+	case storage.ErrInstanceNotFound:
+		res.Code = codeNotFound
+	case storage.ErrKeyNotFound:
+		res.Code = codeKeyNotFound
+	}
+	return res
+}
+
+// mux accepts connections on the raft port, handing raft ones to the raft transport
+// and serving forwarded ones with forward
+type mux struct {
+	listener  net.Listener
+	advertise net.Addr
+	conns     chan net.Conn
+	forward   func(req forwardRequest) forwardResponse
+	// serverTLS and clientTLS secure connections accepted from and dialed to other nodes, nil is plain TCP
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+
+	// lock guards forwards, connections of forwarded calls closed along with mux
+	lock      sync.Mutex
+	forwards  map[net.Conn]struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newMux listens on bind, advertising advertise to other nodes, bind is used when advertise is empty,
+// connections are accepted once serve is called. Without serverTLS and clientTLS anyone reaching bind
+// can join raft and write, so it has to stay on a private network.
+func newMux(bind, advertise string, serverTLS, clientTLS *tls.Config) (*mux, error) {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot listen on %s", bind)
+	}
+	addr := listener.Addr()
+	if advertise != "" {
+		if addr, err = net.ResolveTCPAddr("tcp", advertise); err != nil {
+			listener.Close()
+			return nil, errors.Wrapf(err, "Invalid advertise address %s", advertise)
+		}
+	}
+	m := &mux{
+		listener:  listener,
+		advertise: addr,
+		serverTLS: serverTLS,
+		clientTLS: clientTLS,
+		conns:     make(chan net.Conn),
+		forwards:  make(map[net.Conn]struct{}),
+		closed:    make(chan struct{}),
+	}
+	return m, nil
+}
+
+// serve accepts connections in the background, answering forwarded calls with forward
+func (m *mux) serve(forward func(req forwardRequest) forwardResponse) {
+	m.forward = forward
+	go m.accept()
+}
+
+func (m *mux) accept() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.closed:
+			default:
+				logging.GetLogger().WithError(err).Error("Raft listener stopped")
+			}
+			return
+		}
+		if m.serverTLS != nil {
+			// the handshake happens on the first read, bounded by connTypeTimeout
+			conn = tls.Server(conn, m.serverTLS)
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *mux) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(connTypeTimeout))
+	connType := make([]byte, 1)
+	if _, err := conn.Read(connType); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	switch connType[0] {
+	case connRaft:
+		select {
+		case m.conns <- conn:
+		case <-m.closed:
+			conn.Close()
+		}
+	case connForward:
+		m.serveForward(conn)
+	default:
+		logging.GetLogger().WithField("remote", conn.RemoteAddr().String()).Warn("Unknown raft connection type")
+		conn.Close()
+	}
+}
+
+// serveForward answers forwarded calls on conn until it is closed
+func (m *mux) serveForward(conn net.Conn) {
+	m.lock.Lock()
+	select {
+	case <-m.closed:
+		m.lock.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	m.forwards[conn] = struct{}{}
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.forwards, conn)
+		m.lock.Unlock()
+		conn.Close()
+	}()
+	decoder, encoder := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req forwardRequest
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+		if err := encoder.Encode(m.forward(req)); err != nil {
+			return
+		}
+	}
+}
+
+// Accept returns the next raft connection
+func (m *mux) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.closed:
+		return nil, errTransportClosed
+	}
+}
+
+// Close stops accepting connections and closes the ones of forwarded calls
+func (m *mux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		m.lock.Lock()
+		close(m.closed)
+		for conn := range m.forwards {
+			conn.Close()
+		}
+		m.lock.Unlock()
+		err = m.listener.Close()
+	})
+	return err
+}
+
+// Addr returns the address other nodes reach this one on
+func (m *mux) Addr() net.Addr {
+	return m.advertise
+}
+
+// Dial opens a raft connection to address
+func (m *mux) Dial(address hraft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dial(string(address), connRaft, timeout, m.clientTLS)
+}
+
+// dial connects to address over TLS of config, or plain TCP when nil, announcing connType
+func dial(address string, connType byte, timeout time.Duration, config *tls.Config) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: timeout}
+	if config != nil {
+		// the certificate of address has to name its host
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, config)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{connType}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// forwarder forwards calls to the leader, keeping up to forwardPool idle connections to it
+type forwarder struct {
+	// tls secures connections to the leader, nil is plain TCP
+	tls *tls.Config
+
+	lock    sync.Mutex
+	address string
+	idle    []*forwardConn
+}
+
+type forwardConn struct {
+	net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+// call sends req to the leader at address, idle connections to a previous leader are dropped
+func (f *forwarder) call(address string, req forwardRequest, deadline time.Time) (forwardResponse, error) {
+	var res forwardResponse
+	conn, err := f.get(address, deadline)
+	if err != nil {
+		return res, errors.Wrapf(err, "Failed to connect to leader %s", address)
+	}
+	conn.SetDeadline(deadline)
+	if err := conn.encoder.Encode(req); err != nil {
+		conn.Close()
+		return res, errors.Wrapf(err, "Failed to forward to leader %s", address)
+	}
+	if err := conn.decoder.Decode(&res); err != nil {
+		conn.Close()
+		return res, errors.Wrapf(err, "Failed to read response of leader %s", address)
+	}
+	f.put(address, conn)
+	return res, nil
+}
+
+func (f *forwarder) get(address string, deadline time.Time) (*forwardConn, error) {
+	f.lock.Lock()
+	if f.address != address {
+		f.closeLocked()
+		f.address = address
+	}
+	if n := len(f.idle); n > 0 {
+		conn := f.idle[n-1]
+		f.idle = f.idle[:n-1]
+		f.lock.Unlock()
+		return conn, nil
+	}
+	f.lock.Unlock()
+	conn, err := dial(address, connForward, time.Until(deadline), f.tls)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardConn{Conn: conn, encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}, nil
+}
+
+func (f *forwarder) put(address string, conn *forwardConn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.address != address || len(f.idle) >= forwardPool {
+		conn.Close()
+		return
+	}
+	f.idle = append(f.idle, conn)
+}
+
+func (f *forwarder) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closeLocked()
+}
+
+// closeLocked closes idle connections, caller must hold lock
+func (f *forwarder) closeLocked() {
+	for _, conn := range f.idle {
+		conn.Close()
+	}
+	f.idle = nil
+}
@@ -1,63 +1,494 @@
 package redis
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/guanw/ct-dns/pkg/logging"
 	"github.com/guanw/ct-dns/storage"
 	"github.com/pkg/errors"
 )
 
+const (
+	// changes under key are published to watchChannelPrefix+key
+	watchChannelPrefix = "ct-dns:watch:"
+	// instance metadata under key is kept in hash metaKeyPrefix+key, field is the host
+	metaKeyPrefix = "ct-dns:meta:"
+	// every key ever created is marked by serviceKeyPrefix+key so List can SCAN for them
+	serviceKeyPrefix = "ct-dns:service:"
+	// keys outside the default namespace are prefixed by namespacePrefix+namespace+":",
+	// keys of the default namespace keep the layout they had before namespaces
+	namespacePrefix = "ct-dns:ns:"
+	scanCount       = 100
+	evictInterval   = 5 * time.Second
+)
+
+// migrateScript converts hosts KEYS[1] versions before ttl kept in a set into a sorted set never expiring
+// and marks the service with KEYS[2] so List finds it, keys of any other type are left as they are
+const migrateScript = `
+if redis.call('TYPE', KEYS[1]).ok ~= 'set' then
+	return 0
+end
+local hosts = redis.call('SMEMBERS', KEYS[1])
+redis.call('DEL', KEYS[1])
+for _, host in ipairs(hosts) do
+	redis.call('ZADD', KEYS[1], '+inf', host)
+end
+redis.call('SET', KEYS[2], '')
+return #hosts
+`
+
+// createScript adds host ARGV[2] scored ARGV[1] to KEYS[1], marks the service with KEYS[2] and keeps metadata ARGV[3]
+// in hash KEYS[3], it returns 1 if the host was added or its metadata changed. Errors of the hosts key, like WRONGTYPE,
+// are returned as they are.
+const createScript = `
+local added = redis.pcall('ZADD', KEYS[1], ARGV[1], ARGV[2])
+if type(added) == 'table' and added.err then
+	return added
+end
+redis.call('SET', KEYS[2], '')
+if redis.call('HGET', KEYS[3], ARGV[2]) == ARGV[3] then
+	return added
+end
+redis.call('HSET', KEYS[3], ARGV[2], ARGV[3])
+return 1
+`
+
+// removeScript removes host ARGV[1] from KEYS[1] along with its metadata in hash KEYS[2], it returns 1 if the host
+// was removed. Errors of the hosts key, like WRONGTYPE, are returned as they are.
+const removeScript = `
+local removed = redis.pcall('ZREM', KEYS[1], ARGV[1])
+if type(removed) == 'table' and removed.err then
+	return removed
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+return removed
+`
+
+// transientReplies are prefixes of error replies sent while redis is loading, busy or failing over
+var transientReplies = []string{"LOADING", "BUSY", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN", "READONLY"}
+
 // Pool defines interface for redis.Pool
 type Pool interface {
-	Get() redis.Conn
+	GetContext(ctx context.Context) (redis.Conn, error)
+	Close() error
 }
 
 // Client defines redis client for Create/Get/Delete operations
+// hosts are kept in a sorted set scored by expiration time in unix milliseconds
 type Client struct {
 	Pool Pool
-	lock sync.Mutex
+	// HashTags wraps keys in a hash tag, so the hosts, metadata and marker of a service map to one cluster slot
+	HashTags bool
+	lock     sync.Mutex
+	now      func() time.Time
 }
 
 // NewClient creates new redis client
 func NewClient(pool Pool) storage.Client {
 	return &Client{
 		Pool: pool,
+		now:  time.Now,
+	}
+}
+
+func (c *Client) score(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return "+inf"
+	}
+	return toMillis(c.now().Add(ttl))
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// namespaced returns redis key of key in namespace
+func namespaced(namespace, key string) string {
+	if namespace == storage.DefaultNamespace {
+		return key
 	}
+	return namespacePrefix + namespace + ":" + key
 }
 
-// Create create new key/value pair
-func (c *Client) Create(key, value string) error {
-	ins := c.Pool.Get()
+// redisKey returns redis key of key in namespace, the hosts of key are kept under it
+func (c *Client) redisKey(namespace, key string) string {
+	key = namespaced(namespace, key)
+	if c.HashTags {
+		return "{" + key + "}"
+	}
+	return key
+}
+
+// Create create new key/instance pair expiring after ttl
+func (c *Client) Create(ctx context.Context, namespace, key string, instance storage.Instance, ttl time.Duration) error {
+	key = c.redisKey(namespace, key)
+	meta, err := json.Marshal(instance)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal instance")
+	}
+	ins, err := c.Pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get redis connection")
+	}
 	defer ins.Close()
 	c.lock.Lock()
-	_, err := ins.Do("SADD", key, value)
-	c.lock.Unlock()
-	return err
+	defer c.lock.Unlock()
+	return c.migrating(ctx, ins, key, func() error {
+		return c.create(ctx, ins, key, instance, string(meta), ttl)
+	})
+}
+
+// create adds instance with its metadata meta under key, hosts, marker and metadata are written at once by createScript
+func (c *Client) create(ctx context.Context, ins redis.Conn, key string, instance storage.Instance, meta string, ttl time.Duration) error {
+	changed, err := redis.Int(do(ctx, ins, "EVAL", createScript, 3, key, serviceKeyPrefix+key, metaKeyPrefix+key, c.score(ttl), instance.Host, meta))
+	if err != nil {
+		return err
+	}
+	if changed > 0 {
+		c.publish(ctx, ins, storage.Event{Type: storage.EventAdd, Key: key, Value: instance.Host})
+	}
+	return nil
 }
 
-// Get gets hosts under key
-func (c *Client) Get(key string) (string, error) {
-	ins := c.Pool.Get()
+// Get gets unexpired instances under key, expired hosts are removed along the way
+func (c *Client) Get(ctx context.Context, namespace, key string) (string, error) {
+	key = c.redisKey(namespace, key)
+	ins, err := c.Pool.GetContext(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to get redis connection")
+	}
 	defer ins.Close()
+	var res []storage.Instance
 	c.lock.Lock()
-	reply, err := ins.Do("SMEMBERS", key)
+	err = c.migrating(ctx, ins, key, func() error {
+		res, err = c.get(ctx, ins, key)
+		return err
+	})
 	c.lock.Unlock()
-	res, err := redis.Strings(reply, err)
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to get member from key")
+		return "", err
 	}
 	jsonized, _ := json.Marshal(res)
 	return string(jsonized), nil
 }
 
+// get removes expired hosts under key and returns the others
+func (c *Client) get(ctx context.Context, ins redis.Conn, key string) ([]storage.Instance, error) {
+	now := toMillis(c.now())
+	if err := c.evict(ctx, ins, key, now); err != nil {
+		return nil, errors.Wrap(err, "Failed to remove expired members from key")
+	}
+	hosts, err := redis.Strings(do(ctx, ins, "ZRANGEBYSCORE", key, "("+strconv.FormatInt(now, 10), "+inf"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get member from key")
+	}
+	return c.instances(ctx, ins, key, hosts)
+}
+
+// instances attaches metadata to hosts, hosts registered without metadata are returned bare
+func (c *Client) instances(ctx context.Context, ins redis.Conn, key string, hosts []string) ([]storage.Instance, error) {
+	if len(hosts) == 0 {
+		return []storage.Instance{}, nil
+	}
+	args := redis.Args{}.Add(metaKeyPrefix + key).AddFlat(hosts)
+	metas, err := redis.Strings(do(ctx, ins, "HMGET", args...))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get instance metadata")
+	}
+	res := make([]storage.Instance, len(hosts))
+	for i, host := range hosts {
+		if i < len(metas) && metas[i] != "" {
+			if err := json.Unmarshal([]byte(metas[i]), &res[i]); err != nil {
+				logging.GetLogger().WithError(err).WithField("host", host).Warn("Failed to decode instance metadata")
+			}
+		}
+		res[i].Host = host
+	}
+	return res, nil
+}
+
 // Delete deletes service & host combination
-func (c *Client) Delete(key, value string) error {
-	ins := c.Pool.Get()
+func (c *Client) Delete(ctx context.Context, namespace, key, value string) error {
+	key = c.redisKey(namespace, key)
+	ins, err := c.Pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get redis connection")
+	}
 	defer ins.Close()
 	c.lock.Lock()
-	_, err := ins.Do("SREM", key, value)
-	c.lock.Unlock()
+	defer c.lock.Unlock()
+	return c.migrating(ctx, ins, key, func() error {
+		return c.remove(ctx, ins, key, value)
+	})
+}
+
+// remove drops value and its metadata under key at once with removeScript and publishes the removal
+func (c *Client) remove(ctx context.Context, ins redis.Conn, key, value string) error {
+	removed, err := redis.Int(do(ctx, ins, "EVAL", removeScript, 2, key, metaKeyPrefix+key, value))
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		c.publish(ctx, ins, storage.Event{Type: storage.EventRemove, Key: key, Value: value})
+	}
+	return nil
+}
+
+// evict removes members expired by now and publishes their removal
+func (c *Client) evict(ctx context.Context, ins redis.Conn, key string, now int64) error {
+	expired, err := redis.Strings(do(ctx, ins, "ZRANGEBYSCORE", key, "-inf", now))
+	if err != nil {
+		return err
+	}
+	for _, value := range expired {
+		if err := c.remove(ctx, ins, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) publish(ctx context.Context, ins redis.Conn, event storage.Event) {
+	payload, _ := json.Marshal(event)
+	if _, err := do(ctx, ins, "PUBLISH", watchChannelPrefix+event.Key, string(payload)); err != nil {
+		logging.GetLogger().WithError(err).WithField("key", event.Key).Warn("Failed to publish redis watch event")
+	}
+}
+
+// Renew extends expiration of service & host combination by ttl
+func (c *Client) Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error {
+	key = c.redisKey(namespace, key)
+	ins, err := c.Pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get redis connection")
+	}
+	defer ins.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.migrating(ctx, ins, key, func() error {
+		return c.renew(ctx, ins, key, value, ttl)
+	})
+}
+
+// renew extends expiration of value under key by ttl
+func (c *Client) renew(ctx context.Context, ins redis.Conn, key, value string, ttl time.Duration) error {
+	score, err := do(ctx, ins, "ZSCORE", key, value)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get expiration of member")
+	}
+	if score == nil {
+		return storage.ErrInstanceNotFound
+	}
+	if expiresAt, err := redis.Float64(score, nil); err == nil && expiresAt <= float64(toMillis(c.now())) {
+		return storage.ErrInstanceNotFound
+	}
+	_, err = do(ctx, ins, "ZADD", key, "XX", c.score(ttl), value)
 	return err
 }
+
+// List scans service markers of namespace matching prefix, keys whose members all expired are skipped
+func (c *Client) List(ctx context.Context, namespace, prefix string) ([]string, error) {
+	ins, err := c.Pool.GetContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get redis connection")
+	}
+	defer ins.Close()
+	now := "(" + strconv.FormatInt(toMillis(c.now()), 10)
+	root := namespaced(namespace, "")
+	pattern := serviceKeyPrefix + escapeGlob(root+prefix) + "*"
+	if c.HashTags {
+		pattern = serviceKeyPrefix + "{" + escapeGlob(root+prefix) + "*}"
+	}
+	seen := make(map[string]bool)
+	res := []string{}
+	cursor := "0"
+	for {
+		values, err := redis.Values(do(ctx, ins, "SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to scan services")
+		}
+		var markers []string
+		if _, err := redis.Scan(values, &cursor, &markers); err != nil {
+			return nil, errors.Wrap(err, "Failed to decode scanned services")
+		}
+		for _, marker := range markers {
+			key := strings.TrimPrefix(marker, serviceKeyPrefix)
+			name := key
+			if c.HashTags {
+				name = strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+			}
+			// SCAN may return a key more than once, markers of other namespaces match the default one
+			if seen[key] || (root == "" && strings.HasPrefix(name, namespacePrefix)) {
+				continue
+			}
+			seen[key] = true
+			count, err := redis.Int(do(ctx, ins, "ZCOUNT", key, now, "+inf"))
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to count members of key")
+			}
+			if count > 0 {
+				res = append(res, strings.TrimPrefix(name, root))
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// migrating runs op on key, hosts of key still kept in a set by versions before ttl are converted
+// with migrateScript the first time op fails on them with WRONGTYPE, then op is run again
+func (c *Client) migrating(ctx context.Context, ins redis.Conn, key string, op func() error) error {
+	err := op()
+	if !isWrongType(err) {
+		return err
+	}
+	migrated, migrateErr := redis.Int(do(ctx, ins, "EVAL", migrateScript, 2, key, serviceKeyPrefix+key))
+	if migrateErr != nil {
+		return errors.Wrap(migrateErr, "Failed to migrate hosts set to sorted set")
+	}
+	logging.GetLogger().WithField("key", key).WithField("hosts", migrated).Info("Migrated redis hosts set to sorted set")
+	return op()
+}
+
+func isWrongType(err error) bool {
+	reply, ok := errors.Cause(err).(redis.Error)
+	return ok && strings.HasPrefix(string(reply), "WRONGTYPE")
+}
+
+// IsTransient tells connection failures and redis loading/busy/failover replies from permanent errors
+func (c *Client) IsTransient(err error) bool {
+	err = errors.Cause(err)
+	switch err {
+	case redis.ErrPoolExhausted, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if reply, ok := err.(redis.Error); ok {
+		for _, prefix := range transientReplies {
+			if strings.HasPrefix(string(reply), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// do runs cmd on ins, giving up once ctx is done or its deadline passes
+func do(ctx context.Context, ins redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(ins, time.Until(deadline), cmd, args...)
+	}
+	return ins.Do(cmd, args...)
+}
+
+// escapeGlob escapes characters special to redis MATCH patterns
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Watch subscribes to changes published under key until ctx is done
+func (c *Client) Watch(ctx context.Context, namespace, key string) (<-chan storage.Event, error) {
+	conn, err := c.Pool.GetContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get redis connection")
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(watchChannelPrefix + c.redisKey(namespace, key)); err != nil {
+		psc.Close()
+		return nil, errors.Wrap(err, "Failed to subscribe to key")
+	}
+	go func() {
+		// closing the connection unblocks Receive below
+		<-ctx.Done()
+		psc.Close()
+	}()
+	go func() {
+		// expired members are only removed (and published) when key is read
+		ticker := time.NewTicker(evictInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.Get(ctx, namespace, key)
+			}
+		}
+	}()
+
+	events := make(chan storage.Event)
+	go func() {
+		defer close(events)
+		defer psc.Close()
+		for {
+			switch msg := receive(psc).(type) {
+			case redis.Message:
+				var event storage.Event
+				if err := json.Unmarshal(msg.Data, &event); err != nil {
+					logging.GetLogger().WithError(err).WithField("key", key).Warn("Failed to decode redis watch event")
+					continue
+				}
+				// events are published under the namespaced key
+				event.Key = key
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// receive waits for the next message of psc, disregarding the read timeout of its connection
+func receive(psc redis.PubSubConn) interface{} {
+	if _, ok := psc.Conn.(redis.ConnWithTimeout); ok {
+		return psc.ReceiveWithTimeout(0)
+	}
+	return psc.Receive()
+}
+
+// Ping checks a pooled connection answers PING
+func (c *Client) Ping(ctx context.Context) error {
+	ins, err := c.Pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get redis connection")
+	}
+	defer ins.Close()
+	if _, err := do(ctx, ins, "PING"); err != nil {
+		return errors.Wrap(err, "Failed to ping redis")
+	}
+	return nil
+}
+
+// Close closes idle connections of the pool, connections in use are closed once released
+func (c *Client) Close() error {
+	return c.Pool.Close()
+}
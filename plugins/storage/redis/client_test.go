@@ -1,42 +1,265 @@
 package redis
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/guanw/ct-dns/plugins/storage/redis/mocks"
+	"github.com/guanw/ct-dns/storage"
+	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
+var now = time.Unix(1577836800, 0)
+
+func newTestClient(p Pool) *Client {
+	client := NewClient(p).(*Client)
+	client.now = func() time.Time { return now }
+	return client
+}
+
 func Test_SetKeyValueNonError(t *testing.T) {
 	p := &mocks.Pool{}
 	c := &mocks.Conn{}
-	p.On("Get").Return(c)
-	c.On("Do", "SADD", "dummy-service", "192.0.0.1").Return(nil, nil)
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "EVAL", createScript, 3, "dummy-service", "ct-dns:service:dummy-service", "ct-dns:meta:dummy-service", "+inf", "192.0.0.1", `{"host":"192.0.0.1","zone":"us-east-1a","weight":10}`).Return(int64(1), nil)
+	c.On("Do", "PUBLISH", "ct-dns:watch:dummy-service", `{"type":"add","key":"dummy-service","value":"192.0.0.1"}`).Return(int64(0), nil)
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+	err := client.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1", Zone: "us-east-1a", Weight: 10}, 0)
+	assert.NoError(t, err)
+}
+
+func Test_SetKeyValueWithTTL(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "EVAL", createScript, 3, "dummy-service", "ct-dns:service:dummy-service", "ct-dns:meta:dummy-service", int64(1577836810000), "192.0.0.1", `{"host":"192.0.0.1"}`).Return(int64(0), nil)
 	c.On("Close").Return(nil)
-	client := NewClient(p)
-	err := client.Create("dummy-service", "192.0.0.1")
+	client := newTestClient(p)
+	err := client.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second)
 	assert.NoError(t, err)
+	c.AssertNotCalled(t, "Do", "PUBLISH", mock.Anything, mock.Anything)
 }
 
 func Test_Get(t *testing.T) {
 	p := &mocks.Pool{}
 	c := &mocks.Conn{}
-	p.On("Get").Return(c)
-	c.On("Do", "SMEMBERS", "dummy-service").Return([]interface{}{"192.0.0.1", "192.0.0.2"}, nil)
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "ZRANGEBYSCORE", "dummy-service", "-inf", int64(1577836800000)).Return([]interface{}{"192.0.0.3"}, nil)
+	c.On("Do", "EVAL", removeScript, 2, "dummy-service", "ct-dns:meta:dummy-service", "192.0.0.3").Return(int64(1), nil)
+	c.On("Do", "PUBLISH", "ct-dns:watch:dummy-service", `{"type":"remove","key":"dummy-service","value":"192.0.0.3"}`).Return(int64(0), nil)
+	c.On("Do", "ZRANGEBYSCORE", "dummy-service", "(1577836800000", "+inf").Return([]interface{}{"192.0.0.1", "192.0.0.2"}, nil)
+	c.On("Do", "HMGET", "ct-dns:meta:dummy-service", "192.0.0.1", "192.0.0.2").Return([]interface{}{[]byte(`{"host":"192.0.0.1","canary":true}`), nil}, nil)
 	c.On("Close").Return(nil)
-	client := NewClient(p)
-	res, err := client.Get("dummy-service")
+	client := newTestClient(p)
+	res, err := client.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
 	assert.NoError(t, err)
-	assert.Equal(t, `["192.0.0.1","192.0.0.2"]`, res)
+	assert.Equal(t, `[{"host":"192.0.0.1","canary":true},{"host":"192.0.0.2"}]`, res)
+}
+
+func Test_MigrateHostsSet(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	wrongType := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "ZRANGEBYSCORE", "legacy-service", "-inf", int64(1577836800000)).Return(nil, wrongType).Once()
+	c.On("Do", "EVAL", migrateScript, 2, "legacy-service", "ct-dns:service:legacy-service").Return(int64(2), nil).Once()
+	c.On("Do", "ZRANGEBYSCORE", "legacy-service", "-inf", int64(1577836800000)).Return([]interface{}{}, nil)
+	c.On("Do", "ZRANGEBYSCORE", "legacy-service", "(1577836800000", "+inf").Return([]interface{}{"192.0.0.1", "192.0.0.2"}, nil)
+	c.On("Do", "HMGET", "ct-dns:meta:legacy-service", "192.0.0.1", "192.0.0.2").Return([]interface{}{nil, nil}, nil)
+	c.On("Do", "EVAL", removeScript, 2, "other-service", "ct-dns:meta:other-service", "192.0.0.1").Return(nil, wrongType).Once()
+	c.On("Do", "EVAL", migrateScript, 2, "other-service", "ct-dns:service:other-service").Return(nil, redis.Error("ERR script failed"))
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+
+	res, err := client.Get(context.Background(), storage.DefaultNamespace, "legacy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2"}]`, res)
+	c.AssertNumberOfCalls(t, "Do", 5)
+
+	err = client.Delete(context.Background(), storage.DefaultNamespace, "other-service", "192.0.0.1")
+	assert.Error(t, err)
+	assert.False(t, isWrongType(err))
 }
 
 func Test_Delete(t *testing.T) {
 	p := &mocks.Pool{}
 	c := &mocks.Conn{}
-	p.On("Get").Return(c)
-	c.On("Do", "SREM", "dummy-service", "192.0.0.1").Return(nil, nil)
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "EVAL", removeScript, 2, "dummy-service", "ct-dns:meta:dummy-service", "192.0.0.1").Return(int64(1), nil)
+	c.On("Do", "PUBLISH", "ct-dns:watch:dummy-service", `{"type":"remove","key":"dummy-service","value":"192.0.0.1"}`).Return(int64(0), nil)
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+	err := client.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1")
+	assert.NoError(t, err)
+}
+
+func Test_Renew(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "ZSCORE", "dummy-service", "192.0.0.1").Return([]byte("1577836805000"), nil)
+	c.On("Do", "ZADD", "dummy-service", "XX", int64(1577836810000), "192.0.0.1").Return(int64(0), nil)
+	c.On("Do", "ZSCORE", "dummy-service", "192.0.0.2").Return(nil, nil)
+	c.On("Do", "ZSCORE", "dummy-service", "192.0.0.3").Return([]byte("1577836790000"), nil)
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+
+	err := client.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", 10*time.Second)
+	assert.NoError(t, err)
+	err = client.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2", 10*time.Second)
+	assert.Equal(t, storage.ErrInstanceNotFound, err)
+	err = client.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.3", 10*time.Second)
+	assert.Equal(t, storage.ErrInstanceNotFound, err)
+}
+
+func Test_List(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "SCAN", "0", "MATCH", `ct-dns:service:dummy\*-*`, "COUNT", 100).Return([]interface{}{[]byte("17"), []interface{}{[]byte("ct-dns:service:dummy*-service"), []byte("ct-dns:service:dummy*-expired")}}, nil)
+	c.On("Do", "SCAN", "17", "MATCH", `ct-dns:service:dummy\*-*`, "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:dummy*-api"), []byte("ct-dns:service:dummy*-service")}}, nil)
+	c.On("Do", "ZCOUNT", "dummy*-service", "(1577836800000", "+inf").Return(int64(2), nil)
+	c.On("Do", "ZCOUNT", "dummy*-expired", "(1577836800000", "+inf").Return(int64(0), nil)
+	c.On("Do", "ZCOUNT", "dummy*-api", "(1577836800000", "+inf").Return(int64(1), nil)
 	c.On("Close").Return(nil)
-	client := NewClient(p)
-	err := client.Delete("dummy-service", "192.0.0.1")
+	client := newTestClient(p)
+
+	res, err := client.List(context.Background(), storage.DefaultNamespace, "dummy*-")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy*-api", "dummy*-service"}, res)
+	c.AssertNumberOfCalls(t, "Do", 5)
+
+	c.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:*", "COUNT", 100).Return(nil, errors.New("connection closed"))
+	_, err = client.List(context.Background(), storage.DefaultNamespace, "")
+	assert.Error(t, err)
+}
+
+func Test_Watch(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Send", "SUBSCRIBE", "ct-dns:watch:dummy-service").Return(nil)
+	c.On("Flush").Return(nil)
+	c.On("Receive").Return([]interface{}{[]byte("subscribe"), []byte("ct-dns:watch:dummy-service"), int64(1)}, nil).Once()
+	c.On("Receive").Return([]interface{}{[]byte("message"), []byte("ct-dns:watch:dummy-service"), []byte(`{"type":"add","key":"dummy-service","value":"192.0.0.1"}`)}, nil).Once()
+	c.On("Receive").Return(nil, errors.New("connection closed"))
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := client.Watch(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func Test_IsTransient(t *testing.T) {
+	client := newTestClient(&mocks.Pool{})
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{err: redis.ErrPoolExhausted, transient: true},
+		{err: io.EOF, transient: true},
+		{err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, transient: true},
+		{err: pkgerrors.Wrap(redis.Error("LOADING Redis is loading the dataset in memory"), "Failed"), transient: true},
+		{err: redis.Error("READONLY You can't write against a read only replica."), transient: true},
+		{err: redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{err: redis.ErrNil},
+		{err: storage.ErrInstanceNotFound},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.transient, client.IsTransient(test.err), test.err.Error())
+	}
+}
+
+func Test_CanceledContext(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.Get(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.Equal(t, context.Canceled, pkgerrors.Cause(err))
+	c.AssertNotCalled(t, "Do", mock.Anything)
+}
+
+func Test_Namespaces(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "EVAL", createScript, 3, "ct-dns:ns:team-a:api", "ct-dns:service:ct-dns:ns:team-a:api", "ct-dns:meta:ct-dns:ns:team-a:api", "+inf", "192.0.0.1", `{"host":"192.0.0.1"}`).Return(int64(1), nil)
+	c.On("Do", "PUBLISH", "ct-dns:watch:ct-dns:ns:team-a:api", `{"type":"add","key":"ct-dns:ns:team-a:api","value":"192.0.0.1"}`).Return(int64(0), nil)
+	c.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:ct-dns:ns:team-a:*", "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:ct-dns:ns:team-a:api")}}, nil)
+	c.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:*", "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:ct-dns:ns:team-a:api"), []byte("ct-dns:service:api")}}, nil)
+	c.On("Do", "ZCOUNT", "ct-dns:ns:team-a:api", "(1577836800000", "+inf").Return(int64(1), nil)
+	c.On("Do", "ZCOUNT", "api", "(1577836800000", "+inf").Return(int64(1), nil)
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+
+	assert.NoError(t, client.Create(context.Background(), "team-a", "api", storage.Instance{Host: "192.0.0.1"}, 0))
+	res, err := client.List(context.Background(), "team-a", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api"}, res)
+	res, err = client.List(context.Background(), storage.DefaultNamespace, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api"}, res)
+}
+
+func Test_Ping(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil).Once()
+	c.On("Do", "PING").Return("PONG", nil).Once()
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+	assert.NoError(t, client.Ping(context.Background()))
+
+	p.On("GetContext", mock.Anything).Return(c, nil).Once()
+	c.On("Do", "PING").Return(nil, errors.New("LOADING Redis is loading the dataset in memory")).Once()
+	assert.Error(t, client.Ping(context.Background()))
+	p.On("GetContext", mock.Anything).Return(nil, errors.New("connection refused")).Once()
+	assert.EqualError(t, client.Ping(context.Background()), "Failed to get redis connection: connection refused")
+}
+
+func Test_Close(t *testing.T) {
+	p := &mocks.Pool{}
+	p.On("Close").Return(nil)
+	assert.NoError(t, newTestClient(p).Close())
+	p.AssertCalled(t, "Close")
+}
+
+func Test_HashTags(t *testing.T) {
+	p := &mocks.Pool{}
+	c := &mocks.Conn{}
+	p.On("GetContext", mock.Anything).Return(c, nil)
+	c.On("Do", "EVAL", createScript, 3, "{ct-dns:ns:team-a:api}", "ct-dns:service:{ct-dns:ns:team-a:api}", "ct-dns:meta:{ct-dns:ns:team-a:api}", "+inf", "192.0.0.1", `{"host":"192.0.0.1"}`).Return(int64(1), nil)
+	c.On("Do", "PUBLISH", "ct-dns:watch:{ct-dns:ns:team-a:api}", `{"type":"add","key":"{ct-dns:ns:team-a:api}","value":"192.0.0.1"}`).Return(int64(0), nil)
+	c.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:{*}", "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:{dummy-service}"), []byte("ct-dns:service:{ct-dns:ns:team-a:api}")}}, nil)
+	c.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:{ct-dns:ns:team-a:*}", "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:{ct-dns:ns:team-a:api}")}}, nil)
+	c.On("Do", "ZCOUNT", "{dummy-service}", "(1577836800000", "+inf").Return(int64(1), nil)
+	c.On("Do", "ZCOUNT", "{ct-dns:ns:team-a:api}", "(1577836800000", "+inf").Return(int64(1), nil)
+	c.On("Close").Return(nil)
+	client := newTestClient(p)
+	client.HashTags = true
+
+	assert.NoError(t, client.Create(context.Background(), "team-a", "api", storage.Instance{Host: "192.0.0.1"}, 0))
+	res, err := client.List(context.Background(), storage.DefaultNamespace, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy-service"}, res)
+	res, err = client.List(context.Background(), "team-a", "")
 	assert.NoError(t, err)
+	assert.Equal(t, []string{"api"}, res)
 }
@@ -0,0 +1,494 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	// slotCount is the number of hash slots keys of a redis cluster are spread over
+	slotCount = 16384
+	// maxRedirects bounds MOVED/ASK redirections followed by a command
+	maxRedirects = 3
+)
+
+// keylessCommands do not take a key, they are sent to any master
+var keylessCommands = map[string]bool{"PING": true, "PUBLISH": true, "ROLE": true, "CLUSTER": true}
+
+// cluster is Pool of a redis cluster, commands of its connections are sent to the master serving the slot of their key.
+// The slot layout is loaded from the cluster with CLUSTER SLOTS, reloaded once a node moved a slot or could not be reached.
+type cluster struct {
+	seeds   []string
+	newPool func(addr string) Pool
+
+	lock  sync.Mutex
+	slots []string
+	// ids holds node ids of masters by address, masters not reporting one are identified by their address
+	ids   map[string]string
+	pools map[string]Pool
+	stale bool
+}
+
+// node is a master of the cluster
+type node struct {
+	id   string
+	addr string
+}
+
+// newCluster creates cluster loading its slot layout from seeds, nodes are connected to by pools newPool creates
+func newCluster(seeds []string, newPool func(addr string) Pool) *cluster {
+	return &cluster{
+		seeds:   seeds,
+		newPool: newPool,
+		pools:   make(map[string]Pool),
+		stale:   true,
+	}
+}
+
+// GetContext returns connection routing commands to the masters of the cluster, loading the slot layout if stale
+func (c *cluster) GetContext(ctx context.Context) (redis.Conn, error) {
+	c.lock.Lock()
+	stale := c.stale
+	c.lock.Unlock()
+	if stale {
+		if err := c.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &clusterConn{cluster: c, ctx: ctx, conns: make(map[string]redis.Conn)}, nil
+}
+
+// Close closes the pools of every node
+func (c *cluster) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var err error
+	for addr, pool := range c.pools {
+		if closeErr := pool.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(c.pools, addr)
+	}
+	return err
+}
+
+// pool returns pool of node addr
+func (c *cluster) pool(addr string) Pool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pool, found := c.pools[addr]
+	if !found {
+		pool = c.newPool(addr)
+		c.pools[addr] = pool
+	}
+	return pool
+}
+
+// masters returns sorted addresses of the masters serving slots
+func (c *cluster) masters() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	seen := make(map[string]bool)
+	var res []string
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			res = append(res, addr)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// nodes returns the masters serving slots sorted by node id
+func (c *cluster) nodes() []node {
+	masters := c.masters()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res := make([]node, len(masters))
+	for i, addr := range masters {
+		res[i] = node{id: addr, addr: addr}
+		if id := c.ids[addr]; id != "" {
+			res[i].id = id
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+	return res
+}
+
+// addr returns address of the master serving slot, slots not served by any are sent to the first master
+func (c *cluster) addr(slot int) string {
+	var addr string
+	c.lock.Lock()
+	if c.slots != nil {
+		addr = c.slots[slot]
+	}
+	c.lock.Unlock()
+	if addr != "" {
+		return addr
+	}
+	if masters := c.masters(); len(masters) > 0 {
+		return masters[0]
+	}
+	return c.seeds[0]
+}
+
+// moved records slot is served by addr until the layout is reloaded
+func (c *cluster) moved(slot int, addr string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.slots != nil {
+		c.slots[slot] = addr
+	}
+	c.stale = true
+}
+
+// invalidate makes the next connection reload the layout
+func (c *cluster) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stale = true
+}
+
+// refresh loads the slot layout from the first known master or seed answering CLUSTER SLOTS
+func (c *cluster) refresh(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range append(c.masters(), c.seeds...) {
+		slots, ids, err := c.loadSlots(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.lock.Lock()
+		c.slots, c.ids, c.stale = slots, ids, false
+		c.lock.Unlock()
+		return nil
+	}
+	return errors.Wrap(lastErr, "Failed to load redis cluster slots")
+}
+
+// loadSlots maps every slot to the address of its master reported by node addr, along with the node ids of masters
+// by address
+func (c *cluster) loadSlots(ctx context.Context, addr string) ([]string, map[string]string, error) {
+	conn, err := c.pool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to get redis connection to %s", addr)
+	}
+	defer conn.Close()
+	ranges, err := redis.Values(do(ctx, conn, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to get cluster slots of %s", addr)
+	}
+	slots := make([]string, slotCount)
+	ids := make(map[string]string)
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, nil, errors.Errorf("Invalid cluster slots reply of %s", addr)
+		}
+		start, _ := redis.Int(fields[0], nil)
+		end, _ := redis.Int(fields[1], nil)
+		master, _ := redis.Values(fields[2], nil)
+		if start < 0 || end >= slotCount || start > end || len(master) < 2 {
+			return nil, nil, errors.Errorf("Invalid cluster slots reply of %s", addr)
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if host == "" {
+			// the node answering reports itself without host
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		masterAddr := net.JoinHostPort(host, strconv.Itoa(port))
+		if len(master) > 2 {
+			// redis before 4.0 does not report node ids
+			ids[masterAddr], _ = redis.String(master[2], nil)
+		}
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = masterAddr
+		}
+	}
+	return slots, ids, nil
+}
+
+// clusterConn sends each command to the master serving the slot of its key on a connection taken from the pool
+// of that master, held until Close. Send, Flush and Receive, used to subscribe, go to a single master,
+// messages published on any node reach subscribers of every node.
+type clusterConn struct {
+	cluster *cluster
+	ctx     context.Context
+	// lock guards conns and pubsub, Watch closes the connection while receiving on it
+	lock   sync.Mutex
+	conns  map[string]redis.Conn
+	pubsub redis.Conn
+}
+
+// conn returns connection to node addr
+func (cc *clusterConn) conn(addr string) (redis.Conn, error) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.conns == nil {
+		return nil, errors.New("Redis cluster connection is closed")
+	}
+	if conn, found := cc.conns[addr]; found {
+		return conn, nil
+	}
+	conn, err := cc.cluster.pool(addr).GetContext(cc.ctx)
+	if err != nil {
+		cc.cluster.invalidate()
+		return nil, errors.Wrapf(err, "Failed to get redis connection to %s", addr)
+	}
+	cc.conns[addr] = conn
+	return conn, nil
+}
+
+// Do sends cmd to the master serving its key
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return cc.route(func(conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+		return conn.Do(cmd, args...)
+	}, cmd, args...)
+}
+
+// DoWithTimeout sends cmd to the master serving its key, waiting up to timeout for its reply
+func (cc *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return cc.route(func(conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+		return redis.DoWithTimeout(conn, timeout, cmd, args...)
+	}, cmd, args...)
+}
+
+// route sends cmd through do to the master serving its key, following MOVED and ASK redirections
+func (cc *clusterConn) route(do func(conn redis.Conn, cmd string, args ...interface{}) (interface{}, error), cmd string, args ...interface{}) (interface{}, error) {
+	name := strings.ToUpper(cmd)
+	if name == "SCAN" {
+		return cc.scan(do, args...)
+	}
+	slot := -1
+	addr := cc.cluster.addr(0)
+	if key, ok := commandKey(name, args); ok {
+		slot = keySlot(key)
+		addr = cc.cluster.addr(slot)
+	}
+	asking := false
+	for redirects := 0; ; redirects++ {
+		conn, err := cc.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+		if asking {
+			if _, err := do(conn, "ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := do(conn, cmd, args...)
+		if _, ok := errors.Cause(err).(net.Error); ok || err == io.EOF {
+			cc.cluster.invalidate()
+		}
+		redirect, ok := err.(redis.Error)
+		if !ok || redirects == maxRedirects {
+			return reply, err
+		}
+		// MOVED <slot> <addr> or ASK <slot> <addr>
+		fields := strings.Fields(string(redirect))
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+		addr = fields[2]
+		asking = fields[0] == "ASK"
+		if !asking && slot >= 0 {
+			cc.cluster.moved(slot, addr)
+		}
+	}
+}
+
+// commandKey returns the key args of cmd are routed by, the first one, or the first of KEYS of EVAL and EVALSHA.
+// Keyless commands, and scripts not given keys, are routed to any master.
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch {
+	case keylessCommands[cmd] || len(args) == 0:
+		return "", false
+	case cmd == "EVAL" || cmd == "EVALSHA":
+		// EVAL <script> <numkeys> <key>...
+		if len(args) < 3 || keyString(args[1]) == "0" {
+			return "", false
+		}
+		return keyString(args[2]), true
+	default:
+		return keyString(args[0]), true
+	}
+}
+
+// scan runs SCAN on every master in turn, ordered by node id. The cursor "<cursor>-<node id>" tells the master and
+// its cursor to continue at, so masters added or removed while scanning neither make it skip nor repeat the others.
+// A master gone before its scan started is passed over, one gone halfway fails the scan with a transient error.
+func (cc *clusterConn) scan(do func(conn redis.Conn, cmd string, args ...interface{}) (interface{}, error), args ...interface{}) (interface{}, error) {
+	nodes := cc.cluster.nodes()
+	if len(args) == 0 || len(nodes) == 0 {
+		return nil, errors.New("Cannot scan redis cluster without cursor or masters")
+	}
+	current, cursor := nodes[0], "0"
+	if start := keyString(args[0]); start != "0" {
+		parts := strings.SplitN(start, "-", 2)
+		if _, err := strconv.ParseUint(parts[0], 10, 64); err != nil || len(parts) != 2 || parts[1] == "" {
+			return nil, errors.Errorf("Invalid redis cluster scan cursor %q", start)
+		}
+		cursor = parts[0]
+		i := sort.Search(len(nodes), func(i int) bool { return nodes[i].id >= parts[1] })
+		switch {
+		case i < len(nodes) && nodes[i].id == parts[1]:
+			current = nodes[i]
+		case cursor != "0":
+			return nil, storage.Transient(errors.Errorf("Redis cluster node %s left while being scanned", parts[1]))
+		case i == len(nodes):
+			return []interface{}{[]byte("0"), []interface{}{}}, nil
+		default:
+			current = nodes[i]
+		}
+	}
+	conn, err := cc.conn(current.addr)
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Values(do(conn, "SCAN", append([]interface{}{cursor}, args[1:]...)...))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 2 {
+		return nil, errors.Errorf("Invalid scan reply of %s", current.addr)
+	}
+	next, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	if next == "0" {
+		i := sort.Search(len(nodes), func(i int) bool { return nodes[i].id > current.id })
+		if i == len(nodes) {
+			return []interface{}{[]byte("0"), values[1]}, nil
+		}
+		current = nodes[i]
+	}
+	return []interface{}{[]byte(next + "-" + current.id), values[1]}, nil
+}
+
+// Send queues cmd on the connection subscriptions are made on
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	cc.lock.Lock()
+	pubsub := cc.pubsub
+	cc.lock.Unlock()
+	if pubsub == nil {
+		conn, err := cc.conn(cc.cluster.addr(0))
+		if err != nil {
+			return err
+		}
+		cc.lock.Lock()
+		cc.pubsub, pubsub = conn, conn
+		cc.lock.Unlock()
+	}
+	return pubsub.Send(cmd, args...)
+}
+
+// sent returns the connection commands were sent on
+func (cc *clusterConn) sent() (redis.Conn, error) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.pubsub == nil {
+		return nil, errors.New("Nothing sent on redis cluster connection")
+	}
+	return cc.pubsub, nil
+}
+
+// Flush flushes commands queued by Send
+func (cc *clusterConn) Flush() error {
+	conn, err := cc.sent()
+	if err != nil {
+		return err
+	}
+	return conn.Flush()
+}
+
+// Receive receives reply of the connection commands were sent on
+func (cc *clusterConn) Receive() (interface{}, error) {
+	conn, err := cc.sent()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Receive()
+}
+
+// ReceiveWithTimeout receives reply of the connection commands were sent on, waiting up to timeout
+func (cc *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	conn, err := cc.sent()
+	if err != nil {
+		return nil, err
+	}
+	return redis.ReceiveWithTimeout(conn, timeout)
+}
+
+// Err returns error of the connection commands were sent on
+func (cc *clusterConn) Err() error {
+	if conn, err := cc.sent(); err == nil {
+		return conn.Err()
+	}
+	return nil
+}
+
+// Close returns connections to the pools of their masters
+func (cc *clusterConn) Close() error {
+	cc.lock.Lock()
+	conns := cc.conns
+	cc.conns, cc.pubsub = nil, nil
+	cc.lock.Unlock()
+	var err error
+	for _, conn := range conns {
+		if closeErr := conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func keyString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	default:
+		return fmt.Sprint(arg)
+	}
+}
+
+// keySlot returns hash slot of key, only its hash tag, the part between the first { and the following }, is hashed if not empty
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % slotCount)
+}
+
+// crc16 is the CRC-16/XMODEM checksum redis cluster hashes keys with
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/guanw/ct-dns/plugins/storage/redis/mocks"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newTestCluster creates cluster of two masters, 10.0.0.1:6379 serving slots 0-8191 and 10.0.0.2:6379,
+// the seed, serving slots 8192-16383
+func newTestCluster(t *testing.T) (*cluster, *mocks.Conn, *mocks.Conn) {
+	conns := map[string]*mocks.Conn{"10.0.0.1:6379": {}, "10.0.0.2:6379": {}}
+	pools := make(map[string]*mocks.Pool)
+	for addr, c := range conns {
+		p := &mocks.Pool{}
+		p.On("GetContext", mock.Anything).Return(c, nil)
+		p.On("Close").Return(nil)
+		pools[addr] = p
+		c.On("Close").Return(nil)
+	}
+	conns["10.0.0.1:6379"].On("Do", "CLUSTER", "SLOTS").Return([]interface{}{
+		[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(6379), []byte("e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca")}},
+		[]interface{}{int64(8192), int64(16383), []interface{}{[]byte("10.0.0.2"), int64(6379), []byte("67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1")}},
+	}, nil)
+	// the seed reports itself without host
+	conns["10.0.0.2:6379"].On("Do", "CLUSTER", "SLOTS").Return([]interface{}{
+		[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(6379), []byte("e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca")}},
+		[]interface{}{int64(8192), int64(16383), []interface{}{[]byte(""), int64(6379), []byte("67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1")}},
+	}, nil)
+	c := newCluster([]string{"10.0.0.2:6379"}, func(addr string) Pool {
+		p, found := pools[addr]
+		assert.True(t, found, "unknown node %s", addr)
+		return p
+	})
+	return c, conns["10.0.0.1:6379"], conns["10.0.0.2:6379"]
+}
+
+func Test_KeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), crc16("123456789"))
+	assert.Equal(t, 12182, keySlot("foo"))
+	assert.Equal(t, 5061, keySlot("bar"))
+	assert.Equal(t, keySlot("user1000"), keySlot("{user1000}.following"))
+	assert.Equal(t, keySlot("ct-dns:meta:{dummy-service}"), keySlot("{dummy-service}"))
+	// empty hash tags are hashed along with the key
+	assert.NotEqual(t, keySlot("bar"), keySlot("foo{}{bar}"))
+}
+
+func Test_ClusterRoute(t *testing.T) {
+	c, first, second := newTestCluster(t)
+	first.On("Do", "ZADD", "bar", "+inf", "192.0.0.1").Return(int64(1), nil)
+	second.On("Do", "ZADD", "foo", "+inf", "192.0.0.1").Return(int64(1), nil)
+	second.On("Do", "PING").Return("PONG", nil)
+	conn, err := c.GetContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:6379", "10.0.0.2:6379"}, c.masters())
+
+	_, err = conn.Do("ZADD", "bar", "+inf", "192.0.0.1")
+	assert.NoError(t, err)
+	_, err = conn.Do("ZADD", "foo", "+inf", "192.0.0.1")
+	assert.NoError(t, err)
+	// keyless commands go to the master of slot 0
+	first.On("Do", "PING").Return("PONG", nil)
+	_, err = conn.Do("PING")
+	assert.NoError(t, err)
+	first.AssertCalled(t, "Do", "PING")
+
+	assert.NoError(t, conn.Close())
+	first.AssertNumberOfCalls(t, "Close", 1)
+	_, err = conn.Do("ZADD", "bar", "+inf", "192.0.0.1")
+	assert.Error(t, err)
+	assert.NoError(t, c.Close())
+}
+
+func Test_ClusterRedirect(t *testing.T) {
+	c, first, second := newTestCluster(t)
+	first.On("Do", "ZSCORE", "bar", "192.0.0.1").Return(nil, redis.Error("MOVED 5061 10.0.0.2:6379"))
+	second.On("Do", "ZSCORE", "bar", "192.0.0.1").Return([]byte("1577836800000"), nil)
+	second.On("Do", "ZSCORE", "foo", "192.0.0.1").Return(nil, redis.Error("ASK 12182 10.0.0.1:6379"))
+	first.On("Do", "ASKING").Return("OK", nil)
+	first.On("Do", "ZSCORE", "foo", "192.0.0.1").Return([]byte("1577836800000"), nil)
+	conn, err := c.GetContext(context.Background())
+	assert.NoError(t, err)
+
+	score, err := redis.String(conn.Do("ZSCORE", "bar", "192.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1577836800000", score)
+	assert.Equal(t, "10.0.0.2:6379", c.addr(5061))
+	score, err = redis.String(conn.Do("ZSCORE", "foo", "192.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1577836800000", score)
+	// ASK only redirects a single command
+	assert.Equal(t, "10.0.0.2:6379", c.addr(12182))
+
+	// MOVED reloads the layout from the known masters on the next connection
+	_, err = c.GetContext(context.Background())
+	assert.NoError(t, err)
+	first.AssertCalled(t, "Do", "CLUSTER", "SLOTS")
+	assert.Equal(t, "10.0.0.1:6379", c.addr(5061))
+}
+
+func Test_ClusterScan(t *testing.T) {
+	c, first, second := newTestCluster(t)
+	// masters are scanned in order of node id, 10.0.0.2:6379 first
+	second.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:*", "COUNT", 100).Return([]interface{}{[]byte("12"), []interface{}{[]byte("ct-dns:service:{foo}")}}, nil)
+	second.On("Do", "SCAN", "12", "MATCH", "ct-dns:service:*", "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{}}, nil)
+	first.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:*", "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:{bar}")}}, nil)
+	conn, err := c.GetContext(context.Background())
+	assert.NoError(t, err)
+
+	var keys, cursors []string
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "ct-dns:service:*", "COUNT", 100))
+		assert.NoError(t, err)
+		var scanned []string
+		_, err = redis.Scan(values, &cursor, &scanned)
+		assert.NoError(t, err)
+		keys = append(keys, scanned...)
+		cursors = append(cursors, cursor)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"ct-dns:service:{foo}", "ct-dns:service:{bar}"}, keys)
+	assert.Equal(t, []string{
+		"12-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1",
+		"0-e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca",
+		"0",
+	}, cursors)
+	_, err = conn.Do("SCAN", "5-0", "MATCH", "ct-dns:service:*", "COUNT", 100)
+	assert.Error(t, err)
+	_, err = conn.Do("SCAN", "x-e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca", "MATCH", "ct-dns:service:*", "COUNT", 100)
+	assert.EqualError(t, err, `Invalid redis cluster scan cursor "x-e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca"`)
+}
+
+func Test_ClusterScanLayoutChange(t *testing.T) {
+	c, first, _ := newTestCluster(t)
+	first.On("Do", "SCAN", "0", "MATCH", "ct-dns:service:*", "COUNT", 100).Return([]interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:{bar}")}}, nil)
+	conn, err := c.GetContext(context.Background())
+	assert.NoError(t, err)
+	// 10.0.0.2:6379 hands its slots over to 10.0.0.1:6379
+	for slot := 8192; slot < slotCount; slot++ {
+		c.moved(slot, "10.0.0.1:6379")
+	}
+
+	// the scan continues with the next master by node id, not by position
+	values, err := redis.Values(conn.Do("SCAN", "0-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1", "MATCH", "ct-dns:service:*", "COUNT", 100))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{[]byte("0"), []interface{}{[]byte("ct-dns:service:{bar}")}}, values)
+	values, err = redis.Values(conn.Do("SCAN", "0-f000000000000000000000000000000000000000", "MATCH", "ct-dns:service:*", "COUNT", 100))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{[]byte("0"), []interface{}{}}, values)
+	// the cursor of a master gone halfway cannot be continued elsewhere
+	_, err = conn.Do("SCAN", "12-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1", "MATCH", "ct-dns:service:*", "COUNT", 100)
+	assert.EqualError(t, err, "Redis cluster node 67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 left while being scanned")
+	assert.True(t, storage.IsTransient(err))
+}
+
+func Test_ClusterRouteScript(t *testing.T) {
+	c, first, second := newTestCluster(t)
+	first.On("Do", "EVAL", "return 1", 2, "{bar}", "ct-dns:meta:{bar}").Return(int64(1), nil)
+	second.On("Do", "EVAL", "return 1", 2, "{foo}", "ct-dns:meta:{foo}").Return(int64(1), nil)
+	first.On("Do", "EVAL", "return 1", 0).Return(int64(1), nil)
+	conn, err := c.GetContext(context.Background())
+	assert.NoError(t, err)
+
+	_, err = conn.Do("EVAL", "return 1", 2, "{bar}", "ct-dns:meta:{bar}")
+	assert.NoError(t, err)
+	_, err = conn.Do("EVAL", "return 1", 2, "{foo}", "ct-dns:meta:{foo}")
+	assert.NoError(t, err)
+	// scripts without keys go to the master of slot 0
+	_, err = conn.Do("EVAL", "return 1", 0)
+	assert.NoError(t, err)
+	first.AssertNumberOfCalls(t, "Do", 2)
+	second.AssertCalled(t, "Do", "EVAL", "return 1", 2, "{foo}", "ct-dns:meta:{foo}")
+}
+
+func Test_ClusterPubSub(t *testing.T) {
+	c, first, _ := newTestCluster(t)
+	first.On("Send", "SUBSCRIBE", "ct-dns:watch:{foo}").Return(nil)
+	first.On("Flush").Return(nil)
+	first.On("Receive").Return([]interface{}{[]byte("subscribe"), []byte("ct-dns:watch:{foo}"), int64(1)}, nil)
+	conn, err := c.GetContext(context.Background())
+	assert.NoError(t, err)
+
+	psc := redis.PubSubConn{Conn: conn}
+	assert.NoError(t, psc.Subscribe("ct-dns:watch:{foo}"))
+	assert.Equal(t, redis.Subscription{Kind: "subscribe", Channel: "ct-dns:watch:{foo}", Count: 1}, psc.Receive())
+	assert.NoError(t, psc.Close())
+	_, err = conn.Receive()
+	assert.Error(t, err)
+}
+
+func Test_ClusterUnreachable(t *testing.T) {
+	p := &mocks.Pool{}
+	p.On("GetContext", mock.Anything).Return(nil, context.DeadlineExceeded)
+	c := newCluster([]string{"10.0.0.1:6379"}, func(addr string) Pool { return p })
+	_, err := c.GetContext(context.Background())
+	assert.EqualError(t, err, "Failed to load redis cluster slots: Failed to get redis connection to 10.0.0.1:6379: context deadline exceeded")
+}
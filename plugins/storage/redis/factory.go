@@ -1,42 +1,176 @@
 package redis
 
 import (
+	"time"
+
 	"github.com/gomodule/redigo/redis"
-	config "github.com/guanw/ct-dns/cmd"
 	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/pkg/tlsconfig"
 	"github.com/guanw/ct-dns/storage"
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ModeStandalone connects to the single redis at Endpoint
+	ModeStandalone = "standalone"
+	// ModeSentinel connects to the master sentinels at SentinelAddresses report for SentinelMaster
+	ModeSentinel = "sentinel"
+	// ModeCluster connects to every master of the redis cluster ClusterAddresses belong to
+	ModeCluster = "cluster"
 )
 
-type builder struct {
-	Endpoint string
+// Config contains config for redis storage
+type Config struct {
+	// Mode is standalone, sentinel or cluster, empty is standalone
+	Mode     string `yaml:"mode"`
+	Endpoint string `yaml:"endpoint"`
+	// SentinelAddresses are host:port of sentinels monitoring master SentinelMaster,
+	// SentinelUsername and SentinelPassword authenticate to them
+	SentinelAddresses []string `yaml:"sentineladdresses"`
+	SentinelMaster    string   `yaml:"sentinelmaster"`
+	SentinelUsername  string   `yaml:"sentinelusername"`
+	SentinelPassword  string   `yaml:"sentinelpassword"`
+	// ClusterAddresses are host:port of cluster nodes the slot layout is loaded from
+	ClusterAddresses []string `yaml:"clusteraddresses"`
+	// Username and Password are sent with AUTH, Username needs redis 6 ACLs
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// DB is selected on every connection, redis cluster only has DB 0
+	DB           int           `yaml:"db"`
+	DialTimeout  time.Duration `yaml:"dialtimeout"`
+	ReadTimeout  time.Duration `yaml:"readtimeout"`
+	WriteTimeout time.Duration `yaml:"writetimeout"`
+	// MaxIdle and MaxActive bound idle and open connections, per node in cluster mode, 0 MaxActive is unlimited
+	MaxIdle     int           `yaml:"maxidle"`
+	MaxActive   int           `yaml:"maxactive"`
+	IdleTimeout time.Duration `yaml:"idletimeout"`
+	// Wait makes calls wait for a connection at MaxActive instead of failing
+	Wait bool `yaml:"wait"`
+	// TLS connects over TLS, implied by any of TLSCert, TLSKey or TLSCA
+	TLS           bool   `yaml:"tls"`
+	TLSCert       string `yaml:"tlscert"`
+	TLSKey        string `yaml:"tlskey"`
+	TLSCA         string `yaml:"tlsca"`
+	TLSSkipVerify bool   `yaml:"tlsskipverify"`
+}
+
+// useTLS tells whether redis-tls or any of cert, key or ca is set
+func (cfg Config) useTLS() bool {
+	return cfg.TLS || cfg.TLSCert != "" || cfg.TLSKey != "" || cfg.TLSCA != ""
 }
 
-func initFromViper(v *viper.Viper, cfg config.Config) *builder {
-	endpoint := v.GetString("redis-endpoint")
-	if cfg.Redis.Host != "" && cfg.Redis.Port != "" {
-		endpoint = cfg.Redis.Host + ":" + cfg.Redis.Port
+// dialOptions returns timeouts, along with TLS options when useTLS
+func (cfg Config) dialOptions() ([]redis.DialOption, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(cfg.DialTimeout),
+		redis.DialReadTimeout(cfg.ReadTimeout),
+		redis.DialWriteTimeout(cfg.WriteTimeout),
 	}
-	return &builder{
-		Endpoint: endpoint,
+	if !cfg.useTLS() {
+		return options, nil
 	}
+	tlsConfig, err := tlsconfig.ClientConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA, cfg.TLSSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig)), nil
 }
 
-// NewFactory creates storage client with redis.Pool
-func NewFactory(v *viper.Viper, cfg config.Config) (storage.Client, error) {
-	b := initFromViper(v, cfg)
-	pool := &redis.Pool{
-		MaxIdle:   80,
-		MaxActive: 12000, // max number of connections
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", b.Endpoint)
-			if err != nil {
-				return nil, errors.Wrap(err, "Failed to create redis pool")
+// dialFunc returns func connecting to an address with options, authenticating as username when password is set
+// and selecting db. AUTH and SELECT are sent here as redis.DialPassword cannot send a username.
+func dialFunc(options []redis.DialOption, username, password string, db int) func(addr string) (redis.Conn, error) {
+	return func(addr string) (redis.Conn, error) {
+		c, err := redis.Dial("tcp", addr, options...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to connect to redis %s", addr)
+		}
+		if password != "" {
+			args := redis.Args{}
+			if username != "" {
+				args = args.Add(username)
+			}
+			if _, err := c.Do("AUTH", args.Add(password)...); err != nil {
+				c.Close()
+				return nil, errors.Wrapf(err, "Failed to authenticate to redis %s", addr)
 			}
-			return c, err
-		},
+		}
+		if db != 0 {
+			if _, err := c.Do("SELECT", db); err != nil {
+				c.Close()
+				return nil, errors.Wrapf(err, "Failed to select redis db %d", db)
+			}
+		}
+		return c, nil
+	}
+}
+
+// newPool creates redis.Pool sized by cfg connecting with dial
+func (cfg Config) newPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     cfg.MaxIdle,
+		MaxActive:   cfg.MaxActive,
+		IdleTimeout: cfg.IdleTimeout,
+		Wait:        cfg.Wait,
+		Dial:        dial,
+	}
+}
+
+// NewFactory creates storage client on redis.Pool connecting to the redis of cfg.Mode
+func NewFactory(cfg Config) (storage.Client, error) {
+	options, err := cfg.dialOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot load redis tls config")
+	}
+	dial := dialFunc(options, cfg.Username, cfg.Password, cfg.DB)
+	fields := logrus.Fields{
+		"Mode":      cfg.Mode,
+		"TLS":       cfg.useTLS(),
+		"DB":        cfg.DB,
+		"MaxIdle":   cfg.MaxIdle,
+		"MaxActive": cfg.MaxActive,
+	}
+
+	var c *Client
+	switch cfg.Mode {
+	case "", ModeStandalone:
+		fields["Endpoint"] = cfg.Endpoint
+		c = NewClient(cfg.newPool(func() (redis.Conn, error) {
+			return dial(cfg.Endpoint)
+		})).(*Client)
+	case ModeSentinel:
+		if len(cfg.SentinelAddresses) == 0 || cfg.SentinelMaster == "" {
+			return nil, errors.New("Redis sentinel mode needs sentinel addresses and master")
+		}
+		fields["Sentinels"], fields["Master"] = cfg.SentinelAddresses, cfg.SentinelMaster
+		s := &sentinel{
+			Addresses: cfg.SentinelAddresses,
+			Master:    cfg.SentinelMaster,
+			dial:      dialFunc(options, cfg.SentinelUsername, cfg.SentinelPassword, 0),
+		}
+		pool := cfg.newPool(func() (redis.Conn, error) {
+			return s.dialMaster(dial)
+		})
+		pool.TestOnBorrow = testMasterOnBorrow
+		c = NewClient(pool).(*Client)
+	case ModeCluster:
+		if len(cfg.ClusterAddresses) == 0 {
+			return nil, errors.New("Redis cluster mode needs cluster addresses")
+		}
+		if cfg.DB != 0 {
+			return nil, errors.New("Redis cluster only has db 0")
+		}
+		fields["Nodes"] = cfg.ClusterAddresses
+		c = NewClient(newCluster(cfg.ClusterAddresses, func(addr string) Pool {
+			return cfg.newPool(func() (redis.Conn, error) {
+				return dial(addr)
+			})
+		})).(*Client)
+		c.HashTags = true
+	default:
+		return nil, errors.Errorf("Unknown redis mode %q, expected standalone, sentinel or cluster", cfg.Mode)
 	}
-	logging.GetLogger().WithField("Endpoint", b.Endpoint).Info("Creating redis pool")
-	return NewClient(pool), nil
+	// passwords are not logged
+	logging.GetLogger().WithFields(fields).Info("Creating redis pool")
+	return c, nil
 }
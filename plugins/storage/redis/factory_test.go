@@ -1,27 +1,73 @@
 package redis
 
 import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
 	"testing"
 
-	config "github.com/guanw/ct-dns/cmd"
-	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_NewFactory(t *testing.T) {
-	v := viper.New()
-	_, err := NewFactory(v, config.Config{})
+	_, err := NewFactory(Config{Endpoint: "0.0.0.0:6379"})
 	assert.NoError(t, err)
+	c, err := NewFactory(Config{Mode: ModeSentinel, SentinelAddresses: []string{"0.0.0.0:26379"}, SentinelMaster: "ct-dns"})
+	assert.NoError(t, err)
+	assert.False(t, c.(*Client).HashTags)
+	c, err = NewFactory(Config{Mode: ModeCluster, ClusterAddresses: []string{"0.0.0.0:7000"}})
+	assert.NoError(t, err)
+	assert.True(t, c.(*Client).HashTags)
+
+	_, err = NewFactory(Config{Mode: ModeSentinel, SentinelAddresses: []string{"0.0.0.0:26379"}})
+	assert.EqualError(t, err, "Redis sentinel mode needs sentinel addresses and master")
+	_, err = NewFactory(Config{Mode: ModeCluster, ClusterAddresses: []string{"0.0.0.0:7000"}, DB: 1})
+	assert.EqualError(t, err, "Redis cluster only has db 0")
+	_, err = NewFactory(Config{Mode: "replicated"})
+	assert.EqualError(t, err, `Unknown redis mode "replicated", expected standalone, sentinel or cluster`)
+}
+
+func Test_NewFactoryInvalidTLS(t *testing.T) {
+	_, err := NewFactory(Config{Endpoint: "0.0.0.0:6379", TLSCA: "/nonexistent/ca.pem"})
+	assert.Error(t, err)
 }
 
-func Test_initFromViperWithCfg(t *testing.T) {
-	expectedHost := "redis-test"
-	expectedPort := "6379"
-	b := initFromViper(viper.New(), config.Config{
-		Redis: config.RedisConfig{
-			Host: expectedHost,
-			Port: expectedPort,
-		},
-	})
-	assert.Equal(t, expectedHost+":"+expectedPort, b.Endpoint)
+func Test_DialFunc(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	commands := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			// commands are arrays of bulk strings, *<n> followed by $<len> and <arg> lines
+			line, _ := r.ReadString('\n')
+			var n int
+			if _, err := fmt.Sscanf(line, "*%d", &n); err != nil {
+				return
+			}
+			args := make([]string, n)
+			for j := range args {
+				r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args[j] = strings.TrimSpace(arg)
+			}
+			commands <- strings.Join(args, " ")
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}()
+
+	options, err := Config{}.dialOptions()
+	assert.NoError(t, err)
+	c, err := dialFunc(options, "ct-dns", "secret", 2)(listener.Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, "AUTH ct-dns secret", <-commands)
+	assert.Equal(t, "SELECT 2", <-commands)
 }
@@ -1,8 +1,32 @@
 package redis
 
-import "flag"
+import (
+	"flag"
+	"time"
+)
 
 // AddFlags binds flags to redis setup
 func AddFlags(flagSet *flag.FlagSet) {
+	flagSet.String("redis-mode", ModeStandalone, "--redis-mode <standalone|sentinel|cluster>")
 	flagSet.String("redis-endpoint", "0.0.0.0:6379", "--redis-endpoint <name>")
+	flagSet.String("redis-sentinel-addresses", "", "--redis-sentinel-addresses <comma separated host:port> of sentinels")
+	flagSet.String("redis-sentinel-master", "", "--redis-sentinel-master <name> of the master sentinels monitor")
+	flagSet.String("redis-sentinel-username", "", "--redis-sentinel-username <name> to authenticate to sentinels as")
+	flagSet.String("redis-sentinel-password", "", "--redis-sentinel-password <password> of sentinels")
+	flagSet.String("redis-cluster-addresses", "", "--redis-cluster-addresses <comma separated host:port> of cluster nodes")
+	flagSet.String("redis-username", "", "--redis-username <name> to authenticate as, needs redis 6 ACLs")
+	flagSet.String("redis-password", "", "--redis-password <password>")
+	flagSet.Int("redis-db", 0, "--redis-db <index> to select")
+	flagSet.Duration("redis-dial-timeout", 5*time.Second, "--redis-dial-timeout <duration>")
+	flagSet.Duration("redis-read-timeout", 3*time.Second, "--redis-read-timeout <duration>")
+	flagSet.Duration("redis-write-timeout", 3*time.Second, "--redis-write-timeout <duration>")
+	flagSet.Int("redis-max-idle", 80, "--redis-max-idle <count> of idle connections")
+	flagSet.Int("redis-max-active", 12000, "--redis-max-active <count> of open connections, 0 is unlimited")
+	flagSet.Duration("redis-idle-timeout", 5*time.Minute, "--redis-idle-timeout <duration> idle connections are closed after")
+	flagSet.Bool("redis-wait", false, "--redis-wait waits for a connection at --redis-max-active instead of failing")
+	flagSet.Bool("redis-tls", false, "--redis-tls connects to redis over TLS")
+	flagSet.String("redis-tls-cert", "", "--redis-tls-cert <path> of client certificate")
+	flagSet.String("redis-tls-key", "", "--redis-tls-key <path> of client key")
+	flagSet.String("redis-tls-ca", "", "--redis-tls-ca <path> of ca bundle to verify redis with")
+	flagSet.Bool("redis-tls-skip-verify", false, "--redis-tls-skip-verify skips verifying redis certificate, for testing only")
 }
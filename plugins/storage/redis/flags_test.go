@@ -10,8 +10,13 @@ import (
 func Test_AddFlags(t *testing.T) {
 	flagSet := flag.NewFlagSet("redis", flag.ExitOnError)
 	AddFlags(flagSet)
-	flagSet.Parse([]string{"--redis-endpoint", "0.0.0.0:6379"})
+	flagSet.Parse([]string{"--redis-endpoint", "0.0.0.0:6379", "--redis-mode", "sentinel", "--redis-sentinel-addresses", "10.0.0.1:26379,10.0.0.2:26379"})
 	if flagSet.Parsed() {
 		assert.Equal(t, flagSet.Lookup("redis-endpoint").Value.String(), "0.0.0.0:6379")
+		assert.Equal(t, ModeSentinel, flagSet.Lookup("redis-mode").Value.String())
+		assert.Equal(t, "10.0.0.1:26379,10.0.0.2:26379", flagSet.Lookup("redis-sentinel-addresses").Value.String())
+		assert.Equal(t, "0", flagSet.Lookup("redis-db").Value.String())
+		assert.Equal(t, "12000", flagSet.Lookup("redis-max-active").Value.String())
+		assert.Equal(t, "3s", flagSet.Lookup("redis-read-timeout").Value.String())
 	}
 }
@@ -3,8 +3,11 @@
 package mocks
 
 import (
-	redis "github.com/gomodule/redigo/redis"
+	context "context"
+
 	mock "github.com/stretchr/testify/mock"
+
+	redis "github.com/gomodule/redigo/redis"
 )
 
 // Pool is an autogenerated mock type for the Pool type
@@ -12,18 +15,39 @@ type Pool struct {
 	mock.Mock
 }
 
-// Get provides a mock function with given fields:
-func (_m *Pool) Get() redis.Conn {
+// Close provides a mock function with given fields:
+func (_m *Pool) Close() error {
 	ret := _m.Called()
 
-	var r0 redis.Conn
-	if rf, ok := ret.Get(0).(func() redis.Conn); ok {
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
 		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetContext provides a mock function with given fields: ctx
+func (_m *Pool) GetContext(ctx context.Context) (redis.Conn, error) {
+	ret := _m.Called(ctx)
+
+	var r0 redis.Conn
+	if rf, ok := ret.Get(0).(func(context.Context) redis.Conn); ok {
+		r0 = rf(ctx)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(redis.Conn)
 		}
 	}
 
-	return r0
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
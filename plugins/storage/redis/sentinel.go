@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"net"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// roleCheckInterval is how long a connection may idle before its role is checked again when borrowed
+const roleCheckInterval = time.Second
+
+// sentinel discovers the address of master Master from the first of Addresses answering
+type sentinel struct {
+	Addresses []string
+	Master    string
+	dial      func(addr string) (redis.Conn, error)
+}
+
+// masterAddr asks sentinels in turn for the address of the master
+func (s *sentinel) masterAddr() (string, error) {
+	var lastErr error
+	for _, addr := range s.Addresses {
+		c, err := s.dial(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.Master))
+		c.Close()
+		switch {
+		case err == redis.ErrNil:
+			lastErr = errors.Errorf("Sentinel %s does not monitor master %q", addr, s.Master)
+		case err != nil:
+			lastErr = errors.Wrapf(err, "Failed to ask sentinel %s for master", addr)
+		case len(reply) != 2:
+			lastErr = errors.Errorf("Sentinel %s replied %v for master %q", addr, reply, s.Master)
+		default:
+			return net.JoinHostPort(reply[0], reply[1]), nil
+		}
+	}
+	return "", errors.Wrapf(lastErr, "Failed to discover redis master %q", s.Master)
+}
+
+// dialMaster dials the master with dial, checking sentinels did not report a master demoted since
+func (s *sentinel) dialMaster(dial func(addr string) (redis.Conn, error)) (redis.Conn, error) {
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	c, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRole(c, "master"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// testMasterOnBorrow checks connections idle since t still reach a master, a failover demotes
+// the master they were dialed to. Recently used ones are not checked, every borrow would cost
+// a ROLE round trip otherwise
+func testMasterOnBorrow(c redis.Conn, t time.Time) error {
+	if time.Since(t) < roleCheckInterval {
+		return nil
+	}
+	return checkRole(c, "master")
+}
+
+// checkRole checks ROLE of the redis c is connected to is role
+func checkRole(c redis.Conn, role string) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return errors.Wrap(err, "Failed to get redis role")
+	}
+	if len(reply) == 0 {
+		return errors.New("Empty redis role reply")
+	}
+	actual, err := redis.String(reply[0], nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get redis role")
+	}
+	if actual != role {
+		return errors.Errorf("Redis is %s, not %s", actual, role)
+	}
+	return nil
+}
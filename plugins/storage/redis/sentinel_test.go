@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/guanw/ct-dns/plugins/storage/redis/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSentinel(conns map[string]redis.Conn, addresses ...string) *sentinel {
+	return &sentinel{
+		Addresses: addresses,
+		Master:    "ct-dns",
+		dial: func(addr string) (redis.Conn, error) {
+			if c, found := conns[addr]; found {
+				return c, nil
+			}
+			return nil, errors.New("connection refused")
+		},
+	}
+}
+
+func Test_SentinelMasterAddr(t *testing.T) {
+	unknown := &mocks.Conn{}
+	unknown.On("Do", "SENTINEL", "get-master-addr-by-name", "ct-dns").Return(nil, nil)
+	unknown.On("Close").Return(nil)
+	known := &mocks.Conn{}
+	known.On("Do", "SENTINEL", "get-master-addr-by-name", "ct-dns").Return([]interface{}{[]byte("10.0.0.1"), []byte("6379")}, nil)
+	known.On("Close").Return(nil)
+	conns := map[string]redis.Conn{"sentinel-1:26379": unknown, "sentinel-2:26379": known}
+
+	s := newTestSentinel(conns, "sentinel-0:26379", "sentinel-1:26379", "sentinel-2:26379")
+	addr, err := s.masterAddr()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:6379", addr)
+	known.AssertCalled(t, "Close")
+
+	s = newTestSentinel(conns, "sentinel-0:26379", "sentinel-1:26379")
+	_, err = s.masterAddr()
+	assert.EqualError(t, err, `Failed to discover redis master "ct-dns": Sentinel sentinel-1:26379 does not monitor master "ct-dns"`)
+}
+
+func Test_SentinelDialMaster(t *testing.T) {
+	s := &mocks.Conn{}
+	s.On("Do", "SENTINEL", "get-master-addr-by-name", "ct-dns").Return([]interface{}{[]byte("10.0.0.1"), []byte("6379")}, nil)
+	s.On("Close").Return(nil)
+	master := &mocks.Conn{}
+	master.On("Do", "ROLE").Return([]interface{}{[]byte("master"), int64(3129659), []interface{}{}}, nil).Once()
+	master.On("Do", "ROLE").Return([]interface{}{[]byte("slave"), []byte("10.0.0.2"), int64(6379), []byte("connected"), int64(3129659)}, nil)
+	master.On("Close").Return(nil)
+	sentinel := newTestSentinel(map[string]redis.Conn{"sentinel-0:26379": s}, "sentinel-0:26379")
+	dial := func(addr string) (redis.Conn, error) {
+		assert.Equal(t, "10.0.0.1:6379", addr)
+		return master, nil
+	}
+
+	c, err := sentinel.dialMaster(dial)
+	assert.NoError(t, err)
+	assert.Equal(t, master, c)
+	// a demoted master is not used
+	_, err = sentinel.dialMaster(dial)
+	assert.EqualError(t, err, "Redis is slave, not master")
+	master.AssertNumberOfCalls(t, "Close", 1)
+}
+
+func Test_TestMasterOnBorrow(t *testing.T) {
+	demoted := &mocks.Conn{}
+	demoted.On("Do", "ROLE").Return([]interface{}{[]byte("slave"), []byte("10.0.0.2"), int64(6379), []byte("connected"), int64(3129659)}, nil)
+
+	// recently used connections are not checked
+	assert.NoError(t, testMasterOnBorrow(demoted, time.Now()))
+	demoted.AssertNotCalled(t, "Do", "ROLE")
+	assert.EqualError(t, testMasterOnBorrow(demoted, time.Now().Add(-roleCheckInterval)), "Redis is slave, not master")
+}
@@ -0,0 +1,285 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/guanw/ct-dns/storage"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWatchInterval = 5 * time.Second
+	evictInterval        = 30 * time.Second
+)
+
+// queries use $n placeholders in order of appearance, which PostgreSQL and SQLite both bind positionally
+const (
+	upsertQuery = `INSERT INTO ct_dns_instances (namespace, service, host, instance, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (namespace, service, host) DO UPDATE SET instance = excluded.instance, expires_at = excluded.expires_at`
+	getQuery = `SELECT instance FROM ct_dns_instances
+		WHERE namespace = $1 AND service = $2 AND (expires_at = 0 OR expires_at > $3)`
+	deleteQuery = `DELETE FROM ct_dns_instances WHERE namespace = $1 AND service = $2 AND host = $3`
+	renewQuery  = `UPDATE ct_dns_instances SET expires_at = $1
+		WHERE namespace = $2 AND service = $3 AND host = $4 AND (expires_at = 0 OR expires_at > $5)`
+	listQuery = `SELECT DISTINCT service FROM ct_dns_instances
+		WHERE namespace = $1 AND substr(service, 1, $2) = $3 AND (expires_at = 0 OR expires_at > $4)`
+	evictQuery = `DELETE FROM ct_dns_instances WHERE expires_at <> 0 AND expires_at <= $1`
+)
+
+// Client defines storage client on a sql database, instances are rows of ct_dns_instances
+// unique by namespace, service and host, holding the json encoded instance.
+// Replicas share the database, so Watch polls for changes every WatchInterval.
+type Client struct {
+	DB *sql.DB
+	// WatchInterval is how often Watch polls for changes
+	WatchInterval time.Duration
+
+	now func() time.Time
+	// stop ends eviction, stopped is closed once it ended
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewClient creates new sql client on db, whose schema NewFactory migrates,
+// expired rows are deleted every evictInterval until Close
+func NewClient(db *sql.DB) storage.Client {
+	ctx, stop := context.WithCancel(context.Background())
+	c := &Client{
+		DB:            db,
+		WatchInterval: defaultWatchInterval,
+		now:           time.Now,
+		stop:          stop,
+		stopped:       make(chan struct{}),
+	}
+	go c.run(ctx)
+	return c
+}
+
+func (c *Client) expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return c.now().Add(ttl).UnixNano()
+}
+
+// Create upserts instance under key expiring after ttl, replacing the instance registered with its host
+func (c *Client) Create(ctx context.Context, namespace, key string, instance storage.Instance, ttl time.Duration) error {
+	value, err := json.Marshal(instance)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal instance")
+	}
+	if _, err := c.DB.ExecContext(ctx, upsertQuery, namespace, key, instance.Host, string(value), c.expiresAt(ttl)); err != nil {
+		return errors.Wrap(err, "Failed to upsert instance")
+	}
+	return nil
+}
+
+// Get gets unexpired instances under key
+func (c *Client) Get(ctx context.Context, namespace, key string) (string, error) {
+	res, err := c.instances(ctx, namespace, key)
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 0 {
+		return "", storage.ErrKeyNotFound
+	}
+	jsonized, _ := json.Marshal(res)
+	return string(jsonized), nil
+}
+
+// instances returns unexpired instances under key sorted by host
+func (c *Client) instances(ctx context.Context, namespace, key string) ([]storage.Instance, error) {
+	rows, err := c.DB.QueryContext(ctx, getQuery, namespace, key, c.now().UnixNano())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query instances")
+	}
+	defer rows.Close()
+	var res []storage.Instance
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, errors.Wrap(err, "Failed to read instance")
+		}
+		var instance storage.Instance
+		if err := json.Unmarshal([]byte(value), &instance); err != nil {
+			logging.GetLogger().WithError(err).WithField("key", key).Warn("Failed to decode sql instance")
+			continue
+		}
+		res = append(res, instance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to query instances")
+	}
+	// collations of the database may not order hosts bytewise
+	sort.Slice(res, func(i, j int) bool { return res[i].Host < res[j].Host })
+	return res, nil
+}
+
+// Delete deletes service & host combination
+func (c *Client) Delete(ctx context.Context, namespace, key, value string) error {
+	if _, err := c.DB.ExecContext(ctx, deleteQuery, namespace, key, value); err != nil {
+		return errors.Wrap(err, "Failed to delete instance")
+	}
+	return nil
+}
+
+// Renew extends expiration of service & host combination by ttl
+func (c *Client) Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error {
+	res, err := c.DB.ExecContext(ctx, renewQuery, c.expiresAt(ttl), namespace, key, value, c.now().UnixNano())
+	if err != nil {
+		return errors.Wrap(err, "Failed to renew instance")
+	}
+	renewed, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to renew instance")
+	}
+	if renewed == 0 {
+		return storage.ErrInstanceNotFound
+	}
+	return nil
+}
+
+// Watch polls instances under key every WatchInterval, streaming hosts added/removed until ctx is done
+func (c *Client) Watch(ctx context.Context, namespace, key string) (<-chan storage.Event, error) {
+	previous, err := c.instances(ctx, namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan storage.Event)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(c.WatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := c.instances(ctx, namespace, key)
+			if err != nil {
+				logging.GetLogger().WithError(err).WithField("key", key).Warn("Failed to poll sql for changes")
+				continue
+			}
+			for _, event := range diff(key, previous, current) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			previous = current
+		}
+	}()
+	return events, nil
+}
+
+// List lists keys of namespace starting with prefix holding at least one unexpired host
+func (c *Client) List(ctx context.Context, namespace, prefix string) ([]string, error) {
+	// substr compares characters on both databases, unlike LIKE which SQLite matches case insensitively
+	rows, err := c.DB.QueryContext(ctx, listQuery, namespace, utf8.RuneCountInString(prefix), prefix, c.now().UnixNano())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list services")
+	}
+	defer rows.Close()
+	res := []string{}
+	for rows.Next() {
+		var service string
+		if err := rows.Scan(&service); err != nil {
+			return nil, errors.Wrap(err, "Failed to read service")
+		}
+		res = append(res, service)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to list services")
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// IsTransient tells connection failures, timeouts and conflicts worth retrying from permanent errors
+func (c *Client) IsTransient(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case *pq.Error:
+		// connection exception, transaction rollback, insufficient resources and operator intervention
+		switch cause.Code.Class() {
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	case net.Error:
+		return true
+	default:
+		// SQLite reports a write lock held by another connection as locked
+		return cause == driver.ErrBadConn || cause == context.DeadlineExceeded ||
+			strings.Contains(cause.Error(), "database is locked")
+	}
+}
+
+// Ping checks the database is reachable
+func (c *Client) Ping(ctx context.Context) error {
+	if err := c.DB.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "Failed to ping database")
+	}
+	return nil
+}
+
+// Close stops evicting expired rows and closes the connection pool
+func (c *Client) Close() error {
+	c.stop()
+	<-c.stopped
+	return c.DB.Close()
+}
+
+// run deletes expired rows every evictInterval until ctx is done, reads skip them until then
+func (c *Client) run(ctx context.Context) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.evict(ctx); err != nil && ctx.Err() == nil {
+				logging.GetLogger().WithError(err).Warn("Failed to delete expired sql instances")
+			}
+		}
+	}
+}
+
+func (c *Client) evict(ctx context.Context) error {
+	_, err := c.DB.ExecContext(ctx, evictQuery, c.now().UnixNano())
+	return errors.Wrap(err, "Failed to delete expired instances")
+}
+
+func diff(key string, previous, current []storage.Instance) []storage.Event {
+	seen := make(map[string]storage.Instance, len(previous))
+	for _, instance := range previous {
+		seen[instance.Host] = instance
+	}
+	var events []storage.Event
+	for _, instance := range current {
+		if before, found := seen[instance.Host]; !found || !reflect.DeepEqual(before, instance) {
+			events = append(events, storage.Event{Type: storage.EventAdd, Key: key, Value: instance.Host})
+		}
+		delete(seen, instance.Host)
+	}
+	for _, instance := range previous {
+		if _, found := seen[instance.Host]; found {
+			events = append(events, storage.Event{Type: storage.EventRemove, Key: key, Value: instance.Host})
+		}
+	}
+	return events
+}
@@ -0,0 +1,199 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guanw/ct-dns/storage"
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient creates client on a migrated SQLite file reading time from now, close removes the file,
+// expired rows are only deleted by calling evict
+func newTestClient(t *testing.T, now func() time.Time) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "ct-dns-sql")
+	assert.NoError(t, err)
+	db, err := sql.Open(DriverSQLite, filepath.Join(dir, "ct-dns.db"))
+	assert.NoError(t, err)
+	assert.NoError(t, migrate(context.Background(), db))
+	c := NewClient(db).(*Client)
+	c.stop()
+	<-c.stopped
+	c.now = now
+	return c, func() {
+		c.DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_CreateAndGet(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	_, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.Equal(t, storage.ErrKeyNotFound, err)
+
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	// upsert replaces the instance of the host
+	instance := storage.Instance{
+		Host:   "192.0.0.2",
+		Zone:   "us-east-1a",
+		Weight: 10,
+		Canary: true,
+		Tags:   map[string]string{"version": "v2"},
+	}
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", instance, 0))
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.2","zone":"us-east-1a","weight":10,"canary":true,"tags":{"version":"v2"}}]`, res)
+
+	var rows int
+	assert.NoError(t, c.DB.QueryRow(`SELECT COUNT(*) FROM ct_dns_instances`).Scan(&rows))
+	assert.Equal(t, 2, rows)
+	_, err = c.DB.Exec(`INSERT INTO ct_dns_instances (namespace, service, host, instance) VALUES ($1, $2, $3, $4)`,
+		storage.DefaultNamespace, "dummy-service", "192.0.0.1", "{}")
+	assert.Error(t, err, "service and host are unique")
+}
+
+func Test_Delete(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1"))
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.3"))
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.2"}]`, res)
+}
+
+func Test_ExpireAndRenew(t *testing.T) {
+	now := time.Now()
+	c, close := newTestClient(t, func() time.Time { return now })
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 10*time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 10*time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.3"}, 0))
+
+	now = now.Add(5 * time.Second)
+	assert.NoError(t, c.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.1", 10*time.Second))
+	now = now.Add(5 * time.Second)
+	res, err := c.Get(context.Background(), storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"},{"host":"192.0.0.3"}]`, res)
+	assert.Equal(t, storage.ErrInstanceNotFound, c.Renew(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2", 10*time.Second))
+	assert.Equal(t, storage.ErrInstanceNotFound, c.Renew(context.Background(), storage.DefaultNamespace, "unknown-service", "192.0.0.1", 10*time.Second))
+
+	now = now.Add(5 * time.Second)
+	assert.NoError(t, c.evict(context.Background()))
+	var rows int
+	assert.NoError(t, c.DB.QueryRow(`SELECT COUNT(*) FROM ct_dns_instances`).Scan(&rows))
+	assert.Equal(t, 1, rows)
+}
+
+func Test_List(t *testing.T) {
+	now := time.Now()
+	c, close := newTestClient(t, func() time.Time { return now })
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-api", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-expiring", storage.Instance{Host: "192.0.0.3"}, 10*time.Second))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "Dummy-upper", storage.Instance{Host: "192.0.0.4"}, 0))
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy_underscore", storage.Instance{Host: "192.0.0.5"}, 0))
+
+	res, err := c.List(context.Background(), storage.DefaultNamespace, "dummy-")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy-api", "dummy-expiring", "dummy-service"}, res)
+
+	now = now.Add(10 * time.Second)
+	res, err = c.List(context.Background(), storage.DefaultNamespace, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Dummy-upper", "dummy-api", "dummy-service", "dummy_underscore"}, res)
+	res, err = c.List(context.Background(), storage.DefaultNamespace, "dummy_")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dummy_underscore"}, res)
+	res, err = c.List(context.Background(), storage.DefaultNamespace, "unknown")
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func Test_Namespaces(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	assert.NoError(t, c.Create(context.Background(), "team-a", "api", storage.Instance{Host: "192.0.0.1"}, 0))
+	assert.NoError(t, c.Create(context.Background(), "team-b", "api", storage.Instance{Host: "192.0.0.1", Weight: 2}, 0))
+
+	res, err := c.Get(context.Background(), "team-a", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+	_, err = c.Get(context.Background(), storage.DefaultNamespace, "api")
+	assert.Error(t, err)
+	assert.NoError(t, c.Delete(context.Background(), "team-b", "api", "192.0.0.1"))
+	res, err = c.Get(context.Background(), "team-a", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"host":"192.0.0.1"}]`, res)
+	services, err := c.List(context.Background(), "team-b", "")
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func Test_Watch(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	c.WatchInterval = 10 * time.Millisecond
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1"}, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := c.Watch(ctx, storage.DefaultNamespace, "dummy-service")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.2"}, 0))
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+	assert.NoError(t, c.Create(context.Background(), storage.DefaultNamespace, "dummy-service", storage.Instance{Host: "192.0.0.1", Canary: true}, 0))
+	assert.Equal(t, storage.Event{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.1"}, <-events)
+	assert.NoError(t, c.Delete(context.Background(), storage.DefaultNamespace, "dummy-service", "192.0.0.2"))
+	assert.Equal(t, storage.Event{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.2"}, <-events)
+
+	cancel()
+	for range events {
+	}
+}
+
+func Test_IsTransient(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	assert.True(t, c.IsTransient(errors.Wrap(&pq.Error{Code: "08006"}, "Failed to upsert instance")))
+	assert.True(t, c.IsTransient(&pq.Error{Code: "40001"}))
+	assert.False(t, c.IsTransient(&pq.Error{Code: "23505"}))
+	assert.True(t, c.IsTransient(driver.ErrBadConn))
+	assert.True(t, c.IsTransient(errors.New("database is locked")))
+	assert.False(t, c.IsTransient(storage.ErrInstanceNotFound))
+	assert.False(t, c.IsTransient(storage.ErrKeyNotFound))
+}
+
+func Test_PingAndClose(t *testing.T) {
+	c, close := newTestClient(t, time.Now)
+	defer close()
+	assert.NoError(t, c.Ping(context.Background()))
+	assert.NoError(t, c.DB.Close())
+	assert.Error(t, c.Ping(context.Background()))
+}
+
+func Test_Diff(t *testing.T) {
+	previous := []storage.Instance{{Host: "192.0.0.1"}, {Host: "192.0.0.2"}}
+	current := []storage.Instance{{Host: "192.0.0.2", Weight: 3}, {Host: "192.0.0.3"}}
+	assert.Equal(t, []storage.Event{
+		{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.2"},
+		{Type: storage.EventAdd, Key: "dummy-service", Value: "192.0.0.3"},
+		{Type: storage.EventRemove, Key: "dummy-service", Value: "192.0.0.1"},
+	}, diff("dummy-service", previous, current))
+}
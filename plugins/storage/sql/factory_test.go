@@ -0,0 +1,25 @@
+package sql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewFactory(t *testing.T) {
+	_, err := NewFactory(Config{Driver: "mysql", DSN: "ct-dns"})
+	assert.EqualError(t, err, `Cannot open mysql database: sql: unknown driver "mysql" (forgotten import?)`)
+
+	dir, err := ioutil.TempDir("", "ct-dns-sql")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := NewFactory(Config{Driver: DriverSQLite, DSN: filepath.Join(dir, "ct-dns.db"), WatchInterval: time.Second, MaxOpenConns: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, c.(*Client).WatchInterval)
+	assert.NoError(t, c.Close())
+	assert.FileExists(t, filepath.Join(dir, "ct-dns.db"))
+}
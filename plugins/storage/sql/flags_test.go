@@ -0,0 +1,19 @@
+package sql
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AddFlags(t *testing.T) {
+	flagSet := flag.NewFlagSet("sql", flag.ExitOnError)
+	AddFlags(flagSet)
+	flagSet.Parse([]string{"--sql-dsn", "postgres://ct-dns@localhost/ct-dns"})
+	if flagSet.Parsed() {
+		assert.Equal(t, "postgres://ct-dns@localhost/ct-dns", flagSet.Lookup("sql-dsn").Value.String())
+		assert.Equal(t, DriverPostgres, flagSet.Lookup("sql-driver").Value.String())
+		assert.Equal(t, "5s", flagSet.Lookup("sql-watch-interval").Value.String())
+	}
+}
@@ -0,0 +1,73 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/guanw/ct-dns/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+// migrations create and evolve the schema, migration i brings it to version i+1.
+// They are applied in order and never edited once released, changes go into a new migration.
+// Statements run on both PostgreSQL and SQLite.
+var migrations = []string{
+	`CREATE TABLE ct_dns_instances (
+		namespace VARCHAR(255) NOT NULL,
+		service VARCHAR(255) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		instance TEXT NOT NULL,
+		expires_at BIGINT NOT NULL DEFAULT 0,
+		CONSTRAINT ct_dns_instances_service_host UNIQUE (namespace, service, host)
+	)`,
+	`CREATE INDEX ct_dns_instances_expires_at ON ct_dns_instances (expires_at)`,
+}
+
+// migrate applies migrations newer than the version recorded in ct_dns_schema_migrations,
+// each one in a transaction along with its version
+func migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS ct_dns_schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return errors.Wrap(err, "Failed to create schema migrations table")
+	}
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	for version := current + 1; version <= len(migrations); version++ {
+		if err := applyMigration(ctx, db, version); err != nil {
+			// another ct-dns replica starting at the same time may have applied it first
+			if applied, versionErr := schemaVersion(ctx, db); versionErr == nil && applied >= version {
+				continue
+			}
+			return err
+		}
+		logging.GetLogger().WithField("version", version).Info("Applied sql schema migration")
+	}
+	return nil
+}
+
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM ct_dns_schema_migrations`).Scan(&version); err != nil {
+		return 0, errors.Wrap(err, "Failed to read schema version")
+	}
+	if version > len(migrations) {
+		return 0, errors.Errorf("Schema version %d is newer than the %d migrations of this ct-dns", version, len(migrations))
+	}
+	return version, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, version int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin migration")
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, migrations[version-1]); err != nil {
+		return errors.Wrapf(err, "Failed to apply migration %d", version)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ct_dns_schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return errors.Wrapf(err, "Failed to record migration %d", version)
+	}
+	return errors.Wrapf(tx.Commit(), "Failed to commit migration %d", version)
+}
@@ -0,0 +1,52 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-sql")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := sql.Open(DriverSQLite, filepath.Join(dir, "ct-dns.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, migrate(context.Background(), db))
+	version, err := schemaVersion(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+	// migrating a migrated schema does nothing
+	assert.NoError(t, migrate(context.Background(), db))
+
+	// a schema migrated by a newer ct-dns is not used
+	_, err = db.Exec(`INSERT INTO ct_dns_schema_migrations (version) VALUES ($1)`, len(migrations)+1)
+	assert.NoError(t, err)
+	assert.Error(t, migrate(context.Background(), db))
+}
+
+func Test_MigrateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ct-dns-sql")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := sql.Open(DriverSQLite, filepath.Join(dir, "ct-dns.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// an index taking the name of the second migration's makes it fail, rolling back its version
+	_, err = db.Exec(`CREATE TABLE ct_dns_schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE INDEX ct_dns_instances_expires_at ON ct_dns_schema_migrations (version)`)
+	assert.NoError(t, err)
+	assert.Error(t, migrate(context.Background(), db))
+	version, err := schemaVersion(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+}
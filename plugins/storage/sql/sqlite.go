@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package sql
+
+// the sqlite3 driver needs cgo, so it is only built in with -tags sqlite, e.g. for local development
+import _ "github.com/mattn/go-sqlite3"
@@ -1,16 +1,20 @@
 #!/bin/bash
 
-usage="Usage: $(basename "$0") [-h] [-e endpoint] [-r region] -- program to inject dynamodb schema for ct-dns
+usage="Usage: $(basename "$0") [-h] [-e endpoint] [-r region] [-t table] -- program to inject dynamodb schema for ct-dns
 
 where:
     -h  show this help text
     -e  set the dynamodb endpoint (default: http://localhost:8000)
-    -r  set the dynamodb region (default: us-east-1)"
+    -r  set the dynamodb region (default: us-east-1)
+    -t  set the dynamodb table (default: service-discovery)
+
+ct-dns creates the same table at startup with --dynamodb-bootstrap"
 
 endpoint="http://localhost:8000"
 region="us-east-1"
+table="service-discovery"
 
-while getopts ":he:r:" option; do
+while getopts ":he:r:t:" option; do
     case $option in
         h )  echo "$usage"
             exit 0
@@ -19,6 +23,8 @@ while getopts ":he:r:" option; do
             ;;
         r )  region=$OPTARG
             ;;
+        t )  table=$OPTARG
+            ;;
         \? ) printf "illegal option: -%s\n" "$OPTARG"
             echo "$usage"
             exit 1
@@ -29,11 +35,22 @@ shift $((OPTIND-1))
 echo "Creating ct-dns table in dynamodb"
 echo "set endpoint: $endpoint"
 echo "set region: $region"
+echo "set table: $table"
 
 
 aws dynamodb --endpoint-url "$endpoint" --region "$region" \
 	create-table \
-	--table-name service-discovery \
+	--table-name "$table" \
     --attribute-definitions AttributeName=Service,AttributeType=S AttributeName=Host,AttributeType=S \
 	--key-schema AttributeName=Service,KeyType=HASH AttributeName=Host,KeyType=RANGE \
-	--provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
\ No newline at end of file
+	--provisioned-throughput ReadCapacityUnits=1,WriteCapacityUnits=1
+
+aws dynamodb --endpoint-url "$endpoint" --region "$region" \
+	wait table-exists \
+	--table-name "$table"
+
+# expired hosts are deleted by dynamodb
+aws dynamodb --endpoint-url "$endpoint" --region "$region" \
+	update-time-to-live \
+	--table-name "$table" \
+	--time-to-live-specification Enabled=true,AttributeName=ExpiresAt
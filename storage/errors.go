@@ -0,0 +1,40 @@
+package storage
+
+// ErrorClassifier is implemented by clients telling errors worth retrying (connection failures,
+// throttling, leader elections) from ones which can never succeed, like a missing key,
+// errors of clients not implementing it are all considered transient
+type ErrorClassifier interface {
+	IsTransient(err error) bool
+}
+
+type transientError struct {
+	error
+}
+
+// Cause lets errors.Cause see through the mark
+func (e *transientError) Cause() error {
+	return e.error
+}
+
+// Transient marks err as worth retrying, nil stays nil
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transientError{err}
+}
+
+// IsTransient tells whether err or any error it wraps was marked by Transient
+func IsTransient(err error) bool {
+	for err != nil {
+		if _, ok := err.(*transientError); ok {
+			return true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
@@ -1,8 +1,87 @@
 package storage
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultNamespace holds services registered without a namespace
+const DefaultNamespace = "default"
+
+// ErrKeyNotFound is returned by Get when key holds no unexpired value, clients may return an empty list instead
+var ErrKeyNotFound = errors.New("Key not found")
+
+// ErrInstanceNotFound is returned when renewing a host that is not registered (or already expired)
+var ErrInstanceNotFound = errors.New("Instance not found")
+
+// Instance defines a host registered under a key along with its metadata
+type Instance struct {
+	Host string `json:"host"`
+	// Zone is the availability zone of the host, served as envoy locality
+	Zone string `json:"zone,omitempty"`
+	// Weight is the load balancing weight of the host, 0 means the default weight of 1
+	Weight uint32            `json:"weight,omitempty"`
+	Canary bool              `json:"canary,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	// HealthStatus is filled in by active health checking, it is not persisted
+	HealthStatus HealthStatus `json:"health_status,omitempty"`
+}
+
+// HealthStatus defines health of an instance observed by active health checking
+type HealthStatus string
+
+const (
+	// HealthUnknown is the status of instances not checked (yet)
+	HealthUnknown HealthStatus = ""
+	// HealthHealthy is the status of instances passing health checks
+	HealthHealthy HealthStatus = "healthy"
+	// HealthUnhealthy is the status of instances failing health checks
+	HealthUnhealthy HealthStatus = "unhealthy"
+)
+
+// LoadBalancingWeight returns Weight, defaulting to 1 when unset
+func (i Instance) LoadBalancingWeight() uint32 {
+	if i.Weight == 0 {
+		return 1
+	}
+	return i.Weight
+}
+
+// EventType defines kind of change on key
+type EventType string
+
+const (
+	// EventAdd is fired when value is added under key or its metadata changes
+	EventAdd EventType = "add"
+	// EventRemove is fired when value is deleted or expired under key
+	EventRemove EventType = "remove"
+)
+
+// Event describes a single value change under key
+type Event struct {
+	Type  EventType `json:"type"`
+	Key   string    `json:"key"`
+	Value string    `json:"value"`
+}
+
 // Client defines interface for set/get operation
+// keys live in a namespace, the same key in two namespaces holds unrelated values
+// values are instances identified by host, Get returns them json encoded
+// a ttl of 0 means the value never expires
+// every call gives up once ctx is done
+// Watch streams changes under key until ctx is done, the channel is closed
+// when ctx is done or the watch breaks, callers should re-read key and watch again
+// List returns keys of namespace starting with prefix which hold at least one unexpired value, sorted
+// Ping checks storage is reachable and able to serve requests
+// Close releases connections, pools and sessions of the client, it is not usable afterwards
 type Client interface {
-	Create(key, value string) error
-	Get(key string) (string, error)
-	Delete(key, value string) error
+	Create(ctx context.Context, namespace, key string, instance Instance, ttl time.Duration) error
+	Get(ctx context.Context, namespace, key string) (string, error)
+	Delete(ctx context.Context, namespace, key, value string) error
+	Renew(ctx context.Context, namespace, key, value string, ttl time.Duration) error
+	Watch(ctx context.Context, namespace, key string) (<-chan Event, error)
+	List(ctx context.Context, namespace, prefix string) ([]string, error)
+	Ping(ctx context.Context) error
+	Close() error
 }
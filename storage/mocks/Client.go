@@ -2,20 +2,42 @@
 
 package mocks
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	context "context"
+
+	mock "github.com/stretchr/testify/mock"
+
+	storage "github.com/guanw/ct-dns/storage"
+
+	time "time"
+)
 
 // Client is an autogenerated mock type for the Client type
 type Client struct {
 	mock.Mock
 }
 
-// Create provides a mock function with given fields: key, value
-func (_m *Client) Create(key string, value string) error {
-	ret := _m.Called(key, value)
+// Close provides a mock function with given fields:
+func (_m *Client) Close() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Create provides a mock function with given fields: ctx, namespace, key, instance, ttl
+func (_m *Client) Create(ctx context.Context, namespace string, key string, instance storage.Instance, ttl time.Duration) error {
+	ret := _m.Called(ctx, namespace, key, instance, ttl)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(key, value)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, storage.Instance, time.Duration) error); ok {
+		r0 = rf(ctx, namespace, key, instance, ttl)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -23,13 +45,13 @@ func (_m *Client) Create(key string, value string) error {
 	return r0
 }
 
-// Delete provides a mock function with given fields: key, value
-func (_m *Client) Delete(key string, value string) error {
-	ret := _m.Called(key, value)
+// Delete provides a mock function with given fields: ctx, namespace, key, value
+func (_m *Client) Delete(ctx context.Context, namespace string, key string, value string) error {
+	ret := _m.Called(ctx, namespace, key, value)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(key, value)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) error); ok {
+		r0 = rf(ctx, namespace, key, value)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -37,20 +59,94 @@ func (_m *Client) Delete(key string, value string) error {
 	return r0
 }
 
-// Get provides a mock function with given fields: key
-func (_m *Client) Get(key string) (string, error) {
-	ret := _m.Called(key)
+// Get provides a mock function with given fields: ctx, namespace, key
+func (_m *Client) Get(ctx context.Context, namespace string, key string) (string, error) {
+	ret := _m.Called(ctx, namespace, key)
 
 	var r0 string
-	if rf, ok := ret.Get(0).(func(string) string); ok {
-		r0 = rf(key)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) string); ok {
+		r0 = rf(ctx, namespace, key)
 	} else {
 		r0 = ret.Get(0).(string)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(key)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, namespace, key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// List provides a mock function with given fields: ctx, namespace, prefix
+func (_m *Client) List(ctx context.Context, namespace string, prefix string) ([]string, error) {
+	ret := _m.Called(ctx, namespace, prefix)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) []string); ok {
+		r0 = rf(ctx, namespace, prefix)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, namespace, prefix)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Ping provides a mock function with given fields: ctx
+func (_m *Client) Ping(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Renew provides a mock function with given fields: ctx, namespace, key, value, ttl
+func (_m *Client) Renew(ctx context.Context, namespace string, key string, value string, ttl time.Duration) error {
+	ret := _m.Called(ctx, namespace, key, value, ttl)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, time.Duration) error); ok {
+		r0 = rf(ctx, namespace, key, value, ttl)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Watch provides a mock function with given fields: ctx, namespace, key
+func (_m *Client) Watch(ctx context.Context, namespace string, key string) (<-chan storage.Event, error) {
+	ret := _m.Called(ctx, namespace, key)
+
+	var r0 <-chan storage.Event
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) <-chan storage.Event); ok {
+		r0 = rf(ctx, namespace, key)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(<-chan storage.Event)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, namespace, key)
 	} else {
 		r1 = ret.Error(1)
 	}